@@ -40,6 +40,7 @@ type ruleColumns struct {
 	Target   string
 	Hostname string
 	Port     int
+	Ports    string
 	UID      int
 	GID      int
 	Uname    string
@@ -58,6 +59,7 @@ var decisionWaiters []*decisionWaiter
 var editApp, editTarget, editPort, editUser, editGroup *gtk.Entry
 var comboProto *gtk.ComboBoxText
 var radioOnce, radioProcess, radioParent, radioSession, radioPermanent *gtk.RadioButton
+var radioFifteenMinutes, radioOneHour, radioOneDay *gtk.RadioButton
 var btnApprove, btnDeny, btnIgnore *gtk.Button
 var chkUser, chkGroup *gtk.CheckButton
 
@@ -512,12 +514,8 @@ func toggleValidRuleState() {
 	str, err = editPort.GetText()
 	if err != nil || strings.Trim(str, "\t ") == "" {
 		ok = false
-	} else {
-		pval, err := strconv.Atoi(str)
-
-		if err != nil || pval < 0 || pval > 65535 {
-			ok = false
-		}
+	} else if !sgfw.ValidPortSpec(comboProto.GetActiveID(), strings.Trim(str, "\t ")) {
+		ok = false
 	}
 
 	if chkUser.GetActive() {
@@ -546,11 +544,17 @@ func createCurrentRule() (ruleColumns, error) {
 	if radioProcess.GetActive() {
 		rule.Scope = int(sgfw.APPLY_PROCESS)
 	} else if radioParent.GetActive() {
-		return rule, errors.New("Parent process scope is unsupported at the moment")
+		rule.Scope = int(sgfw.APPLY_PARENT)
 	} else if radioSession.GetActive() {
 		rule.Scope = int(sgfw.APPLY_SESSION)
 	} else if radioPermanent.GetActive() {
 		rule.Scope = int(sgfw.APPLY_FOREVER)
+	} else if radioFifteenMinutes.GetActive() {
+		rule.Scope = int(sgfw.APPLY_FIFTEEN_MINUTES)
+	} else if radioOneHour.GetActive() {
+		rule.Scope = int(sgfw.APPLY_ONE_HOUR)
+	} else if radioOneDay.GetActive() {
+		rule.Scope = int(sgfw.APPLY_ONE_DAY)
 	} else {
 		rule.Scope = int(sgfw.APPLY_ONCE)
 	}
@@ -565,11 +569,6 @@ func createCurrentRule() (ruleColumns, error) {
 		return rule, err
 	}
 
-	rule.Port, err = strconv.Atoi(ports)
-	if err != nil {
-		return rule, err
-	}
-
 	rule.Target, err = editTarget.GetText()
 	if err != nil {
 		return rule, err
@@ -577,6 +576,11 @@ func createCurrentRule() (ruleColumns, error) {
 
 	rule.Proto = comboProto.GetActiveID()
 
+	rule.Ports = strings.Trim(ports, "\t ")
+	if !sgfw.ValidPortSpec(rule.Proto, rule.Ports) {
+		return rule, errors.New("Invalid port, port range or service name: " + rule.Ports)
+	}
+
 	rule.UID, rule.GID = 0, 0
 	rule.Uname, rule.Gname = "", ""
 	/*	Pid      int
@@ -597,6 +601,9 @@ func clearEditor() {
 	radioParent.SetActive(false)
 	radioSession.SetActive(false)
 	radioPermanent.SetActive(false)
+	radioFifteenMinutes.SetActive(false)
+	radioOneHour.SetActive(false)
+	radioOneDay.SetActive(false)
 	chkUser.SetActive(false)
 	chkGroup.SetActive(false)
 }
@@ -841,13 +848,20 @@ func main() {
 	radioParent = get_radiobutton(radioOnce, "Parent Process", false)
 	radioSession = get_radiobutton(radioOnce, "Session", false)
 	radioPermanent = get_radiobutton(radioOnce, "Permanent", false)
+	radioFifteenMinutes = get_radiobutton(radioOnce, "15 Minutes", false)
+	radioOneHour = get_radiobutton(radioOnce, "1 Hour", false)
+	radioOneDay = get_radiobutton(radioOnce, "1 Day", false)
 	radioParent.SetSensitive(false)
+	radioParent.SetTooltipText("For this session, only when started by the same parent program")
 	hbox.PackStart(lbl, false, false, 10)
 	hbox.PackStart(radioOnce, false, false, 5)
 	hbox.PackStart(radioProcess, false, false, 5)
 	hbox.PackStart(radioParent, false, false, 5)
 	hbox.PackStart(radioSession, false, false, 5)
 	hbox.PackStart(radioPermanent, false, false, 5)
+	hbox.PackStart(radioFifteenMinutes, false, false, 5)
+	hbox.PackStart(radioOneHour, false, false, 5)
+	hbox.PackStart(radioOneDay, false, false, 5)
 	editbox.PackStart(hbox, false, false, 5)
 
 	hbox = get_hbox()
@@ -902,7 +916,7 @@ func main() {
 		}
 
 		fmt.Println("rule = ", rule)
-		rulestr := "ALLOW|" + rule.Proto + ":" + rule.Target + ":" + strconv.Itoa(rule.Port)
+		rulestr := "ALLOW|" + rule.Proto + ":" + rule.Target + ":" + rule.Ports
 		fmt.Println("RULESTR = ", rulestr)
 		makeDecision(idx, rulestr, int(rule.Scope))
 		fmt.Println("Decision made.")
@@ -928,7 +942,7 @@ func main() {
 		}
 
 		fmt.Println("rule = ", rule)
-		rulestr := "DENY|" + rule.Proto + ":" + rule.Target + ":" + strconv.Itoa(rule.Port)
+		rulestr := "DENY|" + rule.Proto + ":" + rule.Target + ":" + rule.Ports
 		fmt.Println("RULESTR = ", rulestr)
 		makeDecision(idx, rulestr, int(rule.Scope))
 		fmt.Println("Decision made.")
@@ -978,8 +992,12 @@ func main() {
 		radioProcess.SetActive(false)
 		radioProcess.SetSensitive(seldata.Pid > 0)
 		radioParent.SetActive(false)
+		radioParent.SetSensitive(seldata.Pid > 0)
 		radioSession.SetActive(false)
 		radioPermanent.SetActive(false)
+		radioFifteenMinutes.SetActive(false)
+		radioOneHour.SetActive(false)
+		radioOneDay.SetActive(false)
 		comboProto.SetActiveID(seldata.Proto)
 
 		if seldata.Uname != "" {
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/subgraph/fw-daemon/sgfw"
+)
+
+type dbusObject struct {
+	dbus.BusObject
+}
+
+func newDbusObject() (*dbusObject, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return &dbusObject{conn.Object("com.subgraph.Firewall", "/com/subgraph/Firewall")}, nil
+}
+
+type command struct {
+	name string
+	args string
+	help string
+	run  func(ob *dbusObject, fs *flag.FlagSet) error
+}
+
+var commands = []command{
+	{"snapshots", "", "list the saved generations of the rule file", listSnapshots},
+	{"rollback", "ID", "replace the rules with a saved generation", rollback},
+	{"export", "[FILE]", "write rules to FILE, or to standard output", exportRules},
+	{"import", "FILE", "add the rules in FILE, exported or a rule file of an older version, or - for standard input", importRules},
+	{"check", "", "report rules that are shadowed, redundant or stale", checkRules},
+	{"prune", "", "remove permanent rules that have not been used for a while", pruneRules},
+	{"audit", "", "list what audit mode let through that would have been blocked", auditReport},
+	{"audit-app", "APP", "only log the connections of APP instead of filtering them", auditApp},
+	{"learn", "", "allow and record what would be prompted for, for a while", learn},
+	{"candidates", "", "list the rules found while learning", listCandidates},
+	{"review", "[ID...]", "accept or reject the rules found while learning", reviewCandidates},
+	{"lockdown", "", "deny every new connection but those on the allowlist", lockdown},
+	{"status", "", "show the rules queueing connections to the firewall", status},
+	{"stats", "", "show how long each queue takes to filter a packet", queueStats},
+}
+
+func findCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s COMMAND [ARGS]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %-7s %s\n", c.name, c.args, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s COMMAND -h for the options of a command\n", os.Args[0])
+}
+
+// addFilterFlags adds the options shared by commands that select rules.
+func addFilterFlags(fs *flag.FlagSet) *sgfw.DbusRuleFilter {
+	f := new(sgfw.DbusRuleFilter)
+	fs.StringVar(&f.App, "app", "", "only rules of this application (path or name)")
+	fs.StringVar(&f.Sandbox, "sandbox", "", "only rules of this sandbox")
+	fs.StringVar(&f.Mode, "mode", "", "only rules of this mode (PERMANENT, SYSTEM or SESSION)")
+	return f
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := findCommand(flag.Arg(0))
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	ob, err := newDbusObject()
+	if err != nil {
+		log.Fatal("Could not connect to the system bus: ", err)
+	}
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [OPTIONS] %s\n", os.Args[0], c.name, c.args)
+		fs.PrintDefaults()
+	}
+	if err := c.run(ob, fs); err != nil {
+		log.Fatal("Error: ", err)
+	}
+}
+
+// parseArgs parses the flags of a command and checks that it has between min
+// and max arguments; a max of -1 allows any number.
+func parseArgs(fs *flag.FlagSet, min, max int) []string {
+	fs.Parse(flag.Args()[1:])
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return fs.Args()
+}
+
+func listSnapshots(ob *dbusObject, fs *flag.FlagSet) error {
+	parseArgs(fs, 0, 0)
+	snapshots := []sgfw.DbusRuleSnapshot{}
+	if err := ob.Call("com.subgraph.Firewall.ListRuleSnapshots", 0).Store(&snapshots); err != nil {
+		return err
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("No snapshots have been saved.")
+		return nil
+	}
+	for _, s := range snapshots {
+		rules := fmt.Sprintf("%d rules", s.Rules)
+		if s.Rules < 0 {
+			rules = "unreadable"
+		}
+		fmt.Printf("%s  %s  %s\n", s.ID, time.Unix(s.Saved, 0).Format("2006-01-02 15:04:05"), rules)
+	}
+	return nil
+}
+
+func rollback(ob *dbusObject, fs *flag.FlagSet) error {
+	args := parseArgs(fs, 1, 1)
+	if err := ob.Call("com.subgraph.Firewall.RollbackRules", 0, args[0]).Err; err != nil {
+		return err
+	}
+	fmt.Println("Rules rolled back to snapshot", args[0])
+	return nil
+}
+
+func exportRules(ob *dbusObject, fs *flag.FlagSet) error {
+	filter := addFilterFlags(fs)
+	args := parseArgs(fs, 0, 1)
+	var rules string
+	if err := ob.Call("com.subgraph.Firewall.ExportRules", 0, *filter).Store(&rules); err != nil {
+		return err
+	}
+	if len(args) == 0 || args[0] == "-" {
+		fmt.Println(rules)
+		return nil
+	}
+	return ioutil.WriteFile(args[0], []byte(rules+"\n"), 0600)
+}
+
+func importRules(ob *dbusObject, fs *flag.FlagSet) error {
+	replace := fs.Bool("replace", false, "remove the selected rules before importing")
+	dryRun := fs.Bool("n", false, "only report what would be imported")
+	filter := addFilterFlags(fs)
+	args := parseArgs(fs, 1, 1)
+
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	data, legacy, err := sgfw.ConvertImportData(data)
+	if err != nil {
+		return err
+	}
+	if legacy {
+		fmt.Println("Read rules in the format of older versions")
+	}
+	how := sgfw.IMPORT_MERGE
+	if *replace {
+		how = sgfw.IMPORT_REPLACE
+	}
+	var report sgfw.DbusImportReport
+	if err := ob.Call("com.subgraph.Firewall.ImportRules", 0, string(data), how, *dryRun, *filter).Store(&report); err != nil {
+		return err
+	}
+
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d rules", verb, report.Added)
+	if *replace {
+		fmt.Printf(", replacing %d", report.Removed)
+	}
+	fmt.Println()
+	printRules("Skipped duplicates", report.Duplicates)
+	printRules("Skipped conflicting rules", report.Conflicts)
+	printRules("Skipped invalid rules", report.Invalid)
+	return nil
+}
+
+func printRules(title string, rules []string) {
+	if len(rules) == 0 {
+		return
+	}
+	fmt.Printf("%s:\n", title)
+	for _, r := range rules {
+		fmt.Println("  " + r)
+	}
+}
+
+// checkRules prints the warnings of the rule analysis, grouped by
+// application, and exits with status 1 if there are any.
+func checkRules(ob *dbusObject, fs *flag.FlagSet) error {
+	parseArgs(fs, 0, 0)
+	warnings := []sgfw.DbusRuleWarning{}
+	if err := ob.Call("com.subgraph.Firewall.AnalyzeRules", 0).Store(&warnings); err != nil {
+		return err
+	}
+	if len(warnings) == 0 {
+		fmt.Println("No problems found.")
+		return nil
+	}
+	path := ""
+	for _, w := range warnings {
+		if w.Path != path {
+			path = w.Path
+			fmt.Printf("%s:\n", path)
+		}
+		fmt.Printf("  %-13s %s\n", w.Kind, w.Message)
+	}
+	os.Exit(1)
+	return nil
+}
+
+func pruneRules(ob *dbusObject, fs *flag.FlagSet) error {
+	days := fs.Uint("days", 90, "remove rules unused for this many days")
+	dryRun := fs.Bool("n", false, "only list the rules that would be removed")
+	parseArgs(fs, 0, 0)
+	var rules []string
+	if err := ob.Call("com.subgraph.Firewall.PruneUnusedRules", 0, uint32(*days), *dryRun).Store(&rules); err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		fmt.Printf("No rules have been unused for %d days.\n", *days)
+		return nil
+	}
+	title := "Removed"
+	if *dryRun {
+		title = "Would remove"
+	}
+	printRules(title, rules)
+	return nil
+}
+
+func auditReport(ob *dbusObject, fs *flag.FlagSet) error {
+	clearReport := fs.Bool("clear", false, "empty the report after printing it")
+	parseArgs(fs, 0, 0)
+	entries := []sgfw.DbusAuditEntry{}
+	if err := ob.Call("com.subgraph.Firewall.GetAuditReport", 0).Store(&entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("Nothing would have been blocked.")
+	}
+	policy := ""
+	for _, e := range entries {
+		if p := e.Sandbox + "|" + e.Path; p != policy {
+			policy = p
+			if e.Sandbox != "" {
+				fmt.Printf("%s (sandbox %s):\n", e.Path, e.Sandbox)
+			} else {
+				fmt.Printf("%s:\n", e.Path)
+			}
+		}
+		verb := "denied"
+		if e.Kind == sgfw.AUDIT_PROMPT {
+			verb = "prompted"
+		}
+		fmt.Printf("  %-8s %5dx  %s %s  (last %s)\n", verb, e.Count, e.Proto, e.Target,
+			time.Unix(e.Last, 0).Format("2006-01-02 15:04:05"))
+	}
+	if *clearReport {
+		return ob.Call("com.subgraph.Firewall.ClearAuditReport", 0).Err
+	}
+	return nil
+}
+
+func auditApp(ob *dbusObject, fs *flag.FlagSet) error {
+	sandbox := fs.String("sandbox", "", "the sandbox the application runs in")
+	off := fs.Bool("off", false, "filter the connections of APP again")
+	args := parseArgs(fs, 1, 1)
+
+	app := args[0]
+	if !filepath.IsAbs(app) {
+		p, err := exec.LookPath(app)
+		if err != nil {
+			return err
+		}
+		app = p
+	}
+	if p, err := filepath.EvalSymlinks(app); err == nil {
+		app = p
+	}
+	if err := ob.Call("com.subgraph.Firewall.SetPolicyAudit", 0, app, *sandbox, !*off).Err; err != nil {
+		return err
+	}
+	if *off {
+		fmt.Println("Connections of", app, "are filtered again")
+	} else {
+		fmt.Println("Connections of", app, "are only logged")
+	}
+	return nil
+}
+
+func learn(ob *dbusObject, fs *flag.FlagSet) error {
+	d := fs.Duration("for", 24*time.Hour, "how long to learn for")
+	stop := fs.Bool("stop", false, "stop learning")
+	parseArgs(fs, 0, 0)
+	if *stop {
+		return ob.Call("com.subgraph.Firewall.StopLearning", 0).Err
+	}
+	if err := ob.Call("com.subgraph.Firewall.StartLearning", 0, uint32(d.Minutes())).Err; err != nil {
+		return err
+	}
+	fmt.Printf("Learning until %s\n", time.Now().Add(*d).Format("2006-01-02 15:04"))
+	return nil
+}
+
+func getCandidates(ob *dbusObject) ([]sgfw.DbusCandidate, error) {
+	candidates := []sgfw.DbusCandidate{}
+	err := ob.Call("com.subgraph.Firewall.ListCandidates", 0).Store(&candidates)
+	return candidates, err
+}
+
+func listCandidates(ob *dbusObject, fs *flag.FlagSet) error {
+	parseArgs(fs, 0, 0)
+	var until int64
+	if err := ob.Call("com.subgraph.Firewall.GetLearningStatus", 0).Store(&until); err != nil {
+		return err
+	}
+	if until != 0 {
+		fmt.Printf("Learning until %s\n\n", time.Unix(until, 0).Format("2006-01-02 15:04"))
+	}
+	candidates, err := getCandidates(ob)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		fmt.Println("No rules to review.")
+	}
+	policy := ""
+	for _, c := range candidates {
+		if p := c.Sandbox + "|" + c.Path; p != policy {
+			policy = p
+			if c.Sandbox != "" {
+				fmt.Printf("%s (sandbox %s):\n", c.Path, c.Sandbox)
+			} else {
+				fmt.Printf("%s:\n", c.Path)
+			}
+		}
+		fmt.Printf("  %s  ALLOW %s  %dx\n", c.ID, c.Target, c.Count)
+	}
+	return nil
+}
+
+// reviewCandidates accepts the candidates given by id, or rejects them with
+// -reject.  With -all, it does so for every candidate.
+func reviewCandidates(ob *dbusObject, fs *flag.FlagSet) error {
+	reject := fs.Bool("reject", false, "forget the candidates instead of adding them as rules")
+	all := fs.Bool("all", false, "review every candidate")
+	ids := parseArgs(fs, 0, -1)
+	if *all {
+		candidates, err := getCandidates(ob)
+		if err != nil {
+			return err
+		}
+		ids = []string{}
+		for _, c := range candidates {
+			ids = append(ids, c.ID)
+		}
+	} else if len(ids) == 0 {
+		return fmt.Errorf("no candidates given, use -all to review every one")
+	}
+	accepted, rejected := ids, []string{}
+	if *reject {
+		accepted, rejected = []string{}, ids
+	}
+	var added uint32
+	if err := ob.Call("com.subgraph.Firewall.ReviewCandidates", 0, accepted, rejected).Store(&added); err != nil {
+		return err
+	}
+	if *reject {
+		fmt.Printf("Rejected %d candidates\n", len(rejected))
+	} else {
+		fmt.Printf("Added %d rules\n", added)
+	}
+	return nil
+}
+
+func lockdown(ob *dbusObject, fs *flag.FlagSet) error {
+	off := fs.Bool("off", false, "lift the lockdown")
+	status := fs.Bool("status", false, "only tell whether the network is locked down")
+	parseArgs(fs, 0, 0)
+	if !*status {
+		if err := ob.Call("com.subgraph.Firewall.SetLockdown", 0, !*off).Err; err != nil {
+			return err
+		}
+	}
+	var locked bool
+	if err := ob.Call("com.subgraph.Firewall.IsLockdown", 0).Store(&locked); err != nil {
+		return err
+	}
+	if locked {
+		fmt.Println("Network locked down, only lockdown_allow connections are let through")
+	} else {
+		fmt.Println("Network not locked down")
+	}
+	return nil
+}
+
+func status(ob *dbusObject, fs *flag.FlagSet) error {
+	parseArgs(fs, 0, 0)
+	var backend, ruleset string
+	if err := ob.Call("com.subgraph.Firewall.GetFirewallStatus", 0).Store(&backend, &ruleset); err != nil {
+		return err
+	}
+	fmt.Printf("Backend: %s\n\n%s", backend, ruleset)
+	return nil
+}
+
+func queueStats(ob *dbusObject, fs *flag.FlagSet) error {
+	parseArgs(fs, 0, 0)
+	stats := []sgfw.DbusQueueStats{}
+	if err := ob.Call("com.subgraph.Firewall.GetQueueStats", 0).Store(&stats); err != nil {
+		return err
+	}
+	fmt.Printf("%-6s %10s %12s %12s\n", "QUEUE", "PACKETS", "MEAN", "MAX")
+	for _, s := range stats {
+		fmt.Printf("%-6d %10d %12s %12s\n", s.Queue, s.Packets,
+			time.Duration(s.MeanLatency).Round(time.Microsecond), time.Duration(s.MaxLatency).Round(time.Microsecond))
+	}
+	return nil
+}
@@ -11,6 +11,7 @@ func loadConfig(win *gtk.Window, b *builder, dbus *dbusObject) {
 	var redactCheck *gtk.CheckButton
 	var expandedCheck *gtk.CheckButton
 	var expertCheck *gtk.CheckButton
+	var auditCheck *gtk.CheckButton
 	var actionCombo *gtk.ComboBoxText
 
 	b.getItems(
@@ -18,6 +19,7 @@ func loadConfig(win *gtk.Window, b *builder, dbus *dbusObject) {
 		"redact_checkbox", &redactCheck,
 		"expanded_checkbox", &expandedCheck,
 		"expert_checkbox", &expertCheck,
+		"audit_checkbox", &auditCheck,
 		"action_combo", &actionCombo,
 	)
 
@@ -40,6 +42,9 @@ func loadConfig(win *gtk.Window, b *builder, dbus *dbusObject) {
 	if v, ok := conf["prompt_expert"].(bool); ok {
 		expertCheck.SetActive(v)
 	}
+	if v, ok := conf["audit_mode"].(bool); ok {
+		auditCheck.SetActive(v)
+	}
 	if av, ok := conf["default_action"].(uint16); ok {
 		actionCombo.SetActiveID(sgfw.GetFilterScopeString(sgfw.FilterScope(av)))
 	}
@@ -58,6 +63,9 @@ func loadConfig(win *gtk.Window, b *builder, dbus *dbusObject) {
 		"on_expert_checkbox_toggled": func() {
 			dbus.setConfig("prompt_expert", expertCheck.GetActive())
 		},
+		"on_audit_checkbox_toggled": func() {
+			dbus.setConfig("audit_mode", auditCheck.GetActive())
+		},
 		"on_action_combo_changed": func() {
 			dbus.setConfig("default_action", sgfw.GetFilterScopeValue(actionCombo.GetActiveID()))
 		},
@@ -54,6 +54,57 @@ func (ob *dbusObject) listRules() ([]sgfw.DbusRule, error) {
 	return rules, nil
 }
 
+func (ob *dbusObject) analyzeRules() ([]sgfw.DbusRuleWarning, error) {
+	warnings := []sgfw.DbusRuleWarning{}
+	err := ob.Call("com.subgraph.Firewall.AnalyzeRules", 0).Store(&warnings)
+	if err != nil {
+		return nil, err
+	}
+	return warnings, nil
+}
+
+func (ob *dbusObject) pruneUnusedRules(days uint32, dryRun bool) ([]string, error) {
+	rules := []string{}
+	err := ob.Call("com.subgraph.Firewall.PruneUnusedRules", 0, days, dryRun).Store(&rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (ob *dbusObject) startLearning(minutes uint32) error {
+	return ob.Call("com.subgraph.Firewall.StartLearning", 0, minutes).Err
+}
+
+func (ob *dbusObject) stopLearning() error {
+	return ob.Call("com.subgraph.Firewall.StopLearning", 0).Err
+}
+
+func (ob *dbusObject) getLearningStatus() (int64, error) {
+	var until int64
+	if err := ob.Call("com.subgraph.Firewall.GetLearningStatus", 0).Store(&until); err != nil {
+		return 0, err
+	}
+	return until, nil
+}
+
+func (ob *dbusObject) listCandidates() ([]sgfw.DbusCandidate, error) {
+	candidates := []sgfw.DbusCandidate{}
+	err := ob.Call("com.subgraph.Firewall.ListCandidates", 0).Store(&candidates)
+	if err != nil {
+		return nil, err
+	}
+	return candidates, nil
+}
+
+func (ob *dbusObject) reviewCandidates(accept, reject []string) (uint32, error) {
+	var added uint32
+	if err := ob.Call("com.subgraph.Firewall.ReviewCandidates", 0, accept, reject).Store(&added); err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
 func (ob *dbusObject) deleteRule(id uint32) {
 	ob.Call("com.subgraph.Firewall.DeleteRule", 0, id)
 }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/subgraph/fw-daemon/sgfw"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// How long learning lasts when it is started from the settings
+const learningMinutes = 24 * 60
+
+type candidateList struct {
+	dbus   *dbusObject
+	win    *gtk.Window
+	list   *gtk.ListBox
+	checks map[string]*gtk.CheckButton
+}
+
+func newCandidateList(dbus *dbusObject, win *gtk.Window, list *gtk.ListBox) *candidateList {
+	cl := &candidateList{dbus: dbus, win: win, list: list, checks: make(map[string]*gtk.CheckButton)}
+	cl.list.SetSelectionMode(gtk.SELECTION_NONE)
+	return cl
+}
+
+func (cl *candidateList) loadCandidates() error {
+	until, err := cl.dbus.getLearningStatus()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+		return err
+	}
+	candidates, err := cl.dbus.listCandidates()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+		return err
+	}
+	cl.addStatusRow(until)
+	for _, c := range candidates {
+		cl.addCandidateRow(c)
+	}
+	if len(candidates) > 0 {
+		cl.addReviewRow()
+	}
+	return nil
+}
+
+func (cl *candidateList) addStatusRow(until int64) {
+	text := "Learning is off."
+	action := "Learn for a day"
+	if until != 0 {
+		text = fmt.Sprintf("Learning until %s: connections are allowed and recorded below.", time.Unix(until, 0).Format("Jan 2 15:04"))
+		action = "Stop learning"
+	}
+	label, _ := gtk.LabelNew(text)
+	label.SetHAlign(gtk.ALIGN_START)
+	label.SetLineWrap(true)
+	button, _ := gtk.ButtonNewWithLabel(action)
+	button.Connect("clicked", func() {
+		var err error
+		if until != 0 {
+			err = cl.dbus.stopLearning()
+		} else {
+			err = cl.dbus.startLearning(learningMinutes)
+		}
+		if err != nil {
+			fmt.Printf("Unable to change the learning mode: %v\n", err)
+		}
+		glib.IdleAdd(repopulateWin)
+	})
+
+	box, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 10)
+	box.PackStart(label, true, true, 0)
+	box.PackEnd(button, false, false, 0)
+	cl.addRow(box)
+}
+
+func (cl *candidateList) addCandidateRow(c sgfw.DbusCandidate) {
+	text := fmt.Sprintf("%s: allow %s (%d connections)", path.Base(c.Path), c.Target, c.Count)
+	if c.Sandbox != "" {
+		text = fmt.Sprintf("%s (%s): allow %s (%d connections)", path.Base(c.Path), c.Sandbox, c.Target, c.Count)
+	}
+	check, _ := gtk.CheckButtonNewWithLabel(text)
+	check.SetActive(true)
+	check.SetTooltipText(fmt.Sprintf("%s\nFirst seen %s, last seen %s", c.Path,
+		time.Unix(c.First, 0).Format("Jan 2 15:04"), time.Unix(c.Last, 0).Format("Jan 2 15:04")))
+	cl.checks[c.ID] = check
+	cl.addRow(check)
+}
+
+func (cl *candidateList) addReviewRow() {
+	accept, _ := gtk.ButtonNewWithLabel("Accept Selected")
+	accept.Connect("clicked", func() {
+		cl.review(true)
+	})
+	reject, _ := gtk.ButtonNewWithLabel("Reject Selected")
+	reject.Connect("clicked", func() {
+		cl.review(false)
+	})
+
+	box, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 10)
+	box.PackEnd(accept, false, false, 0)
+	box.PackEnd(reject, false, false, 0)
+	cl.addRow(box)
+}
+
+func (cl *candidateList) addRow(w gtk.IWidget) {
+	box, _ := gtk.BoxNew(gtk.ORIENTATION_HORIZONTAL, 0)
+	box.SetMarginStart(10)
+	box.SetMarginEnd(10)
+	box.SetMarginTop(5)
+	box.SetMarginBottom(5)
+	box.PackStart(w, true, true, 0)
+	row, _ := gtk.ListBoxRowNew()
+	row.Add(box)
+	cl.list.Add(row)
+}
+
+// review accepts or rejects the checked candidates.  Rules are only added
+// once the user has confirmed them.
+func (cl *candidateList) review(accept bool) {
+	ids := []string{}
+	for id, check := range cl.checks {
+		if check.GetActive() {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if accept {
+		d := gtk.MessageDialogNew(cl.win, gtk.DIALOG_DESTROY_WITH_PARENT, gtk.MESSAGE_QUESTION, gtk.BUTTONS_OK_CANCEL,
+			"Add %d permanent rules allowing the selected connections?", len(ids))
+		ok := d.Run() == (int)(gtk.RESPONSE_OK)
+		d.Destroy()
+		if !ok {
+			return
+		}
+		_, err := cl.dbus.reviewCandidates(ids, []string{})
+		if err != nil {
+			fmt.Printf("Unable to add the learned rules: %v\n", err)
+		}
+	} else if _, err := cl.dbus.reviewCandidates([]string{}, ids); err != nil {
+		fmt.Printf("Unable to reject the learned rules: %v\n", err)
+	}
+	glib.IdleAdd(repopulateWin)
+}
@@ -17,6 +17,8 @@ var swRulesPermanent *gtk.ScrolledWindow = nil
 var swRulesSession *gtk.ScrolledWindow = nil
 var swRulesProcess *gtk.ScrolledWindow = nil
 var swRulesSystem *gtk.ScrolledWindow = nil
+var swRulesWarnings *gtk.ScrolledWindow = nil
+var swRulesLearned *gtk.ScrolledWindow = nil
 
 func failDialog(parent *gtk.Window, format string, args ...interface{}) {
 	d := gtk.MessageDialogNew(parent, 0, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE,
@@ -71,6 +73,18 @@ func repopulateWin() {
 	}
 	swRulesSystem.Remove(child)
 
+	child, err = swRulesWarnings.GetChild()
+	if err != nil {
+		failDialog(win, "Unable to clear out rule warnings display: %v", err)
+	}
+	swRulesWarnings.Remove(child)
+
+	child, err = swRulesLearned.GetChild()
+	if err != nil {
+		failDialog(win, "Unable to clear out learned rules display: %v", err)
+	}
+	swRulesLearned.Remove(child)
+
 	boxPermanent, _ := gtk.ListBoxNew()
 	swRulesPermanent.Add(boxPermanent)
 
@@ -83,6 +97,12 @@ func repopulateWin() {
 	boxSystem, _ := gtk.ListBoxNew()
 	swRulesSystem.Add(boxSystem)
 
+	boxWarnings, _ := gtk.ListBoxNew()
+	swRulesWarnings.Add(boxWarnings)
+
+	boxLearned, _ := gtk.ListBoxNew()
+	swRulesLearned.Add(boxLearned)
+
 	rlPermanent := newRuleList(dbus, win, boxPermanent)
 	if _, err := dbus.isEnabled(); err != nil {
 		failDialog(win, "Unable is connect to firewall daemon.  Is it running?")
@@ -107,6 +127,9 @@ func repopulateWin() {
 	}
 	rlSystem.loadRules(sgfw.RULE_MODE_SYSTEM)
 
+	newWarningList(dbus, boxWarnings).loadWarnings()
+	newCandidateList(dbus, win, boxLearned).loadCandidates()
+
 	loadConfig(win, fwsbuilder, dbus)
 	//	app.AddWindow(win)
 	win.ShowAll()
@@ -121,6 +144,8 @@ func populateWin(app *gtk.Application, win *gtk.Window) {
 		"swRulesSession", &swRulesSession,
 		"swRulesProcess", &swRulesProcess,
 		"swRulesSystem", &swRulesSystem,
+		"swRulesWarnings", &swRulesWarnings,
+		"swRulesLearned", &swRulesLearned,
 	)
 	//win.SetIconName("security-high-symbolic")
 	win.SetIconName("security-medium")
@@ -137,6 +162,12 @@ func populateWin(app *gtk.Application, win *gtk.Window) {
 	boxSystem, _ := gtk.ListBoxNew()
 	swRulesSystem.Add(boxSystem)
 
+	boxWarnings, _ := gtk.ListBoxNew()
+	swRulesWarnings.Add(boxWarnings)
+
+	boxLearned, _ := gtk.ListBoxNew()
+	swRulesLearned.Add(boxLearned)
+
 	dbus, err := newDbusObject()
 	if err != nil {
 		failDialog(win, "Failed to connect to dbus system bus: %v", err)
@@ -166,7 +197,11 @@ func populateWin(app *gtk.Application, win *gtk.Window) {
 	}
 	rlSystem.loadRules(sgfw.RULE_MODE_SYSTEM)
 
+	newWarningList(dbus, boxWarnings).loadWarnings()
+	newCandidateList(dbus, win, boxLearned).loadCandidates()
+
 	loadConfig(win, b, dbus)
+	setupRuleUsage(win, b, dbus)
 	app.AddWindow(win)
 	fwswin = win
 	win.ShowAll()
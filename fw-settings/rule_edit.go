@@ -3,8 +3,6 @@ package main
 import (
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
 	"unicode"
 
 	"github.com/subgraph/fw-daemon/sgfw"
@@ -26,6 +24,7 @@ type ruleEdit struct {
 	verbCombo    *gtk.ComboBoxText
 	hostEntry    *gtk.Entry
 	portEntry    *gtk.Entry
+	commentEntry *gtk.Entry
 	ok           *gtk.Button
 }
 
@@ -40,6 +39,7 @@ func newRuleEdit(rr *ruleRow, saveasnew bool) *ruleEdit {
 		"verb_combo", &redit.verbCombo,
 		"host_entry", &redit.hostEntry,
 		"port_entry", &redit.portEntry,
+		"comment_entry", &redit.commentEntry,
 		"ok_button", &redit.ok,
 	)
 	b.ConnectSignals(map[string]interface{}{
@@ -69,8 +69,9 @@ func (re *ruleEdit) updateDialogFields() {
 		re.sandboxLabel.SetVisible(false)
 		re.sandboxTitle.SetVisible(false)
 	}
-	target := strings.Split(r.Target, ":")
-	if len(target) != 2 {
+	re.commentEntry.SetText(r.Comment)
+	target, ok := splitTarget(r.Target)
+	if !ok {
 		return
 	}
 	re.hostEntry.SetText(target[0])
@@ -87,7 +88,7 @@ func (re *ruleEdit) validateFields() bool {
 	if !isValidHost(host) {
 		return false
 	}
-	if !isValidPort(port) {
+	if !sgfw.ValidPortSpec(re.row.rule.Proto, port) {
 		return false
 	}
 	return true
@@ -100,29 +101,10 @@ func isValidHost(host string) bool {
 	if net.ParseIP(host) != nil {
 		return true
 	}
-
-	parts := strings.Split(host, ".")
-	if len(parts) < 2 {
-		return false
-	}
-	for _, part := range parts {
-		if part == "" {
-			return false
-		}
-	}
-	return true
-}
-
-func isValidPort(port string) bool {
-	if port == "*" {
+	if _, _, err := net.ParseCIDR(host); err == nil {
 		return true
 	}
-
-	pval, err := strconv.Atoi(port)
-	if err != nil {
-		return false
-	}
-	return pval > 0 && pval <= 0xFFFF
+	return sgfw.ValidHostPattern(host)
 }
 
 func (re *ruleEdit) updateRow() {
@@ -141,6 +123,7 @@ func (re *ruleEdit) updateRow() {
 	host, _ := re.hostEntry.GetText()
 	port, _ := re.portEntry.GetText()
 	r.Target = fmt.Sprintf("%s:%s", host, port)
+	r.Comment, _ = re.commentEntry.GetText()
 	re.row.update()
 }
 
@@ -174,8 +157,9 @@ func (re *ruleEdit) onPortInsertText(entry *gtk.Entry, text string) {
 		entry.StopEmission("insert-text")
 		return
 	}
+	// ports may be given as lists, ranges or service names
 	for _, c := range text {
-		if !unicode.IsDigit(c) {
+		if !unicode.IsDigit(c) && !unicode.IsLetter(c) && c != ',' && c != '-' {
 			entry.StopEmission("insert-text")
 			return
 		}
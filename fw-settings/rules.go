@@ -5,6 +5,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/subgraph/fw-daemon/sgfw"
 
@@ -58,6 +59,9 @@ func (rl *ruleList) loadRules(mode sgfw.RuleMode) error {
 }
 
 func (rl *ruleList) addRules(rules []sgfw.DbusRule, mode sgfw.RuleMode) {
+	if sortByUsage {
+		sortRulesByUsage(rules)
+	}
 	for i := 0; i < len(rules); i++ {
 		if sgfw.RuleMode(rules[i].Mode) != mode {
 			continue
@@ -95,6 +99,9 @@ func createWidget(rule *sgfw.DbusRule) *ruleRow {
 		row.gtkButtonEdit.SetNoShowAll(true)
 		row.gtkButtonDelete.SetSensitive(false)
 		row.gtkButtonDelete.SetTooltipText("Cannot delete system rules")
+		if rule.SourceFile != "" {
+			row.gtkButtonDelete.SetTooltipText("Cannot delete rules from " + rule.SourceFile)
+		}
 		break
 	case sgfw.RULE_MODE_SESSION:
 		row.gtkButtonSave.SetSensitive(true)
@@ -128,7 +135,41 @@ func (rr *ruleRow) update() {
 		rr.gtkLabelOrigin.SetText(rr.rule.Origin + " (" + rr.rule.Proto + ")")
 	}
 	rr.gtkLabelPrivs.SetText(rr.rule.Privs)
-	rr.gtkLabelTarget.SetText(getTargetText(rr.rule))
+	target := getTargetText(rr.rule)
+	if rr.rule.Expires != 0 {
+		target += " (until " + time.Unix(rr.rule.Expires, 0).Format("Jan 2 15:04") + ")"
+	}
+	if rr.rule.Parent != "" {
+		target += " [" + rr.rule.Parent + "]"
+	}
+	if rr.rule.CGroup != "" {
+		target += " [" + rr.rule.CGroup + "]"
+	}
+	rr.gtkLabelTarget.SetText(target)
+	rr.gtkLabelTarget.SetTooltipText(getRuleInfoText(rr.rule))
+}
+
+func getRuleInfoText(rule *sgfw.DbusRule) string {
+	var lines []string
+	if rule.Comment != "" {
+		lines = append(lines, rule.Comment)
+	}
+	if rule.Created != 0 {
+		lines = append(lines, "Created "+time.Unix(rule.Created, 0).Format("Jan 2 2006 15:04"))
+	}
+	if rule.Author != "" {
+		lines = append(lines, "Added by "+rule.Author)
+	}
+	if rule.SourceFile != "" {
+		lines = append(lines, "Read-only, from "+rule.SourceFile)
+	}
+	if rule.Hits == 0 {
+		lines = append(lines, "Never used")
+	} else {
+		lines = append(lines, fmt.Sprintf("Used %d times, last on %s", rule.Hits,
+			time.Unix(rule.LastHit, 0).Format("Jan 2 2006 15:04")))
+	}
+	return strings.Join(lines, "\n")
 }
 
 func getVerbText(rule *sgfw.DbusRule) string {
@@ -142,22 +183,35 @@ func getVerbText(rule *sgfw.DbusRule) string {
 }
 
 func getTargetText(rule *sgfw.DbusRule) string {
+	inbound := sgfw.RuleDirection(rule.Direction) == sgfw.RULE_DIRECTION_IN
 	if rule.Target == "*:*" {
+		if inbound {
+			return "All incoming connections"
+		}
 		return "All connections"
 	}
-	items := strings.Split(rule.Target, ":")
+	items, ok := splitTarget(rule.Target)
 
-	if len(items) != 2 {
+	if !ok {
 		return rule.Target
 	}
 
+	port := "port"
+	if strings.ContainsAny(items[1], ",-") {
+		port = "ports"
+	}
+
+	if inbound {
+		return getInboundTargetText(items, port)
+	}
+
 	if items[0] == "*" {
 		if rule.Proto == "tcp" {
-			return fmt.Sprintf("Connections to ALL hosts on port %s", items[1])
+			return fmt.Sprintf("Connections to ALL hosts on %s %s", port, items[1])
 		} else if rule.Proto == "icmp" {
 			return fmt.Sprintf("Data to ALL hosts with ICMP code %s", items[1])
 		}
-		return fmt.Sprintf("Data to ALL hosts on port %s", items[1])
+		return fmt.Sprintf("Data to ALL hosts on %s %s", port, items[1])
 	}
 	if items[1] == "*" {
 		if rule.Proto == "tcp" {
@@ -167,11 +221,33 @@ func getTargetText(rule *sgfw.DbusRule) string {
 	}
 
 	if rule.Proto == "tcp" {
-		return fmt.Sprintf("Connections to %s on port %s", items[0], items[1])
+		return fmt.Sprintf("Connections to %s on %s %s", items[0], port, items[1])
 	} else if rule.Proto == "icmp" {
 		return fmt.Sprintf("Data to %s with ICMP code %s", items[0], items[1])
 	}
-	return fmt.Sprintf("Data to %s on port %s", items[0], items[1])
+	return fmt.Sprintf("Data to %s on %s %s", items[0], port, items[1])
+}
+
+// getInboundTargetText describes the target of a rule on incoming
+// connections, which is the remote host and the local port.
+func getInboundTargetText(items []string, port string) string {
+	if items[0] == "*" {
+		return fmt.Sprintf("Incoming connections from ALL hosts on %s %s", port, items[1])
+	}
+	if items[1] == "*" {
+		return fmt.Sprintf("All incoming connections from host %s", items[0])
+	}
+	return fmt.Sprintf("Incoming connections from %s on %s %s", items[0], port, items[1])
+}
+
+// splitTarget separates a rule target into its host and port parts.  The
+// port always follows the last colon since IPv6 hosts contain colons too.
+func splitTarget(target string) ([]string, bool) {
+	idx := strings.LastIndex(target, ":")
+	if idx <= 0 {
+		return nil, false
+	}
+	return []string{target[:idx], target[idx+1:]}, true
 }
 
 func (rr *ruleRow) onSaveAsNew() {
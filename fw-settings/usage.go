@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/subgraph/fw-daemon/sgfw"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// sortByUsage orders the rule lists by how often each rule matched.  It is
+// a view setting only and not saved.
+var sortByUsage = false
+
+// the most rules listed when asking before removing unused rules
+const maxPruneListed = 15
+
+func sortRulesByUsage(rules []sgfw.DbusRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Hits != rules[j].Hits {
+			return rules[i].Hits > rules[j].Hits
+		}
+		return rules[i].LastHit > rules[j].LastHit
+	})
+}
+
+// setupRuleUsage connects the rule order and pruning options.  Unlike
+// loadConfig it must only be called once, as it would otherwise connect
+// the handlers again.
+func setupRuleUsage(win *gtk.Window, b *builder, dbus *dbusObject) {
+	var sortCombo *gtk.ComboBoxText
+	var pruneCombo *gtk.ComboBoxText
+	var pruneButton *gtk.Button
+
+	b.getItems(
+		"sort_combo", &sortCombo,
+		"prune_combo", &pruneCombo,
+		"prune_button", &pruneButton,
+	)
+
+	sortCombo.Connect("changed", func() {
+		sortByUsage = sortCombo.GetActiveID() == "USAGE"
+		glib.IdleAdd(repopulateWin)
+	})
+	pruneButton.Connect("clicked", func() {
+		days, err := strconv.Atoi(pruneCombo.GetActiveID())
+		if err != nil {
+			return
+		}
+		pruneUnusedRules(win, dbus, uint32(days))
+	})
+}
+
+func pruneUnusedRules(win *gtk.Window, dbus *dbusObject, days uint32) {
+	rules, err := dbus.pruneUnusedRules(days, true)
+	if err != nil {
+		d := gtk.MessageDialogNew(win, gtk.DIALOG_DESTROY_WITH_PARENT, gtk.MESSAGE_ERROR, gtk.BUTTONS_CLOSE,
+			"Unable to find unused rules: %v", err)
+		d.Run()
+		d.Destroy()
+		return
+	}
+	if len(rules) == 0 {
+		d := gtk.MessageDialogNew(win, gtk.DIALOG_DESTROY_WITH_PARENT, gtk.MESSAGE_INFO, gtk.BUTTONS_CLOSE,
+			"No permanent rules have been unused for %d days.", days)
+		d.Run()
+		d.Destroy()
+		return
+	}
+
+	listed := rules
+	if len(listed) > maxPruneListed {
+		listed = append(listed[:maxPruneListed:maxPruneListed], fmt.Sprintf("and %d more", len(rules)-maxPruneListed))
+	}
+	d := gtk.MessageDialogNew(win, gtk.DIALOG_DESTROY_WITH_PARENT, gtk.MESSAGE_QUESTION, gtk.BUTTONS_OK_CANCEL,
+		"Remove %d rules unused for %d days?\n\n%s", len(rules), days, strings.Join(listed, "\n"))
+	if d.Run() == (int)(gtk.RESPONSE_OK) {
+		if _, err := dbus.pruneUnusedRules(days, false); err != nil {
+			fmt.Printf("Unable to remove unused rules: %v\n", err)
+		}
+	}
+	d.Destroy()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/gotk3/gotk3/gtk"
+)
+
+type warningList struct {
+	dbus *dbusObject
+	list *gtk.ListBox
+}
+
+func newWarningList(dbus *dbusObject, list *gtk.ListBox) *warningList {
+	wl := &warningList{dbus: dbus, list: list}
+	wl.list.SetSelectionMode(gtk.SELECTION_NONE)
+	return wl
+}
+
+func (wl *warningList) loadWarnings() error {
+	warnings, err := wl.dbus.analyzeRules()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %+v\n", err)
+		return err
+	}
+	if len(warnings) == 0 {
+		wl.addRow("No problems found in the rules.", "")
+		return nil
+	}
+	for _, w := range warnings {
+		wl.addRow(fmt.Sprintf("%s (%s): %s", path.Base(w.Path), w.Kind, w.Message), w.Path)
+	}
+	return nil
+}
+
+func (wl *warningList) addRow(text, tooltip string) {
+	label, _ := gtk.LabelNew(text)
+	label.SetHAlign(gtk.ALIGN_START)
+	label.SetLineWrap(true)
+	label.SetMarginStart(10)
+	label.SetMarginEnd(10)
+	label.SetMarginTop(5)
+	label.SetMarginBottom(5)
+	if tooltip != "" {
+		label.SetTooltipText(tooltip)
+	}
+	row, _ := gtk.ListBoxRowNew()
+	row.Add(label)
+	wl.list.Add(row)
+}
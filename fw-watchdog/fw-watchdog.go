@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.com/subgraph/fw-daemon/sgfw"
+)
+
+func main() {
+	sgfw.WatchdogMain()
+}
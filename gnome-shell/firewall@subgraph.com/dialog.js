@@ -14,6 +14,10 @@ const RuleScope = {
     APPLY_SESSION: 1,
     APPLY_PROCESS: 2,
     APPLY_FOREVER: 3,
+    APPLY_FIFTEEN_MINUTES: 4,
+    APPLY_ONE_HOUR: 5,
+    APPLY_ONE_DAY: 6,
+    APPLY_PARENT: 7,
 };
 
 const DetailSection = new Lang.Class({
@@ -142,9 +146,9 @@ const OptionList = new Lang.Class({
     _init: function(pid_known, sandboxed) {
         this.actor = new St.BoxLayout({vertical: true, style_class: 'fw-option-list'});
         if (pid_known) {
-                this.buttonGroup = new ButtonGroup("Forever", "Session", "Once", "PID");
+                this.buttonGroup = new ButtonGroup("Forever", "Session", "Once", "15 Min", "1 Hour", "1 Day", "PID", "Parent");
         } else {
-                this.buttonGroup = new ButtonGroup("Forever", "Session", "Once");
+                this.buttonGroup = new ButtonGroup("Forever", "Session", "Once", "15 Min", "1 Hour", "1 Day");
         }
         this.actor.add_child(this.buttonGroup.actor);
         this.items = [];
@@ -230,7 +234,15 @@ const OptionList = new Lang.Class({
         case 2:
             return RuleScope.APPLY_ONCE;
         case 3:
+            return RuleScope.APPLY_FIFTEEN_MINUTES;
+        case 4:
+            return RuleScope.APPLY_ONE_HOUR;
+        case 5:
+            return RuleScope.APPLY_ONE_DAY;
+        case 6:
             return RuleScope.APPLY_PROCESS;
+        case 7:
+            return RuleScope.APPLY_PARENT;
         default:
             log("SGFW: unexpected scope value "+ this.buttonGroup._selected);
             return RuleScope.APPLY_SESSION;
@@ -239,7 +251,15 @@ const OptionList = new Lang.Class({
 
     scopeToIdx: function(scope) {
         switch (scope) {
+        case RuleScope.APPLY_PARENT:
+            return 7;
         case RuleScope.APPLY_PROCESS:
+            return 6;
+        case RuleScope.APPLY_ONE_DAY:
+            return 5;
+        case RuleScope.APPLY_ONE_HOUR:
+            return 4;
+        case RuleScope.APPLY_FIFTEEN_MINUTES:
             return 3;
         case RuleScope.APPLY_ONCE:
             return 2;
@@ -611,6 +631,16 @@ const PromptDialog = new Lang.Class({
         this.sendReturnValue(false);
     },
 
+    // cancel closes the dialog without an answer, as the daemon no longer
+    // waits for one.
+    cancel: function() {
+        this.close();
+        if (this._invocation) {
+            this._invocation.return_dbus_error("com.subgraph.FirewallPrompt.Closed", "Prompt closed");
+            this._invocation = null;
+        }
+    },
+
     sendReturnValue: function(allow) {
         if (!this._invocation) {
             return;
@@ -675,7 +705,9 @@ const PromptDialog = new Lang.Class({
 
         this.header.setTitle(application);
 
-        if (proto == "tcp") {
+        if (optstring.indexOf("[wants to accept connections]") != -1) {
+            this.header.setMessage("Wants to accept connections from "+ address + " on " + port_str);
+        } else if (proto == "tcp") {
             this.header.setMessage("Wants to connect to "+ address + " on " + port_str);
         } else if (proto == "udp") {
             this.header.setMessage("Wants to send data to "+ address + " on " + port_str);
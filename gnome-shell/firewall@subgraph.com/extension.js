@@ -73,10 +73,13 @@ const FirewallPromptInterface = '<node> \
         <arg type="b" direction="in" name="expanded" /> \
         <arg type="b" direction="in" name="expert" /> \
         <arg type="i" direction="in" name="action" /> \
+        <arg type="u" direction="in" name="id" /> \
         <arg type="i" direction="out" name="scope" /> \
         <arg type="s" direction="out" name="rule" /> \
     </method> \
-    <method name="ClosePrompt"/> \
+    <method name="ClosePrompt"> \
+        <arg type="u" direction="in" name="id" /> \
+    </method> \
     <method name="TestPrompt"/> \
 </interface> \
 </node>';
@@ -91,6 +94,7 @@ const FirewallPromptHandler = new Lang.Class({
         Gio.bus_own_name_on_connection(Gio.DBus.system, 'com.subgraph.FirewallPrompt', Gio.BusNameOwnerFlags.REPLACE, null, null);
         this._dialogs = new Array();
         this._dialog = null;
+        this._dialogId = null;
         this._promptTimeout = null;
         this._initKeybindings();
     },
@@ -158,11 +162,38 @@ const FirewallPromptHandler = new Lang.Class({
 
     _closeDialogs: function() {
         log("SGFW: Closing all dialogs");
-        if (this._dialog !== null && this._dialog !== undefined) {
-            this._dialog.close();
+        if (this._dialog !== null && this._dialog !== undefined && this._dialog !== true) {
+            this._dialog.cancel();
         }
         while (this._dialogs.length > 0) {
-            this._dialogs.shift();
+            let params = this._dialogs.shift();
+            let invocation = params[params.length - 1];
+            if (invocation) {
+                invocation.return_dbus_error("com.subgraph.FirewallPrompt.Closed", "Prompt closed");
+            }
+        }
+    },
+
+    // _closeDialog closes the dialog requested with id, or takes it off the
+    // queue if it is not shown yet, without an answer.
+    _closeDialog: function(id) {
+        if (this._dialogId === id && this._dialog !== null && this._dialog !== undefined && this._dialog !== true) {
+            log("SGFW: Closing dialog " + id);
+            this._dialog.cancel();
+            return;
+        }
+        for (var i = 0; i < this._dialogs.length; i++) {
+            let params = this._dialogs[i];
+            if (params[params.length - 2] !== id) {
+                continue;
+            }
+            log("SGFW: Dropping queued dialog " + id);
+            this._dialogs.splice(i, 1);
+            let invocation = params[params.length - 1];
+            if (invocation) {
+                invocation.return_dbus_error("com.subgraph.FirewallPrompt.Closed", "Prompt closed");
+            }
+            return;
         }
     },
 
@@ -184,7 +215,8 @@ const FirewallPromptHandler = new Lang.Class({
         log("SGFW: Creating next available dialog...");
         try {
             let params = this._dialogs.shift();
-            let [app, icon, path, address, port, ip, origin, proto, uid, gid, user, group, pid, sandbox, tlsguard, optstring, expanded, expert, action, invocation] = params;
+            let [app, icon, path, address, port, ip, origin, proto, uid, gid, user, group, pid, sandbox, tlsguard, optstring, expanded, expert, action, id, invocation] = params;
+            this._dialogId = id;
 
             this._dialog = new Dialog.PromptDialog(invocation, (pid >= 0), (sandbox != ""), tlsguard);
             this._dialog.update(app, icon, path, address, port, ip, origin, uid, gid, user, group, pid, proto, tlsguard, optstring, sandbox, expanded, expert, action);
@@ -217,15 +249,18 @@ const FirewallPromptHandler = new Lang.Class({
             log("SGFW: Error unable to close/destroy modal...");
         }
         this._dialog = null;
+        this._dialogId = null;
         if (this._dialogs.length > 0) {
             log("SGFW: Opening next dialogs (remaining: " + this._dialogs.length + ")");
             this._createDialog();
         }
     },
 
-    CloseAsync: function(params, invocation) {
-        log("SGFW: Close Async Requested");
-        this._closeDialogs();
+    ClosePromptAsync: function(params, invocation) {
+        let [id] = params;
+        log("SGFW: Close Prompt Requested for " + id);
+        this._closeDialog(id);
+        invocation.return_value(null);
     },
 
     TestPrompt: function(params, invocation) {
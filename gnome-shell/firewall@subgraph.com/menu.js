@@ -13,6 +13,12 @@ const FirewallInterface = '<node> \
   <method name="IsEnabled"> \
     <arg name="enabled" direction="out" type="b" /> \
   </method> \
+  <method name="SetLockdown"> \
+    <arg name="lockdown" direction="in" type="b" /> \
+  </method> \
+  <method name="IsLockdown"> \
+    <arg name="lockdown" direction="out" type="b" /> \
+  </method> \
 </interface>\
 </node>';
 
@@ -50,6 +56,15 @@ const FirewallMenu = new Lang.Class({
             let [enabled] = result;
             this.toggle.setToggleState(enabled);
         }));
+        this.proxy.IsLockdownRemote(Lang.bind(this, function(result, err) {
+            if (err) {
+                log(err.message);
+                return;
+            }
+            let [lockdown] = result;
+            this.lockdownToggle.setToggleState(lockdown);
+            this.item.icon.icon_name = lockdown ? "security-low-symbolic" : "security-high-symbolic";
+        }));
     },
 
     destroy: function() {
@@ -79,6 +94,9 @@ const FirewallMenu = new Lang.Class({
         this.toggle = new PopupMenu.PopupSwitchMenuItem("Firewall Enabled", true);
         this.toggle.connect('toggled', Lang.bind(this, this.onToggle));
         this.item.menu.addMenuItem(this.toggle);
+        this.lockdownToggle = new PopupMenu.PopupSwitchMenuItem("Network Lockdown", false);
+        this.lockdownToggle.connect('toggled', Lang.bind(this, this.onLockdownToggle));
+        this.item.menu.addMenuItem(this.lockdownToggle);
 
         //this.item.menu.addAction("Connection Monitor", Lang.bind(this, this.onMonitor));
         this.item.menu.addAction("Firewall Settings", Lang.bind(this, this.onSettings));
@@ -94,6 +112,12 @@ const FirewallMenu = new Lang.Class({
         this.proxy.SetEnabledRemote(this.toggle.state);
     },
 
+    onLockdownToggle: function() {
+        log("Lockdown " + (this.lockdownToggle.state ? "ON" : "OFF"));
+        this.proxy.SetLockdownRemote(this.lockdownToggle.state);
+        this.item.icon.icon_name = this.lockdownToggle.state ? "security-low-symbolic" : "security-high-symbolic";
+    },
+
     onSettings: function() {
         Util.spawnCommandLine("/usr/bin/fw-settings")
     },
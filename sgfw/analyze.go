@@ -0,0 +1,199 @@
+package sgfw
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Kinds of problems reported by analyzeRules
+const (
+	WARN_DUPLICATE     = "duplicate"
+	WARN_CONTRADICTORY = "contradictory"
+	WARN_REDUNDANT     = "redundant"
+	WARN_SHADOWED      = "shadowed"
+	WARN_STALE         = "stale"
+)
+
+type ruleWarning struct {
+	kind  string
+	rule  *Rule
+	other *Rule
+}
+
+func (w *ruleWarning) message() string {
+	other := ""
+	if w.other != nil {
+		other = w.other.String()
+		if w.other.policy != w.rule.policy {
+			other += " of " + w.other.policy.path
+		}
+	}
+	switch w.kind {
+	case WARN_DUPLICATE:
+		return fmt.Sprintf("%s repeats an earlier rule", w.rule)
+	case WARN_CONTRADICTORY:
+		return fmt.Sprintf("%s contradicts the earlier rule %s, which always wins", w.rule, other)
+	case WARN_REDUNDANT:
+		return fmt.Sprintf("%s is not needed, the earlier rule %s already covers it", w.rule, other)
+	case WARN_SHADOWED:
+		return fmt.Sprintf("%s never applies, the earlier rule %s matches everything it does", w.rule, other)
+	case WARN_STALE:
+		return fmt.Sprintf("%s belongs to process %d, which is no longer running", w.rule, w.rule.pid)
+	}
+	return w.rule.String()
+}
+
+// covers reports whether r matches every connection that o matches, so that
+// o can never be reached when r comes first.  It errs on the side of false.
+func (r *Rule) covers(o *Rule) bool {
+	if r.direction != o.direction || r.proto != o.proto || !r.ports.covers(o.ports) {
+		return false
+	}
+	if (r.uid != -1 && r.uid != o.uid) || (r.gid != -1 && r.gid != o.gid) ||
+		(r.uname != "" && r.uname != o.uname) || (r.gname != "" && r.gname != o.gname) {
+		return false
+	}
+	if (r.pid >= 0 && r.pid != o.pid) || (r.saddr != nil && !r.saddr.Equal(o.saddr)) {
+		return false
+	}
+	return r.coversAddr(o) && r.ancestry.covers(o.ancestry) && r.cgroup.covers(o.cgroup)
+}
+
+func (r *Rule) coversAddr(o *Rule) bool {
+	if r.hostname == "" && addrMatchesAny(r.addr) {
+		return true
+	}
+	if r.hostname != "" {
+		return o.hostname != "" && r.hostpat.covers(o.hostpat)
+	}
+	if o.hostname != "" || addrMatchesAny(o.addr) {
+		return false
+	}
+	if r.network != nil {
+		if o.network == nil {
+			return r.network.Contains(o.addr)
+		}
+		rbits, _ := r.network.Mask.Size()
+		obits, _ := o.network.Mask.Size()
+		return rbits <= obits && r.network.Contains(o.network.IP)
+	}
+	return o.network == nil && r.addr.Equal(o.addr)
+}
+
+func (am *ancestryMatch) covers(o *ancestryMatch) bool {
+	if am == nil {
+		return true
+	}
+	if o == nil || am.path != o.path {
+		return false
+	}
+	// the parent is one of the ancestors
+	return am.kind == o.kind || am.kind == ancestryAny
+}
+
+func (cm *cgroupMatch) covers(o *cgroupMatch) bool {
+	if cm == nil {
+		return true
+	}
+	if o == nil || cm.kind != o.kind {
+		return false
+	}
+	if cm.kind == cgroupPath {
+		return o.value == cm.value || strings.HasPrefix(o.value, cm.value+"/")
+	}
+	return cm.value == o.value
+}
+
+// analyzeRules looks for rules that have no effect or contradict others.
+// Since the first matching rule of a policy decides, a rule covered by an
+// earlier one is never reached.  The policy of a systemd unit is evaluated
+// before those of the executables run in it, so a rule limited to a unit is
+// also never reached when one of the unit policy covers it.
+func (fw *Firewall) analyzeRules() []ruleWarning {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	var warnings []ruleWarning
+	now := time.Now()
+	unitRules := make(map[string][]*Rule)
+	for _, p := range fw.policies {
+		if strings.HasPrefix(p.path, unitPolicyPrefix) {
+			p.lock.Lock()
+			unitRules[p.sandbox+"|"+p.path] = p.hidingRules(now)
+			p.lock.Unlock()
+		}
+	}
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		warnings = append(warnings, p.analyzeRules(now, unitRules)...)
+		p.lock.Unlock()
+	}
+	return warnings
+}
+
+// hidingRules returns the rules of the policy that can hide the rules
+// after them: a rule that runs out or whose process is gone cannot do so
+// for good.  It must be called with p.lock held.
+func (p *Policy) hidingRules(now time.Time) []*Rule {
+	var rules []*Rule
+	for _, r := range p.rules {
+		if r.isExpired(now) || !r.expires.IsZero() || (r.mode == RULE_MODE_PROCESS && !processExists(r.pid)) {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// analyzeRules checks the rules of a single policy, after those of the unit
+// policies in unitRules, by sandbox and path, for the rules limited to a
+// unit.  It must be called with p.lock held.
+func (p *Policy) analyzeRules(now time.Time, unitRules map[string][]*Rule) []ruleWarning {
+	var warnings []ruleWarning
+	var earlier []*Rule
+	keys := make(map[*Rule]string)
+	for _, r := range p.rules {
+		if r.isExpired(now) {
+			continue
+		}
+		if r.mode == RULE_MODE_PROCESS && !processExists(r.pid) {
+			warnings = append(warnings, ruleWarning{kind: WARN_STALE, rule: r})
+			continue
+		}
+		keys[r] = r.matchKey()
+		prior := earlier
+		if r.cgroup != nil && r.cgroup.kind == cgroupUnit && !strings.HasPrefix(p.path, unitPolicyPrefix) {
+			prior = append(append([]*Rule{}, unitRules[p.sandbox+"|"+unitPolicyPrefix+r.cgroup.value]...), earlier...)
+		}
+		for _, e := range prior {
+			if keys[e] == keys[r] && e.pid == r.pid {
+				kind := WARN_DUPLICATE
+				if e.rtype != r.rtype {
+					kind = WARN_CONTRADICTORY
+				}
+				warnings = append(warnings, ruleWarning{kind: kind, rule: r, other: e})
+				break
+			}
+			if e.covers(r) {
+				kind := WARN_REDUNDANT
+				if e.rtype != r.rtype {
+					kind = WARN_SHADOWED
+				}
+				warnings = append(warnings, ruleWarning{kind: kind, rule: r, other: e})
+				break
+			}
+		}
+		// a rule that runs out cannot hide the ones after it for good
+		if r.expires.IsZero() {
+			earlier = append(earlier, r)
+		}
+	}
+	return warnings
+}
+
+func processExists(pid int) bool {
+	_, err := os.Stat(fmt.Sprintf("/proc/%d", pid))
+	return err == nil
+}
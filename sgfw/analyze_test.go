@@ -0,0 +1,176 @@
+package sgfw
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostPatternCovers(t *testing.T) {
+	tests := []struct {
+		p, other string
+		want     bool
+	}{
+		{"www.example.com", "www.example.com", true},
+		{".example.com", "www.example.com", true},
+		{".example.com", "example.com", true},
+		{".example.com", ".cdn.example.com", true},
+		{".example.com", "*.cdn.example.com", true},
+		{".cdn.example.com", ".example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", false},
+		{"*.example.com", ".example.com", false},
+		{".example.com", "www.*", false},
+		{"re:.*", "re:.*", true},
+		{"re:.*", "www.example.com", true},
+		{".example.com", "re:.*\\.example\\.com", false},
+	}
+	for _, tt := range tests {
+		hp, err := compileHostPattern(tt.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := compileHostPattern(tt.other)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hp.covers(other); got != tt.want {
+			t.Errorf("%s covers %s: got %v, want %v", tt.p, tt.other, got, tt.want)
+		}
+	}
+}
+
+func TestPortListCovers(t *testing.T) {
+	tests := []struct {
+		pl, other string
+		want      bool
+	}{
+		{"*", "80", true},
+		{"80", "*", false},
+		{"80,443", "443", true},
+		{"1000-2000", "1500-1600,2000", true},
+		{"1000-1500,1501-2000", "1200-1800", true},
+		{"1000-1500,1502-2000", "1200-1800", false},
+		{"65000-65535", "65535", true},
+	}
+	for _, tt := range tests {
+		pl, ok := parsePortList("tcp", tt.pl)
+		other, ok2 := parsePortList("tcp", tt.other)
+		if !ok || !ok2 {
+			t.Fatalf("bad port lists %s, %s", tt.pl, tt.other)
+		}
+		if got := pl.covers(other); got != tt.want {
+			t.Errorf("%s covers %s: got %v, want %v", tt.pl, tt.other, got, tt.want)
+		}
+	}
+}
+
+func testAnalyzePolicy(t *testing.T, rules ...string) *Policy {
+	p := testFirewall().policyForPathAndSandbox("/usr/bin/curl", "")
+	for _, s := range rules {
+		if _, err := p.parseRule(s, true); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	return p
+}
+
+func warningKinds(ws []ruleWarning) []string {
+	var kinds []string
+	for _, w := range ws {
+		kinds = append(kinds, w.kind+" "+w.rule.AddrString(false))
+	}
+	return kinds
+}
+
+func TestAnalyzeRules(t *testing.T) {
+	p := testAnalyzePolicy(t,
+		"ALLOW|.example.com:443|PERMANENT|-1:-1|",
+		"DENY|www.example.com:443|PERMANENT|-1:-1|",
+		"ALLOW|api.example.com:443|PERMANENT|-1:-1|",
+		"ALLOW|10.0.0.0/8:*|PERMANENT|-1:-1|",
+		"ALLOW|10.1.0.0/16:22|PERMANENT|-1:-1|",
+		"DENY|10.1.2.3:22|PERMANENT|-1:-1|",
+		"ALLOW|other.org:80|PERMANENT|-1:-1|",
+		"ALLOW|other.org:80|PERMANENT|-1:-1|",
+		"DENY|other.org:80|PERMANENT|-1:-1|",
+		"DENY|*:25|PERMANENT|-1:-1||||parent:/bin/sh",
+		"DENY|*:25|PERMANENT|-1:-1||||ancestor:/bin/sh",
+		"ALLOW|*:8080|PERMANENT|1000:-1|",
+		"ALLOW|*:8080|PERMANENT|-1:-1|",
+	)
+	want := []string{
+		"shadowed www.example.com:443",
+		"redundant api.example.com:443",
+		"redundant 10.1.0.0/16:22",
+		"shadowed 10.1.2.3:22",
+		"duplicate other.org:80",
+		"contradictory other.org:80",
+	}
+	got := warningKinds(p.analyzeRules(time.Now(), nil))
+	if len(got) != len(want) {
+		t.Fatalf("got warnings %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("warning %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestAnalyzeRulesExpiryAndProcesses(t *testing.T) {
+	p := testAnalyzePolicy(t,
+		"ALLOW|*:443||-1:-1|",
+		"DENY|example.com:443||-1:-1|",
+	)
+	p.rules[0].expires = time.Now().Add(time.Hour)
+	if ws := p.analyzeRules(time.Now(), nil); len(ws) != 0 {
+		t.Errorf("a rule that expires shadows later rules: %v", warningKinds(ws))
+	}
+
+	p = testAnalyzePolicy(t, "ALLOW|*:80||-1:-1|", "ALLOW|*:443||-1:-1|")
+	p.rules[0].mode = RULE_MODE_PROCESS
+	p.rules[0].pid = 1 << 30
+	p.rules[1].mode = RULE_MODE_PROCESS
+	p.rules[1].pid = os.Getpid()
+	got := warningKinds(p.analyzeRules(time.Now(), nil))
+	if len(got) != 1 || got[0] != "stale *:80" {
+		t.Errorf("got warnings %v, want a stale rule for a dead process", got)
+	}
+}
+
+// The rules of a unit policy come first for the processes in the unit, so
+// a rule limited to the unit that one of them covers is never reached.
+func TestAnalyzeRulesAcrossPolicies(t *testing.T) {
+	fw := testFirewall()
+	for path, rules := range map[string][]string{
+		"unit:cron.service": {"ALLOW|*:443|PERMANENT|-1:-1|"},
+		"/usr/bin/curl": {
+			"DENY|example.com:443|PERMANENT|-1:-1||||||OUT",
+			"DENY|example.org:443|PERMANENT|-1:-1|||||unit:cron.service",
+			"DENY|example.net:443|PERMANENT|-1:-1|||||unit:apt-daily.service",
+		},
+		anyExePath: {"ALLOW|example.com:443|PERMANENT|-1:-1|||||unit:cron.service"},
+	} {
+		p := fw.policyForPathAndSandbox(path, "")
+		for _, s := range rules {
+			if _, err := p.parseRule(s, true); err != nil {
+				t.Fatalf("%s: %v", s, err)
+			}
+		}
+	}
+	var got []string
+	for _, w := range fw.analyzeRules() {
+		got = append(got, w.rule.policy.path+" "+w.kind+" "+w.rule.AddrString(false))
+		if w.other == nil || w.other.policy.path != "unit:cron.service" || !strings.Contains(w.message(), " of unit:cron.service") {
+			t.Errorf("%s reported against %v", w.rule, w.other)
+		}
+	}
+	sort.Strings(got)
+	want := []string{"* redundant example.com:443", "/usr/bin/curl shadowed example.org:443"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got warnings %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package sgfw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/subgraph/go-procsnitch"
+)
+
+// Path of the policy holding rules that apply to every executable, such as
+// "anything started by /usr/bin/apt".
+const anyExePath = "*"
+
+// How far up the process tree ancestor rules look
+const maxAncestryDepth = 32
+
+type ancestryKind int
+
+const (
+	ancestryParent ancestryKind = iota
+	ancestryAny
+)
+
+var ancestryKindString = map[ancestryKind]string{
+	ancestryParent: "parent",
+	ancestryAny:    "ancestor",
+}
+
+// ancestryMatch restricts a rule to processes started by a given executable,
+// either directly or anywhere further up the process tree.
+type ancestryMatch struct {
+	kind ancestryKind
+	path string
+}
+
+// parseAncestry parses the ancestry field of a rule, which is either
+// "parent:<path>" or "ancestor:<path>".
+func parseAncestry(s string) (*ancestryMatch, bool) {
+	toks := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(toks) != 2 || !strings.HasPrefix(toks[1], "/") {
+		return nil, false
+	}
+	for kind, str := range ancestryKindString {
+		if toks[0] == str {
+			return &ancestryMatch{kind: kind, path: toks[1]}, true
+		}
+	}
+	return nil, false
+}
+
+func (am *ancestryMatch) String() string {
+	if am == nil {
+		return ""
+	}
+	return ancestryKindString[am.kind] + ":" + am.path
+}
+
+func (am *ancestryMatch) matches(pa *procAncestry) bool {
+	if am.kind == ancestryParent {
+		return pa.parent() == am.path
+	}
+	for _, p := range pa.all() {
+		if p == am.path {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchAncestry(pa *procAncestry) bool {
+	return r.ancestry == nil || r.ancestry.matches(pa)
+}
+
+// procAncestry holds the executables of the ancestors of a process, nearest
+// first.  The process tree is only walked when a rule asks for it.
+type procAncestry struct {
+	pinfo  *procsnitch.Info
+	paths  []string
+	walked bool
+}
+
+func newProcAncestry(pinfo *procsnitch.Info) *procAncestry {
+	return &procAncestry{pinfo: pinfo}
+}
+
+func (pa *procAncestry) parent() string {
+	if pa.pinfo == nil || pa.pinfo.ParentPid <= 0 {
+		return ""
+	}
+	return GetRealRoot(pa.pinfo.ParentExePath, pa.pinfo.ParentPid)
+}
+
+func (pa *procAncestry) all() []string {
+	if pa.walked {
+		return pa.paths
+	}
+	pa.walked = true
+	if pa.pinfo == nil {
+		return nil
+	}
+	pid := pa.pinfo.ParentPid
+	for i := 0; i < maxAncestryDepth && pid > 1; i++ {
+		exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		if err != nil {
+			break
+		}
+		pa.paths = append(pa.paths, GetRealRoot(exe, pid))
+		if pid, err = readParentPid(pid); err != nil {
+			break
+		}
+	}
+	return pa.paths
+}
+
+// readParentPid returns the parent of a process as listed in /proc/<pid>/stat.
+func readParentPid(pid int) (int, error) {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return -1, err
+	}
+	// the command name may contain anything, so skip past its closing paren
+	stat := string(bs)
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return -1, fmt.Errorf("malformed stat data for pid %d", pid)
+	}
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 2 {
+		return -1, fmt.Errorf("malformed stat data for pid %d", pid)
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// anyExePolicy returns the policy holding rules for every executable in the
+// given sandbox, or nil if there is none.
+func (fw *Firewall) anyExePolicy(sandbox string) *Policy {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return fw.policyMap[sandbox+"|"+anyExePath]
+}
@@ -0,0 +1,66 @@
+package sgfw
+
+import (
+	"os"
+	"testing"
+
+	"github.com/subgraph/go-procsnitch"
+)
+
+func TestParseAncestry(t *testing.T) {
+	for _, s := range []string{"parent:/usr/bin/apt", "ancestor:/usr/lib/firefox/firefox"} {
+		am, ok := parseAncestry(s)
+		if !ok {
+			t.Fatalf("failed to parse %q", s)
+		}
+		if am.String() != s {
+			t.Errorf("%q was turned into %q", s, am.String())
+		}
+	}
+	for _, s := range []string{"", "parent:", "parent:usr/bin/apt", "sibling:/usr/bin/apt"} {
+		if _, ok := parseAncestry(s); ok {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestRuleAncestryRoundTrip(t *testing.T) {
+	p := &Policy{fw: &Firewall{}}
+	for _, s := range []string{
+		"DENY|*:443|PERMANENT|-1:-1||||ancestor:/usr/lib/firefox/firefox",
+		"ALLOW|udp:*:123|PERMANENT|-1:-1||10.0.0.1||parent:/usr/bin/apt",
+		"ALLOW|*:80|PERMANENT|-1:-1|",
+	} {
+		r, err := p.parseRule(s, false)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", s, err)
+		}
+		if r.String() != s {
+			t.Errorf("%q was written back as %q", s, r.String())
+		}
+	}
+}
+
+func TestProcAncestry(t *testing.T) {
+	ppid, err := readParentPid(os.Getpid())
+	if err != nil || ppid != os.Getppid() {
+		t.Fatalf("readParentPid returned %d (%v), expected %d", ppid, err, os.Getppid())
+	}
+	pexe, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		t.Skip("cannot read /proc/self/exe")
+	}
+
+	// pretend the test binary is the parent of a process
+	pinfo := &procsnitch.Info{Pid: -1, ParentPid: os.Getpid(), ParentExePath: pexe}
+	pa := newProcAncestry(pinfo)
+	if !(&ancestryMatch{kind: ancestryParent, path: pexe}).matches(pa) {
+		t.Errorf("expected parent %s to match", pexe)
+	}
+	if !(&ancestryMatch{kind: ancestryAny, path: pexe}).matches(pa) {
+		t.Errorf("expected ancestor %s to match", pexe)
+	}
+	if (&ancestryMatch{kind: ancestryAny, path: "/nonexistent"}).matches(pa) {
+		t.Error("unexpected match against a nonexistent ancestor")
+	}
+}
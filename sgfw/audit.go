@@ -0,0 +1,229 @@
+package sgfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+// What the firewall would have done with connections it let through in
+// audit mode is kept here, so that the report survives a restart.
+const auditFile = "/var/lib/sgfw/audit.json"
+
+// The report stops growing after this many distinct entries
+const maxAuditEntries = 10000
+
+const (
+	AUDIT_DENY   = "deny"
+	AUDIT_PROMPT = "prompt"
+)
+
+type auditKey struct {
+	Kind    string `json:"kind"`
+	Sandbox string `json:"sandbox"`
+	Path    string `json:"path"`
+	Proto   string `json:"proto"`
+	Target  string `json:"target"`
+}
+
+type auditEntry struct {
+	auditKey
+	Count uint32    `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// auditLog collects the connections that would have been denied or
+// prompted for.  The zero value is ready to use.
+type auditLog struct {
+	lock    sync.Mutex
+	entries map[auditKey]*auditEntry
+	dropped uint64
+	dirty   bool
+}
+
+// auditing reports whether connections of the policy are only logged.  It
+// must be called with p.lock held.
+func (p *Policy) auditing() bool {
+	return FirewallConfig.AuditMode || p.audit
+}
+
+func auditTarget(hostname string, ip net.IP, port uint16) string {
+	addr := hostname
+	if addr == "" {
+		addr = ip.String()
+	}
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// recordAudit notes that a connection would have been denied or prompted
+// for, had the policy not been in audit mode.
+func (p *Policy) recordAudit(kind, proto, hostname string, ip net.IP, port uint16, pinfo *procsnitch.Info) {
+	target := auditTarget(hostname, ip, port)
+	dst := target
+	if FirewallConfig.LogRedact {
+		dst = STR_REDACTED
+	}
+	if kind == AUDIT_DENY {
+		log.Noticef("AUDIT: would have denied %s connection by %s -> %s", proto, pinfo.ExePath, dst)
+	} else {
+		log.Noticef("AUDIT: would have prompted for %s connection by %s -> %s", proto, pinfo.ExePath, dst)
+	}
+	p.fw.audit.add(auditKey{Kind: kind, Sandbox: p.sandbox, Path: p.path, Proto: proto, Target: target}, time.Now())
+}
+
+func (al *auditLog) add(key auditKey, now time.Time) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	if al.entries == nil {
+		al.entries = make(map[auditKey]*auditEntry)
+	}
+	e, ok := al.entries[key]
+	if !ok {
+		if len(al.entries) >= maxAuditEntries {
+			if al.dropped == 0 {
+				log.Warningf("Audit report is full, further connections are only logged")
+			}
+			al.dropped++
+			return
+		}
+		e = &auditEntry{auditKey: key, First: now}
+		al.entries[key] = e
+	}
+	e.Count++
+	e.Last = now
+	al.dirty = true
+}
+
+// report returns the entries by application, most frequent first.
+func (al *auditLog) report() []auditEntry {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	entries := make([]auditEntry, 0, len(al.entries))
+	for _, e := range al.entries {
+		entries = append(entries, *e)
+	}
+	sort.Sort(byAuditOrder(entries))
+	return entries
+}
+
+type byAuditOrder []auditEntry
+
+func (s byAuditOrder) Len() int      { return len(s) }
+func (s byAuditOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byAuditOrder) Less(i, j int) bool {
+	if s[i].Path != s[j].Path {
+		return s[i].Path < s[j].Path
+	}
+	if s[i].Sandbox != s[j].Sandbox {
+		return s[i].Sandbox < s[j].Sandbox
+	}
+	if s[i].Kind != s[j].Kind {
+		return s[i].Kind < s[j].Kind
+	}
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Target < s[j].Target
+}
+
+func (al *auditLog) clear() {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	al.entries = nil
+	al.dropped = 0
+	al.dirty = true
+}
+
+func (al *auditLog) load(fname string) error {
+	bs, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var entries []auditEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return err
+	}
+
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	al.entries = make(map[auditKey]*auditEntry)
+	for i := range entries {
+		al.entries[entries[i].auditKey] = &entries[i]
+	}
+	return nil
+}
+
+// save writes the report to fname if it changed since it was last saved.
+func (al *auditLog) save(fname string) error {
+	al.lock.Lock()
+	dirty := al.dirty
+	al.dirty = false
+	al.lock.Unlock()
+	if !dirty {
+		return nil
+	}
+	bs, err := json.MarshalIndent(al.report(), "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeRuleFile(fname, "", append(bs, '\n'))
+}
+
+// setPolicyAudit turns audit mode on or off for the policy of an executable.
+func (fw *Firewall) setPolicyAudit(path, sandbox string, audit bool) error {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	p := fw.policyForPathAndSandbox(path, sandbox)
+	p.lock.Lock()
+	p.audit = audit
+	p.lock.Unlock()
+	if audit {
+		log.Noticef("Connections of %s are only audited from now on", path)
+	} else {
+		log.Noticef("Connections of %s are filtered again", path)
+	}
+	return fw.writeRules()
+}
+
+func (fw *Firewall) saveAudit() {
+	if err := fw.audit.save(auditFile); err != nil {
+		log.Warningf("Failed to save the audit report: %v", err)
+	}
+}
+
+// auditVerdict returns what would have become of a connection let through
+// in audit mode, or "" if it would have been allowed anyway.
+func auditVerdict(result FilterResult) string {
+	switch result {
+	case FILTER_DENY:
+		return AUDIT_DENY
+	case FILTER_PROMPT:
+		return AUDIT_PROMPT
+	}
+	return ""
+}
+
+// auditPacket accepts a packet of a policy in audit mode, after recording
+// what would have become of it.  It must be called with p.lock held.
+func (p *Policy) auditPacket(result FilterResult, pkt *nfqueue.NFQPacket, hostname string, pinfo *procsnitch.Info) {
+	if kind := auditVerdict(result); kind != "" {
+		dstip := net.IP(pkt.Packet.NetworkLayer().NetworkFlow().Dst().Raw())
+		_, dstp := getPacketPorts(pkt)
+		p.recordAudit(kind, getNFQProto(pkt), hostname, dstip, dstp, pinfo)
+	}
+	pkt.Accept()
+}
@@ -0,0 +1,100 @@
+package sgfw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditReport(t *testing.T) {
+	fw := testFirewall()
+	curl := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	wget := fw.policyForPathAndSandbox("/usr/bin/wget", "oz")
+	pinfo := testPInfo()
+	ip := net.IP{203, 0, 113, 1}
+
+	for i := 0; i < 3; i++ {
+		curl.recordAudit(auditVerdict(FILTER_DENY), "tcp", "tracker.example.com", ip, 443, pinfo)
+	}
+	curl.recordAudit(auditVerdict(FILTER_PROMPT), "tcp", "", ip, 80, pinfo)
+	curl.recordAudit(auditVerdict(FILTER_PROMPT), "udp", "", ip, 53, pinfo)
+	curl.recordAudit(auditVerdict(FILTER_PROMPT), "udp", "", ip, 53, pinfo)
+	wget.recordAudit(auditVerdict(FILTER_DENY), "tcp", "", ip, 22, pinfo)
+	if auditVerdict(FILTER_ALLOW) != "" || auditVerdict(FILTER_ALLOW_TLSONLY) != "" {
+		t.Error("allowed connections recorded as blocked")
+	}
+
+	want := []string{
+		"/usr/bin/curl deny tcp tracker.example.com:443 3",
+		"/usr/bin/curl prompt udp 203.0.113.1:53 2",
+		"/usr/bin/curl prompt tcp 203.0.113.1:80 1",
+		"/usr/bin/wget deny tcp 203.0.113.1:22 1",
+	}
+	check := func(entries []auditEntry) {
+		if len(entries) != len(want) {
+			t.Fatalf("got %d report entries, want %d: %v", len(entries), len(want), entries)
+		}
+		for i, e := range entries {
+			if got := fmt.Sprintf("%s %s %s %s %d", e.Path, e.Kind, e.Proto, e.Target, e.Count); got != want[i] {
+				t.Errorf("entry %d: got %q, want %q", i, got, want[i])
+			}
+		}
+	}
+	check(fw.audit.report())
+
+	tmp, err := ioutil.TempDir("", "sgfw-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fname := filepath.Join(tmp, "audit.json")
+	if err := fw.audit.save(fname); err != nil {
+		t.Fatal(err)
+	}
+	var loaded auditLog
+	if err := loaded.load(fname); err != nil {
+		t.Fatal(err)
+	}
+	entries := loaded.report()
+	check(entries)
+	if entries[0].First.IsZero() || entries[0].Last.Before(entries[0].First) {
+		t.Errorf("times not kept: %v - %v", entries[0].First, entries[0].Last)
+	}
+
+	fw.audit.clear()
+	if n := len(fw.audit.report()); n != 0 {
+		t.Errorf("%d entries left after clearing the report", n)
+	}
+}
+
+func TestPolicyAuditSaved(t *testing.T) {
+	fw := testFirewall()
+	fw.rulesUnreadable = true // keep setPolicyAudit from saving
+	fw.setPolicyAudit("/usr/bin/curl", "", true)
+	p := fw.policyMap["|/usr/bin/curl"]
+	if !p.auditing() {
+		t.Fatal("policy not in audit mode")
+	}
+
+	bs, err := fw.marshalRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := testFirewall()
+	if err := loaded.loadRulesJSON(bs); err != nil {
+		t.Fatal(err)
+	}
+	if lp := loaded.policyMap["|/usr/bin/curl"]; lp == nil || !lp.audit {
+		t.Error("audit mode of a policy without rules was not saved")
+	}
+
+	fw.setPolicyAudit("/usr/bin/curl", "", false)
+	FirewallConfig.AuditMode = true
+	defer func() { FirewallConfig.AuditMode = false }()
+	if !p.auditing() {
+		t.Error("global audit mode does not apply to the policy")
+	}
+}
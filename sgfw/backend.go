@@ -0,0 +1,65 @@
+package sgfw
+
+import (
+	"strings"
+)
+
+// Values of FirewallConfig.FirewallBackend
+const (
+	BACKEND_NFTABLES = "nftables"
+	BACKEND_IPTABLES = "iptables"
+)
+
+// firewallBackend installs the rules that queue new connections to the
+// daemon and reject the packets it denies, and removes them on exit.
+type firewallBackend interface {
+	name() string
+	setup() error
+	teardown() error
+	// status returns the rules as they are installed.
+	status() (string, error)
+}
+
+// setupBackend installs the rules with the configured backend, falling
+// back to iptables if nftables cannot be used.
+func setupBackend() firewallBackend {
+	if FirewallConfig.FirewallBackend == BACKEND_NFTABLES {
+		b := nftablesBackend{}
+		err := b.setup()
+		if err == nil {
+			removeLeftIPTRules()
+			return b
+		}
+		log.Warningf("Failed to set up nftables, falling back to iptables: %v", err)
+	}
+	b := iptablesBackend{}
+	b.setup()
+	return b
+}
+
+// configuredBackend returns the backend setupBackend tries first.
+func configuredBackend() firewallBackend {
+	if FirewallConfig.FirewallBackend == BACKEND_NFTABLES {
+		return nftablesBackend{}
+	}
+	return iptablesBackend{}
+}
+
+// rulesInstalled reports whether all the rules of a backend are installed,
+// as its status shows them.
+func rulesInstalled(b firewallBackend) bool {
+	s, err := b.status()
+	if err != nil {
+		log.Warningf("Failed to list the %s rules: %v", b.name(), err)
+		return false
+	}
+	if b.name() == BACKEND_IPTABLES {
+		return !strings.Contains(s, "(missing)")
+	}
+	for _, r := range nftRules() {
+		if !strings.Contains(s, "\t\t"+r.text+" # handle ") {
+			return false
+		}
+	}
+	return true
+}
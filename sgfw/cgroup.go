@@ -0,0 +1,154 @@
+package sgfw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/subgraph/go-procsnitch"
+)
+
+// Policies for a systemd unit are kept under this prefix instead of a path,
+// so that a service can be granted access its binary does not have when it
+// is run interactively.
+const unitPolicyPrefix = "unit:"
+
+type cgroupKind int
+
+const (
+	cgroupUnit cgroupKind = iota
+	cgroupPath
+)
+
+var cgroupKindString = map[cgroupKind]string{
+	cgroupUnit: "unit",
+	cgroupPath: "cgroup",
+}
+
+// cgroupMatch restricts a rule to processes running in a systemd unit, or
+// in a cgroup or any cgroup below it.
+type cgroupMatch struct {
+	kind  cgroupKind
+	value string
+}
+
+// parseCGroupMatch parses the cgroup field of a rule, which is either
+// "unit:<name>" or "cgroup:<path>".
+func parseCGroupMatch(s string) (*cgroupMatch, bool) {
+	toks := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(toks) != 2 || toks[1] == "" {
+		return nil, false
+	}
+	switch toks[0] {
+	case cgroupKindString[cgroupUnit]:
+		if strings.Contains(toks[1], "/") {
+			return nil, false
+		}
+		return &cgroupMatch{kind: cgroupUnit, value: toks[1]}, true
+	case cgroupKindString[cgroupPath]:
+		if !strings.HasPrefix(toks[1], "/") {
+			return nil, false
+		}
+		return &cgroupMatch{kind: cgroupPath, value: strings.TrimSuffix(toks[1], "/")}, true
+	}
+	return nil, false
+}
+
+func (cm *cgroupMatch) String() string {
+	if cm == nil {
+		return ""
+	}
+	return cgroupKindString[cm.kind] + ":" + cm.value
+}
+
+func (cm *cgroupMatch) matches(pc *procCGroup) bool {
+	path, unit := pc.get()
+	if cm.kind == cgroupUnit {
+		return unit != "" && unit == cm.value
+	}
+	return path != "" && (path == cm.value || strings.HasPrefix(path, cm.value+"/"))
+}
+
+func (r *Rule) matchCGroup(pc *procCGroup) bool {
+	return r.cgroup == nil || r.cgroup.matches(pc)
+}
+
+// procCGroup is the cgroup of a process, read from /proc the first time a
+// rule asks for it, as most rules are not limited to a cgroup.
+type procCGroup struct {
+	pid    int
+	path   string
+	unit   string
+	loaded bool
+}
+
+func newProcCGroup(pinfo *procsnitch.Info) *procCGroup {
+	if pinfo == nil {
+		return &procCGroup{loaded: true}
+	}
+	return &procCGroup{pid: pinfo.Pid}
+}
+
+// get returns the cgroup path of the process and the systemd unit it runs
+// in, both empty if they are unknown.
+func (pc *procCGroup) get() (string, string) {
+	if !pc.loaded {
+		pc.loaded = true
+		if pc.pid > 0 {
+			pc.path = readCGroup(pc.pid)
+			pc.unit = unitFromCGroup(pc.path)
+		}
+	}
+	return pc.path, pc.unit
+}
+
+// readCGroup returns the path of a process in the unified (v2) cgroup
+// hierarchy, or in the systemd hierarchy on hosts still using cgroup v1.
+func readCGroup(pid int) string {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	cgroup := ""
+	for _, line := range strings.Split(string(bs), "\n") {
+		toks := strings.SplitN(line, ":", 3)
+		if len(toks) != 3 {
+			continue
+		}
+		if toks[1] == "name=systemd" {
+			return toks[2]
+		}
+		if toks[0] == "0" && toks[1] == "" {
+			cgroup = toks[2]
+		}
+	}
+	return cgroup
+}
+
+var unitSuffixes = []string{".service", ".scope", ".socket", ".mount", ".swap", ".timer"}
+
+// unitFromCGroup returns the innermost systemd unit named in a cgroup path,
+// such as "apt-daily.service" for "/system.slice/apt-daily.service".
+func unitFromCGroup(cgroup string) string {
+	toks := strings.Split(cgroup, "/")
+	for i := len(toks) - 1; i >= 0; i-- {
+		for _, suffix := range unitSuffixes {
+			if strings.HasSuffix(toks[i], suffix) && len(toks[i]) > len(suffix) {
+				return toks[i]
+			}
+		}
+	}
+	return ""
+}
+
+// unitPolicy returns the policy for the systemd unit of a process, or nil
+// if there is none.
+func (fw *Firewall) unitPolicy(pinfo *procsnitch.Info) *Policy {
+	_, unit := newProcCGroup(pinfo).get()
+	if unit == "" {
+		return nil
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return fw.policyMap[pinfo.Sandbox+"|"+unitPolicyPrefix+unit]
+}
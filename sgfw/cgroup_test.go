@@ -0,0 +1,69 @@
+package sgfw
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCGroupMatch(t *testing.T) {
+	path := "/system.slice/apt-daily.service"
+	cg := &procCGroup{path: path, unit: unitFromCGroup(path), loaded: true}
+	if cg.unit != "apt-daily.service" {
+		t.Fatalf("unexpected unit %q", cg.unit)
+	}
+
+	tests := []struct {
+		spec  string
+		match bool
+	}{
+		{"unit:apt-daily.service", true},
+		{"unit:apt-daily-upgrade.service", false},
+		{"cgroup:/system.slice", true},
+		{"cgroup:/system.slice/", true},
+		{"cgroup:/system.slice/apt-daily.service", true},
+		{"cgroup:/system.sl", false},
+		{"cgroup:/user.slice", false},
+	}
+	for _, tt := range tests {
+		cm, ok := parseCGroupMatch(tt.spec)
+		if !ok {
+			t.Fatalf("failed to parse %q", tt.spec)
+		}
+		if got := cm.matches(cg); got != tt.match {
+			t.Errorf("%q against %s: got %v, want %v", tt.spec, path, got, tt.match)
+		}
+		if cm.matches(newProcCGroup(nil)) {
+			t.Errorf("%q matches a process of unknown cgroup", tt.spec)
+		}
+	}
+
+	for _, s := range []string{"unit:", "unit:system.slice/x.service", "cgroup:system.slice", "slice:/system.slice"} {
+		if _, ok := parseCGroupMatch(s); ok {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestUnitFromCGroup(t *testing.T) {
+	tests := map[string]string{
+		"/system.slice/cron.service": "cron.service",
+		"/user.slice/user-1000.slice/user@1000.service/app.slice/app-firefox-1234.scope": "app-firefox-1234.scope",
+		"/user.slice/user-1000.slice/session-2.scope":                                    "session-2.scope",
+		"/user.slice": "",
+		"/":           "",
+	}
+	for cgroup, unit := range tests {
+		if got := unitFromCGroup(cgroup); got != unit {
+			t.Errorf("unitFromCGroup(%q) = %q, want %q", cgroup, got, unit)
+		}
+	}
+}
+
+func TestReadCGroup(t *testing.T) {
+	if _, err := os.Stat("/proc/self/cgroup"); err != nil {
+		t.Skip("no cgroup of processes to read")
+	}
+	if cgroup := readCGroup(os.Getpid()); cgroup == "" || cgroup[0] != '/' {
+		t.Errorf("unexpected cgroup %q of this process", cgroup)
+	}
+}
@@ -22,6 +22,46 @@ type FirewallConfigs struct {
 	PromptExpert    bool
 	DefaultAction   string
 	DefaultActionID FilterScope `toml:"-"`
+
+	// Record the hash of an executable when a rule for it is approved
+	PinExecutables bool
+	// What to do when an executable no longer matches its pinned hash
+	PinMismatchAction string
+
+	// Log what would be denied or prompted for, but let every connection through
+	AuditMode bool
+
+	// How the rules queueing connections to the daemon are installed:
+	// "iptables", or "nftables", falling back to iptables if it fails
+	FirewallBackend string
+
+	// How many queues new connections are spread over, by flow, each
+	// filtered by a worker of its own, and the number of the first
+	QueueCount int
+	QueueNum   int
+	// Whether connections are let through ("open") or blocked ("closed")
+	// while the daemon is not running, and the verdict of packets it
+	// cannot judge
+	FailMode string
+	// Whether the verdict of a connection let through by a rule is kept
+	// on its conntrack entry, for the kernel to give its later packets
+	CacheVerdicts bool
+	// Whether connections from other hosts are filtered as well, by the
+	// rules of the application accepting them
+	FilterInbound bool
+
+	// Connections still let through while the network is locked down
+	LockdownAllow []string
+
+	// Seconds a connection waits for its prompt to be answered, 0 for ever
+	PromptTimeout int
+	// What becomes of connections whose prompt timed out, or that could
+	// not be queued for one
+	PromptFallbackAction string
+	// How many connections may wait for a prompt, per application and in
+	// all; 0 for no limit
+	MaxPendingPerPolicy int
+	MaxPending          int
 }
 
 var FirewallConfig FirewallConfigs
@@ -59,6 +99,17 @@ func readConfig() {
 		PromptExpert:    false,
 		DefaultAction:   "SESSION",
 		DefaultActionID: 1,
+
+		PinExecutables:    false,
+		PinMismatchAction: PIN_MISMATCH_PROMPT,
+
+		FirewallBackend: BACKEND_IPTABLES,
+		QueueCount:      1,
+		FailMode:        FAIL_OPEN,
+
+		PromptFallbackAction: PROMPT_FALLBACK_DENY,
+		MaxPendingPerPolicy:  defaultMaxPendingPerPolicy,
+		MaxPending:           defaultMaxPending,
 	}
 
 	if len(buf) > 0 {
@@ -69,6 +120,18 @@ func readConfig() {
 	}
 	FirewallConfig.LoggingLevel, _ = logging.LogLevel(FirewallConfig.LogLevel)
 	FirewallConfig.DefaultActionID = GetFilterScopeValue(FirewallConfig.DefaultAction)
+	if FirewallConfig.PinMismatchAction != PIN_MISMATCH_DENY {
+		FirewallConfig.PinMismatchAction = PIN_MISMATCH_PROMPT
+	}
+	if b := FirewallConfig.FirewallBackend; b != BACKEND_IPTABLES && b != BACKEND_NFTABLES {
+		log.Warningf("Unknown firewall_backend %q, using %s", b, BACKEND_IPTABLES)
+	}
+	if FirewallConfig.FailMode != FAIL_CLOSED {
+		FirewallConfig.FailMode = FAIL_OPEN
+	}
+	if FirewallConfig.PromptFallbackAction != PROMPT_FALLBACK_ALLOW {
+		FirewallConfig.PromptFallbackAction = PROMPT_FALLBACK_DENY
+	}
 }
 
 func writeConfig() {
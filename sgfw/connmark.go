@@ -0,0 +1,194 @@
+package sgfw
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"syscall"
+)
+
+// The conntrack mark of a connection let through or blocked by a rule holds
+// the verdict and an ID of the rule, taken from its UUID rather than its
+// number, which changes when the rules are loaded again.  Kernel rules give
+// the later packets of a marked connection the same verdict without
+// queueing them, which matters for UDP, whose packets are all NEW until a
+// reply is seen.
+// Rejected packets are never confirmed by conntrack, so denied connections
+// are not marked as they are judged; connmarkDeny is for those that were
+// let through before.
+const (
+	connmarkAllow   = 0x80000000
+	connmarkDeny    = 0x40000000
+	connmarkVerdict = connmarkAllow | connmarkDeny
+	connmarkRuleID  = ^uint32(connmarkVerdict)
+)
+
+// Netlink constants of ctnetlink, from
+// linux/netfilter/nfnetlink_conntrack.h
+const (
+	nfnlSubsysCtnetlink = 1
+
+	ipctnlMsgCtNew    = 0
+	ipctnlMsgCtGet    = 1
+	ipctnlMsgCtDelete = 2
+
+	ctaTupleOrig = 1
+	ctaProtoinfo = 4
+	ctaMark      = 8
+	ctaMarkMask  = 21
+
+	ctaTupleIP      = 1
+	ctaTupleProto   = 2
+	ctaIPv4Src      = 1
+	ctaIPv4Dst      = 2
+	ctaIPv6Src      = 3
+	ctaIPv6Dst      = 4
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	ctaProtoinfoTCP      = 1
+	ctaProtoinfoTCPState = 1
+	tcpConntrackTimeWait = 7
+	tcpConntrackClose    = 8
+)
+
+func ctMsgType(msg uint16) uint16 {
+	return nfnlSubsysCtnetlink<<8 | msg
+}
+
+// ctFlow is a connection tracked by conntrack, in the direction it was
+// opened in.
+type ctFlow struct {
+	family           uint8
+	proto            uint8
+	src, dst         net.IP
+	srcPort, dstPort uint16
+	mark             uint32
+	// set for a TCP connection that has been closed
+	closed bool
+	// the CTA_TUPLE_ORIG attribute, which identifies the connection
+	tuple []byte
+}
+
+func parseCtFlow(m syscall.NetlinkMessage) (ctFlow, bool) {
+	if len(m.Data) < 4 {
+		return ctFlow{}, false
+	}
+	attrs := nftParseAttrs(m.Data[4:])
+	f := ctFlow{family: m.Data[0], tuple: append([]byte(nil), attrs[ctaTupleOrig]...)}
+	tuple := nftParseAttrs(f.tuple)
+	ip, proto := nftParseAttrs(tuple[ctaTupleIP]), nftParseAttrs(tuple[ctaTupleProto])
+	if f.family == syscall.AF_INET6 {
+		f.src, f.dst = net.IP(ip[ctaIPv6Src]), net.IP(ip[ctaIPv6Dst])
+	} else {
+		f.src, f.dst = net.IP(ip[ctaIPv4Src]), net.IP(ip[ctaIPv4Dst])
+	}
+	if len(f.tuple) == 0 || len(proto[ctaProtoNum]) != 1 || f.src == nil || f.dst == nil {
+		return ctFlow{}, false
+	}
+	f.proto = proto[ctaProtoNum][0]
+	if p := proto[ctaProtoSrcPort]; len(p) == 2 {
+		f.srcPort = binary.BigEndian.Uint16(p)
+	}
+	if p := proto[ctaProtoDstPort]; len(p) == 2 {
+		f.dstPort = binary.BigEndian.Uint16(p)
+	}
+	if m := attrs[ctaMark]; len(m) == 4 {
+		f.mark = binary.BigEndian.Uint32(m)
+	}
+	tcp := nftParseAttrs(nftParseAttrs(attrs[ctaProtoinfo])[ctaProtoinfoTCP])
+	if st := tcp[ctaProtoinfoTCPState]; len(st) == 1 {
+		f.closed = st[0] == tcpConntrackTimeWait || st[0] == tcpConntrackClose
+	}
+	return f, true
+}
+
+// flows lists the connections tracked whose mark, under mask, is mark; all
+// of them for a mask of 0.
+func (c *nftConn) flows(mark, mask uint32) ([]ctFlow, error) {
+	var attrs []nftAttr
+	if mask != 0 {
+		attrs = []nftAttr{nftU32(ctaMark, mark), nftU32(ctaMarkMask, mask)}
+	}
+	var flows []ctFlow
+	err := c.request(nftMessage{ctMsgType(ipctnlMsgCtGet), syscall.NLM_F_DUMP, attrs}, syscall.AF_UNSPEC, func(m syscall.NetlinkMessage) {
+		if f, ok := parseCtFlow(m); ok {
+			flows = append(flows, f)
+		}
+	})
+	return flows, err
+}
+
+// updateFlow sends a ctnetlink message about a connection, such as
+// ipctnlMsgCtDelete, and reports whether it was still tracked.
+func (c *nftConn) updateFlow(f ctFlow, msg uint16, attrs ...nftAttr) (bool, error) {
+	attrs = append([]nftAttr{{typ: ctaTupleOrig | syscall.NLA_F_NESTED, data: f.tuple}}, attrs...)
+	err := c.request(nftMessage{ctMsgType(msg), syscall.NLM_F_ACK, attrs}, f.family, func(syscall.NetlinkMessage) {})
+	if e, ok := err.(*nftError); ok && e.errno == syscall.ENOENT {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func cacheVerdicts() bool {
+	return FirewallConfig.CacheVerdicts
+}
+
+// verdictMark returns the mark of the connections decided by r.
+func verdictMark(r *Rule) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(r.uuid))
+	if r.rtype == RULE_ACTION_DENY {
+		return connmarkDeny | h.Sum32()&connmarkRuleID
+	}
+	return connmarkAllow | h.Sum32()&connmarkRuleID
+}
+
+// acceptCached lets a packet through, with the verdict of rule r as its
+// mark when r is not nil, for the kernel rules to save on its connection.
+func acceptCached(pkt packetVerdict, r *Rule) {
+	if r != nil && cacheVerdicts() {
+		pkt.SetMark(verdictMark(r))
+	}
+	pkt.Accept()
+}
+
+// clearConnmarks clears the mark of every connection whose mark, under
+// mask, is mark, and returns how many were cleared.
+func clearConnmarks(mark, mask uint32) (int, error) {
+	c, err := nftDial()
+	if err != nil {
+		return 0, err
+	}
+	defer c.close()
+	flows, err := c.flows(mark, mask)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, f := range flows {
+		ok, err := c.updateFlow(f, ipctnlMsgCtNew, nftU32(ctaMark, 0))
+		if err != nil {
+			return n, err
+		} else if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// forgetAllVerdicts clears the verdicts cached on every connection, so
+// that their later packets are queued and judged again.
+func forgetAllVerdicts() {
+	if !cacheVerdicts() {
+		return
+	}
+	for _, m := range []uint32{connmarkAllow, connmarkDeny} {
+		if n, err := clearConnmarks(m, m); err != nil {
+			log.Warningf("Failed to clear the verdicts cached on connections: %v", err)
+		} else if n > 0 {
+			log.Infof("Cleared the verdict cached on %d connections", n)
+		}
+	}
+}
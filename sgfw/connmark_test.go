@@ -0,0 +1,95 @@
+package sgfw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerdictCache(t *testing.T) {
+	defer func(saved bool) { FirewallConfig.CacheVerdicts = saved }(FirewallConfig.CacheVerdicts)
+	FirewallConfig.CacheVerdicts = true
+
+	allow := &Rule{id: 7, uuid: newRuleUUID(), rtype: RULE_ACTION_ALLOW}
+	v := &testVerdict{}
+	acceptCached(v, allow)
+	if !v.accepted || v.mark&connmarkVerdict != connmarkAllow || v.mark != verdictMark(allow) {
+		t.Errorf("allowed packet given verdict %+v", v)
+	}
+	deny := &Rule{id: 7, uuid: newRuleUUID(), rtype: RULE_ACTION_DENY}
+	if m := verdictMark(deny); m&connmarkVerdict != connmarkDeny || m&connmarkRuleID == v.mark&connmarkRuleID {
+		t.Errorf("deny mark %#x, allow mark %#x", m, v.mark)
+	}
+	v = &testVerdict{}
+	acceptCached(v, nil)
+	if !v.accepted || v.mark != 0 {
+		t.Errorf("packet without a rule given verdict %+v", v)
+	}
+
+	// The cached verdicts come before the queue rule.
+	var texts []string
+	for _, r := range nftRules() {
+		if r.chain == "output" {
+			texts = append(texts, r.text)
+		}
+	}
+	if len(texts) != 3 || !strings.HasSuffix(texts[0], "accept") || !strings.HasSuffix(texts[1], "drop") || !strings.Contains(texts[2], "queue") {
+		t.Errorf("output chain is %q", texts)
+	}
+
+	FirewallConfig.CacheVerdicts = false
+	v = &testVerdict{}
+	acceptCached(v, allow)
+	if v.mark != 0 {
+		t.Errorf("verdict cached while disabled: %+v", v)
+	}
+	for _, r := range nftRules() {
+		if strings.Contains(r.text, "ct mark") {
+			t.Errorf("rule %q installed while caching is disabled", r.text)
+		}
+	}
+	for _, r := range ipTablesRules() {
+		if strings.Contains(r, "connmark") || strings.Contains(r, "CONNMARK") {
+			t.Errorf("rule %q installed while caching is disabled", r)
+		}
+	}
+}
+
+// The rules keep the marks of the connections they decided when the rules
+// are loaded again, although they are numbered anew.
+func TestVerdictMarkAcrossReload(t *testing.T) {
+	fw := testFirewall()
+	p := fw.PolicyForPathAndSandbox("/usr/bin/curl", "")
+	for _, line := range []string{"DENY|ads.example.com:443|PERMANENT|-1:-1|", "ALLOW|www.example.com:443|PERMANENT|-1:-1|"} {
+		if processRuleLine(p, line) == nil {
+			t.Fatalf("rule %q not parsed", line)
+		}
+	}
+	marks := func(fw *Firewall) []uint32 {
+		var m []uint32
+		for _, r := range fw.PolicyForPathAndSandbox("/usr/bin/curl", "").rules {
+			m = append(m, verdictMark(r))
+		}
+		return m
+	}
+	before := marks(fw)
+	bs, err := fw.marshalRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a rule added to another policy first shifts the numbers of the others
+	loaded := testFirewall()
+	if processRuleLine(loaded.PolicyForPathAndSandbox("/usr/bin/wget", ""), "ALLOW|*:80|SYSTEM|-1:-1||") == nil {
+		t.Fatal("rule not parsed")
+	}
+	if err := loaded.loadRulesJSON(bs); err != nil {
+		t.Fatal(err)
+	}
+	after := marks(loaded)
+	if len(before) != 2 || len(after) != 2 || before[0] != after[0] || before[1] != after[1] {
+		t.Errorf("marks %#x before loading the rules again, %#x after", before, after)
+	}
+	if before[0]&connmarkVerdict != connmarkDeny || before[1]&connmarkVerdict != connmarkAllow {
+		t.Errorf("marks %#x do not hold the verdicts", before)
+	}
+}
@@ -2,12 +2,16 @@ package sgfw
 
 import (
 	"strings"
+	"time"
 )
 
 // Static strings for various usage
 const (
 	STR_REDACTED = "[redacted]"
 	STR_UNKNOWN  = "[uknown]"
+
+	STR_BINARY_CHANGED = "binary changed since rules were created"
+	STR_INBOUND        = "wants to accept connections"
 )
 
 //RuleAction is the action to apply to a rule
@@ -59,6 +63,41 @@ var RuleModeValue = map[string]RuleMode{
 	RuleModeString[RULE_MODE_SYSTEM]:    RULE_MODE_SYSTEM,
 }
 
+//RuleDirection tells whether a rule applies to the connections an
+//application opens or to those it accepts
+type RuleDirection uint16
+
+const (
+	RULE_DIRECTION_OUT RuleDirection = iota
+	RULE_DIRECTION_IN
+)
+
+// RuleDirectionString is used to get a rule direction string from its id
+var RuleDirectionString = map[RuleDirection]string{
+	RULE_DIRECTION_OUT: "OUT",
+	RULE_DIRECTION_IN:  "IN",
+}
+
+// RuleDirectionValue converts a direction string to its id
+var RuleDirectionValue = map[string]RuleDirection{
+	RuleDirectionString[RULE_DIRECTION_OUT]: RULE_DIRECTION_OUT,
+	RuleDirectionString[RULE_DIRECTION_IN]:  RULE_DIRECTION_IN,
+}
+
+// Authors recorded for rules that were not made by hand
+const (
+	RULE_AUTHOR_PROMPT   = "prompt"
+	RULE_AUTHOR_OZ       = "oz"
+	RULE_AUTHOR_IMPORT   = "import"
+	RULE_AUTHOR_LEARNING = "learning"
+)
+
+// Ways of importing rules with ImportRules
+const (
+	IMPORT_MERGE   = "merge"
+	IMPORT_REPLACE = "replace"
+)
+
 //FilterScope contains a filter's time scope
 type FilterScope uint16
 
@@ -67,22 +106,41 @@ const (
 	APPLY_SESSION
 	APPLY_PROCESS
 	APPLY_FOREVER
+	APPLY_FIFTEEN_MINUTES
+	APPLY_ONE_HOUR
+	APPLY_ONE_DAY
+	APPLY_PARENT
 )
 
 // FilterScopeString converts a filter scope ID to its string
 var FilterScopeString = map[FilterScope]string{
-	APPLY_ONCE:    "ONCE",
-	APPLY_SESSION: "SESSION",
-	APPLY_PROCESS: "PROCESS",
-	APPLY_FOREVER: "FOREVER",
+	APPLY_ONCE:            "ONCE",
+	APPLY_SESSION:         "SESSION",
+	APPLY_PROCESS:         "PROCESS",
+	APPLY_FOREVER:         "FOREVER",
+	APPLY_FIFTEEN_MINUTES: "FIFTEEN_MINUTES",
+	APPLY_ONE_HOUR:        "ONE_HOUR",
+	APPLY_ONE_DAY:         "ONE_DAY",
+	APPLY_PARENT:          "PARENT",
 }
 
 // FilterScopeString converts a filter scope string to its ID
 var FilterScopeValue = map[string]FilterScope{
-	FilterScopeString[APPLY_ONCE]:    APPLY_ONCE,
-	FilterScopeString[APPLY_SESSION]: APPLY_SESSION,
-	FilterScopeString[APPLY_PROCESS]: APPLY_PROCESS,
-	FilterScopeString[APPLY_FOREVER]: APPLY_FOREVER,
+	FilterScopeString[APPLY_ONCE]:            APPLY_ONCE,
+	FilterScopeString[APPLY_SESSION]:         APPLY_SESSION,
+	FilterScopeString[APPLY_PROCESS]:         APPLY_PROCESS,
+	FilterScopeString[APPLY_FOREVER]:         APPLY_FOREVER,
+	FilterScopeString[APPLY_FIFTEEN_MINUTES]: APPLY_FIFTEEN_MINUTES,
+	FilterScopeString[APPLY_ONE_HOUR]:        APPLY_ONE_HOUR,
+	FilterScopeString[APPLY_ONE_DAY]:         APPLY_ONE_DAY,
+	FilterScopeString[APPLY_PARENT]:          APPLY_PARENT,
+}
+
+// FilterScopeDuration holds the lifetime of rules created with a timed scope
+var FilterScopeDuration = map[FilterScope]time.Duration{
+	APPLY_FIFTEEN_MINUTES: 15 * time.Minute,
+	APPLY_ONE_HOUR:        time.Hour,
+	APPLY_ONE_DAY:         24 * time.Hour,
 }
 
 // GetFilterScopeString is used to safely return a filter scope string
@@ -130,18 +188,103 @@ var FilterResultValue = map[string]FilterResult{
 
 // DbusRule struct of the rule passed to the dbus interface
 type DbusRule struct {
-	ID      uint32
-	Net     string
-	Origin  string
-	Proto   string
-	Pid     uint32
-	Privs   string
+	ID         uint32
+	Net        string
+	Origin     string
+	Proto      string
+	Pid        uint32
+	Privs      string
+	App        string
+	Path       string
+	Verb       uint16
+	Target     string
+	Mode       uint16
+	Sandbox    string
+	Expires    int64
+	Parent     string
+	CGroup     string
+	UUID       string
+	Created    int64
+	Author     string
+	Comment    string
+	SourceFile string
+	Hits       uint64
+	// LastHit is 0 if the rule never matched
+	LastHit int64
+	// Direction is RULE_DIRECTION_IN for a rule on accepted connections,
+	// whose Target is the remote host and the local port
+	Direction uint16
+}
+
+// DbusRuleSnapshot describes a previous generation of the rule file
+type DbusRuleSnapshot struct {
+	ID    string
+	Saved int64
+	// Rules is -1 if the snapshot cannot be loaded
+	Rules int32
+}
+
+// DbusRuleFilter selects rules to export or import; empty fields match all
+type DbusRuleFilter struct {
 	App     string
+	Sandbox string
+	Mode    string
+}
+
+// DbusImportReport describes the outcome of importing rules
+type DbusImportReport struct {
+	Added      uint32
+	Removed    uint32
+	Duplicates []string
+	Conflicts  []string
+	Invalid    []string
+}
+
+// DbusAuditEntry counts the connections of an application in audit mode
+// that would have been denied or prompted for, as Kind says
+type DbusAuditEntry struct {
+	Kind    string
+	Sandbox string
 	Path    string
-	Verb    uint16
+	Proto   string
 	Target  string
-	Mode    uint16
+	Count   uint32
+	First   int64
+	Last    int64
+}
+
+// DbusCandidate is a rule found while learning that awaits review
+type DbusCandidate struct {
+	ID      string
 	Sandbox string
+	Path    string
+	Target  string
+	Count   uint32
+	First   int64
+	Last    int64
+}
+
+// DbusQueueStats tells how many packets the worker of a queue filtered,
+// and the mean and longest time one took, in nanoseconds
+type DbusQueueStats struct {
+	Queue       uint16
+	Packets     uint64
+	MeanLatency uint64
+	MaxLatency  uint64
+}
+
+// DbusRuleWarning describes a rule found by the rule analysis; OtherID is
+// the earlier rule it clashes with if HasOther is set, as 0 is a rule ID
+// as well
+type DbusRuleWarning struct {
+	Kind     string
+	Path     string
+	RuleID   uint32
+	Rule     string
+	OtherID  uint32
+	HasOther bool
+	Other    string
+	Message  string
 }
 
 /*const (
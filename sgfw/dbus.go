@@ -2,8 +2,10 @@ package sgfw
 
 import (
 	"errors"
+	"io/ioutil"
 	"path"
 	"strconv"
+	"time"
 
 	"github.com/godbus/dbus"
 	"github.com/godbus/dbus/introspect"
@@ -22,6 +24,23 @@ const introspectXML = `
       <arg name="enabled" direction="out" type="b" />
     </method>
 
+    <method name="SetLockdown">
+      <arg name="lockdown" direction="in" type="b" />
+    </method>
+
+    <method name="IsLockdown">
+      <arg name="lockdown" direction="out" type="b" />
+    </method>
+
+    <method name="GetFirewallStatus">
+      <arg name="backend" direction="out" type="s" />
+      <arg name="ruleset" direction="out" type="s" />
+    </method>
+
+    <method name="GetQueueStats">
+      <arg name="stats" direction="out" type="a(qttt)" />
+    </method>
+
     <method name="ListRules">
       <arg name="rules" direction="out" type="a(ussus)" />
     </method>
@@ -34,6 +53,71 @@ const introspectXML = `
       <arg name="rule" direction="in" type="(ussus)" />
     </method>
 
+    <method name="ListRuleSnapshots">
+      <arg name="snapshots" direction="out" type="a(sxi)" />
+    </method>
+
+    <method name="RollbackRules">
+      <arg name="id" direction="in" type="s" />
+    </method>
+
+    <method name="ExportRules">
+      <arg name="filter" direction="in" type="(sss)" />
+      <arg name="rules" direction="out" type="s" />
+    </method>
+
+    <method name="ImportRules">
+      <arg name="rules" direction="in" type="s" />
+      <arg name="how" direction="in" type="s" />
+      <arg name="dryrun" direction="in" type="b" />
+      <arg name="filter" direction="in" type="(sss)" />
+      <arg name="report" direction="out" type="(uuasasas)" />
+    </method>
+
+    <method name="PruneUnusedRules">
+      <arg name="days" direction="in" type="u" />
+      <arg name="dryrun" direction="in" type="b" />
+      <arg name="rules" direction="out" type="as" />
+    </method>
+
+    <method name="GetAuditReport">
+      <arg name="entries" direction="out" type="a(sssssuxx)" />
+    </method>
+
+    <method name="ClearAuditReport">
+    </method>
+
+    <method name="SetPolicyAudit">
+      <arg name="path" direction="in" type="s" />
+      <arg name="sandbox" direction="in" type="s" />
+      <arg name="audit" direction="in" type="b" />
+    </method>
+
+    <method name="StartLearning">
+      <arg name="minutes" direction="in" type="u" />
+    </method>
+
+    <method name="StopLearning">
+    </method>
+
+    <method name="GetLearningStatus">
+      <arg name="until" direction="out" type="x" />
+    </method>
+
+    <method name="ListCandidates">
+      <arg name="candidates" direction="out" type="a(ssssuxx)" />
+    </method>
+
+    <method name="ReviewCandidates">
+      <arg name="accept" direction="in" type="as" />
+      <arg name="reject" direction="in" type="as" />
+      <arg name="added" direction="out" type="u" />
+    </method>
+
+    <method name="AnalyzeRules">
+      <arg name="warnings" direction="out" type="a(ssusubss)" />
+    </method>
+
     <method name="GetConfig">
       <arg name="config" direction="out" type="a{sv}" />
     </method>
@@ -76,15 +160,19 @@ func DbusProcDeathCB(pid int, param interface{}) {
 	for !done {
 		done = true
 		for _, p := range ds.fw.policies {
+			p.lock.Lock()
 			for r := 0; r < len(p.rules); r++ {
 				if p.rules[r].pid == pid && p.rules[r].mode == RULE_MODE_PROCESS {
+					ds.fw.forgetVerdicts(p.rules[r])
 					p.rules = append(p.rules[:r], p.rules[r+1:]...)
+					p.rulesChanged()
 					done = false
 					updated = true
 					log.Notice("Removed per-process firewall rule for PID: ", pid)
 					break
 				}
 			}
+			p.lock.Unlock()
 		}
 	}
 
@@ -132,6 +220,48 @@ func (ds *dbusServer) IsEnabled() (bool, *dbus.Error) {
 	return ds.fw.isEnabled(), nil
 }
 
+// SetLockdown denies every new connection but those on the lockdown
+// allowlist, or lifts the lockdown.
+func (ds *dbusServer) SetLockdown(flag bool) *dbus.Error {
+	log.Noticef("SetLockdown(%v) called", flag)
+	if err := ds.fw.setLockdown(flag); err != nil {
+		log.Warningf("Failed to record the network lockdown: %v", err)
+		return dbusError(err)
+	}
+	return nil
+}
+
+func (ds *dbusServer) IsLockdown() (bool, *dbus.Error) {
+	log.Debug("IsLockdown() called")
+	return ds.fw.inLockdown(), nil
+}
+
+// GetFirewallStatus returns the backend installing the rules that queue
+// connections to the daemon, and those rules as they are installed.
+func (ds *dbusServer) GetFirewallStatus() (string, string, *dbus.Error) {
+	log.Debug("GetFirewallStatus() called")
+	ruleset, err := ds.fw.backend.status()
+	if err != nil {
+		return "", "", dbusError(err)
+	}
+	return ds.fw.backend.name(), ruleset, nil
+}
+
+func (ds *dbusServer) GetQueueStats() ([]DbusQueueStats, *dbus.Error) {
+	log.Debug("GetQueueStats() called")
+	result := []DbusQueueStats{}
+	for i, s := range ds.fw.getQueueStats() {
+		n, mean, max := s.latency()
+		result = append(result, DbusQueueStats{
+			Queue:       queueNum() + uint16(i),
+			Packets:     n,
+			MeanLatency: uint64(mean),
+			MaxLatency:  uint64(max),
+		})
+	}
+	return result, nil
+}
+
 func createDbusRule(r *Rule) DbusRule {
 	netstr := ""
 	if r.network != nil {
@@ -154,19 +284,42 @@ func createDbusRule(r *Rule) DbusRule {
 		pstr += ":" + strconv.Itoa(r.gid)
 	}
 	log.Debugf("SANDBOX SANDBOX SANDBOX: %s", r.sandbox)
+	expires := int64(0)
+	if !r.expires.IsZero() {
+		expires = r.expires.Unix()
+	}
+	created := int64(0)
+	if !r.created.IsZero() {
+		created = r.created.Unix()
+	}
+	lastHit := int64(0)
+	if last := r.lastHit(); !last.IsZero() {
+		lastHit = last.Unix()
+	}
 	return DbusRule{
-		ID:      uint32(r.id),
-		Net:     netstr,
-		Origin:  ostr,
-		Proto:   r.proto,
-		Pid:     uint32(r.pid),
-		Privs:   pstr,
-		App:     path.Base(r.policy.path),
-		Path:    r.policy.path,
-		Verb:    uint16(r.rtype),
-		Target:  r.AddrString(false),
-		Mode:    uint16(r.mode),
-		Sandbox: r.sandbox,
+		ID:         uint32(r.id),
+		Net:        netstr,
+		Origin:     ostr,
+		Proto:      r.proto,
+		Pid:        uint32(r.pid),
+		Privs:      pstr,
+		App:        path.Base(r.policy.path),
+		Path:       r.policy.path,
+		Verb:       uint16(r.rtype),
+		Target:     r.AddrString(false),
+		Mode:       uint16(r.mode),
+		Sandbox:    r.sandbox,
+		Expires:    expires,
+		Parent:     r.ancestry.String(),
+		CGroup:     r.cgroup.String(),
+		UUID:       r.uuid,
+		Created:    created,
+		Author:     r.author,
+		Comment:    r.comment,
+		SourceFile: r.sourceFile,
+		Hits:       r.hitCount(),
+		LastHit:    lastHit,
+		Direction:  uint16(r.direction),
 	}
 }
 
@@ -215,17 +368,40 @@ func (ds *dbusServer) UpdateRule(rule DbusRule) *dbus.Error {
 			log.Warningf("Unable to parse target: %s", rule.Target)
 			return nil
 		}
+		if rule.Parent != "" {
+			am, ok := parseAncestry(rule.Parent)
+			if !ok {
+				log.Warningf("Unable to parse process ancestry: %s", rule.Parent)
+				return nil
+			}
+			tmp.ancestry = am
+		}
+		if rule.CGroup != "" {
+			cm, ok := parseCGroupMatch(rule.CGroup)
+			if !ok {
+				log.Warningf("Unable to parse cgroup: %s", rule.CGroup)
+				return nil
+			}
+			tmp.cgroup = cm
+		}
 		r.policy.lock.Lock()
+		// the connections it decided are judged again by the new rule
+		ds.fw.forgetVerdicts(r)
 		if RuleAction(rule.Verb) == RULE_ACTION_ALLOW || RuleAction(rule.Verb) == RULE_ACTION_DENY {
 			r.rtype = RuleAction(rule.Verb)
 		}
 		r.hostname = tmp.hostname
+		r.hostpat = tmp.hostpat
 		r.proto = tmp.proto
 		r.pid = tmp.pid
 		r.addr = tmp.addr
-		r.port = tmp.port
+		r.ports = tmp.ports
 		r.mode = RuleMode(rule.Mode)
 		r.sandbox = rule.Sandbox
+		r.ancestry = tmp.ancestry
+		r.cgroup = tmp.cgroup
+		r.comment = rule.Comment
+		r.policy.rulesChanged()
 		r.policy.lock.Unlock()
 		if r.mode != RULE_MODE_SESSION {
 			ds.fw.saveRules()
@@ -234,6 +410,195 @@ func (ds *dbusServer) UpdateRule(rule DbusRule) *dbus.Error {
 	return nil
 }
 
+func (ds *dbusServer) ListRuleSnapshots() ([]DbusRuleSnapshot, *dbus.Error) {
+	snapshots, err := listRuleSnapshots(ruleBackupDir)
+	if err != nil {
+		return nil, dbusError(err)
+	}
+	result := []DbusRuleSnapshot{}
+	for _, s := range snapshots {
+		n := -1
+		if bs, err := ioutil.ReadFile(s.fname); err == nil {
+			if c, err := countRules(bs); err == nil {
+				n = c
+			}
+		}
+		result = append(result, DbusRuleSnapshot{ID: s.id, Saved: s.saved.Unix(), Rules: int32(n)})
+	}
+	return result, nil
+}
+
+func (ds *dbusServer) RollbackRules(id string) *dbus.Error {
+	log.Noticef("RollbackRules(%s) called", id)
+	if err := ds.fw.rollbackRules(id); err != nil {
+		log.Warningf("Unable to roll back rules: %v", err)
+		return dbusError(err)
+	}
+	dbusp.alertRule("Firewall rules rolled back")
+	return nil
+}
+
+func (ds *dbusServer) ExportRules(filter DbusRuleFilter) (string, *dbus.Error) {
+	log.Debugf("ExportRules %v", filter)
+	f, err := newRuleFilter(filter)
+	if err != nil {
+		return "", dbusError(err)
+	}
+	bs, err := ds.fw.exportRules(f)
+	if err != nil {
+		return "", dbusError(err)
+	}
+	return string(bs), nil
+}
+
+func (ds *dbusServer) ImportRules(rules string, how string, dryRun bool, filter DbusRuleFilter) (DbusImportReport, *dbus.Error) {
+	log.Debugf("ImportRules %s %v %v", how, dryRun, filter)
+	f, err := newRuleFilter(filter)
+	if err != nil {
+		return DbusImportReport{}, dbusError(err)
+	}
+	report, err := ds.fw.importRules([]byte(rules), how, dryRun, f)
+	if err != nil {
+		log.Warningf("Unable to import rules: %v", err)
+		return report, dbusError(err)
+	}
+	if !dryRun {
+		dbusp.alertRule("Firewall rules imported")
+	}
+	return report, nil
+}
+
+func (ds *dbusServer) GetAuditReport() ([]DbusAuditEntry, *dbus.Error) {
+	result := []DbusAuditEntry{}
+	for _, e := range ds.fw.audit.report() {
+		result = append(result, DbusAuditEntry{
+			Kind:    e.Kind,
+			Sandbox: e.Sandbox,
+			Path:    e.Path,
+			Proto:   e.Proto,
+			Target:  e.Target,
+			Count:   e.Count,
+			First:   e.First.Unix(),
+			Last:    e.Last.Unix(),
+		})
+	}
+	return result, nil
+}
+
+func (ds *dbusServer) ClearAuditReport() *dbus.Error {
+	log.Notice("ClearAuditReport() called")
+	ds.fw.audit.clear()
+	ds.fw.saveAudit()
+	return nil
+}
+
+// SetPolicyAudit lets the connections of a single application through
+// while logging them, as audit mode does for all of them.
+func (ds *dbusServer) SetPolicyAudit(path, sandbox string, audit bool) *dbus.Error {
+	if path == "" {
+		return dbusError(errors.New("no application path given"))
+	}
+	if err := ds.fw.setPolicyAudit(path, sandbox, audit); err != nil {
+		log.Warningf("Failed to save the audit setting of %s: %v", path, err)
+		return dbusError(err)
+	}
+	return nil
+}
+
+// StartLearning lets connections that would be prompted for through for
+// the given number of minutes, and records them as candidate rules.
+func (ds *dbusServer) StartLearning(minutes uint32) *dbus.Error {
+	log.Noticef("StartLearning(%d) called", minutes)
+	if err := ds.fw.learner.start(time.Duration(minutes) * time.Minute); err != nil {
+		return dbusError(err)
+	}
+	ds.fw.saveLearned()
+	return nil
+}
+
+func (ds *dbusServer) StopLearning() *dbus.Error {
+	log.Notice("StopLearning() called")
+	ds.fw.learner.stop()
+	ds.fw.saveLearned()
+	return nil
+}
+
+// GetLearningStatus returns when learning ends, or 0 if it is off.
+func (ds *dbusServer) GetLearningStatus() (int64, *dbus.Error) {
+	until := ds.fw.learner.learningUntil()
+	if !until.After(time.Now()) {
+		return 0, nil
+	}
+	return until.Unix(), nil
+}
+
+func (ds *dbusServer) ListCandidates() ([]DbusCandidate, *dbus.Error) {
+	result := []DbusCandidate{}
+	for _, c := range ds.fw.learner.list() {
+		result = append(result, DbusCandidate{
+			ID:      c.ID,
+			Sandbox: c.Sandbox,
+			Path:    c.Path,
+			Target:  c.Target,
+			Count:   c.Count,
+			First:   c.First.Unix(),
+			Last:    c.Last.Unix(),
+		})
+	}
+	return result, nil
+}
+
+// ReviewCandidates makes permanent rules of the accepted candidates and
+// forgets the rejected ones.  It returns the number of rules added.
+func (ds *dbusServer) ReviewCandidates(accept, reject []string) (uint32, *dbus.Error) {
+	log.Noticef("ReviewCandidates(%d accepted, %d rejected) called", len(accept), len(reject))
+	added := ds.fw.reviewCandidates(accept, reject)
+	ds.fw.saveLearned()
+	if added > 0 {
+		dbusp.alertRule("Learned firewall rules added")
+	}
+	return uint32(added), nil
+}
+
+// PruneUnusedRules removes the permanent rules that have not matched for
+// the given number of days, and returns them.
+func (ds *dbusServer) PruneUnusedRules(days uint32, dryRun bool) ([]string, *dbus.Error) {
+	log.Noticef("PruneUnusedRules(%d, %v) called", days, dryRun)
+	if days == 0 {
+		return nil, dbusError(errors.New("rules must be unused for at least one day"))
+	}
+	cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+	result := []string{}
+	for _, r := range ds.fw.pruneUnusedRules(cutoff, dryRun) {
+		result = append(result, r.policy.path+": "+r.String())
+	}
+	if !dryRun && len(result) > 0 {
+		dbusp.alertRule("Unused firewall rules removed")
+	}
+	return result, nil
+}
+
+func (ds *dbusServer) AnalyzeRules() ([]DbusRuleWarning, *dbus.Error) {
+	log.Debug("AnalyzeRules")
+	result := []DbusRuleWarning{}
+	for _, w := range ds.fw.analyzeRules() {
+		dw := DbusRuleWarning{
+			Kind:    w.kind,
+			Path:    w.rule.policy.path,
+			RuleID:  uint32(w.rule.id),
+			Rule:    w.rule.String(),
+			Message: w.message(),
+		}
+		if w.other != nil {
+			dw.OtherID = uint32(w.other.id)
+			dw.HasOther = true
+			dw.Other = w.other.String()
+		}
+		result = append(result, dw)
+	}
+	return result, nil
+}
+
 func (ds *dbusServer) GetConfig() (map[string]dbus.Variant, *dbus.Error) {
 	conf := make(map[string]dbus.Variant)
 	conf["log_level"] = dbus.MakeVariant(int32(ds.fw.logBackend.GetLevel("sgfw")))
@@ -241,6 +606,7 @@ func (ds *dbusServer) GetConfig() (map[string]dbus.Variant, *dbus.Error) {
 	conf["prompt_expanded"] = dbus.MakeVariant(FirewallConfig.PromptExpanded)
 	conf["prompt_expert"] = dbus.MakeVariant(FirewallConfig.PromptExpert)
 	conf["default_action"] = dbus.MakeVariant(uint16(FirewallConfig.DefaultActionID))
+	conf["audit_mode"] = dbus.MakeVariant(FirewallConfig.AuditMode)
 	return conf, nil
 }
 
@@ -263,11 +629,23 @@ func (ds *dbusServer) SetConfig(key string, val dbus.Variant) *dbus.Error {
 	case "default_action":
 		l := val.Value().(uint16)
 		FirewallConfig.DefaultActionID = FilterScope(l)
+	case "audit_mode":
+		flag := val.Value().(bool)
+		FirewallConfig.AuditMode = flag
+		if flag {
+			log.Notice("Audit mode turned on, no connection will be blocked")
+		} else {
+			log.Notice("Audit mode turned off")
+		}
 	}
 	writeConfig()
 	return nil
 }
 
+func dbusError(err error) *dbus.Error {
+	return dbus.NewError(interfaceName+".Error", []interface{}{err.Error()})
+}
+
 func (ds *dbusServer) prompt(p *Policy) {
 	log.Info("prompting...")
 	ds.prompter.prompt(p)
@@ -0,0 +1,173 @@
+package sgfw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Directories holding rules installed by the administrator and by packages.
+// A file in an earlier directory replaces a file of the same name in a later
+// one, so that a packaged rule file can be overridden or masked with an
+// empty file.
+var ruleDropInDirs = []string{"/etc/sgfw/rules.d", "/usr/share/sgfw/rules.d"}
+
+const ruleDropInSuffix = ".rules"
+
+// dropInRuleFiles returns the rule files found in dirs, ordered by name.
+func dropInRuleFiles(dirs []string) []string {
+	byName := make(map[string]string)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		matches, err := filepath.Glob(filepath.Join(dirs[i], "*"+ruleDropInSuffix))
+		if err != nil {
+			log.Warningf("Failed to list rule files in %s: %v", dirs[i], err)
+			continue
+		}
+		for _, m := range matches {
+			byName[filepath.Base(m)] = m
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]string, len(names))
+	for i, name := range names {
+		files[i] = byName[name]
+	}
+	return files
+}
+
+// dropInRules collects the rules read from drop-in files for each policy.
+type dropInRules map[*Policy]RuleList
+
+// loadDropInRules adds the rules of every drop-in file as read-only SYSTEM
+// rules.  They are placed ahead of the rules from the user rule file, so
+// that they cannot be overridden from the prompt or fw-settings.  The rules
+// read from drop-in files before are replaced, including those of policies
+// that the user rule file does not empty.  It must be called with fw.lock
+// held.
+func (fw *Firewall) loadDropInRules(dirs []string) {
+	fw.removeDropInRules()
+	added := make(dropInRules)
+	for _, fname := range dropInRuleFiles(dirs) {
+		bs, err := ioutil.ReadFile(fname)
+		if err != nil {
+			log.Warningf("Failed to open %s for reading: %v", fname, err)
+			continue
+		}
+		trimmed := strings.TrimSpace(string(bs))
+		if strings.HasPrefix(trimmed, "{") {
+			err = fw.parseDropInJSON(fname, bs, added)
+		} else {
+			err = fw.parseDropInLines(fname, string(bs), added)
+		}
+		if err != nil {
+			log.Warningf("Error loading rules from %s: %v", fname, err)
+		}
+	}
+	for p, rules := range added {
+		p.lock.Lock()
+		p.rules = append(rules, p.rules...)
+		p.lock.Unlock()
+	}
+}
+
+// removeDropInRules takes the rules read from drop-in files out of every
+// policy.  It must be called with fw.lock held.
+func (fw *Firewall) removeDropInRules() {
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		var rules RuleList
+		for _, r := range p.rules {
+			if r.sourceFile == "" {
+				rules = append(rules, r)
+				continue
+			}
+			fw.ruleLock.Lock()
+			delete(fw.rulesByID, r.id)
+			fw.ruleLock.Unlock()
+		}
+		p.rules = rules
+		p.lock.Unlock()
+	}
+}
+
+func (fw *Firewall) parseDropInJSON(fname string, bs []byte, added dropInRules) error {
+	data, err := decodeRuleFile(bs)
+	if err != nil {
+		return err
+	}
+	for _, pr := range data.Policies {
+		policy := fw.policyForPathAndSandbox(pr.Path, pr.Sandbox)
+		if pr.Hash != "" {
+			log.Warningf("Ignoring executable hash for %s in %s", pr.Path, fname)
+		}
+		for _, rec := range pr.Rules {
+			r, err := policy.parseRecord(rec)
+			if err != nil {
+				log.Warningf("Error parsing rule in %s: %v", fname, err)
+				continue
+			}
+			if rec.ID == "" {
+				r.uuid = dropInRuleUUID(fname, rec.Verb+"|"+rec.Target)
+			}
+			added.add(r, fname)
+		}
+	}
+	return nil
+}
+
+// parseDropInLines reads a drop-in file in the line based format, in which
+// each policy starts with a [sandbox|path] line.
+func (fw *Firewall) parseDropInLines(fname, s string, added dropInRules) error {
+	var policy *Policy
+	for n, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			toks := strings.Split(line[1:len(line)-1], "|")
+			if len(toks) < 2 || toks[1] == "" {
+				return fmt.Errorf("invalid policy line %d: %s", n+1, line)
+			}
+			if len(toks) > 2 {
+				log.Warningf("Ignoring executable hash for %s in %s", toks[1], fname)
+			}
+			policy = fw.policyForPathAndSandbox(toks[1], toks[0])
+			continue
+		}
+		if policy == nil {
+			return fmt.Errorf("rule on line %d precedes the first policy line", n+1)
+		}
+		r, err := policy.parseRule(line, false)
+		if err != nil {
+			log.Warningf("Error parsing rule on line %d of %s: %v", n+1, fname, err)
+			continue
+		}
+		r.created = time.Time{}
+		r.uuid = dropInRuleUUID(fname, line)
+		added.add(r, fname)
+	}
+	return nil
+}
+
+func (added dropInRules) add(r *Rule, fname string) {
+	r.mode = RULE_MODE_SYSTEM
+	r.sourceFile = fname
+	added[r.policy] = append(added[r.policy], r)
+}
+
+// dropInRuleUUID derives the identifier of a rule which has none of its own
+// from where it was read, so that it stays the same across reloads.
+func dropInRuleUUID(fname, rule string) string {
+	sum := sha256.Sum256([]byte(fname + "\n" + rule))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,94 @@
+package sgfw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	fname := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+func TestDropInRules(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sgfw-rules.d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	etc, share := filepath.Join(tmp, "etc"), filepath.Join(tmp, "share")
+	for _, dir := range []string{etc, share} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeTestFile(t, share, "20-curl.rules", "[|/usr/bin/curl]\nALLOW|*:80|PERMANENT|-1:-1|\n")
+	writeTestFile(t, share, "50-masked.rules", "[|/usr/bin/curl]\nALLOW|*:*|PERMANENT|-1:-1|\n")
+	writeTestFile(t, share, "ignored.conf", "[|/usr/bin/curl]\nALLOW|*:21|PERMANENT|-1:-1|\n")
+	etcCurl := writeTestFile(t, etc, "10-curl.rules", strings.Join([]string{
+		"# shipped by configuration management",
+		"[|/usr/bin/curl]",
+		"DENY|evil.example.com:443|PERMANENT|-1:-1|",
+	}, "\n"))
+	writeTestFile(t, etc, "50-masked.rules", "")
+	writeTestFile(t, etc, "60-wget.rules", `{"version": 2, "policies": [{"sandbox": "", "path": "/usr/bin/wget",
+		"rules": [{"id": "w1", "verb": "ALLOW", "target": "*:443", "comment": "downloads"}]}]}`)
+
+	fw := testFirewall()
+	user := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	processRuleLine(user, "ALLOW|evil.example.com:443|PERMANENT|-1:-1|")
+
+	// loading again replaces the rules read before
+	fw.loadDropInRules([]string{etc, share})
+	fw.loadDropInRules([]string{etc, share})
+
+	var got []string
+	for _, r := range user.rules {
+		got = append(got, r.String())
+	}
+	want := []string{
+		"DENY|evil.example.com:443|SYSTEM|-1:-1|",
+		"ALLOW|*:80|SYSTEM|-1:-1|",
+		"ALLOW|evil.example.com:443|PERMANENT|-1:-1|",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected rules for curl:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if user.rules[0].sourceFile != etcCurl {
+		t.Errorf("source file not recorded: %q", user.rules[0].sourceFile)
+	}
+	uuid := user.rules[0].uuid
+
+	wget := fw.policyMap["|/usr/bin/wget"]
+	if wget == nil || len(wget.rules) != 1 || wget.rules[0].uuid != "w1" || wget.rules[0].mode != RULE_MODE_SYSTEM {
+		t.Fatalf("JSON drop-in not loaded: %v", wget)
+	}
+	if r := fw.getRuleByID(user.rules[0].id); r != user.rules[0] || len(fw.rulesByID) != 4 {
+		t.Errorf("%d rules by ID after loading again", len(fw.rulesByID))
+	}
+
+	bs, err := fw.marshalRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := testFirewall()
+	if err := saved.loadRulesJSON(bs); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.policies) != 1 || len(saved.policies[0].rules) != 1 || saved.policies[0].rules[0].sourceFile != "" {
+		t.Errorf("drop-in rules written to the user rule file:\n%s", bs)
+	}
+
+	again := testFirewall()
+	again.loadDropInRules([]string{etc, share})
+	if r := again.policyMap["|/usr/bin/curl"].rules[0]; r.uuid != uuid {
+		t.Errorf("rule identifier changed on reload: %q, was %q", r.uuid, uuid)
+	}
+}
@@ -0,0 +1,371 @@
+package sgfw
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+// How long after the rules change the open connections are judged again,
+// so that a burst of changes is handled at once
+const enforceDelay = 500 * time.Millisecond
+
+// What becomes of an open connection judged again
+type flowAction int
+
+const (
+	// it is still let through
+	flowKeep flowAction = iota
+	// it is let through by another rule, whose verdict it is marked with
+	flowRemark
+	// its next packet is queued, to be prompted for
+	flowRequeue
+	// it is denied, and aborted
+	flowKill
+)
+
+// Netlink constants of sock_diag, from linux/sock_diag.h and
+// linux/inet_diag.h
+const (
+	sockDiagDestroy     = 21
+	sizeofInetDiagReqV2 = 56
+)
+
+// enforceLater has the open connections judged again once the rules have
+// settled.  It does not block, and does nothing for a firewall that is not
+// running, such as those of the tests.
+func (fw *Firewall) enforceLater() {
+	if fw == nil || fw.enforceChan == nil {
+		return
+	}
+	select {
+	case fw.enforceChan <- true:
+	default:
+	}
+}
+
+func (fw *Firewall) enforceLoop() {
+	for range fw.enforceChan {
+		time.Sleep(enforceDelay)
+		fw.enforceRules()
+	}
+}
+
+// enforceRules judges the open connections again, and ends those the rules
+// no longer let through: denied ones are aborted, and those let through by
+// a rule that no longer does are queued again, for their next packet to be
+// prompted for.  Connections let through without a rule, after a prompt
+// applied once, are only ended when denied, if the cached verdicts tell
+// them apart.  Nothing is ended during lockdown, which only concerns new
+// connections.
+func (fw *Firewall) enforceRules() {
+	forgotten := fw.takeForgotten()
+	if !fw.isEnabled() || fw.inLockdown() {
+		clearVerdicts(forgotten)
+		return
+	}
+	killed, requeued := 0, 0
+	if c, err := nftDial(); err != nil {
+		log.Warningf("Failed to judge the open connections again: %v", err)
+	} else {
+		killed, requeued = fw.enforceFlows(c, forgotten)
+		c.close()
+	}
+	closed := fw.enforceSocks()
+	if killed+requeued+closed > 0 {
+		log.Noticef("Rules changed: %d connections aborted, %d to be judged again, %d SOCKS sessions closed", killed, requeued, closed)
+	}
+}
+
+// forgetVerdicts has the open connections judged again after rules are
+// removed or changed: those the rules no longer let through are ended.
+// When verdicts are cached, the marks of the rules are cleared then, and
+// the connections still let through are marked with the verdict of the
+// rule that now does.  It does not wait for this, as it is called with the
+// locks of the firewall held.
+func (fw *Firewall) forgetVerdicts(rules ...*Rule) {
+	if len(rules) == 0 {
+		return
+	}
+	if cacheVerdicts() {
+		fw.ruleLock.Lock()
+		if fw.forgotten == nil {
+			fw.forgotten = make(map[uint32]bool)
+		}
+		for _, r := range rules {
+			fw.forgotten[verdictMark(r)] = true
+		}
+		fw.ruleLock.Unlock()
+	}
+	fw.enforceLater()
+}
+
+// takeForgotten returns the marks given to forgetVerdicts since it was
+// last called.
+func (fw *Firewall) takeForgotten() map[uint32]bool {
+	fw.ruleLock.Lock()
+	defer fw.ruleLock.Unlock()
+	forgotten := fw.forgotten
+	fw.forgotten = nil
+	return forgotten
+}
+
+// clearVerdicts clears the marks of the connections with the given marks.
+func clearVerdicts(marks map[uint32]bool) {
+	for m := range marks {
+		if _, err := clearConnmarks(m, ^uint32(0)); err != nil {
+			log.Warningf("Failed to clear the verdict cached on connections (mark %#x): %v", m, err)
+		}
+	}
+}
+
+// enforceFlows judges the connections opened from this host that conntrack
+// tracks, and returns how many were aborted and queued again.  The marks
+// of the rules in forgotten are cleared from those kept.  The processes of
+// the connections are all looked up in one snapshot of /proc, taken after
+// the connections are listed, so that every socket they were opened from
+// is in it.
+func (fw *Firewall) enforceFlows(c *nftConn, forgotten map[uint32]bool) (int, int) {
+	flows, err := c.flows(0, 0)
+	if err != nil {
+		log.Warningf("Failed to list the open connections: %v", err)
+		clearVerdicts(forgotten)
+		return 0, 0
+	}
+	local := localAddrs()
+	snap := newProcSnapshot()
+	killed, requeued := 0, 0
+	for _, f := range flows {
+		if f.closed || (f.proto != syscall.IPPROTO_TCP && f.proto != syscall.IPPROTO_UDP) || !local[f.src.String()] {
+			if forgotten[f.mark] {
+				if _, err := c.updateFlow(f, ipctnlMsgCtNew, nftU32(ctaMark, 0)); err != nil {
+					log.Warningf("Failed to update an open connection: %v", err)
+				}
+			}
+			continue
+		}
+		action, r := fw.judgeFlow(f, snap)
+		var err error
+		switch action {
+		case flowKill:
+			if err := destroySocket(f); err != nil {
+				log.Warningf("Failed to abort the socket of a denied connection: %v", err)
+			}
+			_, err = c.updateFlow(f, ipctnlMsgCtDelete)
+			killed++
+		case flowRequeue:
+			_, err = c.updateFlow(f, ipctnlMsgCtDelete)
+			requeued++
+		case flowRemark:
+			_, err = c.updateFlow(f, ipctnlMsgCtNew, nftU32(ctaMark, verdictMark(r)))
+		default:
+			// unless the rule that marked it still lets it through
+			if forgotten[f.mark] && (r == nil || verdictMark(r) != f.mark) {
+				_, err = c.updateFlow(f, ipctnlMsgCtNew, nftU32(ctaMark, 0))
+			}
+		}
+		if err != nil {
+			log.Warningf("Failed to update an open connection: %v", err)
+		}
+	}
+	return killed, requeued
+}
+
+// judgeFlow applies the rules to an open connection as to its first packet,
+// and returns what becomes of it, with the rule that lets it through if
+// any.  Its process is looked up in snap.
+func (fw *Firewall) judgeFlow(f ctFlow, snap *procSnapshot) (flowAction, *Rule) {
+	pkt := f.packet()
+	if pkt == nil || basicAllowPacket(pkt) {
+		return flowKeep, nil
+	}
+	// marked with the verdict of the rule that let it through
+	marked := cacheVerdicts() && f.mark&connmarkVerdict == connmarkAllow
+	// without the marks, any connection may have been let through by a rule
+	byRule := marked || !cacheVerdicts()
+
+	strictness := procsnitch.MATCH_STRICT
+	if f.proto == syscall.IPPROTO_UDP {
+		strictness = procsnitch.MATCH_LOOSE
+	}
+	pinfo, optstr := findSocketProcess(getNFQProto(pkt), f.src, f.srcPort, f.dst, f.dstPort, -1, f.family == syscall.AF_INET6, strictness, snap)
+	if pinfo == nil {
+		// its process is gone, and may have taken the rule with it
+		if marked {
+			return flowRequeue, nil
+		}
+		return flowKeep, nil
+	}
+	policy := fw.PolicyForPathAndSandbox(policyPath(pinfo), pinfo.Sandbox)
+	policy.lock.Lock()
+	audit := policy.auditing()
+	policy.lock.Unlock()
+	if audit {
+		return flowKeep, nil
+	}
+	var ap *Policy
+	if policy.path != anyExePath {
+		ap = fw.anyExePolicy(policy.sandbox)
+	}
+	name := fw.dns.Lookup(f.dst, pinfo.Pid)
+	result, r := matchPolicies(RULE_DIRECTION_OUT, fw.unitPolicy(pinfo), policy, ap, pkt, pinfo, f.src, f.dst, f.dstPort, name, optstr)
+	switch {
+	case result == FILTER_DENY:
+		dst := STR_REDACTED
+		if !FirewallConfig.LogRedact {
+			dst = auditTarget(name, f.dst, f.dstPort)
+		}
+		log.Warningf("Aborting %s connection by %s -> %s: denied by %s", getNFQProto(pkt), pinfo.ExePath, dst, r.getString(FirewallConfig.LogRedact))
+		return flowKill, nil
+	case result == FILTER_PROMPT && byRule && !fw.learner.active(time.Now()):
+		return flowRequeue, nil
+	case result == FILTER_ALLOW && marked && f.mark != verdictMark(r):
+		return flowRemark, r
+	case result == FILTER_ALLOW:
+		return flowKeep, r
+	}
+	return flowKeep, nil
+}
+
+// packet returns the first packet of the connection, as it was queued.
+func (f ctFlow) packet() *nfqueue.NFQPacket {
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, SrcIP: f.src, DstIP: f.dst}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: f.src, DstIP: f.dst}
+	var ipl gopacket.NetworkLayer = ip4
+	first := layers.LayerTypeIPv4
+	if f.family == syscall.AF_INET6 {
+		ipl = ip6
+		first = layers.LayerTypeIPv6
+	}
+
+	var l4 gopacket.SerializableLayer
+	switch f.proto {
+	case syscall.IPPROTO_TCP:
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(f.srcPort), DstPort: layers.TCPPort(f.dstPort), SYN: true}
+		tcp.SetNetworkLayerForChecksum(ipl)
+		ip4.Protocol, ip6.NextHeader, l4 = layers.IPProtocolTCP, layers.IPProtocolTCP, tcp
+	case syscall.IPPROTO_UDP:
+		udp := &layers.UDP{SrcPort: layers.UDPPort(f.srcPort), DstPort: layers.UDPPort(f.dstPort)}
+		udp.SetNetworkLayerForChecksum(ipl)
+		ip4.Protocol, ip6.NextHeader, l4 = layers.IPProtocolUDP, layers.IPProtocolUDP, udp
+	default:
+		return nil
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ipl.(gopacket.SerializableLayer), l4); err != nil {
+		return nil
+	}
+	return &nfqueue.NFQPacket{Packet: gopacket.NewPacket(buf.Bytes(), first, gopacket.Default)}
+}
+
+// localAddrs returns the addresses of this host.
+func localAddrs() map[string]bool {
+	local := make(map[string]bool)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warningf("Failed to list the addresses of this host: %v", err)
+		return local
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			local[ipn.IP.String()] = true
+		}
+	}
+	return local
+}
+
+// destroySocket aborts the socket a connection was opened from, so that
+// the program using it gets an error at once rather than on its next
+// packet.  It does nothing if the socket is gone.
+func destroySocket(f ctFlow) error {
+	c, err := netlinkDial(syscall.NETLINK_INET_DIAG)
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	req := make([]byte, sizeofInetDiagReqV2)
+	req[0], req[1] = f.family, f.proto
+	nlNative.PutUint32(req[4:], ^uint32(0)) // every state
+	binary.BigEndian.PutUint16(req[8:], f.srcPort)
+	binary.BigEndian.PutUint16(req[10:], f.dstPort)
+	if f.family == syscall.AF_INET6 {
+		copy(req[12:], f.src.To16())
+		copy(req[28:], f.dst.To16())
+	} else {
+		copy(req[12:], f.src.To4())
+		copy(req[28:], f.dst.To4())
+	}
+	// no cookie, the socket is found by its addresses
+	nlNative.PutUint32(req[48:], ^uint32(0))
+	nlNative.PutUint32(req[52:], ^uint32(0))
+
+	seq := c.seq
+	c.seq++
+	hdr := make([]byte, syscall.NLMSG_HDRLEN)
+	nlNative.PutUint32(hdr, uint32(len(hdr)+len(req)))
+	nlNative.PutUint16(hdr[4:], sockDiagDestroy)
+	nlNative.PutUint16(hdr[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK)
+	nlNative.PutUint32(hdr[8:], seq)
+	if err := c.send(append(hdr, req...)); err != nil {
+		return err
+	}
+	err = c.receive(seq, seq, func(syscall.NetlinkMessage) {})
+	if e, ok := err.(*nftError); ok && e.errno == syscall.ENOENT {
+		return nil
+	}
+	return err
+}
+
+// enforceSocks closes the SOCKS sessions the rules no longer let through,
+// and returns how many.
+func (fw *Firewall) enforceSocks() int {
+	fw.lock.Lock()
+	chains := fw.socksChains
+	fw.lock.Unlock()
+	n := 0
+	for _, s := range chains {
+		for _, c := range s.openSessions() {
+			if !c.judge() {
+				c.close()
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// judge applies the rules to an open session again, and reports whether
+// it is still let through.
+func (c *socksChainSession) judge() bool {
+	c.policy.lock.Lock()
+	audit := c.policy.auditing()
+	c.policy.lock.Unlock()
+	if audit {
+		return true
+	}
+	result, r := c.match()
+	switch result {
+	case FILTER_DENY:
+		dst := STR_REDACTED
+		if !FirewallConfig.LogRedact {
+			dst = auditTarget(c.hostname, c.ip, c.port)
+		}
+		log.Warningf("Closing [socks5] session of %s -> %s: denied by %s", c.pinfo.ExePath, dst, r.getString(FirewallConfig.LogRedact))
+		return false
+	case FILTER_PROMPT:
+		return c.rule == nil || c.server.fw.learner.active(time.Now())
+	}
+	if c.rule != nil {
+		c.rule = r
+	}
+	return true
+}
@@ -0,0 +1,212 @@
+package sgfw
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/subgraph/go-procsnitch"
+)
+
+func TestParseCtFlow(t *testing.T) {
+	tuple := nftNested(ctaTupleOrig,
+		nftNested(ctaTupleIP, nftAttr{typ: ctaIPv4Src, data: net.IPv4(192, 0, 2, 2).To4()}, nftAttr{typ: ctaIPv4Dst, data: net.IPv4(198, 51, 100, 7).To4()}),
+		nftNested(ctaTupleProto, nftAttr{typ: ctaProtoNum, data: []byte{syscall.IPPROTO_TCP}}, nftU16(ctaProtoSrcPort, 40000), nftU16(ctaProtoDstPort, 443)))
+	b := new(bytes.Buffer)
+	nftMessage{ctMsgType(ipctnlMsgCtNew), 0, []nftAttr{
+		tuple,
+		nftU32(ctaMark, connmarkAllow|7),
+		nftNested(ctaProtoinfo, nftNested(ctaProtoinfoTCP, nftAttr{typ: ctaProtoinfoTCPState, data: []byte{tcpConntrackTimeWait}})),
+	}}.encode(b, 1, syscall.AF_INET, 0)
+	msgs, err := syscall.ParseNetlinkMessage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, ok := parseCtFlow(msgs[0])
+	if !ok {
+		t.Fatal("flow not parsed")
+	}
+	if f.proto != syscall.IPPROTO_TCP || !f.src.Equal(net.IPv4(192, 0, 2, 2)) || !f.dst.Equal(net.IPv4(198, 51, 100, 7)) ||
+		f.srcPort != 40000 || f.dstPort != 443 || f.mark != connmarkAllow|7 || !f.closed {
+		t.Errorf("flow parsed as %+v", f)
+	}
+
+	// the tuple is sent back as it came to address the connection
+	b.Reset()
+	tuple.encode(b)
+	if !bytes.Equal(f.tuple, b.Bytes()[syscall.SizeofRtAttr:]) {
+		t.Error("tuple not kept as it came")
+	}
+	pkt := f.packet()
+	if src, dst := getPacketIPAddrs(pkt); !src.Equal(f.src) || !dst.Equal(f.dst) || getNFQProto(pkt) != "tcp" {
+		t.Errorf("packet of the flow is %v", pkt.Packet)
+	}
+	if _, port := getPacketPorts(pkt); port != 443 {
+		t.Errorf("packet of the flow is to port %d", port)
+	}
+}
+
+func TestSocksSessionsJudgedAgain(t *testing.T) {
+	fw := &Firewall{policyMap: make(map[string]*Policy)}
+	p := fw.PolicyForPathAndSandbox("/usr/bin/test", "")
+	allow, err := p.parseRule("ALLOW|www.example.com:443|SYSTEM|-1:-1||", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := &socksChain{fw: fw}
+	session := func() *socksChainSession {
+		return &socksChainSession{server: chain, policy: p, pinfo: testPInfo(), hostname: "www.example.com", port: 443}
+	}
+	byRule, once := session(), session()
+	byRule.rule = allow
+	if !byRule.judge() || !once.judge() {
+		t.Fatal("allowed session closed")
+	}
+
+	// a session let through by a rule is closed when the rule goes, one
+	// let through by a prompt applied once only when denied
+	p.removeRule(allow)
+	if byRule.judge() {
+		t.Error("session kept after its rule was removed")
+	}
+	if !once.judge() {
+		t.Error("session allowed once closed without a rule denying it")
+	}
+	if _, err := p.parseRule("DENY|www.example.com:443|SYSTEM|-1:-1||", true); err != nil {
+		t.Fatal(err)
+	}
+	if once.judge() {
+		t.Error("denied session kept")
+	}
+}
+
+func TestProcSnapshot(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	src, dst := c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr)
+
+	snap := newProcSnapshot()
+	pinfo, _ := findSocketProcess("tcp", src.IP, uint16(src.Port), dst.IP, uint16(dst.Port), -1, false, procsnitch.MATCH_STRICT, snap)
+	if pinfo == nil || pinfo.Pid != os.Getpid() {
+		t.Fatalf("connection of this process found as %+v", pinfo)
+	}
+
+	// the sockets no process holds are left out
+	dir, err := ioutil.TempDir("", "sgfw-enforce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	held := ""
+	for inode := range snap.held {
+		held = inode
+		break
+	}
+	table := filepath.Join(dir, "tcp")
+	if err := ioutil.WriteFile(table, []byte(strings.Join([]string{
+		"sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode",
+		"0: 0100007F:A0D2 0100007F:0050 01 00000000:00000000 00:00000000 00000000  1000        0 " + held + " 1 0000000000000000 20 4 30 10 -1",
+		"1: 0100007F:A0D3 0100007F:0050 04 00000000:00000000 00:00000000 00000000     0        0 0 3 0000000000000000 20 4 30 10 -1",
+	}, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := snap.lines(table)
+	if err != nil || len(lines) != 1 || !strings.HasPrefix(lines[0], "0:") {
+		t.Errorf("socket table read as %q, %v", lines, err)
+	}
+}
+
+// The marks of removed rules are cleared once the connections have been
+// judged again, and only then.
+func TestForgetVerdicts(t *testing.T) {
+	defer func(saved bool) { FirewallConfig.CacheVerdicts = saved }(FirewallConfig.CacheVerdicts)
+	FirewallConfig.CacheVerdicts = true
+	fw := &Firewall{policyMap: make(map[string]*Policy), enforceChan: make(chan bool, 1)}
+	p := fw.PolicyForPathAndSandbox("/usr/bin/test", "")
+	allow, err := p.parseRule("ALLOW|www.example.com:443|SYSTEM|-1:-1||", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-fw.enforceChan
+	p.removeRule(allow)
+	select {
+	case <-fw.enforceChan:
+	default:
+		t.Error("connections not judged again after a rule was removed")
+	}
+	if forgotten := fw.takeForgotten(); len(forgotten) != 1 || !forgotten[verdictMark(allow)] {
+		t.Errorf("marks to clear are %v", forgotten)
+	}
+	if forgotten := fw.takeForgotten(); len(forgotten) != 0 {
+		t.Errorf("marks to clear taken twice: %v", forgotten)
+	}
+}
+
+// Without cached verdicts, a connection no rule lets through any more is
+// queued again, as it cannot be told apart from those a rule let through.
+func TestJudgeFlowWithoutCache(t *testing.T) {
+	defer func(saved bool) { FirewallConfig.CacheVerdicts = saved }(FirewallConfig.CacheVerdicts)
+	// connections to the loopback interface are always let through
+	host := ""
+	for addr := range localAddrs() {
+		if ip := net.ParseIP(addr).To4(); ip != nil && !ip.IsLoopback() {
+			host = addr
+			break
+		}
+	}
+	if host == "" {
+		t.Skip("no address other than the loopback one")
+	}
+	l, err := net.Listen("tcp4", host+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp4", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	src, dst := c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr)
+	f := ctFlow{family: syscall.AF_INET, proto: syscall.IPPROTO_TCP, src: src.IP.To4(), dst: dst.IP.To4(), srcPort: uint16(src.Port), dstPort: uint16(dst.Port)}
+
+	snap := newProcSnapshot()
+	pinfo, _ := findSocketProcess("tcp", src.IP, uint16(src.Port), dst.IP, uint16(dst.Port), -1, false, procsnitch.MATCH_STRICT, snap)
+	if pinfo == nil {
+		t.Skip("unable to look up the sockets of this process")
+	}
+	fw := testFirewall()
+	fw.dns = newDNSCache()
+	p := fw.PolicyForPathAndSandbox(policyPath(pinfo), pinfo.Sandbox)
+
+	for _, cache := range []bool{false, true} {
+		FirewallConfig.CacheVerdicts = cache
+		want := map[bool]flowAction{false: flowRequeue, true: flowKeep}[cache]
+		if action, _ := fw.judgeFlow(f, snap); action != want {
+			t.Errorf("cache_verdicts=%v: unmarked connection no rule lets through judged %d, want %d", cache, action, want)
+		}
+	}
+
+	FirewallConfig.CacheVerdicts = false
+	allow, err := p.parseRule(fmt.Sprintf("ALLOW|%s:%d|SYSTEM|-1:-1||", host, dst.Port), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action, r := fw.judgeFlow(f, snap); action != flowKeep || r != allow {
+		t.Errorf("connection let through by a rule judged %d by %v", action, r)
+	}
+}
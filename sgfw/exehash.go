@@ -0,0 +1,236 @@
+package sgfw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+const exeHashPrefix = "sha256:"
+
+// Values of FirewallConfig.PinMismatchAction
+const (
+	PIN_MISMATCH_PROMPT = "prompt"
+	PIN_MISMATCH_DENY   = "deny"
+)
+
+// exeHashCacheKey identifies a particular version of a file, so that an
+// executable only has to be hashed again after it has been replaced or
+// modified.
+type exeHashCacheKey struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime syscall.Timespec
+	ctime syscall.Timespec
+}
+
+// exeHashEntry is the hash of the version of an executable last hashed.
+type exeHashEntry struct {
+	key exeHashCacheKey
+	sum string
+}
+
+// The hashes of executables, one per policy, so that an upgraded binary
+// replaces the entry of its previous version instead of adding another.
+var exeHashCache = make(map[string]exeHashEntry)
+var exeHashCacheLock sync.Mutex
+
+// hashFile returns the SHA-256 digest of a file in the form stored in the
+// rule file.  The digest is cached under name, as the file is given by a
+// path under /proc which changes with the process.
+func hashFile(fname, name string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", fmt.Errorf("unable to stat %s", fname)
+	}
+	key := exeHashCacheKey{dev: uint64(st.Dev), ino: uint64(st.Ino), size: st.Size, mtime: st.Mtim, ctime: st.Ctim}
+
+	exeHashCacheLock.Lock()
+	e, ok := exeHashCache[name]
+	exeHashCacheLock.Unlock()
+	if ok && e.key == key {
+		return e.sum, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	sum := exeHashPrefix + hex.EncodeToString(h.Sum(nil))
+
+	exeHashCacheLock.Lock()
+	exeHashCache[name] = exeHashEntry{key: key, sum: sum}
+	exeHashCacheLock.Unlock()
+	return sum, nil
+}
+
+// exeHash hashes the file a policy applies to, as seen by the process in
+// pinfo.  The running image is used where possible, so that a binary that
+// is replaced underneath a process cannot be mistaken for the original.
+// Interpreted scripts are hashed through the root of the process, which
+// also covers processes running in a sandbox.
+func (p *Policy) exeHash(pinfo *procsnitch.Info) (string, error) {
+	name := p.sandbox + "|" + p.path
+	if pinfo == nil || pinfo.Pid <= 0 {
+		return hashFile(p.path, name)
+	}
+	if pinfo.ExePath == p.path {
+		return hashFile(fmt.Sprintf("/proc/%d/exe", pinfo.Pid), name)
+	}
+	return hashFile(fmt.Sprintf("/proc/%d/root%s", pinfo.Pid, p.path), name)
+}
+
+// pinCheck is the hash of the executable behind a connection, for
+// checkPin.  It is taken before p.lock is held, as hashing a file that is
+// not in the cache can take a while.  changed tells whether it differed
+// from the pinned hash at the time, so that the connection is matched
+// against the DENY rules alone.
+type pinCheck struct {
+	sum     string
+	err     error
+	changed bool
+}
+
+// hashForPin hashes the executable behind a connection if the policy is
+// pinned.
+func (p *Policy) hashForPin(pinfo *procsnitch.Info) pinCheck {
+	p.lock.Lock()
+	pinned := p.pinnedHash
+	p.lock.Unlock()
+	if pinned == "" {
+		return pinCheck{}
+	}
+	sum, err := p.exeHash(pinfo)
+	return pinCheck{sum: sum, err: err, changed: err != nil || sum != pinned}
+}
+
+// match is matchPolicies, or matchDenyingPolicies if the executable
+// changed.
+func (pc pinCheck) match(dir RuleDirection, up, p, ap *Policy, pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, src, dst net.IP, dstPort uint16, hostname, optstr string) (FilterResult, *Rule) {
+	match := matchPolicies
+	if pc.changed {
+		match = matchDenyingPolicies
+	}
+	return match(dir, up, p, ap, pkt, pinfo, src, dst, dstPort, hostname, optstr)
+}
+
+// checkPin reports whether the executable behind a connection, as hashed
+// by hashForPin, is the one pinned by the policy.  Policies without a
+// pinned hash always pass.  It must be called with p.lock held.
+func (p *Policy) checkPin(pc pinCheck) bool {
+	if p.pinnedHash == "" {
+		return true
+	}
+	if pc.err != nil {
+		log.Warningf("Unable to hash executable %s: %v", p.path, pc.err)
+		return false
+	}
+	if pc.sum != p.pinnedHash {
+		log.Warningf("Executable %s does not match the hash pinned in its policy (%s)", p.path, pc.sum)
+		return false
+	}
+	return true
+}
+
+// pinnedVerdict returns the verdict for a connection of the executable of
+// p, hashed by hashForPin, given the verdict of the rules and the rule that
+// decided it, and whether the executable is the one pinned.  A changed
+// executable is denied outright with pin_mismatch_action "deny".  Otherwise
+// only the rules denying its connections apply until the user approves it,
+// so that a DENY answer to its prompt takes effect: result should come from
+// pin.match.  Anything else is prompted for.
+// It must be called with p.lock held.
+func (p *Policy) pinnedVerdict(pin pinCheck, result FilterResult, r *Rule) (FilterResult, *Rule, bool) {
+	if p.checkPin(pin) {
+		return result, r, true
+	}
+	if FirewallConfig.PinMismatchAction == PIN_MISMATCH_DENY {
+		if !p.auditing() {
+			log.Warningf("DENIED connection attempt by %s: %s", p.path, STR_BINARY_CHANGED)
+		}
+		return FILTER_DENY, nil, false
+	}
+	if result == FILTER_DENY {
+		return result, r, false
+	}
+	return FILTER_PROMPT, nil, false
+}
+
+// updatePin records the hash of the executable behind a connection the user
+// has just allowed.  A hash is only recorded for a policy which has none yet
+// if executable pinning is enabled; an existing pin is always replaced once
+// the user approved the changed binary.  It reports whether the pin changed.
+func (p *Policy) updatePin(pinfo *procsnitch.Info) bool {
+	if !strings.HasPrefix(p.path, "/") {
+		// [unknown], units and the like do not name a file
+		return false
+	}
+	p.lock.Lock()
+	pinned := p.pinnedHash != ""
+	p.lock.Unlock()
+	if !pinned && !FirewallConfig.PinExecutables {
+		return false
+	}
+	sum, err := p.exeHash(pinfo)
+	if err != nil {
+		log.Warningf("Unable to hash executable %s: %v", p.path, err)
+		return false
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if sum == p.pinnedHash {
+		return false
+	}
+	log.Noticef("Pinning executable %s to %s", p.path, sum)
+	p.pinnedHash = sum
+	return true
+}
+
+// parsePinnedHash normalizes an executable hash read from the rule file and
+// reports whether it is well formed.
+func parsePinnedHash(s string) (string, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return "", true
+	}
+	if !strings.HasPrefix(s, exeHashPrefix) {
+		return s, false
+	}
+	b, err := hex.DecodeString(s[len(exeHashPrefix):])
+	if err != nil || len(b) != sha256.Size {
+		return s, false
+	}
+	return s, true
+}
+
+// setPinnedHash sets the hash read from the rule file.  It must be called
+// with p.lock held.
+func (p *Policy) setPinnedHash(s string) {
+	sum, ok := parsePinnedHash(s)
+	if !ok {
+		// keep it anyway, so that the policy fails closed
+		log.Warningf("Invalid executable hash for %s will never match: %s", p.path, s)
+	}
+	p.pinnedHash = sum
+}
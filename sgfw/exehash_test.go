@@ -0,0 +1,151 @@
+package sgfw
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecutablePinning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sgfw-exehash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "curl")
+	if err := ioutil.WriteFile(exe, []byte("original"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{path: exe}
+	if !p.checkPin(p.hashForPin(nil)) {
+		t.Fatal("a policy without a pinned hash should always pass")
+	}
+
+	FirewallConfig.PinExecutables = true
+	defer func() { FirewallConfig.PinExecutables = false }()
+	if !p.updatePin(nil) || p.pinnedHash == "" {
+		t.Fatal("expected the executable to be pinned")
+	}
+	if _, ok := parsePinnedHash(p.pinnedHash); !ok {
+		t.Errorf("pinned hash %q does not parse", p.pinnedHash)
+	}
+	if !p.checkPin(p.hashForPin(nil)) {
+		t.Fatal("unchanged executable should match its pin")
+	}
+
+	if err := ioutil.WriteFile(exe+".new", []byte("replaced"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(exe+".new", exe); err != nil {
+		t.Fatal(err)
+	}
+	if p.checkPin(p.hashForPin(nil)) {
+		t.Fatal("replaced executable should not match its pin")
+	}
+	// the hash of the new version replaces that of the old one
+	if e, ok := exeHashCache["|"+exe]; !ok || e.sum == p.pinnedHash {
+		t.Errorf("cached hash of the replaced executable is %+v", e)
+	}
+}
+
+func TestParsePinnedHash(t *testing.T) {
+	good := "SHA256:E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855"
+	if s, ok := parsePinnedHash(good); !ok || s != "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("failed to parse %q: %q", good, s)
+	}
+	for _, bad := range []string{"md5:d41d8cd98f00b204e9800998ecf8427e", "sha256:1234", "sha256:xyz"} {
+		if _, ok := parsePinnedHash(bad); ok {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+// A changed executable is prompted for even where a rule allows it, but the
+// rules denying its connections still apply, so a DENY answer to the prompt
+// is not asked again.  Allowing a connection approves the executable.
+func TestPinMismatchAnswers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sgfw-exehash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	exe := filepath.Join(dir, "curl")
+	if err := ioutil.WriteFile(exe, []byte("original"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	saved := FirewallConfig
+	defer func() { FirewallConfig = saved }()
+	FirewallConfig.PinExecutables = true
+	FirewallConfig.PinMismatchAction = PIN_MISMATCH_PROMPT
+	defer func(saved *dbusObjectP) { dbusp = saved }(dbusp)
+	dbusp = &dbusObjectP{&testBusObject{}}
+
+	fw := testFirewall()
+	p := fw.PolicyForPath(exe)
+	pinfo := testPInfo()
+	pinfo.ExePath, pinfo.Pid = exe, 0
+	if !p.updatePin(pinfo) {
+		t.Fatal("executable not pinned")
+	}
+	if processRuleLine(p, "ALLOW|www.example.com:443|SYSTEM|-1:-1||") == nil {
+		t.Fatal("rule not parsed")
+	}
+	p.rulesChanged()
+	if err := ioutil.WriteFile(exe+".new", []byte("replaced"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(exe+".new", exe); err != nil {
+		t.Fatal(err)
+	}
+
+	// judge does what filterConnect does for a connection to port 443 of
+	// host, and queues it for a prompt
+	judge := func(host string) (FilterResult, *pendingSocksConnection) {
+		pc := testPendingSocks(p, time.Now())
+		pc.hname, pc.pinfo = host, pinfo
+		pin := p.hashForPin(pinfo)
+		result, r := pin.match(RULE_DIRECTION_OUT, nil, p, nil, nil, pinfo, nil, pc.destIP, 443, host, "")
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		result, _, _ = p.pinnedVerdict(pin, result, r)
+		if result == FILTER_PROMPT && !p.queuePending(pc) {
+			t.Fatal("connection not queued")
+		}
+		return result, pc
+	}
+	pr := &prompter{}
+
+	result, pc := judge("www.example.com")
+	if result != FILTER_PROMPT {
+		t.Fatalf("changed executable given %s by an ALLOW rule", FilterResultString[result])
+	}
+	pr.applyAnswer(p, pc, int32(APPLY_SESSION), "DENY|www.example.com:443")
+	if v := <-pc.verdict; v != socksVerdictDrop {
+		t.Errorf("DENY answer gave verdict %d", v)
+	}
+	if result, _ := judge("www.example.com"); result != FILTER_DENY {
+		t.Errorf("second connection after a DENY answer: %s", FilterResultString[result])
+	}
+	p.lock.Lock()
+	p.pendingQueue = nil
+	p.lock.Unlock()
+
+	result, pc = judge("mail.example.com")
+	if result != FILTER_PROMPT {
+		t.Fatalf("changed executable given %s without approval", FilterResultString[result])
+	}
+	pr.applyAnswer(p, pc, int32(APPLY_SESSION), "ALLOW|mail.example.com:443")
+	if v := <-pc.verdict; v != socksVerdictAccept {
+		t.Errorf("ALLOW answer gave verdict %d", v)
+	}
+	pin := p.hashForPin(pinfo)
+	p.lock.Lock()
+	approved := p.checkPin(pin)
+	p.lock.Unlock()
+	if !approved {
+		t.Error("executable not pinned again after an ALLOW answer")
+	}
+}
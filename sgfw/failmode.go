@@ -0,0 +1,165 @@
+package sgfw
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/op/go-logging"
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+)
+
+// Values of FirewallConfig.FailMode
+const (
+	FAIL_OPEN   = "open"
+	FAIL_CLOSED = "closed"
+)
+
+// While this file exists the firewall fails open whatever fail_mode says,
+// so that the network can be brought back when the daemon cannot be.  It
+// is under /run so that it does not outlast a reboot.
+const failOpenOverride = "/run/sgfw/fail-open"
+
+const defaultWatchdogInterval = 5 * time.Second
+
+// failClosed reports whether new connections are blocked while the daemon
+// is not running.
+func failClosed() bool {
+	if FirewallConfig.FailMode != FAIL_CLOSED {
+		return false
+	}
+	_, err := os.Stat(failOpenOverride)
+	return err != nil
+}
+
+// defaultVerdict is given to packets the filter cannot judge: they are let
+// through, unless failing closed.
+func defaultVerdict(pkt *nfqueue.NFQPacket) {
+	if failClosed() {
+		pkt.Drop()
+		return
+	}
+	pkt.Accept()
+}
+
+// setFailOpenOverride creates or removes the override file.
+func setFailOpenOverride(flag bool) error {
+	if !flag {
+		if err := os.Remove(failOpenOverride); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := maybeCreateDir(filepath.Dir(failOpenOverride)); err != nil {
+		return err
+	}
+	data := time.Now().UTC().Format(time.RFC3339) + "\n"
+	return writeRuleFile(failOpenOverride, "", []byte(data))
+}
+
+// daemonRunning reports whether fw-daemon owns its name on the system bus.
+func daemonRunning() bool {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return false
+	}
+	var owned bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, busName).Store(&owned); err != nil {
+		log.Warningf("Failed to ask the system bus whether fw-daemon runs: %v", err)
+		return false
+	}
+	return owned
+}
+
+// WatchdogMain runs fw-watchdog, which keeps the rules of a firewall that
+// fails closed installed while the daemon is not running, so that the host
+// stays blocked until it is back, even across reboots and ruleset flushes.
+func WatchdogMain() {
+	release := flag.Bool("release", false, "fail open until -restore or a reboot, and remove the rules")
+	restore := flag.Bool("restore", false, "fail closed again after -release")
+	interval := flag.Duration("interval", defaultWatchdogInterval, "how often to check that fw-daemon runs")
+	flag.Parse()
+
+	readConfig()
+	logBackend, logBackend2 := setupLoggerBackend(FirewallConfig.LoggingLevel)
+	if logBackend2 == nil {
+		logging.SetBackend(logBackend)
+	} else {
+		logging.SetBackend(logBackend, logBackend2)
+	}
+	if os.Geteuid() != 0 {
+		log.Error("Must be run as root")
+		os.Exit(1)
+	}
+
+	switch {
+	case *release:
+		if err := setFailOpenOverride(true); err != nil {
+			log.Errorf("Failed to create %s: %v", failOpenOverride, err)
+			os.Exit(1)
+		}
+		if !daemonRunning() {
+			removeBackendRules()
+		}
+		fmt.Println("Failing open: connections are let through while fw-daemon is not running")
+		return
+	case *restore:
+		if err := setFailOpenOverride(false); err != nil {
+			log.Errorf("Failed to remove %s: %v", failOpenOverride, err)
+			os.Exit(1)
+		}
+		fmt.Println("Failing closed: connections are blocked while fw-daemon is not running")
+		return
+	}
+
+	if FirewallConfig.FailMode != FAIL_CLOSED {
+		log.Notice("fail_mode is not closed, the watchdog has nothing to do")
+		return
+	}
+	blocking := false
+	backend := configuredBackend()
+	for ; ; time.Sleep(*interval) {
+		if !failClosed() {
+			if blocking {
+				log.Warningf("%s exists, letting connections through", failOpenOverride)
+				removeBackendRules()
+				blocking = false
+			}
+			continue
+		}
+		if daemonRunning() {
+			if blocking {
+				log.Notice("fw-daemon is running again")
+				blocking = false
+			}
+			continue
+		}
+		// the rules are only set up again if some were removed, as that
+		// replaces the whole nftables table
+		if !rulesInstalled(backend) {
+			log.Warning("The rules blocking new connections are missing, installing them again")
+			backend = setupBackend()
+		}
+		if !blocking {
+			log.Warning("fw-daemon is not running, new connections are blocked until it is back")
+			blocking = true
+		}
+	}
+}
+
+// removeBackendRules removes the rules installed by either backend, as the
+// daemon may have fallen back to iptables.
+func removeBackendRules() {
+	for _, b := range []firewallBackend{nftablesBackend{}, iptablesBackend{}} {
+		if _, err := exec.LookPath("iptables"); err != nil && b.name() == BACKEND_IPTABLES {
+			continue
+		}
+		if err := b.teardown(); err != nil {
+			log.Warningf("Failed to remove the %s rules: %v", b.name(), err)
+		}
+	}
+}
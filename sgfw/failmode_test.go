@@ -0,0 +1,41 @@
+package sgfw
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFailClosedRules(t *testing.T) {
+	if _, err := os.Stat(failOpenOverride); err == nil {
+		t.Skipf("%s exists", failOpenOverride)
+	}
+	saved := FirewallConfig
+	defer func() { FirewallConfig = saved }()
+	FirewallConfig.QueueCount = 2
+	FirewallConfig.QueueNum = 10
+
+	FirewallConfig.FailMode = FAIL_OPEN
+	if r := iptablesRule(); !strings.HasSuffix(r, "--queue-balance 10:11 --queue-bypass") {
+		t.Errorf("failing open: %s", r)
+	}
+	if r := nftRules()[1]; r.text != "udp sport 53 queue num 10-11 bypass" {
+		t.Errorf("failing open: %s", r.text)
+	}
+
+	FirewallConfig.FailMode = FAIL_CLOSED
+	if !failClosed() {
+		t.Fatal("not failing closed")
+	}
+	if r := dnsRule(); strings.Contains(r, "bypass") || !strings.HasSuffix(r, "--queue-balance 10:11") {
+		t.Errorf("failing closed: %s", r)
+	}
+	if r := nftRules()[0]; strings.Contains(r.text, "bypass") {
+		t.Errorf("failing closed: %s", r.text)
+	}
+
+	FirewallConfig.QueueNum = 65535
+	if queueNum() != 0 {
+		t.Error("queues past 65535 used")
+	}
+}
@@ -0,0 +1,175 @@
+package sgfw
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Hostname patterns accepted in rule targets:
+//
+//	www.example.com    exact name
+//	*.example.com      "*" matches within a single label only
+//	.example.com       example.com itself and every name below it
+//	re:<expr>          regular expression, always anchored at both ends
+//
+// All forms are case insensitive and ignore a trailing dot.  Since the rule
+// file uses '|' as its field separator, regular expressions cannot use it.
+type hostPatternKind int
+
+const (
+	hostPatternExact hostPatternKind = iota
+	hostPatternWildcard
+	hostPatternSuffix
+	hostPatternRegexp
+)
+
+const hostPatternRegexpPrefix = "re:"
+
+type hostPattern struct {
+	kind hostPatternKind
+	name string
+	re   *regexp.Regexp
+}
+
+func normalizeHostname(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+func compileHostPattern(p string) (*hostPattern, error) {
+	if strings.HasPrefix(p, hostPatternRegexpPrefix) {
+		expr := p[len(hostPatternRegexpPrefix):]
+		if expr == "" {
+			return nil, errors.New("empty hostname regular expression")
+		}
+		re, err := regexp.Compile("(?i)^(?:" + expr + ")$")
+		if err != nil {
+			return nil, err
+		}
+		return &hostPattern{kind: hostPatternRegexp, re: re}, nil
+	}
+
+	name := normalizeHostname(p)
+	if name == "" || name == "." {
+		return nil, errors.New("empty hostname pattern")
+	}
+
+	if strings.HasPrefix(name, ".") {
+		suffix := name[1:]
+		if strings.Contains(suffix, "*") || hasEmptyLabel(suffix) {
+			return nil, errors.New("invalid hostname suffix: " + p)
+		}
+		return &hostPattern{kind: hostPatternSuffix, name: suffix}, nil
+	}
+
+	if hasEmptyLabel(name) {
+		return nil, errors.New("invalid hostname pattern: " + p)
+	}
+
+	if !strings.Contains(name, "*") {
+		return &hostPattern{kind: hostPatternExact, name: name}, nil
+	}
+
+	labels := strings.Split(name, ".")
+	for i, l := range labels {
+		parts := strings.Split(l, "*")
+		for j := range parts {
+			parts[j] = regexp.QuoteMeta(parts[j])
+		}
+		labels[i] = strings.Join(parts, "[^.]*")
+	}
+	re, err := regexp.Compile("^" + strings.Join(labels, `\.`) + "$")
+	if err != nil {
+		return nil, err
+	}
+	return &hostPattern{kind: hostPatternWildcard, name: name, re: re}, nil
+}
+
+func hasEmptyLabel(name string) bool {
+	for _, l := range strings.Split(name, ".") {
+		if l == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (hp *hostPattern) match(hostname string) bool {
+	if hostname == "" {
+		return false
+	}
+	if hp.kind == hostPatternRegexp {
+		return hp.re.MatchString(strings.TrimSuffix(hostname, "."))
+	}
+
+	name := normalizeHostname(hostname)
+	switch hp.kind {
+	case hostPatternExact:
+		return name == hp.name
+	case hostPatternSuffix:
+		return name == hp.name || strings.HasSuffix(name, "."+hp.name)
+	case hostPatternWildcard:
+		return hp.re.MatchString(name)
+	}
+	return false
+}
+
+// migrateHostPattern gives a rule read from the line based rule file of
+// older versions the meaning its hostname pattern had there, where a "*"
+// could match across labels: "*.ntp.org" matched every name below ntp.org,
+// and is rewritten to the suffix form ".ntp.org".  Other wildcards are kept,
+// and the rules whose patterns now match fewer names are logged.
+func (r *Rule) migrateHostPattern() {
+	if r.hostpat == nil || r.hostpat.kind != hostPatternWildcard {
+		return
+	}
+	old := r.hostname
+	if strings.HasPrefix(old, "*.") && r.parseAddr(old[1:]) && r.hostpat.kind == hostPatternSuffix {
+		log.Noticef("Rule %s migrated: a leading \"*.\" now only matches a single label, so it became a leading \".\"", r.getString(FirewallConfig.LogRedact))
+		return
+	}
+	r.parseAddr(old)
+	log.Warningf("Rule %s matches fewer hostnames than it used to: \"*\" now only matches within a single label", r.getString(FirewallConfig.LogRedact))
+}
+
+// ValidHostPattern reports whether p is an acceptable hostname pattern
+// for a rule target.
+func ValidHostPattern(p string) bool {
+	_, err := compileHostPattern(p)
+	return err == nil
+}
+
+// covers reports whether every name matched by other is also matched by hp.
+// Regular expressions are only known to cover themselves.
+func (hp *hostPattern) covers(other *hostPattern) bool {
+	switch other.kind {
+	case hostPatternExact:
+		return hp.match(other.name)
+	case hostPatternSuffix:
+		return hp.kind == hostPatternSuffix && hostIsBelow(other.name, hp.name)
+	case hostPatternWildcard:
+		if hp.kind == hostPatternWildcard {
+			return hp.name == other.name
+		}
+		if hp.kind != hostPatternSuffix {
+			return false
+		}
+		// every match lies below the labels after the last wildcard
+		labels := strings.Split(other.name, ".")
+		last := 0
+		for i, l := range labels {
+			if strings.Contains(l, "*") {
+				last = i
+			}
+		}
+		return hostIsBelow(strings.Join(labels[last+1:], "."), hp.name)
+	case hostPatternRegexp:
+		return hp.kind == hostPatternRegexp && hp.re.String() == other.re.String()
+	}
+	return false
+}
+
+// hostIsBelow reports whether name is domain or a name below it.
+func hostIsBelow(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
@@ -0,0 +1,88 @@
+package sgfw
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHostPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		hostname string
+		match    bool
+	}{
+		{"www.example.com", "www.example.com", true},
+		{"www.example.com", "WWW.Example.COM.", true},
+		{"www.example.com", "www.example.com.evil.org", false},
+		{"www.example.com", "wwwxexample.com", false},
+		{"*.ntp.org", "pool.ntp.org", true},
+		{"*.ntp.org", "0.pool.ntp.org", false},
+		{"*.ntp.org", "ntp.org", false},
+		{"*.ntp.org", "evilntp.org.attacker.com", false},
+		{"*.ntp.org", "evilntp.org", false},
+		{"www*.example.com", "www2.example.com", true},
+		{".ntp.org", "ntp.org", true},
+		{".ntp.org", "0.debian.pool.ntp.org", true},
+		{".ntp.org", "evilntp.org", false},
+		{".ntp.org", "ntp.org.attacker.com", false},
+		{`re:[a-z]+\.example\.com`, "mail.example.com", true},
+		{`re:[a-z]+\.example\.com`, "Mail.Example.com.", true},
+		{`re:[a-z]+\.example\.com`, "mail.example.com.attacker.com", false},
+		{`re:[a-z]+\.example\.com`, "1.mail.example.com", false},
+		{"www.example.com", "", false},
+	}
+
+	for _, tt := range tests {
+		hp, err := compileHostPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compileHostPattern(%q) failed: %v", tt.pattern, err)
+		}
+		if got := hp.match(tt.hostname); got != tt.match {
+			t.Errorf("pattern %q against %q: got %v, want %v", tt.pattern, tt.hostname, got, tt.match)
+		}
+	}
+}
+
+func TestHostPatternInvalid(t *testing.T) {
+	for _, p := range []string{"", ".", "re:", "re:(", "www..example.com", ".*.example.com"} {
+		if ValidHostPattern(p) {
+			t.Errorf("expected pattern %q to be rejected", p)
+		}
+	}
+}
+
+// A "*" of the line based rule file could match across labels.
+func TestLegacyHostPatternMigration(t *testing.T) {
+	fw := testFirewall()
+	fw.loadLegacyRules([]byte(strings.Join([]string{
+		"[|/usr/sbin/ntpd]",
+		"ALLOW|udp:*.ntp.org:123|SYSTEM||",
+		"ALLOW|www*.example.com:443|SYSTEM||",
+		"ALLOW|*.*.example.org:443|SYSTEM||",
+		"ALLOW|.example.net:443|SYSTEM||",
+	}, "\n")))
+	want := []string{
+		"ALLOW|udp:.ntp.org:123|SYSTEM|-1:-1|",
+		"ALLOW|www*.example.com:443|SYSTEM|-1:-1|",
+		"ALLOW|*.*.example.org:443|SYSTEM|-1:-1|",
+		"ALLOW|.example.net:443|SYSTEM|-1:-1|",
+	}
+	rules := fw.policyMap["|/usr/sbin/ntpd"].rules
+	if len(rules) != len(want) {
+		t.Fatalf("%d rules loaded, want %d", len(rules), len(want))
+	}
+	for i, r := range rules {
+		if r.String() != want[i] {
+			t.Errorf("rule migrated as %q, want %q", r.String(), want[i])
+		}
+	}
+	if !rules[0].hostpat.match("0.debian.pool.ntp.org") {
+		t.Errorf("migrated rule does not match every name below ntp.org")
+	}
+
+	// rules in the current format are taken as written
+	p := testPolicy(t, []string{"ALLOW|*.example.com:443|SYSTEM|-1:-1||"})
+	if p.rules[0].hostname != "*.example.com" || p.rules[0].hostpat.match("a.b.example.com") {
+		t.Errorf("current rule changed: %q", p.rules[0].hostname)
+	}
+}
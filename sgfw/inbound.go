@@ -0,0 +1,139 @@
+package sgfw
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+// With filter_inbound, the first packet of every TCP connection from
+// another host is queued as well, to a queue of its own (see
+// inboundQueueNum), and judged by the rules of the application listening
+// for it.  Those rules have RULE_DIRECTION_IN, and match the remote host and
+// the local port.
+func filterInbound() bool {
+	return FirewallConfig.FilterInbound
+}
+
+// findListenerForPacket returns the process listening for the connection a
+// packet from another host opens.  The connection has no socket yet, so the
+// listener is found by the local address and port: it may be bound to that
+// address or to none, and an IPv6 listener takes IPv4 connections as well.
+func findListenerForPacket(pkt *nfqueue.NFQPacket) *procsnitch.Info {
+	_, dstip := getPacketIPAddrs(pkt)
+	_, dstp := getPacketTCPPorts(pkt)
+	tables := []bool{false, true}
+	if dstip.To4() == nil {
+		tables = []bool{true}
+	}
+
+	for _, ipv6 := range tables {
+		fname := "/proc/net/" + procNetFile("tcp", ipv6)
+		rlines, err := readProcNetLines(fname)
+		if err != nil {
+			log.Warningf("Error reading proc data from %s: %v", fname, err)
+			continue
+		}
+		// a listener has no remote end
+		unbound := net.IPv4zero
+		if ipv6 {
+			unbound = net.IPv6unspecified
+		}
+		for _, addr := range []net.IP{dstip, unbound} {
+			if res := lookupSocketProcess("tcp", addr, dstp, unbound, 0, -1, procsnitch.MATCH_STRICT, rlines); res != nil {
+				return res
+			}
+		}
+	}
+	return nil
+}
+
+// filterInboundPacket judges a packet of the inbound queue.
+func (fw *Firewall) filterInboundPacket(pkt *nfqueue.NFQPacket) {
+	if pkt.Packet.Layer(layers.LayerTypeTCP) == nil {
+		// only TCP is queued there
+		pkt.Accept()
+		return
+	}
+	pinfo := findListenerForPacket(pkt)
+	if pinfo == nil {
+		// nothing listens, and the kernel refuses the connection itself
+		log.Debugf("No listener found for %s", printInboundPacket(pkt, "", nil))
+		pkt.Accept()
+		return
+	}
+	ppath := policyPath(pinfo)
+	log.Debugf("filterInboundPacket [%s] %s", ppath, printInboundPacket(pkt, "", nil))
+	if fw.inLockdown() {
+		log.Warningf("DENIED incoming connection attempt to %s: network locked down", ppath)
+		pkt.Drop()
+		return
+	}
+	policy := fw.PolicyForPathAndSandbox(ppath, pinfo.Sandbox)
+	policy.processInboundPacket(pkt, pinfo)
+}
+
+// processInboundPacket judges a connection from another host to the
+// application of p, as processPacket does those it opens.  Denied ones are
+// dropped, so the other host sees them time out rather than refused.
+// Connections accepted by an application are neither learned nor recorded
+// while auditing, and their verdict is not cached on them.
+func (p *Policy) processInboundPacket(pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info) {
+	up := p.fw.unitPolicy(pinfo)
+	var ap *Policy
+	if p.path != anyExePath {
+		ap = p.fw.anyExePolicy(p.sandbox)
+	}
+	pin := p.hashForPin(pinfo)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	peer, local := getPacketIPAddrs(pkt)
+	_, port := getPacketTCPPorts(pkt)
+	name := p.fw.dns.Lookup(peer, pinfo.Pid)
+	optstr := "[" + STR_INBOUND + "]"
+
+	result, rule := pin.match(RULE_DIRECTION_IN, up, p, ap, pkt, pinfo, local, peer, port, name, optstr)
+	result, rule, pinned := p.pinnedVerdict(pin, result, rule)
+	if !pinned {
+		optstr = pinMismatchOptString(optstr)
+	}
+	if rule != nil {
+		rule.hit(time.Now())
+	}
+	if p.auditing() {
+		pkt.Accept()
+		return
+	}
+	switch result {
+	case FILTER_DENY:
+		pkt.Drop()
+	case FILTER_ALLOW:
+		pkt.Accept()
+	case FILTER_PROMPT:
+		p.processPromptResult(&pendingPkt{pol: p, name: name, pkt: pkt, dir: RULE_DIRECTION_IN, pinfo: pinfo, optstring: optstr, prompting: false, queued: time.Now()})
+	default:
+		// TLS is only checked on connections made through the SOCKS proxy
+		log.Warningf("Unexpected filter result for an incoming connection: %d", result)
+		pkt.Drop()
+	}
+}
+
+func printInboundPacket(pkt *nfqueue.NFQPacket, hostname string, pinfo *procsnitch.Info) string {
+	peer, local := getPacketIPAddrs(pkt)
+	peerp, localp := getPacketTCPPorts(pkt)
+	if FirewallConfig.LogRedact {
+		hostname = STR_REDACTED
+	}
+	name := hostname
+	if name == "" {
+		name = peer.String()
+	}
+	if pinfo == nil {
+		return fmt.Sprintf("(TCP %s:%d <- %s:%d)", local, localp, name, peerp)
+	}
+	return fmt.Sprintf("%s TCP %s:%d <- %s:%d", pinfo.ExePath, local, localp, name, peerp)
+}
@@ -0,0 +1,103 @@
+package sgfw
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestInboundRules(t *testing.T) {
+	p := testPolicy(t, []string{
+		"ALLOW|192.0.2.9:*|SYSTEM|-1:-1||||||IN",
+		"DENY|*:22|SYSTEM|-1:-1||||||IN",
+		"ALLOW|*:80|SYSTEM|-1:-1||",
+	})
+	if s := p.rules[1].String(); s != "DENY|*:22|SYSTEM|-1:-1||||||IN" {
+		t.Errorf("inbound rule written as %q", s)
+	}
+	if s := p.rules[2].String(); strings.HasSuffix(s, "IN") {
+		t.Errorf("outbound rule written as %q", s)
+	}
+	rec := p.rules[1].record()
+	r := &Rule{policy: p}
+	if rec.Direction != "IN" || !r.parseRecord(rec) || r.direction != RULE_DIRECTION_IN {
+		t.Errorf("direction lost in the rule file: %+v", rec)
+	}
+	if p.rules[1].covers(&Rule{direction: RULE_DIRECTION_OUT, proto: "tcp", addr: net.ParseIP("192.0.2.1"), ports: p.rules[1].ports, uid: -1, gid: -1, pid: -1}) {
+		t.Errorf("inbound rule covers an outbound one")
+	}
+
+	local := net.ParseIP("192.0.2.2").To4()
+	pinfo := testPInfo()
+	tests := []struct {
+		dir    RuleDirection
+		remote string
+		port   uint16
+		want   FilterResult
+	}{
+		{RULE_DIRECTION_IN, "192.0.2.9", 22, FILTER_ALLOW},
+		{RULE_DIRECTION_IN, "198.51.100.7", 22, FILTER_DENY},
+		{RULE_DIRECTION_IN, "198.51.100.7", 80, FILTER_PROMPT},
+		{RULE_DIRECTION_OUT, "198.51.100.7", 22, FILTER_PROMPT},
+		{RULE_DIRECTION_OUT, "198.51.100.7", 80, FILTER_ALLOW},
+	}
+	for _, tt := range tests {
+		remote := net.ParseIP(tt.remote).To4()
+		pkt := testPacket(t, "tcp", local, remote, tt.port)
+		if tt.dir == RULE_DIRECTION_IN {
+			pkt = testPacket(t, "tcp", remote, local, tt.port)
+		}
+		if got, _ := matchPolicies(tt.dir, nil, p, nil, pkt, pinfo, local, remote, tt.port, "", ""); got != tt.want {
+			t.Errorf("%s connection with %s on port %d: got %s, want %s", RuleDirectionString[tt.dir], tt.remote, tt.port, FilterResultString[got], FilterResultString[tt.want])
+		}
+	}
+
+	// a prompt for a connection from another host shows the remote end
+	pp := &pendingPkt{pol: p, pkt: testPacket(t, "tcp", net.ParseIP("198.51.100.7").To4(), local, 22), dir: RULE_DIRECTION_IN, pinfo: pinfo}
+	if !pp.src().Equal(local) || pp.dst().String() != "198.51.100.7" || pp.dstPort() != 22 || pp.srcPort() != 22 {
+		t.Errorf("incoming connection prompted as %s:%d -> %s:%d", pp.src(), pp.srcPort(), pp.dst(), pp.dstPort())
+	}
+}
+
+func TestInboundQueueRules(t *testing.T) {
+	defer func(saved bool) { FirewallConfig.FilterInbound = saved }(FirewallConfig.FilterInbound)
+	for _, enabled := range []bool{false, true} {
+		FirewallConfig.FilterInbound = enabled
+		n := 0
+		for _, r := range nftRules() {
+			if r.chain == "input" && strings.HasPrefix(r.text, `iifname != "lo"`) {
+				n++
+			}
+		}
+		for _, r := range ipTablesRules() {
+			if r == inboundRule() {
+				n++
+			}
+		}
+		if want := map[bool]int{false: 0, true: 2}[enabled]; n != want {
+			t.Errorf("filter_inbound=%v: %d rules queueing incoming connections, want %d", enabled, n, want)
+		}
+	}
+}
+
+// Connections from other hosts have a queue of their own after the others,
+// which tells them apart from those opened by this host.
+func TestInboundQueue(t *testing.T) {
+	saved := FirewallConfig
+	defer func() { FirewallConfig = saved }()
+	FirewallConfig.FilterInbound = true
+	FirewallConfig.QueueNum = 10
+	FirewallConfig.QueueCount = 2
+	FirewallConfig.FailMode = FAIL_OPEN
+	if n := inboundQueueNum(); n != 12 {
+		t.Errorf("inbound queue is %d", n)
+	}
+	if r := inboundRule(); !strings.HasSuffix(r, "--queue-num 12 --queue-bypass") {
+		t.Errorf("inbound rule is %q", r)
+	}
+	for _, r := range nftRules() {
+		if strings.HasPrefix(r.text, `iifname != "lo"`) && !strings.HasSuffix(r.text, "queue num 12 bypass") {
+			t.Errorf("inbound nftables rule is %q", r.text)
+		}
+	}
+}
@@ -39,6 +39,14 @@ func addInitPid(pid int, name string, sboxid int) {
 	OzInitPids = append(OzInitPids, ozi)
 }
 
+// ozInitProcs returns a copy of OzInitPids, to be read without holding
+// OzInitPidsLock.
+func ozInitProcs() []OzInitProc {
+	OzInitPidsLock.Lock()
+	defer OzInitPidsLock.Unlock()
+	return append([]OzInitProc(nil), OzInitPids...)
+}
+
 func removeInitPid(pid int) {
 	fmt.Println("::::::::::: removing PID: ", pid)
 	OzInitPidsLock.Lock()
@@ -63,7 +71,10 @@ func addFWRule(fw *Firewall, whitelist bool, srchost, dsthost, dstport string) e
 	}
 
 	rulestr += "|" + dsthost + ":" + dstport + "|SESSION|" + srchost
-	_, err := policy.parseRule(rulestr, true)
+	r, err := policy.parseRule(rulestr, true)
+	if err == nil {
+		r.author = RULE_AUTHOR_OZ
+	}
 
 	return err
 }
@@ -137,11 +148,7 @@ func ReceiverLoop(fw *Firewall, c net.Conn) {
 					hostname = " (" + rl[r].hostname + ") "
 				}
 
-				portstr := strconv.Itoa(int(rl[r].port))
-
-				if rl[r].port == 0 {
-					portstr = "*"
-				}
+				portstr := rl[r].ports.String()
 
 				ruledesc := fmt.Sprintf("id %v, %v | %v, src:%v -> %v%v: %v\n", rl[r].id, RuleModeString[rl[r].mode], RuleActionString[rl[r].rtype], rl[r].saddr, rl[r].addr, hostname, portstr)
 				c.Write([]byte(ruledesc))
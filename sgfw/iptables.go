@@ -1,38 +1,230 @@
 package sgfw
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
 )
 
-const iptablesRule = "OUTPUT -t mangle -m conntrack --ctstate NEW -j NFQUEUE --queue-num 0 --queue-bypass"
-const dnsRule = "INPUT --protocol udp --sport 53 -j NFQUEUE --queue-num 0 --queue-bypass"
+const iptablesMatch = "OUTPUT -t mangle -m conntrack --ctstate NEW"
+const dnsMatch = "INPUT --protocol udp --sport 53"
+
+// The first packet of the TCP connections from other hosts, queued with
+// filter_inbound (see inbound.go)
+const inboundMatch = "INPUT -t mangle ! -i lo --protocol tcp --syn -m conntrack --ctstate NEW"
+
+func iptablesRule() string {
+	return iptablesMatch + " " + queueTarget(queueNum(), queueCount(), !failClosed())
+}
+
+func dnsRule() string {
+	return dnsMatch + " " + queueTarget(queueNum(), queueCount(), !failClosed())
+}
+
+func inboundRule() string {
+	return inboundMatch + " " + queueTarget(inboundQueueNum(), 1, !failClosed())
+}
+
+// queueTarget spreads packets over the n queues from first by flow when
+// there are several, so that the packets of a connection all go to the same
+// one.  With bypass, packets are let through while no one reads the queues.
+func queueTarget(first uint16, n int, bypass bool) string {
+	target := fmt.Sprintf("-j NFQUEUE --queue-num %d", first)
+	if n > 1 {
+		target = fmt.Sprintf("-j NFQUEUE --queue-balance %d:%d", first, int(first)+n-1)
+	}
+	if bypass {
+		target += " --queue-bypass"
+	}
+	return target
+}
 
 //const logRule = "OUTPUT --protocol tcp -m mark --mark 1 -j LOG"
-const blockRule = "OUTPUT --protocol tcp -m mark --mark 1 -j REJECT"
+
+// Denied packets of these protocols are accepted with mark 1 and rejected
+// by the rule for them, so that a TCP connection is reset and the sender of
+// a UDP datagram gets a port unreachable error at once.
+var blockRules = map[string]string{
+	"tcp": "OUTPUT --protocol tcp -m mark --mark 1 -j REJECT --reject-with tcp-reset",
+	"udp": "OUTPUT --protocol udp -m mark --mark 1 -j REJECT",
+}
+
+// The block rule of earlier versions, which answered TCP with an ICMP error
+const legacyBlockRule = "OUTPUT --protocol tcp -m mark --mark 1 -j REJECT"
+
+// The rules of earlier versions, which queued everything to queue 0 and
+// only installed them with iptables
+var legacyRules = []string{
+	iptablesMatch + " -j NFQUEUE --queue-num 0 --queue-bypass",
+	dnsMatch + " -j NFQUEUE --queue-num 0 --queue-bypass",
+	legacyBlockRule,
+}
+
+// The rules giving a connection the verdict cached on it, and saving the
+// verdict of a packet let through on its connection (see connmark.go).
+// Those in the mangle table are inserted after the queue rule, so that they
+// come before it.
+var cacheRules = []string{
+	fmt.Sprintf("OUTPUT -t mangle -m connmark --mark %#x/%#x -j ACCEPT", connmarkAllow, connmarkVerdict),
+	fmt.Sprintf("OUTPUT -t mangle -m connmark --mark %#x/%#x -j DROP", connmarkDeny, connmarkVerdict),
+	fmt.Sprintf("OUTPUT -m mark --mark %#x/%#x -j CONNMARK --save-mark", connmarkAllow, connmarkVerdict),
+}
+
+// rejectProtos holds the protocols whose block rule is installed for both
+// IPv4 and IPv6.  Denied packets of any other protocol are dropped.
+var rejectProtos = make(map[string]bool)
+
+// iptablesBackend installs the rules with the iptables and ip6tables
+// binaries.
+type iptablesBackend struct{}
+
+func (iptablesBackend) name() string {
+	return BACKEND_IPTABLES
+}
+
+func (iptablesBackend) setup() error {
+	setupIPTables()
+	return nil
+}
+
+// teardown removes the rules that setup installed, when failing open or
+// closed, as that may have changed since.
+func (iptablesBackend) teardown() error {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := removeIPTRules(bin, installedIPTRules()...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installedIPTRules returns every rule setup may have installed.
+func installedIPTRules() []string {
+	first, n := queueNum(), queueCount()
+	rules := append(ipTablesRules(), iptablesMatch+" "+queueTarget(first, n, failClosed()), dnsMatch+" "+queueTarget(first, n, failClosed()),
+		inboundRule(), inboundMatch+" "+queueTarget(inboundQueueNum(), 1, failClosed()))
+	return append(rules, cacheRules...)
+}
+
+func removeIPTRules(bin string, rules ...string) error {
+	for _, r := range rules {
+		for iptables(bin, 'C', r) {
+			log.Infof("Removing IPTables rule (%s): %s", bin, r)
+			if !iptables(bin, 'D', r) {
+				return fmt.Errorf("failed to remove %s rule %s", bin, r)
+			}
+		}
+	}
+	return nil
+}
+
+// removeLeftIPTRules removes the iptables rules left by this or an earlier
+// version once the nftables table is in place, as they would queue every
+// packet a second time.  Hosts without the iptables binaries have none.
+func removeLeftIPTRules() {
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if _, err := exec.LookPath(bin); err != nil {
+			continue
+		}
+		if err := removeIPTRules(bin, append(installedIPTRules(), legacyRules...)...); err != nil {
+			log.Warningf("Unable to remove the rules left by the iptables backend: %v", err)
+		}
+	}
+}
+
+// status lists the rules with those that are missing marked.
+func (iptablesBackend) status() (string, error) {
+	b := new(bytes.Buffer)
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		for _, r := range ipTablesRules() {
+			if !iptables(bin, 'C', r) {
+				fmt.Fprint(b, "(missing) ")
+			}
+			fmt.Fprintf(b, "%s -A %s\n", bin, r)
+		}
+	}
+	return b.String(), nil
+}
+
+func ipTablesRules() []string {
+	rules := []string{iptablesRule(), dnsRule(), blockRules["tcp"], blockRules["udp"]}
+	if filterInbound() {
+		rules = append(rules, inboundRule())
+	}
+	if cacheVerdicts() {
+		rules = append(rules, cacheRules...)
+	}
+	return rules
+}
 
 func setupIPTables() {
 	//	addIPTRules(iptablesRule, dnsRule, logRule, blockRule)
-	addIPTRules(iptablesRule, dnsRule, blockRule)
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		addIPTRules(bin, iptablesRule(), dnsRule())
+		if filterInbound() {
+			addIPTRules(bin, inboundRule())
+		}
+		if cacheVerdicts() {
+			addIPTRules(bin, cacheRules...)
+		}
+		if iptables(bin, 'C', legacyBlockRule) {
+			log.Infof("Removing IPTables rule (%s): %s", bin, legacyBlockRule)
+			iptables(bin, 'D', legacyBlockRule)
+		}
+	}
+	for proto, r := range blockRules {
+		rejectProtos[proto] = addIPTRules("iptables", r) && addIPTRules("ip6tables", r)
+		if !rejectProtos[proto] {
+			log.Warningf("Denied %s packets will be dropped, as the rule to reject them could not be installed", proto)
+		}
+	}
 }
 
-func addIPTRules(rules ...string) {
+// addIPTRules installs the rules that are missing, and reports whether all
+// of them are in place.
+func addIPTRules(bin string, rules ...string) bool {
+	ok := true
 	for _, r := range rules {
-		if iptables('C', r) {
-			log.Infof("IPTables rule already present: %s", r)
+		if iptables(bin, 'C', r) {
+			log.Infof("IPTables rule already present (%s): %s", bin, r)
 		} else {
-			log.Infof("Installing IPTables rule: %s", r)
-			iptables('I', r)
+			log.Infof("Installing IPTables rule (%s): %s", bin, r)
+			ok = iptables(bin, 'I', r) && ok
 		}
 	}
+	return ok
+}
+
+// packetVerdict is the part of a queued packet that takes its verdict.
+type packetVerdict interface {
+	SetMark(mark uint32)
+	Accept() error
+	Drop() error
+}
+
+// denyPacket keeps a packet from leaving the machine: it is handed to the
+// block rule of its protocol to be rejected, or dropped from the queue.
+func denyPacket(pkt *nfqueue.NFQPacket) {
+	deny(pkt, getNFQProto(pkt))
+}
+
+func deny(pkt packetVerdict, proto string) {
+	if rejectProtos[proto] {
+		pkt.SetMark(1)
+		pkt.Accept()
+		return
+	}
+	pkt.Drop()
 }
 
-func iptables(verb rune, rule string) bool {
-	iptablesPath, err := exec.LookPath("iptables")
+func iptables(bin string, verb rune, rule string) bool {
+	iptablesPath, err := exec.LookPath(bin)
 	if err != nil {
-		log.Warning("Could not find iptables binary in path")
+		log.Warningf("Could not find %s binary in path", bin)
 		os.Exit(1)
 	}
 	argLine := fmt.Sprintf("-%c %s", verb, rule)
@@ -41,7 +233,7 @@ func iptables(verb rune, rule string) bool {
 	_, err = cmd.CombinedOutput()
 	_, exitErr := err.(*exec.ExitError)
 	if err != nil && !exitErr {
-		log.Warningf("Error running iptables: %v", err)
+		log.Warningf("Error running %s: %v", bin, err)
 	}
 	return !exitErr
 }
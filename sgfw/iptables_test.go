@@ -0,0 +1,318 @@
+package sgfw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+type testVerdict struct {
+	mark     uint32
+	accepted bool
+	dropped  bool
+}
+
+func (v *testVerdict) SetMark(mark uint32) { v.mark = mark }
+func (v *testVerdict) Accept() error       { v.accepted = true; return nil }
+func (v *testVerdict) Drop() error         { v.dropped = true; return nil }
+
+func TestDenyVerdict(t *testing.T) {
+	defer func(saved map[string]bool) { rejectProtos = saved }(rejectProtos)
+
+	rejectProtos = map[string]bool{"tcp": true, "udp": true}
+	for _, proto := range []string{"tcp", "udp", "icmp", "[unknown]"} {
+		v := &testVerdict{}
+		deny(v, proto)
+		if rejected := rejectProtos[proto]; v.dropped == rejected || v.accepted != rejected || (rejected && v.mark != 1) {
+			t.Errorf("denied %s packet given %+v", proto, v)
+		}
+	}
+	// without their block rules, the mark would let them through
+	rejectProtos = make(map[string]bool)
+	for _, proto := range []string{"tcp", "udp"} {
+		v := &testVerdict{}
+		deny(v, proto)
+		if !v.dropped || v.accepted {
+			t.Errorf("denied %s packet given %+v without block rules", proto, v)
+		}
+	}
+}
+
+// inNetNS runs fn on a thread of its own in a new network namespace, with
+// only its loopback interface up, so that rules can be installed there
+// without touching those of the host.  The test is skipped if that is not
+// possible, or if fn returns why it is not.
+func inNetNS(t *testing.T, fn func() string) {
+	if os.Geteuid() != 0 {
+		t.Skip("a network namespace needs root")
+	}
+	done := make(chan string)
+	go func() {
+		// the thread is left locked, so that it exits with the goroutine
+		// instead of being used again outside of the namespace
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			done <- fmt.Sprintf("unable to create a network namespace: %v", err)
+			return
+		}
+		if err := loopbackUp(); err != nil {
+			done <- fmt.Sprintf("unable to bring up the loopback interface: %v", err)
+			return
+		}
+		done <- fn()
+	}()
+	if msg := <-done; msg != "" {
+		t.Skip(msg)
+	}
+}
+
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	ifr.flags = syscall.IFF_UP | syscall.IFF_LOOPBACK | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// markedDialer dials from sockets marked as the verdict of deny marks the
+// packets it lets through.
+func markedDialer(mark uint32) *net.Dialer {
+	return &net.Dialer{
+		Timeout: time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+}
+
+// The block rules installed with nftables stop the packets deny lets
+// through with a mark.  The connections are made over the loopback interface
+// of a network namespace of their own, with only the chains and the block
+// rules of the sgfw table, so that nothing else decides them.
+func TestDeniedPacketsDoNotEgress(t *testing.T) {
+	defer func(saved map[string]bool) { rejectProtos = saved }(rejectProtos)
+	rejectProtos = map[string]bool{"tcp": true, "udp": true}
+	var block []nftRule
+	for _, r := range nftRules() {
+		if strings.HasPrefix(r.text, "meta mark 1 ") {
+			block = append(block, r)
+		}
+	}
+	if len(block) != 2 {
+		t.Fatalf("block rules: %v", block)
+	}
+
+	inNetNS(t, func() string {
+		if err := (nftablesBackend{}).apply(nftSetupMessages(nftChains, block)); err != nil {
+			return fmt.Sprintf("unable to install the nftables rules: %v", err)
+		}
+		for _, proto := range []string{"tcp", "udp"} {
+			v := &testVerdict{}
+			deny(v, proto)
+			for _, mark := range []uint32{0, v.mark} {
+				got, err := loopbackEgress(proto, markedDialer(mark))
+				if err != nil {
+					t.Error(err)
+				} else if want := mark == 0; got != want {
+					t.Errorf("%s packet with mark %d delivered: %v, want %v", proto, mark, got, want)
+				}
+			}
+		}
+		return ""
+	})
+}
+
+// loopbackEgress reports whether a TCP connection or a UDP datagram, made
+// with d, reaches a listener on the loopback interface.
+func loopbackEgress(proto string, d *net.Dialer) (bool, error) {
+	if proto == "tcp" {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return false, err
+		}
+		defer ln.Close()
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return false, nil
+		}
+		conn.Close()
+		return true, nil
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return false, err
+	}
+	defer pc.Close()
+	conn, err := d.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("denied")); err != nil {
+		return false, nil
+	}
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = pc.ReadFrom(make([]byte, 16))
+	return err == nil, nil
+}
+
+// The iptables and ip6tables binaries of fakeIPTables keep their rules, one
+// per line, in a file next to them.
+const fakeIPTablesScript = `#!/bin/sh
+f="$0.rules"
+touch "$f"
+verb=$1
+shift
+case $verb in
+-C) grep -Fxq -- "$*" "$f" ;;
+-I) echo "$*" >> "$f" ;;
+-D) grep -Fxq -- "$*" "$f" || exit 1
+    grep -Fxv -- "$*" "$f" > "$f.new"
+    mv "$f.new" "$f" ;;
+*) exit 2 ;;
+esac
+`
+
+// fakeIPTables puts iptables and ip6tables binaries that only keep a list
+// of rules first in the PATH, and returns a function listing the rules one
+// of them holds.  The returned cleanup function restores the PATH.
+func fakeIPTables(t *testing.T) (func(bin string) []string, func()) {
+	dir, err := ioutil.TempDir("", "sgfw-iptables")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, bin), []byte(fakeIPTablesScript), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	list := func(bin string) []string {
+		data, err := ioutil.ReadFile(filepath.Join(dir, bin+".rules"))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		rules := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if rules[0] == "" {
+			return nil
+		}
+		sort.Strings(rules)
+		return rules
+	}
+	return list, func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestIPTablesSetup(t *testing.T) {
+	list, cleanup := fakeIPTables(t)
+	defer cleanup()
+	defer func(saved map[string]bool) { rejectProtos = saved }(rejectProtos)
+	rejectProtos = make(map[string]bool)
+
+	b := iptablesBackend{}
+	b.setup()
+	want := ipTablesRules()
+	sort.Strings(want)
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if got := list(bin); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s rules installed:\n%s\nwant:\n%s", bin, strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+	if !rejectProtos["tcp"] || !rejectProtos["udp"] {
+		t.Errorf("block rules not recorded as installed: %v", rejectProtos)
+	}
+
+	// setting up again installs nothing twice
+	b.setup()
+	if n := len(list("ip6tables")); n != len(want) {
+		t.Errorf("%d ip6tables rules after setting up twice, want %d", n, len(want))
+	}
+	if err := b.teardown(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if got := list(bin); len(got) != 0 {
+			t.Errorf("%s rules left after teardown: %q", bin, got)
+		}
+	}
+}
+
+// The iptables rules left by this or an earlier version are removed when
+// the nftables backend takes over.
+func TestRemoveLeftIPTRules(t *testing.T) {
+	list, cleanup := fakeIPTables(t)
+	defer cleanup()
+	defer func(saved map[string]bool) { rejectProtos = saved }(rejectProtos)
+	rejectProtos = make(map[string]bool)
+
+	(iptablesBackend{}).setup()
+	for _, r := range legacyRules {
+		addIPTRules("iptables", r)
+	}
+	if len(list("iptables")) == 0 || len(list("ip6tables")) == 0 {
+		t.Fatal("no rules installed")
+	}
+	removeLeftIPTRules()
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		if got := list(bin); len(got) != 0 {
+			t.Errorf("%s rules left: %q", bin, got)
+		}
+	}
+
+	// without the binaries there is nothing to remove
+	os.Setenv("PATH", "/nonexistent")
+	removeLeftIPTRules()
+}
+
+// The watchdog only sets the rules up again once some are missing.
+func TestRulesInstalled(t *testing.T) {
+	_, cleanup := fakeIPTables(t)
+	defer cleanup()
+	defer func(saved map[string]bool) { rejectProtos = saved }(rejectProtos)
+	rejectProtos = make(map[string]bool)
+
+	b := iptablesBackend{}
+	if rulesInstalled(b) {
+		t.Fatal("rules reported installed before setup")
+	}
+	b.setup()
+	if !rulesInstalled(b) {
+		t.Fatal("rules reported missing after setup")
+	}
+	if !iptables("ip6tables", 'D', dnsRule()) {
+		t.Fatal("rule not removed")
+	}
+	if rulesInstalled(b) {
+		t.Error("rules reported installed with one removed")
+	}
+}
@@ -0,0 +1,418 @@
+package sgfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+)
+
+// The candidate rules found while learning are kept here until they are
+// reviewed, along with when learning ends.
+const learnFile = "/var/lib/sgfw/learned.json"
+
+const (
+	minLearningDuration = time.Minute
+	maxLearningDuration = 7 * 24 * time.Hour
+)
+
+// Once there are this many candidates, connections of new targets are still
+// let through while learning but no longer recorded, until some of the
+// candidates have been reviewed
+const maxCandidates = 5000
+
+// A candidate lists up to this many ports, beyond which it takes the range
+// from the lowest to the highest
+const maxCandidatePorts = 10
+
+type candidateKey struct {
+	Sandbox string `json:"sandbox"`
+	Path    string `json:"path"`
+	// the target of the rule, with the protocol if it is not TCP
+	Target string `json:"target"`
+}
+
+// candidate is an ALLOW rule for connections that would have been prompted
+// for while learning.  Its target is generalized from the connections: to
+// every name of a domain once several are seen (*.example.com), and to the
+// ports seen, or the range of them once there are many.
+type candidate struct {
+	ID string `json:"id"`
+	candidateKey
+	Count uint32    `json:"count"`
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+
+	Proto string `json:"proto"`
+	// the hostname pattern or address of the target
+	Host  string   `json:"host"`
+	Ports []uint16 `json:"ports"`
+	// set once Ports holds the ends of a range
+	PortRange bool `json:"port_range,omitempty"`
+}
+
+// learner collects candidate rules while learning mode lasts.  The zero
+// value is ready to use, with learning turned off.
+type learner struct {
+	lock       sync.Mutex
+	until      time.Time
+	candidates map[candidateKey]*candidate
+	dirty      bool
+}
+
+type learnData struct {
+	Until      *time.Time  `json:"until,omitempty"`
+	Candidates []candidate `json:"candidates"`
+}
+
+func (l *learner) active(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return now.Before(l.until)
+}
+
+func (l *learner) learningUntil() time.Time {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.until
+}
+
+func (l *learner) start(d time.Duration) error {
+	if d < minLearningDuration || d > maxLearningDuration {
+		return fmt.Errorf("learning must last between %v and %v", minLearningDuration, maxLearningDuration)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.until = time.Now().Add(d)
+	l.dirty = true
+	log.Noticef("Learning until %s: connections are allowed instead of prompted for", l.until.Format(time.RFC3339))
+	return nil
+}
+
+func (l *learner) stop() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.until.IsZero() {
+		log.Noticef("Learning stopped, %d candidate rules to review", len(l.candidates))
+	}
+	l.until = time.Time{}
+	l.dirty = true
+}
+
+// expire turns learning off once its time is up, and reports whether it
+// just did.
+func (l *learner) expire(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.until.IsZero() || now.Before(l.until) {
+		return false
+	}
+	log.Noticef("Learning finished, %d candidate rules to review", len(l.candidates))
+	l.until = time.Time{}
+	l.dirty = true
+	return true
+}
+
+// candidateHost returns the host of the target of a connection: the
+// hostname if there is one, otherwise the address.
+func candidateHost(hostname string, ip net.IP) string {
+	if hostname != "" {
+		return normalizeHostname(hostname)
+	}
+	if ip.To4() == nil {
+		return "[" + ip.String() + "]"
+	}
+	return ip.String()
+}
+
+// parentDomain returns the domain a hostname is directly below, if it has a
+// dot in it, so that names are not generalized to a whole top level domain.
+func parentDomain(host string) (string, bool) {
+	if strings.HasPrefix(host, "[") || net.ParseIP(host) != nil {
+		return "", false
+	}
+	i := strings.Index(host, ".")
+	if i < 0 || !strings.Contains(host[i+1:], ".") {
+		return "", false
+	}
+	return host[i+1:], true
+}
+
+// covers reports whether the target of c takes connections to host.
+func (c *candidate) covers(host string) bool {
+	if c.Host == host {
+		return true
+	}
+	parent, ok := parentDomain(host)
+	return ok && c.Host == "*."+parent
+}
+
+// sibling reports whether host is another name of the domain of c.
+func (c *candidate) sibling(host string) bool {
+	p1, ok1 := parentDomain(c.Host)
+	p2, ok2 := parentDomain(host)
+	return ok1 && ok2 && p1 == p2
+}
+
+// addPort adds a port to the target of c.
+func (c *candidate) addPort(port uint16) {
+	if c.PortRange {
+		if port < c.Ports[0] {
+			c.Ports[0] = port
+		} else if port > c.Ports[1] {
+			c.Ports[1] = port
+		}
+		return
+	}
+	i := sort.Search(len(c.Ports), func(i int) bool { return c.Ports[i] >= port })
+	if i < len(c.Ports) && c.Ports[i] == port {
+		return
+	}
+	c.Ports = append(c.Ports, 0)
+	copy(c.Ports[i+1:], c.Ports[i:])
+	c.Ports[i] = port
+	if len(c.Ports) > maxCandidatePorts {
+		c.Ports = []uint16{c.Ports[0], c.Ports[len(c.Ports)-1]}
+		c.PortRange = true
+	}
+}
+
+// target returns the target of the rule c stands for, with the protocol if
+// it is not TCP.
+func (c *candidate) target() string {
+	ports := make([]string, len(c.Ports))
+	for i, p := range c.Ports {
+		ports[i] = strconv.Itoa(int(p))
+	}
+	sep := ","
+	if c.PortRange {
+		sep = "-"
+	}
+	target := c.Host + ":" + strings.Join(ports, sep)
+	if c.Proto != "tcp" {
+		target = c.Proto + ":" + target
+	}
+	return target
+}
+
+// learn records a connection of the policy that nothing matched, in the
+// candidate whose target covers it, or in one merging those of the other
+// names of its domain, or else in a new one.
+func (p *Policy) learn(proto, hostname string, ip net.IP, port uint16, now time.Time) {
+	host := candidateHost(hostname, ip)
+	l := &p.fw.learner
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.candidates == nil {
+		l.candidates = make(map[candidateKey]*candidate)
+	}
+	var c *candidate
+	var siblings []*candidate
+	for _, e := range l.candidates {
+		if e.Sandbox != p.sandbox || e.Path != p.path || e.Proto != proto {
+			continue
+		}
+		if e.covers(host) {
+			c = e
+			break
+		} else if e.sibling(host) {
+			siblings = append(siblings, e)
+		}
+	}
+	if c == nil && len(siblings) > 0 {
+		// the first of them becomes the candidate for the whole domain
+		c = siblings[0]
+		parent, _ := parentDomain(host)
+		c.Host = "*." + parent
+		for _, s := range siblings[1:] {
+			delete(l.candidates, s.candidateKey)
+			c.Count += s.Count
+			if s.First.Before(c.First) {
+				c.First = s.First
+			}
+			if s.Last.After(c.Last) {
+				c.Last = s.Last
+			}
+			for _, sp := range s.Ports {
+				c.addPort(sp)
+			}
+		}
+	}
+	if c == nil {
+		if len(l.candidates) >= maxCandidates {
+			log.Warningf("Too many candidate rules, %s connection by %s -> %s:%d not learned", proto, p.path, host, port)
+			return
+		}
+		c = &candidate{ID: newRuleUUID(), First: now, Proto: proto, Host: host}
+		c.Sandbox, c.Path = p.sandbox, p.path
+	}
+	delete(l.candidates, c.candidateKey)
+	c.addPort(port)
+	if target := c.target(); target != c.Target {
+		c.Target = target
+		log.Infof("Learned candidate rule for %s: ALLOW %s", p.path, target)
+	}
+	l.candidates[c.candidateKey] = c
+	c.Count++
+	c.Last = now
+	l.dirty = true
+}
+
+// learnPacket accepts a packet that would have been prompted for, and
+// records it as a candidate.  It must be called with p.lock held.
+func (p *Policy) learnPacket(pkt *nfqueue.NFQPacket, hostname string) {
+	dstip := net.IP(pkt.Packet.NetworkLayer().NetworkFlow().Dst().Raw())
+	_, dstp := getPacketPorts(pkt)
+	p.learn(getNFQProto(pkt), hostname, dstip, dstp, time.Now())
+	pkt.Accept()
+}
+
+// list returns the candidates by application and target.
+func (l *learner) list() []candidate {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	cs := make([]candidate, 0, len(l.candidates))
+	for _, c := range l.candidates {
+		cs = append(cs, *c)
+	}
+	sort.Sort(byCandidateOrder(cs))
+	return cs
+}
+
+type byCandidateOrder []candidate
+
+func (s byCandidateOrder) Len() int      { return len(s) }
+func (s byCandidateOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byCandidateOrder) Less(i, j int) bool {
+	if s[i].Path != s[j].Path {
+		return s[i].Path < s[j].Path
+	}
+	if s[i].Sandbox != s[j].Sandbox {
+		return s[i].Sandbox < s[j].Sandbox
+	}
+	return s[i].Target < s[j].Target
+}
+
+// take removes the candidates with the given ids and returns them.
+func (l *learner) take(ids []string) []candidate {
+	want := make(map[string]bool)
+	for _, id := range ids {
+		want[id] = true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	var taken []candidate
+	for key, c := range l.candidates {
+		if want[c.ID] {
+			taken = append(taken, *c)
+			delete(l.candidates, key)
+			l.dirty = true
+		}
+	}
+	sort.Sort(byCandidateOrder(taken))
+	return taken
+}
+
+// reviewCandidates turns the accepted candidates into permanent rules, and
+// drops the rejected ones.  It returns the number of rules added; accepted
+// candidates that an existing rule already covers add nothing.
+func (fw *Firewall) reviewCandidates(accept, reject []string) int {
+	rejected := fw.learner.take(reject)
+	added := 0
+	for _, c := range fw.learner.take(accept) {
+		p := fw.PolicyForPathAndSandbox(c.Path, c.Sandbox)
+		r, err := p.parseRule(fmt.Sprintf("ALLOW|%s|PERMANENT|-1:-1|%s", c.Target, c.Sandbox), false)
+		if err != nil {
+			log.Warningf("Unable to add learned rule for %s: %v", c.Path, err)
+			continue
+		}
+		r.author = RULE_AUTHOR_LEARNING
+		r.comment = fmt.Sprintf("Learned from %d connections between %s and %s", c.Count,
+			c.First.Format("Jan 2 15:04"), c.Last.Format("Jan 2 15:04"))
+
+		p.lock.Lock()
+		duplicate := false
+		for _, e := range p.rules {
+			if e.mode != RULE_MODE_PROCESS && e.matchKey() == r.matchKey() {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			p.rules = append(p.rules, r)
+			p.rulesChanged()
+			added++
+		}
+		p.lock.Unlock()
+	}
+	if added > 0 {
+		fw.saveRules()
+	}
+	log.Noticef("Reviewed candidate rules: %d rules added, %d candidates rejected", added, len(rejected))
+	return added
+}
+
+func (l *learner) load(fname string) error {
+	bs, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var data learnData
+	if err := json.Unmarshal(bs, &data); err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.until = time.Time{}
+	if data.Until != nil {
+		l.until = *data.Until
+	}
+	l.candidates = make(map[candidateKey]*candidate)
+	for i := range data.Candidates {
+		l.candidates[data.Candidates[i].candidateKey] = &data.Candidates[i]
+	}
+	return nil
+}
+
+// save writes the candidates to fname if they changed since they were last
+// saved.
+func (l *learner) save(fname string) error {
+	l.lock.Lock()
+	dirty := l.dirty
+	l.dirty = false
+	data := learnData{}
+	if !l.until.IsZero() {
+		t := l.until.UTC()
+		data.Until = &t
+	}
+	l.lock.Unlock()
+	if !dirty {
+		return nil
+	}
+	data.Candidates = l.list()
+	bs, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeRuleFile(fname, "", append(bs, '\n'))
+}
+
+func (fw *Firewall) saveLearned() {
+	if err := fw.learner.save(learnFile); err != nil {
+		log.Warningf("Failed to save the candidate rules: %v", err)
+	}
+}
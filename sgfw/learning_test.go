@@ -0,0 +1,150 @@
+package sgfw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLearnCandidates(t *testing.T) {
+	fw := testFirewall()
+	fw.rulesUnreadable = true // keep reviewCandidates from saving
+	curl := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	wget := fw.policyForPathAndSandbox("/usr/bin/wget", "oz")
+	processRuleLine(curl, "ALLOW|www.example.com:443|PERMANENT|-1:-1|")
+	now := time.Now()
+
+	if fw.learner.active(now) {
+		t.Fatal("learning is on by default")
+	}
+	if err := fw.learner.start(maxLearningDuration + time.Hour); err == nil {
+		t.Error("learning for longer than allowed")
+	}
+	if err := fw.learner.start(30 * time.Second); err == nil {
+		t.Error("learning for less than a minute")
+	}
+	if err := fw.learner.start(time.Hour); err != nil || !fw.learner.active(now) {
+		t.Fatalf("learning not started: %v", err)
+	}
+
+	ip := net.IP{203, 0, 113, 1}
+	for i := 0; i < 3; i++ {
+		curl.learn("tcp", "api.example.org", ip, 443, now)
+	}
+	curl.learn("tcp", "www.example.com", ip, 443, now)
+	curl.learn("udp", "", ip, 53, now)
+	wget.learn("tcp", "", net.ParseIP("2001:db8::1"), 80, now)
+
+	want := []string{
+		"/usr/bin/curl api.example.org:443 3",
+		"/usr/bin/curl udp:203.0.113.1:53 1",
+		"/usr/bin/curl www.example.com:443 1",
+		"/usr/bin/wget [2001:db8::1]:80 1",
+	}
+	check := func(cs []candidate, want []string) {
+		if len(cs) != len(want) {
+			t.Fatalf("got %d candidates, want %d: %v", len(cs), len(want), cs)
+		}
+		for i, c := range cs {
+			if got := fmt.Sprintf("%s %s %d", c.Path, c.Target, c.Count); got != want[i] {
+				t.Errorf("candidate %d: got %q, want %q", i, got, want[i])
+			}
+		}
+	}
+	cs := fw.learner.list()
+	check(cs, want)
+
+	tmp, err := ioutil.TempDir("", "sgfw-learn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fname := filepath.Join(tmp, "learned.json")
+	if err := fw.learner.save(fname); err != nil {
+		t.Fatal(err)
+	}
+	var loaded learner
+	if err := loaded.load(fname); err != nil {
+		t.Fatal(err)
+	}
+	check(loaded.list(), want)
+	if !loaded.active(now) {
+		t.Error("end of learning not kept")
+	}
+
+	// candidates only become rules once accepted, and covered ones add nothing
+	if len(curl.rules) != 1 || len(wget.rules) != 0 {
+		t.Fatalf("rules added before review: %d, %d", len(curl.rules), len(wget.rules))
+	}
+	added := fw.reviewCandidates([]string{cs[0].ID, cs[2].ID, cs[3].ID}, []string{cs[1].ID, "unknown"})
+	if added != 2 {
+		t.Errorf("%d rules added, want 2", added)
+	}
+	if len(curl.rules) != 2 || curl.rules[1].String() != "ALLOW|api.example.org:443|PERMANENT|-1:-1|" || curl.rules[1].author != RULE_AUTHOR_LEARNING {
+		t.Errorf("wrong rules for curl: %v", curl.rules)
+	}
+	if len(wget.rules) != 1 || wget.rules[0].sandbox != "oz" || !wget.rules[0].addr.Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("wrong rules for wget: %v", wget.rules)
+	}
+	check(fw.learner.list(), nil)
+
+	if !fw.learner.expire(now.Add(2*time.Hour)) || fw.learner.active(now) {
+		t.Error("learning did not end on time")
+	}
+}
+
+// Connections to several names of a domain, or to several ports of a host,
+// are learned as one candidate.
+func TestLearnGeneralizes(t *testing.T) {
+	fw := testFirewall()
+	curl := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	wget := fw.policyForPathAndSandbox("/usr/bin/wget", "")
+	now := time.Now()
+	ip := net.IP{203, 0, 113, 1}
+
+	curl.learn("tcp", "www.example.com", ip, 443, now)
+	curl.learn("tcp", "static.example.com", ip, 443, now.Add(time.Minute))
+	curl.learn("tcp", "img.example.com", ip, 80, now)
+	curl.learn("tcp", "example.com", ip, 443, now)
+	curl.learn("tcp", "www.example.net", ip, 443, now)
+	curl.learn("udp", "www.example.net", ip, 443, now)
+	wget.learn("tcp", "mirror.example.com", ip, 443, now)
+	for port := uint16(6881); port < 6900; port++ {
+		curl.learn("udp", "", ip, port, now)
+	}
+	curl.learn("udp", "", ip, 1024, now)
+
+	var got []string
+	for _, c := range fw.learner.list() {
+		got = append(got, fmt.Sprintf("%s %s %d", c.Path, c.Target, c.Count))
+	}
+	want := []string{
+		"/usr/bin/curl *.example.com:80,443 3",
+		"/usr/bin/curl example.com:443 1",
+		"/usr/bin/curl udp:203.0.113.1:1024-6899 20",
+		"/usr/bin/curl udp:www.example.net:443 1",
+		"/usr/bin/curl www.example.net:443 1",
+		"/usr/bin/wget mirror.example.com:443 1",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got candidates\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// the generalized candidates are valid rules
+	cs := fw.learner.list()
+	fw.rulesUnreadable = true // keep reviewCandidates from saving
+	if added := fw.reviewCandidates([]string{cs[0].ID, cs[2].ID}, nil); added != 2 {
+		t.Fatalf("%d rules added, want 2", added)
+	}
+	if r := curl.rules[0]; !r.matchHostname("cdn.example.com") || !r.ports.matches(80) || r.ports.matches(8080) {
+		t.Errorf("rule for the domain is %s", r)
+	}
+	if r := curl.rules[1]; !r.ports.matches(5000) || r.ports.matches(7000) {
+		t.Errorf("rule for the range is %s", r)
+	}
+}
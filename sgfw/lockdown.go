@@ -0,0 +1,160 @@
+package sgfw
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+// The network is locked down for as long as this file exists, so that the
+// lockdown survives a restart of the daemon until it is lifted.
+const lockdownFile = "/var/lib/sgfw/lockdown"
+
+// The allowlist entry for every connection made through the SOCKS proxy
+const lockdownSocks = "socks"
+
+// lockdownEntry is a connection allowed during lockdown: that of an
+// executable, to a target, or through the SOCKS proxy.  Whatever is set
+// must all match.
+type lockdownEntry struct {
+	socks  bool
+	path   string
+	target *Rule
+}
+
+// parseLockdownEntry parses an allowlist entry, which holds an absolute
+// executable path, a rule target such as "udp:vpn.example.com:1194", the
+// word "socks", or several of these separated by spaces.
+func parseLockdownEntry(s string) (*lockdownEntry, error) {
+	e := &lockdownEntry{}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty lockdown allowlist entry")
+	}
+	for _, f := range fields {
+		switch {
+		case f == lockdownSocks && !e.socks:
+			e.socks = true
+		case filepath.IsAbs(f) && e.path == "":
+			e.path = f
+		case e.target == nil:
+			r := &Rule{}
+			if !r.parseTarget(f) {
+				return nil, fmt.Errorf("invalid target %s in lockdown allowlist entry %q", f, s)
+			}
+			e.target = r
+		default:
+			return nil, fmt.Errorf("invalid lockdown allowlist entry %q", s)
+		}
+	}
+	return e, nil
+}
+
+func (e *lockdownEntry) allows(socks bool, path, proto string, src, dst net.IP, port uint16, hostname string) bool {
+	if e.socks && !socks {
+		return false
+	}
+	if e.path != "" && e.path != path {
+		return false
+	}
+	if e.target != nil {
+		return e.target.proto == proto && e.target.matchTarget(src, dst, port, hostname)
+	}
+	return true
+}
+
+// compileLockdownAllow parses the allowlist of the configuration, skipping
+// invalid entries.
+func compileLockdownAllow(entries []string) []*lockdownEntry {
+	var allow []*lockdownEntry
+	for _, s := range entries {
+		e, err := parseLockdownEntry(s)
+		if err != nil {
+			log.Warning(err.Error())
+			continue
+		}
+		allow = append(allow, e)
+	}
+	return allow
+}
+
+func (fw *Firewall) inLockdown() bool {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return fw.lockdown
+}
+
+// setLockdown locks the network down or lifts the lockdown, and records it
+// so that it is restored when the daemon starts.
+func (fw *Firewall) setLockdown(flag bool) error {
+	var err error
+	if flag {
+		data := time.Now().UTC().Format(time.RFC3339) + "\n"
+		if err = maybeCreateDir(filepath.Dir(lockdownFile)); err == nil {
+			err = writeRuleFile(lockdownFile, "", []byte(data))
+		}
+	} else if err = os.Remove(lockdownFile); os.IsNotExist(err) {
+		err = nil
+	}
+
+	fw.lock.Lock()
+	changed := fw.lockdown != flag
+	fw.lockdown = flag
+	fw.lock.Unlock()
+	if changed && flag {
+		log.Warningf("Network locked down, only %d allowlisted kinds of connection are let through", len(fw.lockdownAllow))
+		fw.dropPending(time.Now(), true, "network locked down")
+		// the connections that rules let through have to be allowlisted
+		forgetAllVerdicts()
+	} else if changed {
+		log.Notice("Network lockdown lifted")
+		// the rules may have changed during lockdown
+		fw.enforceLater()
+	}
+	return err
+}
+
+// loadLockdown restores a lockdown that was not lifted before the daemon
+// stopped.
+func (fw *Firewall) loadLockdown() {
+	if _, err := os.Stat(lockdownFile); err == nil {
+		fw.lockdown = true
+		log.Warning("Network is still locked down")
+	}
+}
+
+// lockdownAllows reports whether a connection is let through during
+// lockdown.  It does not need fw.lock, as the allowlist never changes.
+func (fw *Firewall) lockdownAllows(socks bool, path, proto string, src, dst net.IP, port uint16, hostname string) bool {
+	for _, e := range fw.lockdownAllow {
+		if e.allows(socks, path, proto, src, dst, port, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockdownPacket accepts or denies a packet during lockdown, without any
+// prompt, rule, learning or audit getting a say.
+func (fw *Firewall) lockdownPacket(pkt *nfqueue.NFQPacket, path string, pinfo *procsnitch.Info) {
+	srcip, dstip := getPacketIPAddrs(pkt)
+	_, dstp := getPacketPorts(pkt)
+	proto := getNFQProto(pkt)
+	name := fw.dns.Lookup(dstip, pinfo.Pid)
+	if fw.lockdownAllows(false, path, proto, srcip, dstip, dstp, name) {
+		pkt.Accept()
+		return
+	}
+	dst := STR_REDACTED
+	if !FirewallConfig.LogRedact {
+		dst = auditTarget(name, dstip, dstp)
+	}
+	log.Warningf("DENIED outgoing %s connection attempt by %s -> %s: network locked down", proto, path, dst)
+	denyPacket(pkt)
+}
@@ -0,0 +1,50 @@
+package sgfw
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLockdownAllow(t *testing.T) {
+	for _, s := range []string{"", "tor", "socks socks", "/usr/bin/tor /usr/bin/tor", "*:443 *:80"} {
+		if _, err := parseLockdownEntry(s); err == nil {
+			t.Errorf("invalid entry %q accepted", s)
+		}
+	}
+
+	fw := testFirewall()
+	fw.lockdownAllow = compileLockdownAllow([]string{
+		"/usr/bin/tor",
+		"udp:vpn.example.com:1194",
+		"/usr/sbin/openvpn 198.51.100.0/24:443",
+		"socks *:443",
+		"bad:entry",
+	})
+	if len(fw.lockdownAllow) != 4 {
+		t.Fatalf("%d allowlist entries, want 4", len(fw.lockdownAllow))
+	}
+
+	ip := net.IP{198, 51, 100, 7}
+	tests := []struct {
+		socks    bool
+		path     string
+		proto    string
+		port     uint16
+		hostname string
+		want     bool
+	}{
+		{false, "/usr/bin/tor", "tcp", 9001, "", true},
+		{false, "/usr/bin/curl", "udp", 1194, "vpn.example.com", true},
+		{false, "/usr/bin/curl", "tcp", 1194, "vpn.example.com", false},
+		{false, "/usr/bin/curl", "udp", 1194, "www.example.com", false},
+		{false, "/usr/sbin/openvpn", "tcp", 443, "", true},
+		{false, "/usr/bin/curl", "tcp", 443, "", false},
+		{true, "/usr/bin/curl", "tcp", 443, "www.example.com", true},
+		{true, "/usr/bin/curl", "tcp", 80, "www.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := fw.lockdownAllows(tt.socks, tt.path, tt.proto, nil, ip, tt.port, tt.hostname); got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,623 @@
+package sgfw
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The table holding every rule the daemon installs with nftables.  It is
+// deleted on exit, which removes them all at once.
+const nftTable = "sgfw"
+
+// Netlink constants of nf_tables, from linux/netfilter/nf_tables.h and
+// linux/netfilter/nfnetlink.h
+const (
+	nfnlSubsysNFTables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+	nfprotoInet        = 1
+
+	nftMsgNewTable = 0
+	nftMsgDelTable = 2
+	nftMsgNewChain = 3
+	nftMsgGetChain = 4
+	nftMsgNewRule  = 6
+	nftMsgGetRule  = 7
+
+	nftaTableName    = 1
+	nftaChainTable   = 1
+	nftaChainName    = 3
+	nftaChainHook    = 4
+	nftaChainType    = 7
+	nftaHookHooknum  = 1
+	nftaHookPriority = 2
+	nftaRuleTable    = 1
+	nftaRuleChain    = 2
+	nftaRuleHandle   = 3
+	nftaRuleExprs    = 4
+	nftaRuleUserdata = 7
+	nftaListElem     = 1
+	nftaExprName     = 1
+	nftaExprData     = 2
+	nftaDataValue    = 1
+
+	nftRegister = 1 // NFT_REG_1
+	nftCmpEq    = 0
+	nftCmpNeq   = 1
+
+	nftMetaMark    = 3
+	nftMetaIifname = 6
+	nftMetaL4Proto = 16
+	nftCtState     = 0
+	nftCtStateNew  = 1 << 3
+	nftCtMark      = 3
+
+	nftRegVerdict  = 0 // NFT_REG_VERDICT
+	nftDataVerdict = 2
+	nfDrop         = 0
+	nfAccept       = 1
+
+	nftPayloadTransport = 2
+
+	nftQueueFlagBypass    = 1
+	nftRejectTCPReset     = 1
+	nftRejectICMPXUnreach = 2
+	nftRejectICMPXPort    = 1
+
+	nfInetLocalIn  = 1
+	nfInetLocalOut = 3
+
+	// The comment of a rule, as nft stores it in the rule userdata
+	nftUdataRuleComment = 0
+)
+
+// The byte order of netlink headers, and of the registers of nf_tables
+var nlNative = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// nftAttr is a netlink attribute, holding either data or nested attributes.
+type nftAttr struct {
+	typ    uint16
+	data   []byte
+	nested []nftAttr
+}
+
+func nftString(typ uint16, s string) nftAttr {
+	return nftAttr{typ: typ, data: append([]byte(s), 0)}
+}
+
+func nftU32(typ uint16, v uint32) nftAttr {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, v)
+	return nftAttr{typ: typ, data: data}
+}
+
+func nftU16(typ uint16, v uint16) nftAttr {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, v)
+	return nftAttr{typ: typ, data: data}
+}
+
+func nftNested(typ uint16, attrs ...nftAttr) nftAttr {
+	return nftAttr{typ: typ | syscall.NLA_F_NESTED, nested: attrs}
+}
+
+func (a nftAttr) encode(b *bytes.Buffer) {
+	payload := a.data
+	if a.nested != nil {
+		nb := new(bytes.Buffer)
+		for _, n := range a.nested {
+			n.encode(nb)
+		}
+		payload = nb.Bytes()
+	}
+	hdr := make([]byte, syscall.SizeofRtAttr)
+	nlNative.PutUint16(hdr, uint16(len(hdr)+len(payload)))
+	nlNative.PutUint16(hdr[2:], a.typ)
+	b.Write(hdr)
+	b.Write(payload)
+	b.Write(make([]byte, nlaAlign(len(payload))-len(payload)))
+}
+
+func nlaAlign(n int) int {
+	return (n + syscall.NLA_ALIGNTO - 1) &^ (syscall.NLA_ALIGNTO - 1)
+}
+
+// nftExpr returns an expression of a rule, with its attributes.
+func nftExpr(name string, attrs ...nftAttr) nftAttr {
+	return nftNested(nftaListElem, nftString(nftaExprName, name), nftNested(nftaExprData, attrs...))
+}
+
+// nftLoadMeta loads a meta key, such as the mark of a packet, in the
+// register.
+func nftLoadMeta(key uint32) nftAttr {
+	return nftExpr("meta", nftU32(1, nftRegister), nftU32(2, key))
+}
+
+// nftLoadPayload loads the bytes at an offset of a header in the register.
+func nftLoadPayload(base, offset, length uint32) nftAttr {
+	return nftExpr("payload", nftU32(1, nftRegister), nftU32(2, base), nftU32(3, offset), nftU32(4, length))
+}
+
+// nftCtStateIs matches the connection tracking states in mask.
+func nftCtStateIs(mask uint32) []nftAttr {
+	data := make([]byte, 4)
+	nlNative.PutUint32(data, mask)
+	return []nftAttr{
+		nftExpr("ct", nftU32(1, nftRegister), nftU32(2, nftCtState)),
+		nftExpr("bitwise", nftU32(1, nftRegister), nftU32(2, nftRegister), nftU32(3, 4),
+			nftNested(4, nftAttr{typ: nftaDataValue, data: data}),
+			nftNested(5, nftAttr{typ: nftaDataValue, data: make([]byte, 4)})),
+		nftCmp(nftCmpNeq, make([]byte, 4)),
+	}
+}
+
+// nftMaskedIs matches when the value loaded in the register by load,
+// masked, equals want.
+func nftMaskedIs(load nftAttr, mask, want uint32) []nftAttr {
+	m, w := make([]byte, 4), make([]byte, 4)
+	nlNative.PutUint32(m, mask)
+	nlNative.PutUint32(w, want)
+	return []nftAttr{
+		load,
+		nftExpr("bitwise", nftU32(1, nftRegister), nftU32(2, nftRegister), nftU32(3, 4),
+			nftNested(4, nftAttr{typ: nftaDataValue, data: m}),
+			nftNested(5, nftAttr{typ: nftaDataValue, data: make([]byte, 4)})),
+		nftCmp(nftCmpEq, w),
+	}
+}
+
+func nftLoadCt(key uint32) nftAttr {
+	return nftExpr("ct", nftU32(1, nftRegister), nftU32(2, key))
+}
+
+// nftSetCt sets a key of the connection, such as its mark, to the value in
+// the register.
+func nftSetCt(key uint32) nftAttr {
+	return nftExpr("ct", nftU32(2, key), nftU32(4, nftRegister))
+}
+
+// nftVerdict ends the evaluation of a packet with a verdict.
+func nftVerdict(code uint32) nftAttr {
+	return nftExpr("immediate", nftU32(1, nftRegVerdict),
+		nftNested(2, nftNested(nftDataVerdict, nftU32(1, code))))
+}
+
+// nftCmp compares the register with data, and ends the rule unless the
+// comparison holds.
+func nftCmp(op uint32, data []byte) nftAttr {
+	return nftExpr("cmp", nftU32(1, nftRegister), nftU32(2, op), nftNested(3, nftAttr{typ: nftaDataValue, data: data}))
+}
+
+func nftMarkIs(mark uint32) []nftAttr {
+	data := make([]byte, 4)
+	nlNative.PutUint32(data, mark)
+	return []nftAttr{nftLoadMeta(nftMetaMark), nftCmp(nftCmpEq, data)}
+}
+
+func nftProtoIs(proto uint8) []nftAttr {
+	return []nftAttr{nftLoadMeta(nftMetaL4Proto), nftCmp(nftCmpEq, []byte{proto})}
+}
+
+// nftTCPFlagsAre matches TCP packets whose flags, under mask, are want.
+func nftTCPFlagsAre(mask, want uint8) []nftAttr {
+	return append(nftProtoIs(syscall.IPPROTO_TCP),
+		nftLoadPayload(nftPayloadTransport, 13, 1),
+		nftExpr("bitwise", nftU32(1, nftRegister), nftU32(2, nftRegister), nftU32(3, 1),
+			nftNested(4, nftAttr{typ: nftaDataValue, data: []byte{mask}}),
+			nftNested(5, nftAttr{typ: nftaDataValue, data: []byte{0}})),
+		nftCmp(nftCmpEq, []byte{want}))
+}
+
+// nftQueue queues packets to the count queues from num, spread by flow.
+func nftQueue(num, count uint16, flags uint16) nftAttr {
+	return nftExpr("queue", nftU16(1, num), nftU16(2, count), nftU16(3, flags))
+}
+
+func nftReject(typ uint32, code uint8) nftAttr {
+	return nftExpr("reject", nftU32(1, typ), nftAttr{typ: 2, data: []byte{code}})
+}
+
+// nftChain is a base chain of the sgfw table, attached to a netfilter hook.
+type nftChain struct {
+	name     string
+	hook     uint32
+	priority int32
+}
+
+// nftRule is a rule of the sgfw table.  Its text, in nft syntax, is kept
+// as the comment of the rule so that the installed ruleset can be shown
+// without decoding the expressions.
+type nftRule struct {
+	chain string
+	text  string
+	exprs []nftAttr
+}
+
+// The chains and rules of the sgfw table, which do what iptablesRule(),
+// dnsRule(), inboundRule() and blockRules do with iptables for both IPv4
+// and IPv6.
+var nftChains = []nftChain{
+	{"output", nfInetLocalOut, -150},
+	{"input", nfInetLocalIn, 0},
+	{"reject", nfInetLocalOut, 0},
+}
+
+func nftRules() []nftRule {
+	concat := func(exprs ...[]nftAttr) []nftAttr {
+		var all []nftAttr
+		for _, e := range exprs {
+			all = append(all, e...)
+		}
+		return all
+	}
+	first, n := queueNum(), queueCount()
+	queueText := fmt.Sprintf("queue num %d", first)
+	if n > 1 {
+		queueText = fmt.Sprintf("queue num %d-%d", first, int(first)+n-1)
+	}
+	var flags uint16
+	if !failClosed() {
+		flags = nftQueueFlagBypass
+		queueText += " bypass"
+	}
+	queue := nftQueue(first, uint16(n), flags)
+	inboundText := fmt.Sprintf("queue num %d", inboundQueueNum())
+	if flags&nftQueueFlagBypass != 0 {
+		inboundText += " bypass"
+	}
+	var rules []nftRule
+	if cacheVerdicts() {
+		// the verdict cached on a connection comes before queueing, and is
+		// saved from the mark of the packet once it has been let through
+		rules = []nftRule{
+			{"output", fmt.Sprintf("ct mark and %#x == %#x accept", connmarkVerdict, connmarkAllow),
+				append(nftMaskedIs(nftLoadCt(nftCtMark), connmarkVerdict, connmarkAllow), nftVerdict(nfAccept))},
+			{"output", fmt.Sprintf("ct mark and %#x == %#x drop", connmarkVerdict, connmarkDeny),
+				append(nftMaskedIs(nftLoadCt(nftCtMark), connmarkVerdict, connmarkDeny), nftVerdict(nfDrop))},
+			{"reject", fmt.Sprintf("meta mark and %#x == %#x ct mark set meta mark", connmarkVerdict, connmarkAllow),
+				append(nftMaskedIs(nftLoadMeta(nftMetaMark), connmarkVerdict, connmarkAllow), nftLoadMeta(nftMetaMark), nftSetCt(nftCtMark))},
+		}
+	}
+	if filterInbound() {
+		// the first packet of the TCP connections from other hosts
+		const fin, syn, rst, ack = 0x01, 0x02, 0x04, 0x10
+		rules = append(rules, nftRule{"input", `iifname != "lo" tcp flags & (fin|syn|rst|ack) == syn ct state new ` + inboundText,
+			concat([]nftAttr{nftLoadMeta(nftMetaIifname), nftCmp(nftCmpNeq, []byte("lo\x00"))},
+				nftTCPFlagsAre(fin|syn|rst|ack, syn), nftCtStateIs(nftCtStateNew), []nftAttr{nftQueue(inboundQueueNum(), 1, flags)})})
+	}
+	return append(rules, []nftRule{
+		{"output", "ct state new " + queueText,
+			concat(nftCtStateIs(nftCtStateNew), []nftAttr{queue})},
+		{"input", "udp sport 53 " + queueText,
+			concat(nftProtoIs(syscall.IPPROTO_UDP),
+				[]nftAttr{nftLoadPayload(nftPayloadTransport, 0, 2), nftCmp(nftCmpEq, []byte{0, 53}), queue})},
+		{"reject", "meta mark 1 meta l4proto tcp reject with tcp reset",
+			concat(nftMarkIs(1), nftProtoIs(syscall.IPPROTO_TCP), []nftAttr{nftReject(nftRejectTCPReset, 0)})},
+		{"reject", "meta mark 1 meta l4proto udp reject",
+			concat(nftMarkIs(1), nftProtoIs(syscall.IPPROTO_UDP), []nftAttr{nftReject(nftRejectICMPXUnreach, nftRejectICMPXPort)})},
+	}...)
+}
+
+// nftMessage is an nf_tables netlink message.
+type nftMessage struct {
+	typ   uint16
+	flags uint16
+	attrs []nftAttr
+}
+
+func (m nftMessage) encode(b *bytes.Buffer, seq uint32, family uint8, resID uint16) {
+	body := new(bytes.Buffer)
+	body.Write([]byte{family, 0, byte(resID >> 8), byte(resID)})
+	for _, a := range m.attrs {
+		a.encode(body)
+	}
+	hdr := make([]byte, syscall.NLMSG_HDRLEN)
+	nlNative.PutUint32(hdr, uint32(len(hdr)+body.Len()))
+	nlNative.PutUint16(hdr[4:], m.typ)
+	nlNative.PutUint16(hdr[6:], m.flags|syscall.NLM_F_REQUEST)
+	nlNative.PutUint32(hdr[8:], seq)
+	b.Write(hdr)
+	b.Write(body.Bytes())
+}
+
+func nftMsgType(msg uint16) uint16 {
+	return nfnlSubsysNFTables<<8 | msg
+}
+
+// nftBatch encodes the messages, which the kernel applies all together or
+// not at all, starting with sequence number seq.  Every message in it is
+// acknowledged.
+func nftBatch(seq uint32, msgs []nftMessage) []byte {
+	b := new(bytes.Buffer)
+	nftMessage{typ: nfnlMsgBatchBegin}.encode(b, seq, syscall.AF_UNSPEC, nfnlSubsysNFTables)
+	for i, m := range msgs {
+		m.flags |= syscall.NLM_F_ACK
+		m.encode(b, seq+1+uint32(i), nfprotoInet, 0)
+	}
+	nftMessage{typ: nfnlMsgBatchEnd}.encode(b, seq+1+uint32(len(msgs)), syscall.AF_UNSPEC, nfnlSubsysNFTables)
+	return b.Bytes()
+}
+
+func nftNewTable() nftMessage {
+	return nftMessage{nftMsgType(nftMsgNewTable), syscall.NLM_F_CREATE, []nftAttr{nftString(nftaTableName, nftTable)}}
+}
+
+func nftDelTable() nftMessage {
+	return nftMessage{nftMsgType(nftMsgDelTable), 0, []nftAttr{nftString(nftaTableName, nftTable)}}
+}
+
+func (c nftChain) message() nftMessage {
+	return nftMessage{nftMsgType(nftMsgNewChain), syscall.NLM_F_CREATE, []nftAttr{
+		nftString(nftaChainTable, nftTable),
+		nftString(nftaChainName, c.name),
+		nftNested(nftaChainHook, nftU32(nftaHookHooknum, c.hook), nftU32(nftaHookPriority, uint32(c.priority))),
+		nftString(nftaChainType, "filter"),
+	}}
+}
+
+func (r nftRule) message() nftMessage {
+	comment := append([]byte(r.text), 0)
+	return nftMessage{nftMsgType(nftMsgNewRule), syscall.NLM_F_CREATE | syscall.NLM_F_APPEND, []nftAttr{
+		nftString(nftaRuleTable, nftTable),
+		nftString(nftaRuleChain, r.chain),
+		nftNested(nftaRuleExprs, r.exprs...),
+		{typ: nftaRuleUserdata, data: append([]byte{nftUdataRuleComment, byte(len(comment))}, comment...)},
+	}}
+}
+
+// nftSetupMessages replaces the sgfw table with one holding the chains and
+// rules.  The table is created first so that deleting it cannot fail.
+func nftSetupMessages(chains []nftChain, rules []nftRule) []nftMessage {
+	msgs := []nftMessage{nftNewTable(), nftDelTable(), nftNewTable()}
+	for _, c := range chains {
+		msgs = append(msgs, c.message())
+	}
+	for _, r := range rules {
+		msgs = append(msgs, r.message())
+	}
+	return msgs
+}
+
+// nftConn is a netlink socket to nf_tables, or to another subsystem of
+// netfilter or of the kernel.
+type nftConn struct {
+	fd  int
+	seq uint32
+}
+
+func nftDial() (*nftConn, error) {
+	return netlinkDial(syscall.NETLINK_NETFILTER)
+}
+
+func netlinkDial(proto int) (*nftConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	tv := syscall.NsecToTimeval(int64(5 * time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &nftConn{fd: fd, seq: uint32(time.Now().Unix())}, nil
+}
+
+func (c *nftConn) close() {
+	syscall.Close(c.fd)
+}
+
+func (c *nftConn) send(b []byte) error {
+	return syscall.Sendto(c.fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// nftError is an error returned by the kernel for a message.
+type nftError struct {
+	msg, count uint32
+	errno      syscall.Errno
+}
+
+func (e *nftError) Error() string {
+	return fmt.Sprintf("netfilter message %d of %d: %v", e.msg, e.count, e.errno)
+}
+
+// receive reads the replies to the messages from first to last, handing
+// those carrying data to fn, until the last one is acknowledged or a dump
+// is done.  The first error returned by the kernel is returned.
+func (c *nftConn) receive(first, last uint32, fn func(m syscall.NetlinkMessage)) error {
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq < first || m.Header.Seq > last {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return fmt.Errorf("short netlink error message")
+				}
+				if errno := int32(nlNative.Uint32(m.Data)); errno != 0 {
+					return &nftError{m.Header.Seq - first + 1, last - first + 1, syscall.Errno(-errno)}
+				}
+				if m.Header.Seq == last {
+					return nil
+				}
+			default:
+				fn(m)
+			}
+		}
+	}
+}
+
+// apply sends the messages in a batch and waits for them all to be
+// applied.
+func (c *nftConn) apply(msgs []nftMessage) error {
+	seq := c.seq
+	c.seq += uint32(len(msgs)) + 2
+	if err := c.send(nftBatch(seq, msgs)); err != nil {
+		return err
+	}
+	return c.receive(seq+1, seq+uint32(len(msgs)), func(syscall.NetlinkMessage) {})
+}
+
+// request sends a message of any netfilter subsystem, for a protocol
+// family, and hands the replies carrying data to fn until it is
+// acknowledged or a dump is done.
+func (c *nftConn) request(m nftMessage, family uint8, fn func(m syscall.NetlinkMessage)) error {
+	seq := c.seq
+	c.seq++
+	b := new(bytes.Buffer)
+	m.encode(b, seq, family, 0)
+	if err := c.send(b.Bytes()); err != nil {
+		return err
+	}
+	return c.receive(seq, seq, fn)
+}
+
+// dump returns the attributes of every object of a kind the kernel lists
+// for a message, such as every chain for nftMsgGetChain.
+func (c *nftConn) dump(msg uint16, attrs ...nftAttr) ([]map[uint16][]byte, error) {
+	var objs []map[uint16][]byte
+	err := c.request(nftMessage{nftMsgType(msg), syscall.NLM_F_DUMP, attrs}, nfprotoInet, func(m syscall.NetlinkMessage) {
+		if len(m.Data) >= 4 {
+			objs = append(objs, nftParseAttrs(m.Data[4:]))
+		}
+	})
+	return objs, err
+}
+
+// nftParseAttrs returns the data of the attributes in b by type.
+func nftParseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= syscall.SizeofRtAttr {
+		l := int(nlNative.Uint16(b))
+		if l < syscall.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs[nlNative.Uint16(b[2:])&^syscall.NLA_F_NESTED] = b[syscall.SizeofRtAttr:l]
+		if nlaAlign(l) > len(b) {
+			break
+		}
+		b = b[nlaAlign(l):]
+	}
+	return attrs
+}
+
+func nftAttrString(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// nftablesBackend installs the rules in a table of their own with nf_tables.
+type nftablesBackend struct{}
+
+func (nftablesBackend) name() string {
+	return BACKEND_NFTABLES
+}
+
+func (nftablesBackend) apply(msgs []nftMessage) error {
+	c, err := nftDial()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+	return c.apply(msgs)
+}
+
+func (b nftablesBackend) setup() error {
+	if err := b.apply(nftSetupMessages(nftChains, nftRules())); err != nil {
+		return err
+	}
+	log.Infof("Installed nftables table inet %s", nftTable)
+	rejectProtos["tcp"] = true
+	rejectProtos["udp"] = true
+	return nil
+}
+
+// teardown deletes the sgfw table, creating it first so that this does not
+// fail if it is already gone.
+func (b nftablesBackend) teardown() error {
+	if err := b.apply([]nftMessage{nftNewTable(), nftDelTable()}); err != nil {
+		return err
+	}
+	log.Infof("Removed nftables table inet %s", nftTable)
+	return nil
+}
+
+var nfHookNames = map[uint32]string{0: "prerouting", 1: "input", 2: "forward", 3: "output", 4: "postrouting"}
+
+// status lists the chains and rules of the sgfw table as the kernel has
+// them, in nft syntax.
+func (nftablesBackend) status() (string, error) {
+	c, err := nftDial()
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+	chains, err := c.dump(nftMsgGetChain)
+	if err != nil {
+		return "", err
+	}
+	rules, err := c.dump(nftMsgGetRule, nftString(nftaRuleTable, nftTable))
+	if err != nil {
+		return "", err
+	}
+
+	b := new(bytes.Buffer)
+	n := 0
+	fmt.Fprintf(b, "table inet %s {\n", nftTable)
+	for _, ch := range chains {
+		if nftAttrString(ch[nftaChainTable]) != nftTable {
+			continue
+		}
+		n++
+		name := nftAttrString(ch[nftaChainName])
+		fmt.Fprintf(b, "\tchain %s {\n", name)
+		if hook := nftParseAttrs(ch[nftaChainHook]); len(hook[nftaHookHooknum]) == 4 && len(hook[nftaHookPriority]) == 4 {
+			fmt.Fprintf(b, "\t\ttype %s hook %s priority %d;\n", nftAttrString(ch[nftaChainType]),
+				nfHookNames[binary.BigEndian.Uint32(hook[nftaHookHooknum])], int32(binary.BigEndian.Uint32(hook[nftaHookPriority])))
+		}
+		for _, r := range rules {
+			if nftAttrString(r[nftaRuleChain]) != name {
+				continue
+			}
+			text := "(rule not installed by sgfw)"
+			if u := r[nftaRuleUserdata]; len(u) > 2 && u[0] == nftUdataRuleComment && int(u[1]) <= len(u)-2 {
+				text = nftAttrString(u[2 : 2+u[1]])
+			}
+			var handle uint64
+			if len(r[nftaRuleHandle]) == 8 {
+				handle = binary.BigEndian.Uint64(r[nftaRuleHandle])
+			}
+			fmt.Fprintf(b, "\t\t%s # handle %d\n", text, handle)
+		}
+		fmt.Fprintf(b, "\t}\n")
+	}
+	fmt.Fprintf(b, "}\n")
+	if n == 0 {
+		return fmt.Sprintf("table inet %s is not installed\n", nftTable), nil
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,51 @@
+package sgfw
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestNftBatchEncoding(t *testing.T) {
+	rules := nftRules()
+	msgs := nftSetupMessages(nftChains, rules)
+	nlmsgs, err := syscall.ParseNetlinkMessage(nftBatch(100, msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nlmsgs) != len(msgs)+2 {
+		t.Fatalf("%d netlink messages, want %d", len(nlmsgs), len(msgs)+2)
+	}
+	if nlmsgs[0].Header.Type != nfnlMsgBatchBegin || nlmsgs[len(nlmsgs)-1].Header.Type != nfnlMsgBatchEnd {
+		t.Error("messages not wrapped in a batch")
+	}
+	for i, m := range nlmsgs {
+		if m.Header.Seq != uint32(100+i) {
+			t.Errorf("message %d has sequence number %d", i, m.Header.Seq)
+		}
+	}
+
+	// The rules follow the table and its chains, and keep their text.
+	chains := make(map[string]bool)
+	for _, c := range nftChains {
+		chains[c.name] = true
+	}
+	for i, r := range rules {
+		m := nlmsgs[1+len(msgs)-len(rules)+i]
+		if m.Header.Type != nftMsgType(nftMsgNewRule) || m.Header.Flags&syscall.NLM_F_ACK == 0 {
+			t.Errorf("rule %d sent as message type %x, flags %x", i, m.Header.Type, m.Header.Flags)
+		}
+		if m.Data[0] != nfprotoInet {
+			t.Errorf("rule %d is not in the inet family", i)
+		}
+		attrs := nftParseAttrs(m.Data[4:])
+		if !chains[nftAttrString(attrs[nftaRuleChain])] {
+			t.Errorf("rule %d is in missing chain %q", i, attrs[nftaRuleChain])
+		}
+		if u := attrs[nftaRuleUserdata]; nftAttrString(u[2:]) != r.text || int(u[1]) != len(r.text)+1 {
+			t.Errorf("rule %d comment encoded as %q", i, u)
+		}
+		if exprs := nftParseAttrs(attrs[nftaRuleExprs]); len(exprs) == 0 {
+			t.Errorf("rule %d has no expressions", i)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package sgfw
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Values of FirewallConfig.PromptFallbackAction
+const (
+	PROMPT_FALLBACK_DENY  = "deny"
+	PROMPT_FALLBACK_ALLOW = "allow"
+)
+
+// Defaults of the limits on connections waiting for a verdict
+const (
+	defaultMaxPendingPerPolicy = 50
+	defaultMaxPending          = 500
+)
+
+func promptTimeout() time.Duration {
+	return time.Duration(FirewallConfig.PromptTimeout) * time.Second
+}
+
+// pendingDesc describes a connection waiting for a prompt in the log, by
+// its direction and the application that opened or accepts it.
+func pendingDesc(pc pendingConnection) string {
+	if pc.direction() == RULE_DIRECTION_IN {
+		return "incoming connection attempt to " + pc.procInfo().ExePath
+	}
+	return "outgoing connection attempt by " + pc.procInfo().ExePath
+}
+
+// fallbackVerdict lets a connection that was not answered through a prompt
+// through once, or denies it, as configured.
+func fallbackVerdict(pc pendingConnection, why string) {
+	if FirewallConfig.PromptFallbackAction == PROMPT_FALLBACK_ALLOW {
+		log.Noticef("Allowed %s once: %s", pendingDesc(pc), why)
+		pc.accept()
+		return
+	}
+	log.Warningf("DENIED %s: %s", pendingDesc(pc), why)
+	pc.drop()
+}
+
+// queuePending adds a connection to those waiting for a prompt, unless too
+// many already are.  It must be called with p.lock held.
+func (p *Policy) queuePending(pc pendingConnection) bool {
+	if FirewallConfig.MaxPendingPerPolicy > 0 && len(p.pendingQueue) >= FirewallConfig.MaxPendingPerPolicy {
+		return false
+	}
+	if n := atomic.AddInt32(&p.fw.pendingCount, 1); FirewallConfig.MaxPending > 0 && int(n) > FirewallConfig.MaxPending {
+		atomic.AddInt32(&p.fw.pendingCount, -1)
+		return false
+	}
+	p.pendingQueue = append(p.pendingQueue, pc)
+	return true
+}
+
+// takePending removes the connections for which take returns true from the
+// queue, and returns them.  It must be called with p.lock held.
+func (p *Policy) takePending(take func(pc pendingConnection) bool) []pendingConnection {
+	var taken, remaining []pendingConnection
+	for _, pc := range p.pendingQueue {
+		if take(pc) {
+			taken = append(taken, pc)
+		} else {
+			remaining = append(remaining, pc)
+		}
+	}
+	if len(taken) > 0 {
+		p.pendingQueue = remaining
+		atomic.AddInt32(&p.fw.pendingCount, -int32(len(taken)))
+	}
+	return taken
+}
+
+// resolvedPending closes the prompt shown for a connection that was given
+// a verdict by other means.
+func (p *Policy) resolvedPending(pc pendingConnection) {
+	if pc.getPrompting() && p.fw.dbus != nil {
+		p.fw.dbus.prompter.cancel(pc)
+	}
+}
+
+// dropPending gives the fallback verdict to the connections that have
+// waited longer than the prompt timeout, and denies every waiting
+// connection if all is set.
+func (fw *Firewall) dropPending(now time.Time, all bool, why string) {
+	timeout := promptTimeout()
+	if !all && timeout <= 0 {
+		return
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		expired := p.takePending(func(pc pendingConnection) bool {
+			return all || now.Sub(pc.queuedAt()) >= timeout
+		})
+		for _, pc := range expired {
+			p.resolvedPending(pc)
+			if all {
+				log.Warningf("DENIED %s: %s", pendingDesc(pc), why)
+				pc.drop()
+			} else {
+				fallbackVerdict(pc, why)
+			}
+		}
+		if len(p.pendingQueue) == 0 {
+			p.promptInProgress = false
+		}
+		p.lock.Unlock()
+	}
+}
+
+// expirePending gives the fallback verdict to the connections that waited
+// too long for a prompt to be answered.
+func (fw *Firewall) expirePending() {
+	fw.dropPending(time.Now(), false, "prompt timed out")
+}
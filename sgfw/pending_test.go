@@ -0,0 +1,81 @@
+package sgfw
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testPendingSocks(p *Policy, queued time.Time) *pendingSocksConnection {
+	return &pendingSocksConnection{
+		pol:      p,
+		destIP:   net.IP{203, 0, 113, 1},
+		destPort: 443,
+		pinfo:    testPInfo(),
+		verdict:  make(chan int, 1),
+		queued:   queued,
+	}
+}
+
+func TestPendingLimitsAndTimeouts(t *testing.T) {
+	saved := FirewallConfig
+	defer func() { FirewallConfig = saved }()
+	FirewallConfig.MaxPendingPerPolicy = 2
+	FirewallConfig.MaxPending = 3
+	FirewallConfig.PromptTimeout = 60
+	FirewallConfig.PromptFallbackAction = PROMPT_FALLBACK_ALLOW
+
+	fw := testFirewall()
+	curl := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	wget := fw.policyForPathAndSandbox("/usr/bin/wget", "")
+	now := time.Now()
+	old := testPendingSocks(curl, now.Add(-2*time.Minute))
+	queued := []*pendingSocksConnection{old, testPendingSocks(curl, now), testPendingSocks(wget, now)}
+	for _, pc := range queued {
+		if !pc.pol.queuePending(pc) {
+			t.Fatal("connection not queued")
+		}
+	}
+	if curl.queuePending(testPendingSocks(curl, now)) {
+		t.Error("queued more connections of an application than allowed")
+	}
+	if wget.queuePending(testPendingSocks(wget, now)) {
+		t.Error("queued more connections than allowed in all")
+	}
+	if fw.pendingCount != 3 {
+		t.Errorf("%d connections counted, want 3", fw.pendingCount)
+	}
+
+	fw.dropPending(now, false, "prompt timed out")
+	if v := <-old.verdict; v != socksVerdictAccept {
+		t.Errorf("timed out connection got verdict %d, want the fallback", v)
+	}
+	if len(curl.pendingQueue) != 1 || fw.pendingCount != 2 {
+		t.Errorf("%d connections left, %d counted", len(curl.pendingQueue), fw.pendingCount)
+	}
+	if curl.removePending(old) || !curl.removePending(queued[1]) || fw.pendingCount != 1 {
+		t.Errorf("connections not removed once: %d counted", fw.pendingCount)
+	}
+
+	FirewallConfig.PromptTimeout = 0
+	fw.dropPending(now.Add(time.Hour), false, "prompt timed out")
+	if len(wget.pendingQueue) != 1 {
+		t.Error("connection timed out with timeouts turned off")
+	}
+	fw.dropPending(now, true, "network locked down")
+	if v := <-queued[2].verdict; v != socksVerdictDrop || fw.pendingCount != 0 {
+		t.Errorf("dropping all connections gave verdict %d, %d still counted", v, fw.pendingCount)
+	}
+}
+
+func TestPendingDesc(t *testing.T) {
+	p := testPolicy(t, nil)
+	out := testPendingSocks(p, time.Now())
+	in := &pendingPkt{pol: p, dir: RULE_DIRECTION_IN, pinfo: testPInfo()}
+	if d := pendingDesc(out); d != "outgoing connection attempt by "+testPInfo().ExePath {
+		t.Errorf("outgoing connection logged as %q", d)
+	}
+	if d := pendingDesc(in); d != "incoming connection attempt to "+testPInfo().ExePath {
+		t.Errorf("incoming connection logged as %q", d)
+	}
+}
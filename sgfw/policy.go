@@ -1,10 +1,13 @@
 package sgfw
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	//	"encoding/binary"
 
@@ -47,21 +50,28 @@ type pendingConnection interface {
 	dstPort() uint16
 	sandbox() string
 	socks() bool
+	direction() RuleDirection
 	accept()
 	acceptTLSOnly()
 	drop()
 	setPrompting(bool)
 	getPrompting() bool
+	queuedAt() time.Time
 	print() string
 }
 
+// pendingPkt is a connection queued as a packet.  For one from another
+// host, src is the local end of the connection and dst the remote one, as
+// the rules have them.
 type pendingPkt struct {
 	pol       *Policy
 	name      string
 	pkt       *nfqueue.NFQPacket
+	dir       RuleDirection
 	pinfo     *procsnitch.Info
 	optstring string
 	prompting bool
+	queued    time.Time
 }
 
 func getEmptyPInfo() *procsnitch.Info {
@@ -83,6 +93,10 @@ func (pp *pendingPkt) socks() bool {
 	return false
 }
 
+func (pp *pendingPkt) direction() RuleDirection {
+	return pp.dir
+}
+
 func (pp *pendingPkt) policy() *Policy {
 	return pp.pol
 }
@@ -104,12 +118,18 @@ func (pp *pendingPkt) hostname() string {
 }
 
 func (pp *pendingPkt) src() net.IP {
-	src, _ := getPacketIPAddrs(pp.pkt)
+	src, dst := getPacketIPAddrs(pp.pkt)
+	if pp.dir == RULE_DIRECTION_IN {
+		return dst
+	}
 	return src
 }
 
 func (pp *pendingPkt) dst() net.IP {
-	_, dst := getPacketIPAddrs(pp.pkt)
+	src, dst := getPacketIPAddrs(pp.pkt)
+	if pp.dir == RULE_DIRECTION_IN {
+		return src
+	}
 	return dst
 }
 
@@ -118,7 +138,7 @@ func getNFQProto(pkt *nfqueue.NFQPacket) string {
 		return "tcp"
 	} else if pkt.Packet.Layer(layers.LayerTypeUDP) != nil {
 		return "udp"
-	} else if pkt.Packet.Layer(layers.LayerTypeICMPv4) != nil {
+	} else if pkt.Packet.Layer(layers.LayerTypeICMPv4) != nil || pkt.Packet.Layer(layers.LayerTypeICMPv6) != nil {
 		return "icmp"
 	}
 
@@ -130,12 +150,19 @@ func (pp *pendingPkt) proto() string {
 }
 
 func (pp *pendingPkt) srcPort() uint16 {
-	srcp, _ := getPacketTCPPorts(pp.pkt)
+	srcp, dstp := getPacketTCPPorts(pp.pkt)
+	if pp.dir == RULE_DIRECTION_IN {
+		return dstp
+	}
 	return srcp
 }
 
 func (pp *pendingPkt) dstPort() uint16 {
-	if pp.proto() == "tcp" {
+	if pp.dir == RULE_DIRECTION_IN {
+		// the port of the local listener
+		_, dstp := getPacketTCPPorts(pp.pkt)
+		return dstp
+	} else if pp.proto() == "tcp" {
 		_, dstp := getPacketTCPPorts(pp.pkt)
 		return dstp
 	} else if pp.proto() == "udp" {
@@ -156,13 +183,16 @@ func (pp *pendingPkt) accept() {
 func (pp *pendingPkt) acceptTLSOnly() {
 	// Not implemented
 
-	pp.pkt.SetMark(1)
-	pp.pkt.Accept()
+	pp.drop()
 }
 
 func (pp *pendingPkt) drop() {
-	pp.pkt.SetMark(1)
-	pp.pkt.Accept()
+	if pp.dir == RULE_DIRECTION_IN {
+		// the block rules only reject packets going out
+		pp.pkt.Drop()
+		return
+	}
+	denyPacket(pp.pkt)
 }
 
 func (pp *pendingPkt) getPrompting() bool {
@@ -173,7 +203,14 @@ func (pp *pendingPkt) setPrompting(val bool) {
 	pp.prompting = val
 }
 
+func (pp *pendingPkt) queuedAt() time.Time {
+	return pp.queued
+}
+
 func (pp *pendingPkt) print() string {
+	if pp.dir == RULE_DIRECTION_IN {
+		return printInboundPacket(pp.pkt, pp.name, pp.pinfo)
+	}
 	return printPacket(pp.pkt, pp.name, pp.pinfo)
 }
 
@@ -183,7 +220,12 @@ type Policy struct {
 	sandbox          string
 	application      string
 	icon             string
+	pinnedHash       string
+	audit            bool
 	rules            RuleList
+	unparsed         []ruleRecord
+	fileExtra        map[string]json.RawMessage
+	index            atomic.Value
 	pendingQueue     []pendingConnection
 	promptInProgress bool
 	lock             sync.Mutex
@@ -246,6 +288,13 @@ func (p *Policy) processPacket(pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, o
 		if err != nil {
 			log.Notice("Failed to get HW address underlying packet: ", err)
 		} else { log.Notice("got hwaddr: ", hbytes) } */
+	// looked up first, as p.lock must not be held while taking fw.lock
+	up := p.fw.unitPolicy(pinfo)
+	var ap *Policy
+	if p.path != anyExePath {
+		ap = p.fw.anyExePolicy(p.sandbox)
+	}
+	pin := p.hashForPin(pinfo)
 	p.lock.Lock()
 	defer p.lock.Unlock()
 	dstb := pkt.Packet.NetworkLayer().NetworkFlow().Dst().Raw()
@@ -258,22 +307,88 @@ func (p *Policy) processPacket(pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, o
 	}
 	//	fwo := matchAgainstOzRules(srcip, dstip, dstp)
 
-	result := p.rules.filterPacket(pkt, pinfo, srcip, name, optstr)
+	// the rules for the unit a process runs in come before those for its
+	// executable, which come before those for every executable
+	_, dstp := getPacketPorts(pkt)
+	result, rule := pin.match(RULE_DIRECTION_OUT, up, p, ap, pkt, pinfo, srcip, dstip, dstp, name, optstr)
+	result, rule, pinned := p.pinnedVerdict(pin, result, rule)
+	if !pinned {
+		optstr = pinMismatchOptString(optstr)
+	}
+	if rule != nil {
+		rule.hit(time.Now())
+	}
+	if pinned && result == FILTER_PROMPT && p.fw.learner.active(time.Now()) {
+		p.learnPacket(pkt, name)
+		return
+	}
+	if p.auditing() {
+		p.auditPacket(result, pkt, name, pinfo)
+		return
+	}
 	switch result {
 	case FILTER_DENY:
-		pkt.SetMark(1)
-		pkt.Accept()
+		denyPacket(pkt)
 	case FILTER_ALLOW:
-		pkt.Accept()
+		acceptCached(pkt, rule)
 	case FILTER_PROMPT:
-		p.processPromptResult(&pendingPkt{pol: p, name: name, pkt: pkt, pinfo: pinfo, optstring: optstr, prompting: false})
+		p.processPromptResult(&pendingPkt{pol: p, name: name, pkt: pkt, pinfo: pinfo, optstring: optstr, prompting: false, queued: time.Now()})
 	default:
 		log.Warningf("Unexpected filter result: %d", result)
 	}
 }
 
+// policyMatcher is the type of matchPolicies.
+type policyMatcher func(dir RuleDirection, up, p, ap *Policy, pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, src, dst net.IP, dstPort uint16, hostname, optstr string) (FilterResult, *Rule)
+
+// matchPolicies applies the rules for the unit a process runs in, then
+// those for its executable p, then those for every executable, to a
+// connection going in direction dir: a packet, or with pkt nil one made
+// through the SOCKS proxy.  The rule that decided it is returned as well,
+// without counting a hit.
+func matchPolicies(dir RuleDirection, up, p, ap *Policy, pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, src, dst net.IP, dstPort uint16, hostname, optstr string) (FilterResult, *Rule) {
+	return matchPolicyRules(false, dir, up, p, ap, pkt, pinfo, src, dst, dstPort, hostname, optstr)
+}
+
+// matchDenyingPolicies is matchPolicies with only the DENY rules, for an
+// executable that does not match its pinned hash.  Any other verdict waits
+// until the user approves the changed executable, but a connection the user
+// or the rules deny in the meantime stays denied.
+func matchDenyingPolicies(dir RuleDirection, up, p, ap *Policy, pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, src, dst net.IP, dstPort uint16, hostname, optstr string) (FilterResult, *Rule) {
+	return matchPolicyRules(true, dir, up, p, ap, pkt, pinfo, src, dst, dstPort, hostname, optstr)
+}
+
+func matchPolicyRules(denying bool, dir RuleDirection, up, p, ap *Policy, pkt *nfqueue.NFQPacket, pinfo *procsnitch.Info, src, dst net.IP, dstPort uint16, hostname, optstr string) (FilterResult, *Rule) {
+	for i, pol := range []*Policy{up, p, ap} {
+		if pol == nil || (i != 1 && pol == p) {
+			continue
+		}
+		ix := pol.ruleIndex().direction(dir)
+		if denying {
+			ix = ix.denying
+		}
+		if result, r := ix.match(pkt, src, dst, dstPort, hostname, pinfo, optstr); result != FILTER_PROMPT {
+			return result, r
+		}
+	}
+	return FILTER_PROMPT, nil
+}
+
+func pinMismatchOptString(optstr string) string {
+	if optstr == "" {
+		return "[" + STR_BINARY_CHANGED + "]"
+	}
+	return "[" + STR_BINARY_CHANGED + "] " + optstr
+}
+
+// processPromptResult queues a connection for a prompt.  It must be called
+// with p.lock held.
 func (p *Policy) processPromptResult(pc pendingConnection) {
-	p.pendingQueue = append(p.pendingQueue, pc)
+	if !p.queuePending(pc) {
+		// the verdict of a SOCKS connection is awaited by the caller
+		go fallbackVerdict(pc, "too many connections waiting for a prompt")
+		return
+	}
 	//fmt.Println("processPromptResult(): p.promptInProgress = ", p.promptInProgress)
 	if DoMultiPrompt || (!DoMultiPrompt && !p.promptInProgress) {
 		p.promptInProgress = true
@@ -306,19 +421,13 @@ func (p *Policy) nextPending() (pendingConnection, bool) {
 	return nil, false
 }
 
-func (p *Policy) removePending(pc pendingConnection) {
+// removePending takes a connection off the queue, and reports whether it
+// was still waiting for a verdict.
+func (p *Policy) removePending(pc pendingConnection) bool {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	remaining := []pendingConnection{}
-	for _, c := range p.pendingQueue {
-		if c != pc {
-			remaining = append(remaining, c)
-		}
-	}
-	if len(remaining) != len(p.pendingQueue) {
-		p.pendingQueue = remaining
-	}
+	return len(p.takePending(func(c pendingConnection) bool { return c == pc })) > 0
 }
 
 func (p *Policy) processNewRule(r *Rule, scope FilterScope) bool {
@@ -327,8 +436,9 @@ func (p *Policy) processNewRule(r *Rule, scope FilterScope) bool {
 
 	if scope != APPLY_ONCE {
 		p.rules = append(p.rules, r)
+		p.rulesChanged()
 	}
-	p.filterPending(r)
+	p.filterPending(r, scope != APPLY_ONCE)
 	if len(p.pendingQueue) == 0 {
 		p.promptInProgress = false
 	}
@@ -345,10 +455,13 @@ func (p *Policy) parseRule(s string, add bool) (*Rule, error) {
 	if !r.parse(s) {
 		return nil, parseError(s)
 	}
+	r.uuid = newRuleUUID()
+	r.created = time.Now()
 	if add {
 		p.lock.Lock()
 		defer p.lock.Unlock()
 		p.rules = append(p.rules, r)
+		p.rulesChanged()
 	}
 	p.fw.addRule(r)
 	return r, nil
@@ -365,18 +478,53 @@ func (p *Policy) removeRule(r *Rule) {
 		}
 	}
 	p.rules = newRules
+	p.rulesChanged()
+	p.fw.forgetVerdicts(r)
+}
+
+// rulesChanged publishes a new rule index after p.rules has been modified,
+// and has the open connections judged again by the new rules.  It must be
+// called with p.lock held.
+func (p *Policy) rulesChanged() {
+	p.index.Store(newRuleIndex(p.rules))
+	p.fw.enforceLater()
 }
 
-func (p *Policy) filterPending(rule *Rule) {
+// ruleIndex returns the current rule index of the policy.  It does not
+// need p.lock, since a published index is never modified.
+func (p *Policy) ruleIndex() *ruleIndex {
+	if ix, ok := p.index.Load().(*ruleIndex); ok {
+		return ix
+	}
+	return emptyRuleIndex
+}
+
+// filterPending gives the connections waiting for a prompt that rule
+// matches its verdict.  The verdict of those it lets through is cached on
+// their connection only if the rule is kept, as nothing would clear it
+// otherwise.
+func (p *Policy) filterPending(rule *Rule, kept bool) {
 	remaining := []pendingConnection{}
 	for _, pc := range p.pendingQueue {
-		if rule.match(pc.src(), pc.dst(), pc.dstPort(), pc.hostname(), pc.proto(), pc.procInfo().UID, pc.procInfo().GID, uidToUser(pc.procInfo().UID), gidToGroup(pc.procInfo().GID), pc.procInfo().Sandbox) {
+		if rule.direction == pc.direction() && rule.matchCGroup(newProcCGroup(pc.procInfo())) && rule.matchAncestry(newProcAncestry(pc.procInfo())) && rule.match(pc.src(), pc.dst(), pc.dstPort(), pc.hostname(), pc.proto(), pc.procInfo().UID, pc.procInfo().GID, uidToUser(pc.procInfo().UID), gidToGroup(pc.procInfo().GID), pc.procInfo().Sandbox) {
 			log.Infof("Adding rule for: %s", rule.getString(FirewallConfig.LogRedact))
+			rule.hit(time.Now())
 			// log.Noticef("%s > %s", rule.getString(FirewallConfig.LogRedact), pc.print())
-			if rule.rtype == RULE_ACTION_ALLOW {
+			p.resolvedPending(pc)
+			if pp, ok := pc.(*pendingPkt); ok && kept && pp.dir == RULE_DIRECTION_OUT && rule.rtype == RULE_ACTION_ALLOW {
+				acceptCached(pp.pkt, rule)
+			} else if rule.rtype == RULE_ACTION_ALLOW {
 				pc.accept()
 			} else if rule.rtype == RULE_ACTION_ALLOW_TLSONLY {
 				pc.acceptTLSOnly()
+			} else if pc.direction() == RULE_DIRECTION_IN {
+				from := STR_REDACTED
+				if !FirewallConfig.LogRedact {
+					from = pc.dst().String()
+				}
+				log.Warningf("DENIED incoming connection attempt to %s on %s port %d from %s (user prompt)",
+					pc.procInfo().ExePath, pc.proto(), pc.dstPort(), from)
+				pc.drop()
 			} else {
 				srcs := pc.src().String() + ":" + strconv.Itoa(int(pc.srcPort()))
 				dests := STR_REDACTED
@@ -392,13 +540,14 @@ func (p *Policy) filterPending(rule *Rule) {
 		}
 	}
 	if len(remaining) != len(p.pendingQueue) {
+		atomic.AddInt32(&p.fw.pendingCount, int32(len(remaining)-len(p.pendingQueue)))
 		p.pendingQueue = remaining
 	}
 }
 
 func (p *Policy) hasPersistentRules() bool {
 	for _, r := range p.rules {
-		if r.mode != RULE_MODE_SESSION {
+		if r.mode != RULE_MODE_SESSION && r.sourceFile == "" {
 			return true
 		}
 	}
@@ -416,7 +565,7 @@ func printPacket(pkt *nfqueue.NFQPacket, hostname string, pinfo *procsnitch.Info
 		proto = "TCP"
 	} else if pkt.Packet.Layer(layers.LayerTypeUDP) != nil {
 		proto = "UDP"
-	} else if pkt.Packet.Layer(layers.LayerTypeICMPv4) != nil {
+	} else if pkt.Packet.Layer(layers.LayerTypeICMPv4) != nil || pkt.Packet.Layer(layers.LayerTypeICMPv6) != nil {
 		proto = "ICMP"
 	}
 
@@ -483,8 +632,7 @@ func (fw *Firewall) filterPacket(pkt *nfqueue.NFQPacket) {
 			return
 		} else if fwo == OZ_FWRULE_BLACKLIST {
 			log.Noticef("Automatically blocking blacklisted sandbox traffic from %s to %s:%d\n", srcip, dstip, dstp)
-			pkt.SetMark(1)
-			pkt.Accept()
+			denyPacket(pkt)
 			return
 		} */
 
@@ -504,16 +652,7 @@ func (fw *Firewall) filterPacket(pkt *nfqueue.NFQPacket) {
 		//		pkt.Accept()
 		//		return
 	} else {
-		ppath = pinfo.ExePath
-		cf := strings.Fields(pinfo.CmdLine)
-		if len(cf) > 1 && strings.HasPrefix(cf[1], "/") {
-			for _, intp := range _interpreters {
-				if strings.Contains(pinfo.ExePath, intp) {
-					ppath = cf[1]
-					break
-				}
-			}
-		}
+		ppath = policyPath(pinfo)
 	}
 	log.Debugf("filterPacket [%s] %s", ppath, printPacket(pkt, fw.dns.Lookup(dstip, pinfo.Pid), nil))
 	/*	if basicAllowPacket(pkt) {
@@ -521,11 +660,29 @@ func (fw *Firewall) filterPacket(pkt *nfqueue.NFQPacket) {
 			return
 		}
 	*/
+	if fw.inLockdown() {
+		fw.lockdownPacket(pkt, ppath, pinfo)
+		return
+	}
 	policy := fw.PolicyForPathAndSandbox(ppath, pinfo.Sandbox)
 	//log.Notice("XXX: flunked basicallowpacket; policy = ", policy)
 	policy.processPacket(pkt, pinfo, optstring)
 }
 
+// policyPath returns the path of the policy for the connections of a
+// process: that of its executable, or of the script an interpreter runs.
+func policyPath(pinfo *procsnitch.Info) string {
+	cf := strings.Fields(pinfo.CmdLine)
+	if len(cf) > 1 && strings.HasPrefix(cf[1], "/") {
+		for _, intp := range _interpreters {
+			if strings.Contains(pinfo.ExePath, intp) {
+				return cf[1]
+			}
+		}
+	}
+	return pinfo.ExePath
+}
+
 func readFileDirect(filename string) ([]byte, error) {
 	bfilename, err := syscall.BytePtrFromString(filename)
 
@@ -573,6 +730,41 @@ func readFileDirect(filename string) ([]byte, error) {
 	return data, nil
 }
 
+// procNetFile returns the name of the /proc/net table that lists sockets
+// of the given protocol and address family.
+func procNetFile(proto string, ipv6 bool) string {
+	if ipv6 {
+		return proto + "6"
+	}
+	return proto
+}
+
+// readProcNetLines reads a /proc/net socket table and returns only the
+// socket entries, stripped of surrounding whitespace.
+func readProcNetLines(fname string) ([]string, error) {
+	bdata, err := readFileDirect(fname)
+
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(string(bdata), "\n")
+	rlines := make([]string, 0)
+
+	for l := 0; l < len(lines); l++ {
+		lines[l] = strings.TrimSpace(lines[l])
+		ssplit := strings.Split(lines[l], ":")
+
+		if len(ssplit) != 6 {
+			continue
+		}
+
+		rlines = append(rlines, strings.Join(ssplit, ":"))
+	}
+
+	return rlines, nil
+}
+
 func getAllProcNetDataLocal() ([]string, error) {
 	data := ""
 
@@ -613,6 +805,24 @@ func getAllProcNetDataLocal() ([]string, error) {
 	return rlines, nil
 }
 
+// lookupSocketProcess returns the Info procsnitch finds for the socket of a
+// connection, in the socket table lines rlines, or in those of the host if
+// nil.  icode is only used for ICMP and strictness for UDP.  procsnitch
+// hands out a copy of the Info on every lookup, which the queue workers may
+// change, and lookups run concurrently.
+func lookupSocketProcess(proto string, srcip net.IP, srcp uint16, dstip net.IP, dstp uint16, icode, strictness int, rlines []string) *procsnitch.Info {
+	switch proto {
+	case "tcp":
+		return procsnitch.LookupTCPSocketProcessAll(srcip, srcp, dstip, dstp, rlines)
+	case "udp":
+		return procsnitch.LookupUDPSocketProcessAll(srcip, srcp, dstip, dstp, rlines, strictness)
+	case "icmp":
+		return procsnitch.LookupICMPSocketProcessAll(srcip, dstip, icode, rlines)
+	}
+	log.Warningf("Unable to look up the process of a connection of unknown protocol: %s", proto)
+	return nil
+}
+
 func GetRealRoot(pathname string, pid int) string {
 	pfname := fmt.Sprintf("/proc/%d/root", pid)
 	lnk, err := os.Readlink(pfname)
@@ -641,10 +851,9 @@ func LookupSandboxProc(srcip net.IP, srcp uint16, dstip net.IP, dstp uint16, pro
 	OzInitPidsLock.Lock()
 
 	for i := 0; i < len(OzInitPids); i++ {
-		data := ""
-		fname := fmt.Sprintf("/proc/%d/net/%s", OzInitPids[i].Pid, proto)
+		fname := fmt.Sprintf("/proc/%d/net/%s", OzInitPids[i].Pid, procNetFile(proto, srcip.To4() == nil))
 		//fmt.Println("XXX: opening: ", fname)
-		bdata, err := readFileDirect(fname)
+		rlines, err := readProcNetLines(fname)
 
 		if err != nil {
 			fmt.Println("Error reading proc data from ", fname, ": ", err)
@@ -655,31 +864,9 @@ func LookupSandboxProc(srcip net.IP, srcp uint16, dstip net.IP, dstp uint16, pro
 
 			continue
 		} else {
-			data = string(bdata)
-			lines := strings.Split(data, "\n")
-			rlines := make([]string, 0)
-			for l := 0; l < len(lines); l++ {
-				lines[l] = strings.TrimSpace(lines[l])
-				ssplit := strings.Split(lines[l], ":")
-
-				if len(ssplit) != 6 {
-					continue
-				}
-
-				rlines = append(rlines, strings.Join(ssplit, ":"))
-			}
-
 			// log.Warningf("Looking for %s:%d => %s:%d \n %s\n******\n", srcip, srcp, dstip, dstp, data)
 
-			if proto == "tcp" {
-				res = procsnitch.LookupTCPSocketProcessAll(srcip, srcp, dstip, dstp, rlines)
-			} else if proto == "udp" {
-				res = procsnitch.LookupUDPSocketProcessAll(srcip, srcp, dstip, dstp, rlines, strictness)
-			} else if proto == "icmp" {
-				res = procsnitch.LookupICMPSocketProcessAll(srcip, dstip, icode, rlines)
-			} else {
-				fmt.Printf("unknown proto: %s", proto)
-			}
+			res = lookupSocketProcess(proto, srcip, srcp, dstip, dstp, icode, strictness, rlines)
 
 			if res != nil {
 				// optstr = "Sandbox: " + OzInitPids[i].Name
@@ -708,6 +895,7 @@ func findProcessForPacket(pkt *nfqueue.NFQPacket, reverse bool, strictness int)
 	proto := ""
 	optstr := ""
 	icode := -1
+	ipv6 := pkt.Packet.Layer(layers.LayerTypeIPv6) != nil
 
 	if reverse {
 		dstip, srcip = getPacketIPAddrs(pkt)
@@ -733,61 +921,55 @@ func findProcessForPacket(pkt *nfqueue.NFQPacket, reverse bool, strictness int)
 
 	// log.Noticef("XXX proto = %s, from %v : %v -> %v : %v\n", proto, srcip, srcp, dstip, dstp)
 
+	return findSocketProcess(proto, srcip, srcp, dstip, dstp, icode, ipv6, strictness, nil)
+}
+
+// findSocketProcess looks up the process of a connection in the socket
+// tables of the host, then in those of the sandboxes.  The tables are
+// taken from snap, or read at once without one.
+func findSocketProcess(proto string, srcip net.IP, srcp uint16, dstip net.IP, dstp uint16, icode int, ipv6 bool, strictness int, snap *procSnapshot) (*procsnitch.Info, string) {
 	var res *procsnitch.Info = nil
+	optstr := ""
 
 	// Try normal way first, before the more resource intensive/invasive way.
-	if proto == "tcp" {
-		res = procsnitch.LookupTCPSocketProcessAll(srcip, srcp, dstip, dstp, nil)
-	} else if proto == "udp" {
-		res = procsnitch.LookupUDPSocketProcessAll(srcip, srcp, dstip, dstp, nil, strictness)
-	} else if proto == "icmp" {
-		res = procsnitch.LookupICMPSocketProcessAll(srcip, dstip, icode, nil)
+	if snap == nil {
+		res = lookupSocketProcess(proto, srcip, srcp, dstip, dstp, icode, strictness, nil)
+	} else if rlines, err := snap.lines("/proc/net/" + procNetFile(proto, ipv6)); err != nil {
+		log.Warningf("Error reading proc data: %v", err)
+	} else {
+		res = lookupSocketProcess(proto, srcip, srcp, dstip, dstp, icode, strictness, rlines)
 	}
 
 	if res == nil {
 		removePids := make([]int, 0)
+		// packets are filtered by several workers at once
+		initProcs := ozInitProcs()
 
-		for i := 0; i < len(OzInitPids); i++ {
-			data := ""
-			fname := fmt.Sprintf("/proc/%d/net/%s", OzInitPids[i].Pid, proto)
+		for i := 0; i < len(initProcs); i++ {
+			fname := fmt.Sprintf("/proc/%d/net/%s", initProcs[i].Pid, procNetFile(proto, ipv6))
 			//fmt.Println("XXX: opening: ", fname)
-			bdata, err := readFileDirect(fname)
+			var rlines []string
+			var err error
+			if snap == nil {
+				rlines, err = readProcNetLines(fname)
+			} else {
+				rlines, err = snap.lines(fname)
+			}
 
 			if err != nil {
 				fmt.Println("Error reading proc data from ", fname, ": ", err)
 
 				if err == syscall.ENOENT {
-					removePids = append(removePids, OzInitPids[i].Pid)
+					removePids = append(removePids, initProcs[i].Pid)
 				}
 
 				continue
 			} else {
-				data = string(bdata)
-				lines := strings.Split(data, "\n")
-				rlines := make([]string, 0)
-
-				for l := 0; l < len(lines); l++ {
-					lines[l] = strings.TrimSpace(lines[l])
-					ssplit := strings.Split(lines[l], ":")
-
-					if len(ssplit) != 6 {
-						continue
-					}
-
-					rlines = append(rlines, strings.Join(ssplit, ":"))
-				}
-
-				if proto == "tcp" {
-					res = procsnitch.LookupTCPSocketProcessAll(srcip, srcp, dstip, dstp, rlines)
-				} else if proto == "udp" {
-					res = procsnitch.LookupUDPSocketProcessAll(srcip, srcp, dstip, dstp, rlines, strictness)
-				} else if proto == "icmp" {
-					res = procsnitch.LookupICMPSocketProcessAll(srcip, dstip, icode, rlines)
-				}
+				res = lookupSocketProcess(proto, srcip, srcp, dstip, dstp, icode, strictness, rlines)
 
 				if res != nil {
-					optstr = "Sandbox: " + OzInitPids[i].Name
-					res.ExePath = GetRealRoot(res.ExePath, OzInitPids[i].Pid)
+					optstr = "Sandbox: " + initProcs[i].Name
+					res.ExePath = GetRealRoot(res.ExePath, initProcs[i].Pid)
 					break
 				}
 			}
@@ -803,6 +985,70 @@ func findProcessForPacket(pkt *nfqueue.NFQPacket, reverse bool, strictness int)
 	return res, optstr
 }
 
+// procSnapshot holds the socket tables of the host and of the sandboxes,
+// and the sockets the processes hold, read once to look up the processes
+// of many connections, as when the open connections are judged again.
+// procsnitch scans all of /proc again for a socket it does not know the
+// process of, so the sockets no process holds, such as those left by
+// processes gone, are left out of the tables.
+type procSnapshot struct {
+	held   map[string]bool
+	tables map[string]procTable
+}
+
+type procTable struct {
+	lines []string
+	err   error
+}
+
+// newProcSnapshot lists the sockets held by every process.  The socket
+// tables are only read as they are needed.
+func newProcSnapshot() *procSnapshot {
+	s := &procSnapshot{held: make(map[string]bool), tables: make(map[string]procTable)}
+	for _, n := range readDirNames("/proc") {
+		if _, err := strconv.Atoi(n); err != nil {
+			continue
+		}
+		fdpath := "/proc/" + n + "/fd"
+		for _, fd := range readDirNames(fdpath) {
+			link, err := os.Readlink(fdpath + "/" + fd)
+			if err == nil && strings.HasPrefix(link, "socket:[") && strings.HasSuffix(link, "]") {
+				s.held[link[len("socket:["):len(link)-1]] = true
+			}
+		}
+	}
+	return s
+}
+
+// lines returns the entries of a socket table for lookupSocketProcess,
+// without those of the sockets no process holds.
+func (s *procSnapshot) lines(fname string) ([]string, error) {
+	if t, ok := s.tables[fname]; ok {
+		return t.lines, t.err
+	}
+	rlines, err := readProcNetLines(fname)
+	// never nil, which would have procsnitch read the table of the host
+	held := make([]string, 0, len(rlines))
+	for _, l := range rlines {
+		// the inode is the tenth field
+		if f := strings.Fields(l); len(f) > 9 && s.held[f[9]] {
+			held = append(held, l)
+		}
+	}
+	s.tables[fname] = procTable{held, err}
+	return held, err
+}
+
+func readDirNames(dir string) []string {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	names, _ := d.Readdirnames(0)
+	return names
+}
+
 func basicAllowPacket(pkt *nfqueue.NFQPacket) bool {
 	srcip, dstip := getPacketIPAddrs(pkt)
 	if pkt.Packet.Layer(layers.LayerTypeUDP) != nil {
@@ -816,6 +1062,18 @@ func basicAllowPacket(pkt *nfqueue.NFQPacket) bool {
 		// An ICMP dest unreach packet sent to ourselves probably isn't a big security risk.
 		return true
 	}
+	if icmp6, ok := pkt.Packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		if srcip.Equal(dstip) {
+			return true
+		}
+		// IPv6 stops working altogether without neighbor discovery.
+		switch icmp6.TypeCode.Type() {
+		case layers.ICMPv6TypeRouterSolicitation, layers.ICMPv6TypeRouterAdvertisement,
+			layers.ICMPv6TypeNeighborSolicitation, layers.ICMPv6TypeNeighborAdvertisement,
+			layers.ICMPv6TypeRedirect:
+			return true
+		}
+	}
 	return dstip.IsLoopback() ||
 		dstip.IsLinkLocalMulticast() ||
 		(pkt.Packet.Layer(layers.LayerTypeTCP) == nil &&
@@ -853,7 +1111,14 @@ func getpacketICMPCode(pkt *nfqueue.NFQPacket) (int, string) {
 	icmpLayer := pkt.Packet.Layer(layers.LayerTypeICMPv4)
 
 	if icmpLayer == nil {
-		return -1, ""
+		icmp6Layer := pkt.Packet.Layer(layers.LayerTypeICMPv6)
+
+		if icmp6Layer == nil {
+			return -1, ""
+		}
+
+		icmp6, _ := icmp6Layer.(*layers.ICMPv6)
+		return int(icmp6.TypeCode.Code()), icmp6.TypeCode.String()
 	}
 
 	icmp, _ := icmpLayer.(*layers.ICMPv4)
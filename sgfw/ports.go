@@ -0,0 +1,146 @@
+package sgfw
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portRange is an inclusive range of ports.  A single port has lo == hi,
+// and name is set when the port was given as a service name.
+type portRange struct {
+	lo   uint16
+	hi   uint16
+	name string
+}
+
+// portList is the port part of a rule target.  An empty list matches any port.
+type portList []portRange
+
+func (pl portList) matches(port uint16) bool {
+	if len(pl) == 0 {
+		return true
+	}
+	for _, pr := range pl {
+		if port >= pr.lo && port <= pr.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl portList) isAny() bool {
+	return len(pl) == 0
+}
+
+func (pl portList) String() string {
+	if len(pl) == 0 {
+		return "*"
+	}
+	items := make([]string, 0, len(pl))
+	for _, pr := range pl {
+		if pr.name != "" {
+			items = append(items, pr.name)
+		} else if pr.lo == pr.hi {
+			items = append(items, strconv.Itoa(int(pr.lo)))
+		} else {
+			items = append(items, fmt.Sprintf("%d-%d", pr.lo, pr.hi))
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// parsePortList parses the port part of a rule target, which is either
+// "*" or a comma separated list of ports, port ranges ("8000-8100") and
+// service names from /etc/services.
+func parsePortList(proto, p string) (portList, bool) {
+	p = strings.TrimSpace(p)
+	if p == "*" {
+		return nil, true
+	}
+	// an ICMP code of 0 has always meant "any code"
+	if proto == "icmp" && p == "0" {
+		return nil, true
+	}
+
+	var pl portList
+	for _, item := range strings.Split(p, ",") {
+		item = strings.TrimSpace(item)
+		pr, ok := parsePortItem(proto, item)
+		if !ok {
+			return nil, false
+		}
+		pl = append(pl, pr)
+	}
+	return pl, len(pl) > 0
+}
+
+func parsePortItem(proto, item string) (portRange, bool) {
+	if item == "" {
+		return portRange{}, false
+	}
+	if idx := strings.Index(item, "-"); idx > 0 {
+		lo, ok := parsePortNumber(proto, item[:idx])
+		if !ok {
+			return portRange{}, false
+		}
+		hi, ok := parsePortNumber(proto, item[idx+1:])
+		if !ok || hi < lo {
+			return portRange{}, false
+		}
+		return portRange{lo: lo, hi: hi}, true
+	}
+	if port, ok := parsePortNumber(proto, item); ok {
+		return portRange{lo: port, hi: port}, true
+	}
+	if proto == "icmp" {
+		return portRange{}, false
+	}
+	port, err := net.LookupPort(proto, item)
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return portRange{}, false
+	}
+	return portRange{lo: uint16(port), hi: uint16(port), name: item}, true
+}
+
+func parsePortNumber(proto, p string) (uint16, bool) {
+	port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+	if err != nil || (port == 0 && proto != "icmp") || port > 0xFFFF {
+		return 0, false
+	}
+	return uint16(port), true
+}
+
+// ValidPortSpec reports whether p is an acceptable port part of a rule
+// target for the given protocol.
+func ValidPortSpec(proto, p string) bool {
+	_, ok := parsePortList(proto, p)
+	return ok
+}
+
+// covers reports whether every port in other is also in pl.
+func (pl portList) covers(other portList) bool {
+	if pl.isAny() {
+		return true
+	}
+	if other.isAny() {
+		return false
+	}
+	for _, or := range other {
+		lo := uint32(or.lo)
+		for lo <= uint32(or.hi) {
+			next := lo
+			for _, pr := range pl {
+				if uint32(pr.lo) <= lo && uint32(pr.hi) >= next {
+					next = uint32(pr.hi) + 1
+				}
+			}
+			if next == lo {
+				return false
+			}
+			lo = next
+		}
+	}
+	return true
+}
@@ -2,7 +2,6 @@ package sgfw
 
 import (
 	"fmt"
-	"net"
 	"os/user"
 	"strconv"
 	"strings"
@@ -17,6 +16,9 @@ var DoMultiPrompt = true
 
 const MAX_PROMPTS = 5
 
+// The error a prompter answers with for prompts it closed without an answer
+const promptClosedError = "com.subgraph.FirewallPrompt.Closed"
+
 var outstandingPrompts = 0
 var promptLock = &sync.Mutex{}
 
@@ -25,6 +27,7 @@ func newPrompter(conn *dbus.Conn) *prompter {
 	p.cond = sync.NewCond(&p.lock)
 	p.dbusObj = conn.Object("com.subgraph.FirewallPrompt", "/com/subgraph/FirewallPrompt")
 	p.policyMap = make(map[string]*Policy)
+	p.cancels = make(map[pendingConnection]chan struct{})
 	go p.promptLoop()
 	return p
 }
@@ -35,6 +38,44 @@ type prompter struct {
 	cond        *sync.Cond
 	policyMap   map[string]*Policy
 	policyQueue []*Policy
+
+	// closed when the connection of a prompt is given a verdict elsewhere
+	cancelLock sync.Mutex
+	cancels    map[pendingConnection]chan struct{}
+	lastID     uint32
+}
+
+// watch returns the ID the prompt for a connection is requested with, and a
+// channel closed if the connection is given a verdict elsewhere.
+func (p *prompter) watch(pc pendingConnection) (uint32, chan struct{}) {
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+	c := make(chan struct{})
+	p.cancels[pc] = c
+	p.lastID++
+	return p.lastID, c
+}
+
+func (p *prompter) unwatch(pc pendingConnection) {
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+	delete(p.cancels, pc)
+}
+
+// cancel closes the prompt shown for a connection, if there is one.
+func (p *prompter) cancel(pc pendingConnection) {
+	p.cancelLock.Lock()
+	defer p.cancelLock.Unlock()
+	if c, ok := p.cancels[pc]; ok {
+		close(c)
+		delete(p.cancels, pc)
+	}
+}
+
+// closePrompt asks the prompter to close the prompt requested with id,
+// whether it is shown or still waits to be.
+func (p *prompter) closePrompt(id uint32) {
+	p.dbusObj.Go("com.subgraph.FirewallPrompt.ClosePrompt", dbus.FlagNoReplyExpected, nil, id)
 }
 
 func (p *prompter) prompt(policy *Policy) {
@@ -138,6 +179,13 @@ func (p *prompter) processConnection(pc pendingConnection) {
 		addr = pc.dst().String()
 	}
 	policy := pc.policy()
+	if policy.fw.inLockdown() {
+		log.Warningf("DENIED %s: network locked down, not prompting", pendingDesc(pc))
+		if policy.removePending(pc) {
+			pc.drop()
+		}
+		return
+	}
 
 	dststr := ""
 
@@ -147,7 +195,9 @@ func (p *prompter) processConnection(pc pendingConnection) {
 		dststr = addr + " (proxy to resolve)"
 	}
 
-	call := p.dbusObj.Call("com.subgraph.FirewallPrompt.RequestPrompt", 0,
+	id, cancelled := p.watch(pc)
+	defer p.unwatch(pc)
+	call := p.dbusObj.Go("com.subgraph.FirewallPrompt.RequestPrompt", 0, make(chan *dbus.Call, 1),
 		policy.application,
 		policy.icon,
 		policy.path,
@@ -166,15 +216,41 @@ func (p *prompter) processConnection(pc pendingConnection) {
 		pc.getOptString(),
 		FirewallConfig.PromptExpanded,
 		FirewallConfig.PromptExpert,
-		int32(FirewallConfig.DefaultActionID))
+		int32(FirewallConfig.DefaultActionID),
+		id)
+	select {
+	case <-call.Done:
+	case <-cancelled:
+		log.Infof("Closing prompt for %s, its connection was given a verdict", pc.procInfo().ExePath)
+		p.closePrompt(id)
+		return
+	}
 	err := call.Store(&scope, &rule)
+	if derr, ok := err.(dbus.Error); ok && derr.Name == promptClosedError {
+		// closed by the prompter without an answer, so it is shown again
+		go p.prompt(policy)
+		return
+	}
 	if err != nil {
 		log.Warningf("Error sending dbus RequestPrompt message: %v", err)
-		policy.removePending(pc)
-		pc.drop()
+		if policy.removePending(pc) {
+			pc.drop()
+		}
+		return
+	}
+	if policy.fw.inLockdown() {
+		log.Warningf("DENIED %s: network locked down while prompting", pendingDesc(pc))
+		if policy.removePending(pc) {
+			pc.drop()
+		}
 		return
 	}
+	p.applyAnswer(policy, pc, scope, rule)
+}
 
+// applyAnswer gives a connection the verdict the user answered its prompt
+// with, adding the rule for it unless it only applies once.
+func (p *prompter) applyAnswer(policy *Policy, pc pendingConnection, scope int32, rule string) {
 	// the prompt sends:
 	// ALLOW|dest or DENY|dest
 	//
@@ -195,7 +271,7 @@ func (p *prompter) processConnection(pc pendingConnection) {
 
 	tempRule := fmt.Sprintf("%s|%s", toks[0], toks[1])
 
-	if pc.src() != nil && !pc.src().Equal(net.ParseIP("127.0.0.1")) && sandbox != "" {
+	if pc.src() != nil && !pc.src().IsLoopback() && sandbox != "" {
 
 		//if !strings.HasSuffix(rule, "SYSTEM") && !strings.HasSuffix(rule, "||") {
 		//rule += "||"
@@ -209,17 +285,40 @@ func (p *prompter) processConnection(pc pendingConnection) {
 	r, err := policy.parseRule(tempRule, false)
 	if err != nil {
 		log.Warningf("Error parsing rule string returned from dbus RequestPrompt: %v", err)
-		policy.removePending(pc)
-		pc.drop()
+		if policy.removePending(pc) {
+			pc.drop()
+		}
 		return
 	}
+	r.author = RULE_AUTHOR_PROMPT
+	// the prompt for a connection from another host is answered with its
+	// remote host and local port
+	r.direction = pc.direction()
 	fscope := FilterScope(scope)
-	if fscope == APPLY_SESSION {
+	if fscope == APPLY_PARENT {
+		// only for the rest of the session, and only when started by the
+		// same program as this connection
+		if parent := newProcAncestry(pc.procInfo()).parent(); parent != "" {
+			r.mode = RULE_MODE_SESSION
+			r.ancestry = &ancestryMatch{kind: ancestryParent, path: parent}
+		} else {
+			log.Warningf("Parent of %s is unknown, applying rule once", pc.procInfo().ExePath)
+			fscope = APPLY_ONCE
+		}
+	} else if fscope == APPLY_SESSION {
 		r.mode = RULE_MODE_SESSION
 	} else if fscope == APPLY_PROCESS {
 		r.mode = RULE_MODE_PROCESS
 		r.pid = pc.procInfo().Pid
 		pcoroner.MonitorProcess(r.pid)
+	} else if d, ok := FilterScopeDuration[fscope]; ok {
+		// timed rules are kept in the rule file until they run out
+		r.mode = RULE_MODE_PERMANENT
+		r.expires = time.Now().Add(d)
+	}
+	repinned := false
+	if fscope != APPLY_ONCE && r.rtype != RULE_ACTION_DENY {
+		repinned = policy.updatePin(pc.procInfo())
 	}
 	if !policy.processNewRule(r, fscope) {
 		p.lock.Lock()
@@ -229,6 +328,8 @@ func (p *prompter) processConnection(pc pendingConnection) {
 	if fscope == APPLY_FOREVER {
 		r.mode = RULE_MODE_PERMANENT
 		policy.fw.saveRules()
+	} else if !r.expires.IsZero() || repinned {
+		policy.fw.saveRules()
 	}
 	//log.Warningf("Prompt returning rule: %v", tempRule)
 	dbusp.alertRule("sgfw prompt added new rule")
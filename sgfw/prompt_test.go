@@ -0,0 +1,66 @@
+package sgfw
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// When a connection is given a verdict while its prompt is shown, only that
+// prompt is closed.
+func TestClosePrompt(t *testing.T) {
+	bus := &testBusObject{}
+	pr := &prompter{dbusObj: bus, cancels: make(map[pendingConnection]chan struct{})}
+	fw := testFirewall()
+	p := fw.PolicyForPath("/usr/bin/curl")
+	pcs := []*pendingSocksConnection{testPendingSocks(p, time.Now()), testPendingSocks(p, time.Now())}
+	done := make(chan bool, len(pcs))
+	for _, pc := range pcs {
+		go func(pc *pendingSocksConnection) {
+			pr.processConnection(pc)
+			done <- true
+		}(pc)
+	}
+
+	// the ID of each prompt is the last argument of RequestPrompt
+	ids := map[string]bool{}
+	for start := time.Now(); len(ids) < len(pcs); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("prompts not requested: %v", bus.recorded())
+		}
+		for _, c := range bus.recorded() {
+			if strings.HasPrefix(c, "com.subgraph.FirewallPrompt.RequestPrompt") {
+				f := strings.Fields(strings.TrimSuffix(c, "]"))
+				ids[f[len(f)-1]] = true
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(ids) != len(pcs) {
+		t.Fatalf("prompts requested with the same ID: %v", bus.recorded())
+	}
+
+	pr.cancel(pcs[0])
+	<-done
+	var closed []string
+	for _, c := range bus.recorded() {
+		if strings.HasPrefix(c, "com.subgraph.FirewallPrompt.ClosePrompt") {
+			closed = append(closed, c)
+		}
+	}
+	if len(closed) != 1 {
+		t.Fatalf("prompts closed: %v", closed)
+	}
+	var id uint32
+	if _, err := fmt.Sscanf(closed[0], "com.subgraph.FirewallPrompt.ClosePrompt[%d]", &id); err != nil || !ids[fmt.Sprint(id)] {
+		t.Errorf("closed an unknown prompt: %s", closed[0])
+	}
+	select {
+	case <-done:
+		t.Error("the prompt of the other connection was given up as well")
+	case <-time.After(10 * time.Millisecond):
+	}
+	pr.cancel(pcs[1])
+	<-done
+}
@@ -0,0 +1,136 @@
+package sgfw
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+)
+
+// The most queues packets can be spread over
+const maxQueues = 64
+
+// queueCount returns how many queues new connections are spread over, each
+// with a worker of its own, so that a connection slow to attribute to a
+// process only holds up those in its queue.
+func queueCount() int {
+	switch n := FirewallConfig.QueueCount; {
+	case n < 1:
+		return 1
+	case n > maxQueues:
+		return maxQueues
+	default:
+		return n
+	}
+}
+
+// queueNum returns the number of the first queue.
+func queueNum() uint16 {
+	n := FirewallConfig.QueueNum
+	// room is left for the inbound queue after the others
+	if n < 0 || n+queueCount()+1 > 1<<16 {
+		log.Warningf("Invalid queue_num %d, using queue 0", n)
+		return 0
+	}
+	return uint16(n)
+}
+
+// inboundQueueNum returns the number of the queue of the connections from
+// other hosts, which follows the others.  They are told apart by their
+// queue rather than by their addresses, which may be those of this host.
+func inboundQueueNum() uint16 {
+	return queueNum() + uint16(queueCount())
+}
+
+// queueStats measures how long the worker of a queue takes to handle its
+// packets, which is how long the packets behind them wait.
+type queueStats struct {
+	packets uint64
+	total   int64 // nanoseconds
+	max     int64 // nanoseconds
+}
+
+func (s *queueStats) record(d time.Duration) {
+	atomic.AddUint64(&s.packets, 1)
+	atomic.AddInt64(&s.total, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&s.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// latency returns the number of packets handled, and the mean and longest
+// time taken by one.
+func (s *queueStats) latency() (uint64, time.Duration, time.Duration) {
+	n := atomic.LoadUint64(&s.packets)
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return n, time.Duration(atomic.LoadInt64(&s.total) / int64(n)), time.Duration(atomic.LoadInt64(&s.max))
+}
+
+// openQueues opens the queues and starts their workers, with the inbound
+// queue last if filter_inbound is set.  The queues are returned to be
+// closed on exit.
+func (fw *Firewall) openQueues() []*nfqueue.NFQueue {
+	n := queueCount()
+	if filterInbound() {
+		n++
+	}
+	queues := make([]*nfqueue.NFQueue, n)
+	stats := make([]*queueStats, n)
+	first := queueNum()
+	for i := range queues {
+		num := first + uint16(i)
+		q := nfqueue.NewNFQueue(num)
+		ps, err := q.Open()
+		if err != nil {
+			log.Fatalf("Error opening NFQueue %d: %v", num, err)
+		}
+		q.EnableHWTrace()
+		queues[i] = q
+		stats[i] = &queueStats{}
+		filter := fw.filterPacket
+		if num == inboundQueueNum() {
+			filter = fw.filterInboundPacket
+		}
+		go fw.filterQueue(ps, stats[i], filter)
+	}
+	fw.lock.Lock()
+	fw.queueStats = stats
+	fw.lock.Unlock()
+	log.Infof("Filtering packets from %d queues from queue %d", n, first)
+	return queues
+}
+
+// filterQueue filters the packets of a queue one at a time.
+func (fw *Firewall) filterQueue(ps <-chan *nfqueue.NFQPacket, stats *queueStats, filter func(*nfqueue.NFQPacket)) {
+	for p := range ps {
+		start := time.Now()
+		if fw.isEnabled() || fw.inLockdown() {
+			if p.Packet.Layer(layers.LayerTypeIPv4) == nil {
+				// The queue hands us everything decoded as IPv4, so IPv6
+				// packets have to be decoded again before we can use them.
+				if !decodeIPv6Packet(p) {
+					defaultVerdict(p)
+					continue
+				}
+			}
+
+			filter(p)
+		} else {
+			p.Accept()
+		}
+		stats.record(time.Since(start))
+	}
+}
+
+// getQueueStats returns the statistics of every queue, in order.
+func (fw *Firewall) getQueueStats() []*queueStats {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+	return fw.queueStats
+}
@@ -0,0 +1,135 @@
+package sgfw
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/subgraph/go-procsnitch"
+)
+
+func TestQueueBalance(t *testing.T) {
+	saved := FirewallConfig
+	defer func() { FirewallConfig = saved }()
+
+	for n, want := range map[int]int{0: 1, 1: 1, 4: 4, 1000: maxQueues} {
+		FirewallConfig.QueueCount = n
+		if got := queueCount(); got != want {
+			t.Errorf("queue_count %d gives %d queues, want %d", n, got, want)
+		}
+	}
+	FirewallConfig.QueueCount = 1
+	if !strings.HasSuffix(iptablesRule(), "--queue-num 0 --queue-bypass") {
+		t.Errorf("single queue rule: %s", iptablesRule())
+	}
+	FirewallConfig.QueueCount = 4
+	if !strings.HasSuffix(dnsRule(), "--queue-balance 0:3 --queue-bypass") {
+		t.Errorf("balanced rule: %s", dnsRule())
+	}
+	if r := nftRules()[0]; r.text != "ct state new queue num 0-3 bypass" {
+		t.Errorf("balanced nftables rule: %s", r.text)
+	}
+}
+
+// The workers of the queues match packets against the same rules while
+// they change.
+func TestConcurrentFiltering(t *testing.T) {
+	p := testPolicy(t, []string{
+		"ALLOW|*.example.com:443|SYSTEM|-1:-1||",
+		"DENY|10.1.2.0/24:*|SYSTEM|-1:-1||",
+	})
+	src := net.IP{192, 168, 1, 2}
+	pkt := testPacket(t, "tcp", src, net.IP{10, 1, 2, 3}, 443)
+	stats := &queueStats{}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				start := time.Now()
+				if r, _ := p.ruleIndex().filterPacket(pkt, testPInfo(), src, "www.example.com", ""); r != FILTER_ALLOW && r != FILTER_DENY {
+					t.Errorf("packet not matched: %v", r)
+				}
+				stats.record(time.Since(start))
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		p.lock.Lock()
+		processRuleLine(p, "ALLOW|10.9.0.0/16:22|SESSION|-1:-1||")
+		p.rulesChanged()
+		p.lock.Unlock()
+	}
+	wg.Wait()
+
+	if n, mean, max := stats.latency(); n != 800 || mean > max || max <= 0 {
+		t.Errorf("%d packets counted, mean %v, max %v", n, mean, max)
+	}
+}
+
+// The queue hands over every packet decoded as IPv4.
+func TestDecodeIPv6Packet(t *testing.T) {
+	src, dst := net.ParseIP("2001:db8::2"), net.ParseIP("2001:db8::1")
+	pkt := testPacket(t, "udp", src, dst, 53)
+	pkt.Packet = gopacket.NewPacket(pkt.Packet.Data(), layers.LayerTypeIPv4, gopacket.Default)
+	if !decodeIPv6Packet(pkt) {
+		t.Fatalf("IPv6 packet not decoded")
+	}
+	if s, d := getPacketIPAddrs(pkt); !s.Equal(src) || !d.Equal(dst) {
+		t.Errorf("decoded as %s -> %s", s, d)
+	}
+	if _, port := getPacketUDPPorts(pkt); port != 53 {
+		t.Errorf("decoded with port %d", port)
+	}
+
+	pkt = testPacket(t, "tcp", net.ParseIP("192.0.2.2").To4(), net.ParseIP("192.0.2.1").To4(), 80)
+	if decodeIPv6Packet(pkt) || pkt.Packet.Layer(layers.LayerTypeIPv4) == nil {
+		t.Errorf("IPv4 packet decoded as IPv6")
+	}
+}
+
+// The workers of the queues each get an Info of their own for the process
+// of a connection, which they may change.
+func TestConcurrentProcessLookup(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	local, remote := conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	lookup := func() *procsnitch.Info {
+		return lookupSocketProcess("tcp", local.IP, uint16(local.Port), remote.IP, uint16(remote.Port), -1, procsnitch.MATCH_STRICT, nil)
+	}
+	if pinfo := lookup(); pinfo == nil {
+		t.Skip("unable to look up the sockets of this process")
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				pinfo := lookup()
+				if pinfo == nil || pinfo.Sandbox != "" {
+					t.Errorf("lookup gave %+v", pinfo)
+					return
+				}
+				pinfo.Sandbox = fmt.Sprintf("worker%d", w)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
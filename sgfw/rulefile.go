@@ -0,0 +1,375 @@
+package sgfw
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version of the rule file format written by this daemon.  Version 1 is the
+// line based format read by loadLegacyRules.
+const ruleFileVersion = 2
+
+type ruleFileData struct {
+	Version  int            `json:"version"`
+	Policies []policyRecord `json:"policies"`
+}
+
+type policyRecord struct {
+	Sandbox string       `json:"sandbox"`
+	Path    string       `json:"path"`
+	Hash    string       `json:"hash,omitempty"`
+	Audit   bool         `json:"audit,omitempty"`
+	Rules   []ruleRecord `json:"rules"`
+	extra   map[string]json.RawMessage
+}
+
+type ruleRecord struct {
+	ID      string     `json:"id"`
+	Verb    string     `json:"verb"`
+	Target  string     `json:"target"`
+	Mode    string     `json:"mode"`
+	Privs   string     `json:"privs,omitempty"`
+	Sandbox string     `json:"sandbox,omitempty"`
+	Source  string     `json:"source,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Parent  string     `json:"parent,omitempty"`
+	CGroup  string     `json:"cgroup,omitempty"`
+	Created *time.Time `json:"created,omitempty"`
+	Author  string     `json:"author,omitempty"`
+	Comment string     `json:"comment,omitempty"`
+	Hits    uint64     `json:"hits,omitempty"`
+	LastHit *time.Time `json:"last_hit,omitempty"`
+	// "IN" for a rule on the connections an application accepts
+	Direction string `json:"direction,omitempty"`
+	extra     map[string]json.RawMessage
+}
+
+// Fields this version does not know about are kept, so that a rule file
+// written by a newer daemon survives being saved by an older one.
+
+func (pr *policyRecord) UnmarshalJSON(b []byte) error {
+	type plain policyRecord
+	if err := json.Unmarshal(b, (*plain)(pr)); err != nil {
+		return err
+	}
+	var err error
+	pr.extra, err = unknownFields(b, plain{})
+	return err
+}
+
+func (pr policyRecord) MarshalJSON() ([]byte, error) {
+	type plain policyRecord
+	return marshalWithExtra(plain(pr), pr.extra)
+}
+
+func (rr *ruleRecord) UnmarshalJSON(b []byte) error {
+	type plain ruleRecord
+	if err := json.Unmarshal(b, (*plain)(rr)); err != nil {
+		return err
+	}
+	var err error
+	rr.extra, err = unknownFields(b, plain{})
+	return err
+}
+
+func (rr ruleRecord) MarshalJSON() ([]byte, error) {
+	type plain ruleRecord
+	return marshalWithExtra(plain(rr), rr.extra)
+}
+
+func jsonFieldName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// unknownFields returns the members of a JSON object which do not belong to
+// any field of the struct v.
+func unknownFields(b []byte, v interface{}) (map[string]json.RawMessage, error) {
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		delete(all, jsonFieldName(t.Field(i)))
+	}
+	if len(all) == 0 {
+		return nil, nil
+	}
+	return all, nil
+}
+
+func marshalWithExtra(v interface{}, extra map[string]json.RawMessage) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if _, ok := all[k]; !ok {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
+}
+
+// newRuleUUID returns a random identifier which stays with a rule for as long
+// as it is stored, unlike the rule id which is only valid until the rules are
+// reloaded.
+func newRuleUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Warningf("Unable to generate rule identifier: %v", err)
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+func (r *Rule) privString() string {
+	ustr := strconv.Itoa(r.uid)
+	if r.uname != "" {
+		ustr = r.uname
+	}
+	gstr := strconv.Itoa(r.gid)
+	if r.gname != "" {
+		gstr = r.gname
+	}
+	return ustr + ":" + gstr
+}
+
+func (r *Rule) targetString() string {
+	if r.proto != "tcp" {
+		return r.proto + ":" + r.AddrString(false)
+	}
+	return r.AddrString(false)
+}
+
+func (r *Rule) record() ruleRecord {
+	rec := ruleRecord{
+		ID:      r.uuid,
+		Verb:    RuleActionString[r.rtype],
+		Target:  r.targetString(),
+		Mode:    RuleModeString[r.mode],
+		Privs:   r.privString(),
+		Sandbox: r.sandbox,
+		Parent:  r.ancestry.String(),
+		CGroup:  r.cgroup.String(),
+		Author:  r.author,
+		Comment: r.comment,
+		extra:   r.fileExtra,
+	}
+	if r.saddr != nil {
+		rec.Source = r.saddr.String()
+	}
+	if r.direction == RULE_DIRECTION_IN {
+		rec.Direction = RuleDirectionString[RULE_DIRECTION_IN]
+	}
+	if !r.expires.IsZero() {
+		t := r.expires.UTC()
+		rec.Expires = &t
+	}
+	if !r.created.IsZero() {
+		t := r.created.UTC()
+		rec.Created = &t
+	}
+	rec.Hits = r.hitCount()
+	if last := r.lastHit(); !last.IsZero() {
+		t := last.UTC()
+		rec.LastHit = &t
+	}
+	return rec
+}
+
+func (r *Rule) parseRecord(rec ruleRecord) bool {
+	r.addr = noAddress
+	r.saddr = nil
+
+	switch rec.Mode {
+	case RuleModeString[RULE_MODE_SYSTEM]:
+		r.mode = RULE_MODE_SYSTEM
+	case RuleModeString[RULE_MODE_PERMANENT], "":
+		r.mode = RULE_MODE_PERMANENT
+	case RuleModeString[RULE_MODE_SESSION]:
+		// only found in exported rules
+		r.mode = RULE_MODE_SESSION
+	default:
+		log.Notice("invalid rule mode ", rec.Mode, " in rule ", rec.ID)
+		return false
+	}
+	if !r.parsePrivs(rec.Privs) || !r.parseSandbox(rec.Sandbox) {
+		return false
+	}
+	if rec.Source != "" {
+		if r.saddr = net.ParseIP(rec.Source); r.saddr == nil {
+			log.Notice("invalid source IP ", rec.Source, " in rule ", rec.ID)
+			return false
+		}
+	}
+	r.expires = time.Time{}
+	if rec.Expires != nil {
+		r.expires = *rec.Expires
+	}
+	r.ancestry, r.cgroup = nil, nil
+	if rec.Parent != "" {
+		am, ok := parseAncestry(rec.Parent)
+		if !ok {
+			log.Notice("invalid process ancestry ", rec.Parent, " in rule ", rec.ID)
+			return false
+		}
+		r.ancestry = am
+	}
+	if rec.CGroup != "" {
+		cm, ok := parseCGroupMatch(rec.CGroup)
+		if !ok {
+			log.Notice("invalid cgroup ", rec.CGroup, " in rule ", rec.ID)
+			return false
+		}
+		r.cgroup = cm
+	}
+	if !r.parseDirection(rec.Direction) {
+		log.Notice("invalid direction ", rec.Direction, " in rule ", rec.ID)
+		return false
+	}
+
+	r.uuid = rec.ID
+	if r.uuid == "" {
+		r.uuid = newRuleUUID()
+	}
+	r.created = time.Time{}
+	if rec.Created != nil {
+		r.created = *rec.Created
+	}
+	r.author = rec.Author
+	r.comment = rec.Comment
+	last := time.Time{}
+	if rec.LastHit != nil {
+		last = *rec.LastHit
+	}
+	r.setStats(rec.Hits, last)
+	r.fileExtra = rec.extra
+	return r.parseVerb(rec.Verb) && r.parseTarget(rec.Target)
+}
+
+func (p *Policy) parseRecord(rec ruleRecord) (*Rule, error) {
+	r := new(Rule)
+	r.pid = -1
+	r.policy = p
+	if !r.parseRecord(rec) {
+		return nil, fmt.Errorf("unable to parse rule %s: %s|%s", rec.ID, rec.Verb, rec.Target)
+	}
+	p.fw.addRule(r)
+	return r, nil
+}
+
+func (p *Policy) record() policyRecord {
+	pr := policyRecord{
+		Sandbox: p.sandbox,
+		Path:    p.path,
+		Hash:    p.pinnedHash,
+		Audit:   p.audit,
+		Rules:   []ruleRecord{},
+		extra:   p.fileExtra,
+	}
+	for _, r := range p.rules {
+		if r.sourceFile == "" && (r.mode == RULE_MODE_PERMANENT || r.mode == RULE_MODE_SYSTEM) {
+			pr.Rules = append(pr.Rules, r.record())
+		}
+	}
+	// rules which could not be parsed are written back unchanged
+	pr.Rules = append(pr.Rules, p.unparsed...)
+	return pr
+}
+
+func (fw *Firewall) marshalRules() ([]byte, error) {
+	data := ruleFileData{Version: ruleFileVersion, Policies: []policyRecord{}}
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		if p.hasPersistentRules() || len(p.unparsed) > 0 || p.audit {
+			data.Policies = append(data.Policies, p.record())
+		}
+		p.lock.Unlock()
+	}
+	bs, err := json.MarshalIndent(data, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(bs, '\n'), nil
+}
+
+// decodeRuleFile parses rules in the format of the rule file.
+func decodeRuleFile(bs []byte) (ruleFileData, error) {
+	var data ruleFileData
+	if err := json.Unmarshal(bs, &data); err != nil {
+		return data, err
+	}
+	if data.Version > ruleFileVersion {
+		return data, fmt.Errorf("rule file version %d is newer than the supported version %d", data.Version, ruleFileVersion)
+	}
+	return data, nil
+}
+
+func (fw *Firewall) loadRulesJSON(bs []byte) error {
+	data, err := decodeRuleFile(bs)
+	if err != nil {
+		return err
+	}
+
+	for _, pr := range data.Policies {
+		policy := fw.policyForPathAndSandbox(pr.Path, pr.Sandbox)
+		policy.lock.Lock()
+		policy.fileExtra = pr.extra
+		policy.setPinnedHash(pr.Hash)
+		policy.audit = pr.Audit
+		policy.lock.Unlock()
+
+		for _, rec := range pr.Rules {
+			r, err := policy.parseRecord(rec)
+			policy.lock.Lock()
+			if err != nil {
+				log.Warningf("Error parsing rule for %s: %v", pr.Path, err)
+				policy.unparsed = append(policy.unparsed, rec)
+			} else {
+				policy.rules = append(policy.rules, r)
+			}
+			policy.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+// migrateLegacyRules converts the line based rule file of older versions.
+// The old file is kept under a new name, and is not read again.
+func (fw *Firewall) migrateLegacyRules() bool {
+	bs, err := ioutil.ReadFile(legacyRuleFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warningf("Failed to open %s for reading: %v", legacyRuleFile, err)
+		}
+		return false
+	}
+	log.Noticef("Migrating rules from %s to %s", legacyRuleFile, ruleFile)
+	fw.loadLegacyRules(bs)
+	if err := fw.writeRules(); err != nil {
+		log.Warningf("Failed to save migrated rules: %v", err)
+		return true
+	}
+	if err := os.Rename(legacyRuleFile, legacyRuleFile+".migrated"); err != nil {
+		log.Warningf("Failed to rename %s after migration: %v", legacyRuleFile, err)
+	}
+	return true
+}
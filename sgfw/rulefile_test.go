@@ -0,0 +1,144 @@
+package sgfw
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testFirewall() *Firewall {
+	return &Firewall{policyMap: make(map[string]*Policy)}
+}
+
+func TestRuleFileMigratesLegacyRules(t *testing.T) {
+	fw := testFirewall()
+	fw.loadLegacyRules([]byte(strings.Join([]string{
+		"# comment",
+		"[|/usr/bin/curl|sha256:" + strings.Repeat("ab", 32) + "]",
+		"ALLOW|example.com:443|PERMANENT|nobody:-1|",
+		"DENY|udp:10.0.0.0/8:53|SYSTEM|-1:-1||192.168.1.2|1700000000|parent:/usr/bin/bash|unit:cron.service",
+		"[oz|/usr/bin/wget]",
+		"ALLOW|*:80|PERMANENT|-1:-1|oz",
+	}, "\n")))
+
+	bs, err := fw.marshalRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := testFirewall()
+	if err := loaded.loadRulesJSON(bs); err != nil {
+		t.Fatalf("failed to read back migrated rules: %v\n%s", err, bs)
+	}
+
+	if len(loaded.policies) != 2 {
+		t.Fatalf("expected 2 policies, got %d", len(loaded.policies))
+	}
+	curl := loaded.policyMap["|/usr/bin/curl"]
+	if curl == nil || len(curl.rules) != 2 {
+		t.Fatalf("curl policy not restored: %v", curl)
+	}
+	if curl.pinnedHash != fw.policyMap["|/usr/bin/curl"].pinnedHash {
+		t.Errorf("pinned hash not kept: %q", curl.pinnedHash)
+	}
+	for i, r := range curl.rules {
+		orig := fw.policyMap["|/usr/bin/curl"].rules[i]
+		if r.String() != orig.String() {
+			t.Errorf("rule changed by migration: %q, want %q", r.String(), orig.String())
+		}
+		if r.uuid == "" || r.uuid != orig.uuid {
+			t.Errorf("rule identifier not kept: %q, want %q", r.uuid, orig.uuid)
+		}
+		if !r.created.IsZero() {
+			t.Errorf("migrated rule has a creation time: %v", r.created)
+		}
+	}
+	if curl.rules[0].uname != "nobody" {
+		t.Errorf("user name not kept: %q", curl.rules[0].uname)
+	}
+	if wget := loaded.policyMap["oz|/usr/bin/wget"]; wget == nil || len(wget.rules) != 1 || wget.rules[0].sandbox != "oz" {
+		t.Errorf("sandboxed policy not restored: %v", wget)
+	}
+}
+
+func TestRuleFileKeepsMetadataAndUnknownFields(t *testing.T) {
+	in := `{
+	"version": 2,
+	"policies": [
+		{
+			"sandbox": "",
+			"path": "/usr/bin/curl",
+			"future": [1, 2],
+			"rules": [
+				{
+					"id": "r1",
+					"verb": "ALLOW",
+					"target": "*.example.com:443",
+					"mode": "PERMANENT",
+					"created": "2024-03-01T10:00:00Z",
+					"author": "alice",
+					"comment": "package downloads",
+					"future": {"x": true}
+				},
+				{
+					"id": "r2",
+					"verb": "FROBNICATE",
+					"target": "*:*",
+					"mode": "PERMANENT"
+				}
+			]
+		}
+	]
+}`
+	fw := testFirewall()
+	if err := fw.loadRulesJSON([]byte(in)); err != nil {
+		t.Fatal(err)
+	}
+	p := fw.policyMap["|/usr/bin/curl"]
+	if len(p.rules) != 1 || len(p.unparsed) != 1 {
+		t.Fatalf("expected 1 rule and 1 unparsed record, got %d and %d", len(p.rules), len(p.unparsed))
+	}
+	r := p.rules[0]
+	if r.uuid != "r1" || r.author != "alice" || r.comment != "package downloads" || r.created.Year() != 2024 {
+		t.Errorf("metadata not loaded: %+v", r)
+	}
+
+	bs, err := fw.marshalRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Policies []map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(bs, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !jsonEqual(out.Policies[0]["future"], `[1,2]`) {
+		t.Errorf("unknown policy field lost: %s", bs)
+	}
+	var rules []map[string]json.RawMessage
+	if err := json.Unmarshal(out.Policies[0]["rules"], &rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules to be written back, got %d", len(rules))
+	}
+	if !jsonEqual(rules[0]["future"], `{"x":true}`) {
+		t.Errorf("unknown rule field lost: %s", bs)
+	}
+	if string(rules[1]["verb"]) != `"FROBNICATE"` {
+		t.Errorf("unparsed rule not written back: %s", bs)
+	}
+}
+
+func jsonEqual(raw json.RawMessage, want string) bool {
+	var buf bytes.Buffer
+	return json.Compact(&buf, raw) == nil && buf.String() == want
+}
+
+func TestRuleFileRejectsNewerVersion(t *testing.T) {
+	fw := testFirewall()
+	if err := fw.loadRulesJSON([]byte(`{"version": 3, "policies": []}`)); err == nil {
+		t.Error("expected an error for a newer rule file version")
+	}
+}
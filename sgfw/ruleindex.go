@@ -0,0 +1,349 @@
+package sgfw
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+// Rules whose port list expands to more ports than this are kept in the
+// any-port bucket instead of being added under every single port.
+const maxIndexedPorts = 64
+
+// ruleIndex is an immutable, compiled view of a policy's rules.  Looking up
+// a packet only yields the rules that could possibly match it, which are
+// then evaluated by RuleList.filter in their original order, so the first
+// matching rule still wins.  A new index is built whenever the rules of a
+// policy change; it is never modified once it has been published.  It holds
+// the rules on the connections an application opens, and those on the ones
+// it accepts are in an index of their own.  Both have another index of
+// just their DENY rules, which are all that apply to an executable that no
+// longer matches its pinned hash.
+type ruleIndex struct {
+	rules   RuleList
+	protos  map[string]*protoRuleIndex
+	inbound *ruleIndex
+	denying *ruleIndex
+}
+
+type protoRuleIndex struct {
+	ports   map[uint16]*addrRuleIndex
+	anyPort *addrRuleIndex
+}
+
+type addrRuleIndex struct {
+	any    []int
+	exact  map[string][]int
+	nets   *ipTrieNode
+	hosts  *hostTrieNode
+	hostRe []int
+}
+
+// ipTrieNode is a node of a binary trie over the 128 bits of an IPv6 (or
+// IPv4-mapped) address.  rules holds the networks ending at this node.
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	rules    []int
+}
+
+// hostTrieNode is a node of a trie over hostname labels, starting from the
+// top level domain.
+type hostTrieNode struct {
+	children map[string]*hostTrieNode
+	exact    []int // patterns naming exactly this host
+	suffix   []int // this host and every name below it
+	below    []int // only names below it, narrowed further by the pattern
+}
+
+var emptyRuleIndex = newRuleIndex(nil)
+
+func newRuleIndex(rules RuleList) *ruleIndex {
+	var out, in RuleList
+	for _, r := range rules {
+		if r.direction == RULE_DIRECTION_IN {
+			in = append(in, r)
+		} else {
+			out = append(out, r)
+		}
+	}
+	ix := indexRules(out)
+	ix.denying = indexRules(denyRules(out))
+	ix.inbound = indexRules(in)
+	ix.inbound.denying = indexRules(denyRules(in))
+	return ix
+}
+
+func denyRules(rules RuleList) RuleList {
+	var deny RuleList
+	for _, r := range rules {
+		if r.rtype == RULE_ACTION_DENY {
+			deny = append(deny, r)
+		}
+	}
+	return deny
+}
+
+func indexRules(rules RuleList) *ruleIndex {
+	ix := &ruleIndex{
+		rules:  rules,
+		protos: make(map[string]*protoRuleIndex),
+	}
+	for i, r := range ix.rules {
+		pi := ix.protos[r.proto]
+		if pi == nil {
+			pi = &protoRuleIndex{ports: make(map[uint16]*addrRuleIndex), anyPort: newAddrRuleIndex()}
+			ix.protos[r.proto] = pi
+		}
+		pi.add(i, r)
+	}
+	return ix
+}
+
+func (pi *protoRuleIndex) add(i int, r *Rule) {
+	count := 0
+	for _, pr := range r.ports {
+		count += int(pr.hi) - int(pr.lo) + 1
+	}
+	if r.ports.isAny() || count > maxIndexedPorts {
+		pi.anyPort.add(i, r)
+		return
+	}
+	for _, pr := range r.ports {
+		for port := int(pr.lo); port <= int(pr.hi); port++ {
+			ai := pi.ports[uint16(port)]
+			if ai == nil {
+				ai = newAddrRuleIndex()
+				pi.ports[uint16(port)] = ai
+			}
+			ai.add(i, r)
+		}
+	}
+}
+
+func newAddrRuleIndex() *addrRuleIndex {
+	return &addrRuleIndex{
+		exact: make(map[string][]int),
+		nets:  &ipTrieNode{},
+		hosts: &hostTrieNode{},
+	}
+}
+
+func (ai *addrRuleIndex) add(i int, r *Rule) {
+	switch {
+	case addrMatchesAny(r.addr):
+		ai.any = append(ai.any, i)
+	case r.hostname != "":
+		ai.addHost(i, r.hostpat)
+	case r.network != nil:
+		ip, bits := trieKey(r.network)
+		ai.nets.insert(ip, bits, i)
+	default:
+		key := string(r.addr.To16())
+		ai.exact[key] = append(ai.exact[key], i)
+	}
+}
+
+func (ai *addrRuleIndex) addHost(i int, hp *hostPattern) {
+	if hp == nil {
+		return
+	}
+	switch hp.kind {
+	case hostPatternExact:
+		n := ai.hosts.node(hostLabels(hp.name))
+		n.exact = append(n.exact, i)
+	case hostPatternSuffix:
+		n := ai.hosts.node(hostLabels(hp.name))
+		n.suffix = append(n.suffix, i)
+	case hostPatternWildcard:
+		// index on the labels following the last wildcard
+		labels := strings.Split(hp.name, ".")
+		fixed := len(labels)
+		for fixed > 0 && !strings.Contains(labels[fixed-1], "*") {
+			fixed--
+		}
+		n := ai.hosts.node(hostLabels(strings.Join(labels[fixed:], ".")))
+		n.below = append(n.below, i)
+	default:
+		ai.hostRe = append(ai.hostRe, i)
+	}
+}
+
+func (ai *addrRuleIndex) lookup(res []int, src, dst net.IP, hostname []string, icmp bool) []int {
+	res = append(res, ai.any...)
+	res = ai.lookupIP(res, dst)
+	if icmp && src != nil {
+		res = ai.lookupIP(res, src)
+	}
+	if hostname != nil {
+		res = ai.hosts.lookup(res, hostname)
+		res = append(res, ai.hostRe...)
+	}
+	return res
+}
+
+func (ai *addrRuleIndex) lookupIP(res []int, ip net.IP) []int {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return res
+	}
+	res = append(res, ai.exact[string(ip16)]...)
+	return ai.nets.lookup(res, ip16)
+}
+
+// trieKey returns the 16 byte form of a network and its prefix length
+// within it.
+func trieKey(n *net.IPNet) (net.IP, int) {
+	ones, bits := n.Mask.Size()
+	ip := n.IP.To16()
+	if bits == 8*net.IPv4len {
+		ones += 8 * (net.IPv6len - net.IPv4len)
+	}
+	return ip, ones
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>uint(7-i%8)) & 1
+}
+
+func (t *ipTrieNode) insert(ip net.IP, bits, i int) {
+	n := t
+	for b := 0; b < bits; b++ {
+		c := ipBit(ip, b)
+		if n.children[c] == nil {
+			n.children[c] = &ipTrieNode{}
+		}
+		n = n.children[c]
+	}
+	n.rules = append(n.rules, i)
+}
+
+func (t *ipTrieNode) lookup(res []int, ip net.IP) []int {
+	n := t
+	for b := 0; n != nil; b++ {
+		res = append(res, n.rules...)
+		if b == 8*net.IPv6len {
+			break
+		}
+		n = n.children[ipBit(ip, b)]
+	}
+	return res
+}
+
+// hostLabels splits a normalized hostname into its labels, top level
+// domain first.
+func hostLabels(name string) []string {
+	if name == "" {
+		return []string{}
+	}
+	labels := strings.Split(name, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+func (t *hostTrieNode) node(labels []string) *hostTrieNode {
+	n := t
+	for _, l := range labels {
+		if n.children == nil {
+			n.children = make(map[string]*hostTrieNode)
+		}
+		c := n.children[l]
+		if c == nil {
+			c = &hostTrieNode{}
+			n.children[l] = c
+		}
+		n = c
+	}
+	return n
+}
+
+func (t *hostTrieNode) lookup(res []int, labels []string) []int {
+	n := t
+	for i := 0; ; i++ {
+		res = append(res, n.suffix...)
+		if i == len(labels) {
+			return append(res, n.exact...)
+		}
+		res = append(res, n.below...)
+		n = n.children[labels[i]]
+		if n == nil {
+			return res
+		}
+	}
+}
+
+// candidates returns the rules that could match a packet, in policy order.
+func (ix *ruleIndex) candidates(proto string, src, dst net.IP, dstPort uint16, hostname string) RuleList {
+	pi := ix.protos[proto]
+	if pi == nil {
+		return nil
+	}
+	var labels []string
+	if hostname != "" {
+		labels = hostLabels(normalizeHostname(hostname))
+	}
+	icmp := proto == "icmp"
+	var idx []int
+	if ai := pi.ports[dstPort]; ai != nil {
+		idx = ai.lookup(idx, src, dst, labels, icmp)
+	}
+	idx = pi.anyPort.lookup(idx, src, dst, labels, icmp)
+	if len(idx) == 0 {
+		return nil
+	}
+
+	sort.Ints(idx)
+	result := make(RuleList, 0, len(idx))
+	for i, n := range idx {
+		if i == 0 || n != idx[i-1] {
+			result = append(result, ix.rules[n])
+		}
+	}
+	return result
+}
+
+// filterPacket filters a queued packet, returning the rule that decided it
+// as well.
+func (ix *ruleIndex) filterPacket(p *nfqueue.NFQPacket, pinfo *procsnitch.Info, srcip net.IP, hostname, optstr string) (FilterResult, *Rule) {
+	_, dstip := getPacketIPAddrs(p)
+	_, dstp := getPacketPorts(p)
+	result, r := ix.match(p, srcip, dstip, dstp, hostname, pinfo, optstr)
+	if r != nil {
+		r.hit(time.Now())
+	}
+	return result, r
+}
+
+// filter evaluates the indexed rules with the same results as
+// RuleList.filter.  Connections which did not come in as a packet are
+// decided by the first applicable rule in the list alone, so those are
+// still checked against the whole list.
+func (ix *ruleIndex) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint16, hostname string, pinfo *procsnitch.Info, optstr string) FilterResult {
+	result, r := ix.match(pkt, src, dst, dstPort, hostname, pinfo, optstr)
+	if r != nil {
+		r.hit(time.Now())
+	}
+	return result
+}
+
+// direction returns the index of the rules on the connections going in
+// direction dir.
+func (ix *ruleIndex) direction(dir RuleDirection) *ruleIndex {
+	if dir == RULE_DIRECTION_IN {
+		return ix.inbound
+	}
+	return ix
+}
+
+func (ix *ruleIndex) match(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint16, hostname string, pinfo *procsnitch.Info, optstr string) (FilterResult, *Rule) {
+	if pkt == nil {
+		return ix.rules.match(pkt, src, dst, dstPort, hostname, pinfo, optstr)
+	}
+	rl := ix.candidates(getNFQProto(pkt), src, dst, dstPort, hostname)
+	return rl.match(pkt, src, dst, dstPort, hostname, pinfo, optstr)
+}
@@ -0,0 +1,185 @@
+package sgfw
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
+	"github.com/subgraph/go-procsnitch"
+)
+
+func testPacket(t testing.TB, proto string, src, dst net.IP, dstPort uint16) *nfqueue.NFQPacket {
+	ip4 := &layers.IPv4{Version: 4, TTL: 64, SrcIP: src, DstIP: dst}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: src, DstIP: dst}
+	var ipl gopacket.NetworkLayer = ip4
+	first := layers.LayerTypeIPv4
+	if dst.To4() == nil {
+		ipl = ip6
+		first = layers.LayerTypeIPv6
+	}
+
+	var l4 gopacket.SerializableLayer
+	switch proto {
+	case "tcp":
+		tcp := &layers.TCP{SrcPort: 40000, DstPort: layers.TCPPort(dstPort), SYN: true, Window: 1024}
+		tcp.SetNetworkLayerForChecksum(ipl)
+		ip4.Protocol, ip6.NextHeader, l4 = layers.IPProtocolTCP, layers.IPProtocolTCP, tcp
+	case "udp":
+		udp := &layers.UDP{SrcPort: 40000, DstPort: layers.UDPPort(dstPort)}
+		udp.SetNetworkLayerForChecksum(ipl)
+		ip4.Protocol, ip6.NextHeader, l4 = layers.IPProtocolUDP, layers.IPProtocolUDP, udp
+	default:
+		ip4.Protocol, l4 = layers.IPProtocolICMPv4, &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)}
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ipl.(gopacket.SerializableLayer), l4); err != nil {
+		t.Fatalf("failed to build test packet: %v", err)
+	}
+	return &nfqueue.NFQPacket{Packet: gopacket.NewPacket(buf.Bytes(), first, gopacket.Default)}
+}
+
+func testPolicy(t testing.TB, rules []string) *Policy {
+	p := &Policy{fw: &Firewall{}}
+	for _, s := range rules {
+		processRuleLine(p, s)
+	}
+	if len(p.rules) != len(rules) {
+		t.Fatalf("only %d of %d rules could be parsed", len(p.rules), len(rules))
+	}
+	p.rulesChanged()
+	return p
+}
+
+func testPInfo() *procsnitch.Info {
+	pinfo := getEmptyPInfo()
+	pinfo.UID, pinfo.GID, pinfo.Pid = 1000, 1000, 4242
+	pinfo.ExePath = "/usr/bin/test"
+	return pinfo
+}
+
+func TestRuleIndexMatchesLinearScan(t *testing.T) {
+	p := testPolicy(t, []string{
+		"DENY|evil.example.com:443|SYSTEM|-1:-1||",
+		"ALLOW|*.example.com:443|SYSTEM|-1:-1||",
+		"ALLOW|.ntp.org:123|SYSTEM|-1:-1||",
+		"DENY|udp:.ntp.org:123|SYSTEM|-1:-1||",
+		"ALLOW|udp:.ntp.org:123|SYSTEM|-1:-1||",
+		`ALLOW_TLSONLY|re:mirror[0-9]+\.example\.org:80,443|SYSTEM|-1:-1||`,
+		"DENY|10.1.2.0/24:*|SYSTEM|-1:-1||",
+		"ALLOW|10.0.0.0/8:22|SYSTEM|-1:-1||",
+		"ALLOW|192.0.2.7:8000-8100|SYSTEM|-1:-1||",
+		"DENY|2001:db8::/32:80|SYSTEM|-1:-1||",
+		"ALLOW|2001:db8::1:80|SYSTEM|-1:-1||",
+		"ALLOW|icmp:198.51.100.1:0|SYSTEM|-1:-1||",
+		"ALLOW|*:25|SYSTEM|nobody:-1||",
+		"DENY|*:25|SYSTEM|-1:-1||",
+		"ALLOW|*:1-65535|SYSTEM|-1:-1||",
+	})
+	pinfo := testPInfo()
+	src4, src6 := net.ParseIP("192.168.1.10").To4(), net.ParseIP("2001:db8:ffff::10")
+
+	tests := []struct {
+		proto    string
+		dst      string
+		port     uint16
+		hostname string
+	}{
+		{"tcp", "203.0.113.1", 443, "evil.example.com"},
+		{"tcp", "203.0.113.1", 443, "www.example.com"},
+		{"tcp", "203.0.113.1", 443, "EXAMPLE.com."},
+		{"tcp", "203.0.113.1", 123, "pool.ntp.org"},
+		{"udp", "203.0.113.1", 123, "0.pool.ntp.org"},
+		{"udp", "203.0.113.1", 124, "0.pool.ntp.org"},
+		{"tcp", "203.0.113.1", 80, "mirror12.example.org"},
+		{"tcp", "203.0.113.1", 80, "mirror.example.org"},
+		{"tcp", "10.1.2.3", 22, ""},
+		{"tcp", "10.1.3.3", 22, ""},
+		{"tcp", "10.1.3.3", 23, ""},
+		{"tcp", "192.0.2.7", 8050, ""},
+		{"tcp", "192.0.2.7", 8200, ""},
+		{"tcp", "2001:db8::1", 80, ""},
+		{"tcp", "2001:db9::1", 80, ""},
+		{"icmp", "198.51.100.1", 0, ""},
+		{"icmp", "198.51.100.2", 0, ""},
+		{"udp", "198.51.100.2", 25, ""},
+		{"tcp", "198.51.100.2", 25, "mail.example.net"},
+	}
+
+	ix := p.ruleIndex()
+	for _, tt := range tests {
+		dst := net.ParseIP(tt.dst)
+		src := src6
+		if dst.To4() != nil {
+			dst, src = dst.To4(), src4
+		}
+		pkt := testPacket(t, tt.proto, src, dst, tt.port)
+		_, port := getPacketPorts(pkt)
+		want := p.rules.filter(pkt, src, dst, port, tt.hostname, pinfo, "")
+		if got := ix.filter(pkt, src, dst, port, tt.hostname, pinfo, ""); got != want {
+			t.Errorf("%s %s:%d (%q): indexed result %v, linear result %v", tt.proto, tt.dst, tt.port, tt.hostname, got, want)
+		}
+	}
+}
+
+func TestRuleIndexRebuiltOnChange(t *testing.T) {
+	p := testPolicy(t, []string{"ALLOW|www.example.com:443|SYSTEM|-1:-1||"})
+	pinfo := testPInfo()
+	src, dst := net.IP{192, 168, 1, 10}, net.IP{203, 0, 113, 1}
+	pkt := testPacket(t, "tcp", src, dst, 443)
+
+	if res := p.ruleIndex().filter(pkt, src, dst, 443, "www.example.com", pinfo, ""); res != FILTER_ALLOW {
+		t.Fatalf("expected FILTER_ALLOW, got %v", res)
+	}
+	p.removeRule(p.rules[0])
+	if res := p.ruleIndex().filter(pkt, src, dst, 443, "www.example.com", pinfo, ""); res != FILTER_PROMPT {
+		t.Fatalf("expected FILTER_PROMPT after removing the rule, got %v", res)
+	}
+}
+
+func benchmarkPolicy(b *testing.B, n int) *Policy {
+	rules := make([]string, 0, n+1)
+	for i := 0; i < n; i++ {
+		switch i % 3 {
+		case 0:
+			rules = append(rules, fmt.Sprintf("ALLOW|host%d.example.com:443|SYSTEM|-1:-1||", i))
+		case 1:
+			rules = append(rules, fmt.Sprintf("DENY|10.%d.%d.0/24:%d|SYSTEM|-1:-1||", i/256%256, i%256, 1024+i%1000))
+		default:
+			rules = append(rules, fmt.Sprintf("ALLOW|udp:172.16.%d.%d:53|SYSTEM|-1:-1||", i/256%256, i%256))
+		}
+	}
+	rules = append(rules, "ALLOW|*.example.org:443|SYSTEM|-1:-1||")
+	return testPolicy(b, rules)
+}
+
+func BenchmarkRuleListFilter(b *testing.B) {
+	p := benchmarkPolicy(b, 3000)
+	pinfo := testPInfo()
+	src, dst := net.IP{192, 168, 1, 10}, net.IP{203, 0, 113, 1}
+	pkt := testPacket(b, "tcp", src, dst, 443)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if p.rules.filter(pkt, src, dst, 443, "www.example.org", pinfo, "") != FILTER_ALLOW {
+			b.Fatal("unexpected filter result")
+		}
+	}
+}
+
+func BenchmarkRuleIndexFilter(b *testing.B) {
+	p := benchmarkPolicy(b, 3000)
+	pinfo := testPInfo()
+	src, dst := net.IP{192, 168, 1, 10}, net.IP{203, 0, 113, 1}
+	pkt := testPacket(b, "tcp", src, dst, 443)
+	ix := p.ruleIndex()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ix.filter(pkt, src, dst, 443, "www.example.org", pinfo, "") != FILTER_ALLOW {
+			b.Fatal("unexpected filter result")
+		}
+	}
+}
@@ -2,27 +2,28 @@ package sgfw
 
 import (
 	//	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
 	//	"github.com/subgraph/go-nfnetlink"
 	"github.com/subgraph/go-procsnitch"
 )
 
-const matchAny = 0
-
 //const noAddress = uint32(0xffffffff)
 var anyAddress net.IP = net.IP{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 var noAddress net.IP = net.IP{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
 
 type Rule struct {
+	// first, so that its 64-bit counters are aligned for atomic access
+	stats    ruleStats
 	id       uint
 	policy   *Policy
 	mode     RuleMode
@@ -30,15 +31,30 @@ type Rule struct {
 	proto    string
 	pid      int
 	hostname string
+	hostpat  *hostPattern
 	network  *net.IPNet
 	addr     net.IP
 	saddr    net.IP
-	port     uint16
+	ports    portList
 	uid      int
 	gid      int
 	uname    string
 	gname    string
 	sandbox  string
+	expires  time.Time
+	ancestry *ancestryMatch
+	cgroup   *cgroupMatch
+	uuid     string
+	created  time.Time
+	author   string
+	comment  string
+	// for RULE_DIRECTION_IN, addr and hostname are those of the remote
+	// host, ports those of the local listener and saddr the local address
+	direction RuleDirection
+	// the drop-in file a read-only rule was loaded from
+	sourceFile string
+	// fields of the rule file this version does not know about
+	fileExtra map[string]json.RawMessage
 }
 
 func (r *Rule) String() string {
@@ -62,12 +78,37 @@ func (r *Rule) getString(redact bool) string {
 
 	rpriv := fmt.Sprintf("|%d:%d", r.uid, r.gid)
 
-	sbox := "|"
-	if r.sandbox != "" {
-		sbox = "|" + sbox
+	sbox := "|" + r.sandbox
+
+	// the source address, expiry, ancestry, cgroup and direction fields
+	// are optional and only written out when they are needed
+	var optional [5]string
+	if r.saddr != nil {
+		optional[0] = r.saddr.String()
+	}
+	if !r.expires.IsZero() {
+		optional[1] = strconv.FormatInt(r.expires.Unix(), 10)
+	}
+	optional[2] = r.ancestry.String()
+	optional[3] = r.cgroup.String()
+	if r.direction == RULE_DIRECTION_IN {
+		optional[4] = RuleDirectionString[RULE_DIRECTION_IN]
+	}
+	n := len(optional)
+	for n > 0 && optional[n-1] == "" {
+		n--
+	}
+	extra := ""
+	for _, o := range optional[:n] {
+		extra += "|" + o
 	}
 
-	return fmt.Sprintf("%s|%s%s%s%s%s", rtype, protostr, r.AddrString(redact), rmode, rpriv, sbox)
+	return fmt.Sprintf("%s|%s%s%s%s%s%s", rtype, protostr, r.AddrString(redact), rmode, rpriv, sbox, extra)
+}
+
+// isExpired reports whether a time-limited rule has run out at the given time
+func (r *Rule) isExpired(now time.Time) bool {
+	return !r.expires.IsZero() && !now.Before(r.expires)
 }
 
 func (r *Rule) AddrString(redact bool) string {
@@ -84,8 +125,10 @@ func (r *Rule) AddrString(redact bool) string {
 		addr = r.addr.String()
 	}
 
-	if r.port != matchAny || r.proto == "icmp" {
-		port = fmt.Sprintf("%d", r.port)
+	if !r.ports.isAny() {
+		port = r.ports.String()
+	} else if r.proto == "icmp" {
+		port = "0"
 	}
 
 	if redact && addr != "*" {
@@ -113,31 +156,26 @@ func (r *Rule) match(src net.IP, dst net.IP, dstPort uint16, hostname string, pr
 	} else if r.gname != "" && r.gname != gname {
 		return false
 	}
+	return r.matchTarget(src, dst, dstPort, hostname)
+}
 
-	// log.Notice("comparison: ", hostname, " / ", dst, " : ", dstPort, " -> ", r.addr, " / ", r.hostname, " : ", r.port)
-	if r.port != matchAny && r.port != dstPort {
+// matchTarget reports whether a connection to dst goes where the rule
+// points, by address or hostname and port.  The caller checks the protocol.
+func (r *Rule) matchTarget(src net.IP, dst net.IP, dstPort uint16, hostname string) bool {
+	// log.Notice("comparison: ", hostname, " / ", dst, " : ", dstPort, " -> ", r.addr, " / ", r.hostname, " : ", r.ports)
+	if !r.ports.matches(dstPort) {
 		return false
 	}
 	if addrMatchesAny(r.addr) {
 		return true
 	}
 	if r.hostname != "" {
-		if strings.ContainsAny(r.hostname, "*") {
-			regstr := strings.Replace(r.hostname, "*", ".?", -1)
-			match, err := regexp.MatchString(regstr, hostname)
-
-			if err != nil {
-				log.Errorf("Error comparing hostname against mask %s: %v", regstr, err)
-			} else {
-				return match
-			}
-		}
-		return r.hostname == hostname
+		return r.matchHostname(hostname)
 	}
 	if r.network != nil && r.network.Contains(dst) {
 		return true
 	}
-	if proto == "icmp" {
+	if r.proto == "icmp" {
 		//fmt.Printf("network = %v, src = %v, r.addr = %x, src to4 = %x\n", r.network, src, r.addr, binary.BigEndian.Uint32(src.To4()))
 		if (r.network != nil && r.network.Contains(src)) || (r.addr.Equal(src)) {
 			return true
@@ -146,15 +184,26 @@ func (r *Rule) match(src net.IP, dst net.IP, dstPort uint16, hostname string, pr
 	return r.addr.Equal(dst)
 }
 
-func (rl *RuleList) filterPacket(p *nfqueue.NFQPacket, pinfo *procsnitch.Info, srcip net.IP, hostname, optstr string) FilterResult {
-	_, dstip := getPacketIPAddrs(p)
-	_, dstp := getPacketPorts(p)
-	return rl.filter(p, srcip, dstip, dstp, hostname, pinfo, optstr)
+func (r *Rule) matchHostname(hostname string) bool {
+	if r.hostpat == nil {
+		return false
+	}
+	return r.hostpat.match(hostname)
 }
 
 func (rl *RuleList) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint16, hostname string, pinfo *procsnitch.Info, optstr string) FilterResult {
+	result, r := rl.match(pkt, src, dst, dstPort, hostname, pinfo, optstr)
+	if r != nil {
+		r.hit(time.Now())
+	}
+	return result
+}
+
+// match returns the result of filter and the rule that decided it, nil for
+// FILTER_PROMPT, without counting a hit of the rule.
+func (rl *RuleList) match(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint16, hostname string, pinfo *procsnitch.Info, optstr string) (FilterResult, *Rule) {
 	if rl == nil {
-		return FILTER_PROMPT
+		return FILTER_PROMPT, nil
 	}
 	result := FILTER_PROMPT
 	sandboxed := false
@@ -162,7 +211,13 @@ func (rl *RuleList) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint
 		sandboxed = true
 	}
 	// sandboxed := strings.HasPrefix(optstr, "SOCKS5|Tor / Sandbox")
+	now := time.Now()
+	ancestry := newProcAncestry(pinfo)
+	cgroup := newProcCGroup(pinfo)
 	for _, r := range *rl {
+		if r.isExpired(now) || !r.matchCGroup(cgroup) || !r.matchAncestry(ancestry) {
+			continue
+		}
 		nfqproto := ""
 		//log.Notice("------------ trying match of src ", src, " against: ", r, " | ", r.saddr, " / optstr = ", optstr, "; pid ", pinfo.Pid, " vs rule pid ", r.pid)
 		//log.Notice("r.saddr: ", r.saddr, "src: ", src, "sandboxed ", sandboxed, "optstr: ", optstr)
@@ -180,17 +235,17 @@ func (rl *RuleList) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint
 			if pkt != nil {
 				nfqproto = getNFQProto(pkt)
 			} else {
-				if r.saddr == nil && src == nil && sandboxed == false && (r.port == dstPort || r.port == matchAny) && (r.addr.Equal(anyAddress) || r.hostname == "" || r.hostname == hostname) {
+				if r.saddr == nil && src == nil && sandboxed == false && r.ports.matches(dstPort) && (r.addr.Equal(anyAddress) || r.hostname == "" || r.matchHostname(hostname)) {
 					// log.Notice("+ Socks5 MATCH SUCCEEDED")
 					if r.rtype == RULE_ACTION_DENY {
-						return FILTER_DENY
+						return FILTER_DENY, r
 					} else if r.rtype == RULE_ACTION_ALLOW {
-						return FILTER_ALLOW
+						return FILTER_ALLOW, r
 					} else if r.rtype == RULE_ACTION_ALLOW_TLSONLY {
-						return FILTER_ALLOW_TLSONLY
+						return FILTER_ALLOW_TLSONLY, r
 					}
 				} else {
-					return FILTER_PROMPT
+					return FILTER_PROMPT, nil
 				}
 			}
 		}
@@ -213,16 +268,20 @@ func (rl *RuleList) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint
 			}
 			// log.Noticef("%s > %s %s %s -> %s:%d",
 			//r.getString(FirewallConfig.LogRedact), pinfo.ExePath, r.proto, srcStr, dstStr, dstPort)
-			if r.rtype == RULE_ACTION_DENY {
+			if r.rtype == RULE_ACTION_DENY && r.direction == RULE_DIRECTION_IN {
+				log.Warningf("DENIED incoming connection attempt to %s on %s port %d from %s",
+					pinfo.ExePath, r.proto, dstPort, dstStr)
+				return FILTER_DENY, r
+			} else if r.rtype == RULE_ACTION_DENY {
 				//TODO: Optionally redact below log entry
 				log.Warningf("DENIED outgoing connection attempt by %s from %s %s -> %s:%d",
 					pinfo.ExePath, r.proto,
 					srcStr,
 					dstStr, dstPort)
-				return FILTER_DENY
+				return FILTER_DENY, r
 			} else if r.rtype == RULE_ACTION_ALLOW {
 				result = FILTER_ALLOW
-				return result
+				return result, r
 				/*
 					if r.saddr != nil {
 						return result
@@ -230,7 +289,7 @@ func (rl *RuleList) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint
 				*/
 			} else if r.rtype == RULE_ACTION_ALLOW_TLSONLY {
 				result = FILTER_ALLOW_TLSONLY
-				return result
+				return result, r
 			}
 		}
 		/**else {
@@ -238,7 +297,7 @@ func (rl *RuleList) filter(pkt *nfqueue.NFQPacket, src, dst net.IP, dstPort uint
 		} */
 	}
 	// log.Notice("--- RESULT = ", result)
-	return result
+	return result, nil
 }
 
 func parseError(s string) error {
@@ -249,7 +308,7 @@ func (r *Rule) parse(s string) bool {
 	r.addr = noAddress
 	r.saddr = nil
 	parts := strings.Split(s, "|")
-	if len(parts) < 4 || len(parts) > 6 {
+	if len(parts) < 4 || len(parts) > 10 {
 		log.Notice("invalid number ", len(parts), " of rule parts in line ", s)
 		return false
 	}
@@ -274,7 +333,7 @@ func (r *Rule) parse(s string) bool {
 
 	// fmt.Printf("uid = %v, gid = %v, user = %v, group = %v, hostname = %v, sandbox = %v\n", r.uid, r.gid, r.uname, r.gname, r.hostname, r.sandbox)
 
-	if len(parts) == 6 && len(strings.TrimSpace(parts[5])) > 0 {
+	if len(parts) >= 6 && len(strings.TrimSpace(parts[5])) > 0 {
 		r.saddr = net.ParseIP(parts[5])
 
 		if r.saddr == nil {
@@ -283,9 +342,65 @@ func (r *Rule) parse(s string) bool {
 		}
 
 	}
+
+	if len(parts) >= 7 && !r.parseExpires(parts[6]) {
+		log.Notice("invalid expiry time ", parts[6], " in line ", s)
+		return false
+	}
+
+	r.ancestry = nil
+	if len(parts) >= 8 && len(strings.TrimSpace(parts[7])) > 0 {
+		am, ok := parseAncestry(parts[7])
+		if !ok {
+			log.Notice("invalid process ancestry ", parts[7], " in line ", s)
+			return false
+		}
+		r.ancestry = am
+	}
+
+	r.cgroup = nil
+	if len(parts) >= 9 && len(strings.TrimSpace(parts[8])) > 0 {
+		cm, ok := parseCGroupMatch(parts[8])
+		if !ok {
+			log.Notice("invalid cgroup ", parts[8], " in line ", s)
+			return false
+		}
+		r.cgroup = cm
+	}
+
+	r.direction = RULE_DIRECTION_OUT
+	if len(parts) == 10 && !r.parseDirection(parts[9]) {
+		log.Notice("invalid direction ", parts[9], " in line ", s)
+		return false
+	}
 	return r.parseVerb(parts[0]) && r.parseTarget(parts[1])
 }
 
+func (r *Rule) parseExpires(e string) bool {
+	e = strings.TrimSpace(e)
+	if e == "" {
+		r.expires = time.Time{}
+		return true
+	}
+	ts, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || ts <= 0 {
+		return false
+	}
+	r.expires = time.Unix(ts, 0)
+	return true
+}
+
+func (r *Rule) parseDirection(d string) bool {
+	d = strings.TrimSpace(d)
+	if d == "" {
+		r.direction = RULE_DIRECTION_OUT
+		return true
+	}
+	dir, ok := RuleDirectionValue[d]
+	r.direction = dir
+	return ok
+}
+
 func (r *Rule) parseSandbox(p string) bool {
 	r.sandbox = p
 	return true
@@ -361,12 +476,23 @@ func (r *Rule) parseTarget(t string) bool {
 func (r *Rule) parseAddr(a string) bool {
 	if a == "*" {
 		r.hostname = ""
+		r.hostpat = nil
 		r.addr = anyAddress
 		return true
 	}
+	// IPv6 addresses may be bracketed to set them apart from the port
+	if strings.HasPrefix(a, "[") && strings.HasSuffix(a, "]") {
+		a = a[1 : len(a)-1]
+	}
 	//	if strings.IndexFunc(a, unicode.IsLetter) != -1 {
-	if net.ParseIP(a) == nil {
+	if _, _, err := net.ParseCIDR(a); net.ParseIP(a) == nil && err != nil {
+		hp, err := compileHostPattern(a)
+		if err != nil {
+			log.Noticef("invalid hostname pattern %s: %v", a, err)
+			return false
+		}
 		r.hostname = a
+		r.hostpat = hp
 		return true
 	}
 	//	ip := net.ParseIP(a)
@@ -385,20 +511,19 @@ func (r *Rule) parseAddr(a string) bool {
 }
 
 func (r *Rule) parsePort(p string) bool {
-	if p == "*" {
-		r.port = matchAny
-		return true
-	}
-	var err error
-	port, err := strconv.ParseUint(p, 10, 16)
-	if err != nil || (port == 0 && r.proto != "icmp") || port > 0xFFFF {
+	ports, ok := parsePortList(r.proto, p)
+	if !ok {
 		return false
 	}
-	r.port = uint16(port)
+	r.ports = ports
 	return true
 }
 
-const ruleFile = "/var/lib/sgfw/sgfw_rules"
+const ruleFile = "/var/lib/sgfw/sgfw_rules.json"
+
+// Rule file of versions before the structured format, which is migrated on
+// the first start
+const legacyRuleFile = "/var/lib/sgfw/sgfw_rules"
 
 func maybeCreateDir(dir string) error {
 	_, err := os.Stat(dir)
@@ -419,69 +544,145 @@ func (fw *Firewall) saveRules() {
 	fw.lock.Lock()
 	defer fw.lock.Unlock()
 
+	if err := fw.writeRules(); err != nil {
+		log.Warningf("Failed to save rules: %v", err)
+	}
+}
+
+// writeRules writes the persistent rules of every policy to the rule file.
+// It must be called with fw.lock held.
+func (fw *Firewall) writeRules() error {
+	if fw.rulesUnreadable {
+		return fmt.Errorf("refusing to overwrite %s, which could not be read", ruleFile)
+	}
 	p, err := rulesPath()
 	if err != nil {
-		log.Warningf("Failed to open %s for writing: %v", p, err)
-		return
+		return err
 	}
-	f, err := os.Create(p)
+	bs, err := fw.marshalRules()
 	if err != nil {
-		log.Warningf("Failed to open %s for writing: %v", p, err)
-		return
-	}
-	defer f.Close()
-
-	for _, p := range fw.policies {
-		savePolicy(f, p)
+		return err
 	}
+	return writeRuleFile(p, ruleBackupDir, bs)
 }
 
-func savePolicy(f *os.File, p *Policy) {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	if !p.hasPersistentRules() {
-		return
-	}
-	log.Warningf("p.path: ", p.path)
-	if !writeLine(f, "["+p.sandbox+"|"+p.path+"]") {
-		return
-	}
-	for _, r := range p.rules {
-		if r.mode == RULE_MODE_PERMANENT || r.mode == RULE_MODE_SYSTEM {
-			if !writeLine(f, r.String()) {
-				return
+// expireRules drops every time-limited rule that has run out, and tells
+// the UI about it.
+func (fw *Firewall) expireRules() {
+	now := time.Now()
+	expired, save := false, false
+	var removed []*Rule
+
+	fw.lock.Lock()
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		var remaining RuleList
+		for _, r := range p.rules {
+			if !r.isExpired(now) {
+				remaining = append(remaining, r)
+				continue
+			}
+			log.Noticef("Removing expired rule: %s", r.getString(FirewallConfig.LogRedact))
+			expired = true
+			removed = append(removed, r)
+			if r.mode == RULE_MODE_PERMANENT {
+				save = true
 			}
 		}
+		if len(remaining) != len(p.rules) {
+			p.rules = remaining
+			p.rulesChanged()
+		}
+		p.lock.Unlock()
 	}
-}
+	fw.forgetVerdicts(removed...)
+	fw.lock.Unlock()
 
-func writeLine(f *os.File, line string) bool {
-	_, err := f.WriteString(line + "\n")
-	if err != nil {
-		log.Warningf("Error writing to rule file: %v", err)
-		return false
+	if save {
+		fw.saveRules()
+	}
+	if expired {
+		dbusp.alertRule("Expired firewall rule removed")
 	}
-	return true
 }
 
 func (fw *Firewall) loadRules() {
 	fw.lock.Lock()
 	defer fw.lock.Unlock()
 
+	stats := fw.collectRuleStats()
 	fw.clearRules()
+	fw.rulesUnreadable = false
+	kept := fw.detachRules()
 
 	p, err := rulesPath()
 	if err != nil {
 		log.Warningf("Failed to open %s for reading: %v", p, err)
-		return
-	}
-	bs, err := ioutil.ReadFile(p)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Warningf("Failed to open %s for reading: %v", p, err)
+	} else if bs, err := ioutil.ReadFile(p); os.IsNotExist(err) {
+		fw.migrateLegacyRules()
+	} else {
+		if err == nil {
+			err = fw.loadRulesJSON(bs)
+		}
+		if err != nil {
+			log.Errorf("Failed to load rules from %s: %v", p, err)
+			if fw.restoreRuleSnapshot(p, ruleBackupDir) {
+				if err := fw.writeRules(); err != nil {
+					log.Warningf("Failed to save restored rules: %v", err)
+				}
+			} else {
+				// keep the file for the user to repair instead of saving over it
+				fw.rulesUnreadable = true
+			}
 		}
-		return
 	}
+
+	for p, rules := range kept {
+		p.lock.Lock()
+		p.rules = append(p.rules, rules...)
+		p.lock.Unlock()
+	}
+	fw.loadDropInRules(ruleDropInDirs)
+	fw.restoreRuleStats(stats)
+
+	// the new rules only take effect once the whole file has been read
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		p.rulesChanged()
+		p.lock.Unlock()
+	}
+}
+
+// detachRules takes the rules read from the rule file out of every policy
+// before they are loaded again, so that those of a policy no longer in the
+// file, or in the snapshot rolled back to, are gone as well.  The session
+// and process rules, which are not stored, are returned to be put back, and
+// are given new IDs, as the old ones were cleared.  It must be called with
+// fw.lock held.
+func (fw *Firewall) detachRules() map[*Policy]RuleList {
+	kept := make(map[*Policy]RuleList)
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		for _, r := range p.rules {
+			if r.sourceFile == "" && (r.mode == RULE_MODE_SESSION || r.mode == RULE_MODE_PROCESS) {
+				fw.addRule(r)
+				kept[p] = append(kept[p], r)
+			}
+		}
+		p.rules = nil
+		p.unparsed = nil
+		p.fileExtra = nil
+		p.pinnedHash = ""
+		p.audit = false
+		p.lock.Unlock()
+	}
+	return kept
+}
+
+// loadLegacyRules reads rules in the line based format of older versions,
+// in which each policy starts with a [sandbox|path] line followed by one
+// rule per line.
+func (fw *Firewall) loadLegacyRules(bs []byte) {
 	var policy *Policy
 	for _, line := range strings.Split(string(bs), "\n") {
 		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
@@ -489,7 +690,9 @@ func (fw *Firewall) loadRules() {
 		} else {
 			trimmed := strings.TrimSpace(line)
 			if len(trimmed) > 0 && trimmed[:1] != "#" {
-				processRuleLine(policy, trimmed)
+				if r := processRuleLine(policy, trimmed); r != nil {
+					r.migrateHostPattern()
+				}
 			}
 		}
 	}
@@ -501,20 +704,28 @@ func (fw *Firewall) processPathLine(line string) *Policy {
 	policy := fw.policyForPathAndSandbox(toks[1], toks[0])
 	policy.lock.Lock()
 	defer policy.lock.Unlock()
-	policy.rules = nil
+	if len(toks) > 2 {
+		policy.setPinnedHash(toks[2])
+	}
 	return policy
 }
 
-func processRuleLine(policy *Policy, line string) {
+func processRuleLine(policy *Policy, line string) *Rule {
 	if policy == nil {
 		log.Warningf("Cannot process rule line without first seeing policy key line: %s", line)
-		return
+		return nil
 	}
-	_, err := policy.parseRule(line, true)
+	r, err := policy.parseRule(line, false)
 	if err != nil {
 		log.Warningf("Error parsing rule (%s): %v", line, err)
-		return
+		return nil
 	}
+	// the old format did not record when a rule was made
+	r.created = time.Time{}
+	policy.lock.Lock()
+	policy.rules = append(policy.rules, r)
+	policy.lock.Unlock()
+	return r
 }
 
 func addrMatchesAny(addr net.IP) bool {
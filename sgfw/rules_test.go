@@ -0,0 +1,201 @@
+package sgfw
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus"
+)
+
+func TestParseTargetAddresses(t *testing.T) {
+	tests := []struct {
+		target  string
+		addr    string
+		network string
+		host    string
+		port    string
+	}{
+		{"[2001:db8::1]:443", "2001:db8::1", "", "", "443"},
+		{"2001:db8::1:443", "2001:db8::1", "", "", "443"},
+		{"[::1]:*", "::1", "", "", "*"},
+		{"udp:[2001:db8::53]:53", "2001:db8::53", "", "", "53"},
+		{"2001:db8::/32:80", "2001:db8::", "2001:db8::/32", "", "80"},
+		{"[2001:db8::/32]:80", "2001:db8::", "2001:db8::/32", "", "80"},
+		{"10.0.0.0/8:22", "10.0.0.0", "10.0.0.0/8", "", "22"},
+		{"192.0.2.7:80", "192.0.2.7", "", "", "80"},
+		{"www.example.com:443", "", "", "www.example.com", "443"},
+	}
+	for _, tt := range tests {
+		r := &Rule{}
+		if !r.parseTarget(tt.target) {
+			t.Errorf("%s: failed to parse", tt.target)
+			continue
+		}
+		network := ""
+		if r.network != nil {
+			network = r.network.String()
+		}
+		addr := ""
+		if r.addr != nil {
+			addr = r.addr.String()
+		}
+		if addr != tt.addr || network != tt.network || r.hostname != tt.host || r.ports.String() != tt.port {
+			t.Errorf("%s: parsed as addr %q network %q host %q port %q", tt.target, addr, network, r.hostname, r.ports)
+		}
+	}
+}
+
+type testBusObject struct {
+	dbus.BusObject
+	lock  sync.Mutex
+	calls []string
+}
+
+func (o *testBusObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.calls = append(o.calls, fmt.Sprint(method, args))
+	return &dbus.Call{}
+}
+
+// Go records a call like Call, which is never answered.
+func (o *testBusObject) Go(method string, flags dbus.Flags, ch chan *dbus.Call, args ...interface{}) *dbus.Call {
+	o.Call(method, flags, args...)
+	return &dbus.Call{Done: ch}
+}
+
+func (o *testBusObject) recorded() []string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return append([]string(nil), o.calls...)
+}
+
+func TestRuleExpiry(t *testing.T) {
+	r := &Rule{}
+	if !r.parse("ALLOW|example.com:443|SYSTEM|-1:-1|||1700000000") || !r.expires.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("expiry time parsed as %v", r.expires)
+	}
+	if s := r.String(); s != "ALLOW|example.com:443|SYSTEM|-1:-1|||1700000000" {
+		t.Errorf("rule with an expiry time written as %q", s)
+	}
+	for _, s := range []string{
+		"ALLOW|example.com:443|SYSTEM|-1:-1|||soon",
+		"ALLOW|example.com:443|SYSTEM|-1:-1|||-5",
+		"ALLOW|example.com:443|SYSTEM|-1:-1|||0",
+	} {
+		if (&Rule{}).parse(s) {
+			t.Errorf("invalid expiry time accepted: %q", s)
+		}
+	}
+	if !(&Rule{}).parse("ALLOW|example.com:443|SYSTEM|-1:-1|||") {
+		t.Errorf("empty expiry time rejected")
+	}
+
+	now := time.Now()
+	for _, tt := range []struct {
+		expires time.Time
+		want    bool
+	}{
+		{time.Time{}, false},
+		{now.Add(time.Second), false},
+		{now, true},
+		{now.Add(-time.Hour), true},
+	} {
+		if got := (&Rule{expires: tt.expires}).isExpired(now); got != tt.want {
+			t.Errorf("rule expiring at %v expired at %v: %v", tt.expires, now, got)
+		}
+	}
+
+	defer func(saved *dbusObjectP) { dbusp = saved }(dbusp)
+	bus := &testBusObject{}
+	dbusp = &dbusObjectP{bus}
+	fw := testFirewall()
+	p := fw.PolicyForPath("/usr/bin/test")
+	for _, s := range []string{
+		"ALLOW|expired.example.com:443||-1:-1|||" + strconv.FormatInt(now.Add(-time.Minute).Unix(), 10),
+		"ALLOW|later.example.com:443||-1:-1|||" + strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+		"ALLOW|always.example.com:443||-1:-1||",
+	} {
+		processRuleLine(p, s)
+	}
+	p.rulesChanged()
+	fw.expireRules()
+	if len(p.rules) != 2 || p.rules[0].hostname != "later.example.com" || p.rules[1].hostname != "always.example.com" {
+		t.Errorf("rules left after expiry: %v", p.rules)
+	}
+	if len(bus.calls) != 1 {
+		t.Errorf("UI told %d times about the expired rule", len(bus.calls))
+	}
+	src, dst := net.ParseIP("192.0.2.2").To4(), net.ParseIP("192.0.2.1").To4()
+	if res, _ := matchPolicies(RULE_DIRECTION_OUT, nil, p, nil, testPacket(t, "tcp", src, dst, 443), testPInfo(), src, dst, 443, "expired.example.com", ""); res != FILTER_PROMPT {
+		t.Errorf("expired rule still matches: %s", FilterResultString[res])
+	}
+	fw.expireRules()
+	if len(bus.calls) != 1 {
+		t.Errorf("UI told about expiry with no rule expired")
+	}
+}
+
+func TestParsePortList(t *testing.T) {
+	tests := []struct {
+		proto string
+		spec  string
+		want  string
+		in    []uint16
+		out   []uint16
+	}{
+		{"tcp", "*", "*", []uint16{1, 65535}, nil},
+		{"tcp", "443", "443", []uint16{443}, []uint16{444}},
+		{"tcp", "8000-8100", "8000-8100", []uint16{8000, 8050, 8100}, []uint16{7999, 8101}},
+		{"tcp", "80, 443,8000-8100", "80,443,8000-8100", []uint16{80, 443, 8001}, []uint16{81}},
+		{"tcp", "https", "https", []uint16{443}, []uint16{80}},
+		{"tcp", "http,8080", "http,8080", []uint16{80, 8080}, []uint16{443}},
+		{"udp", "domain", "domain", []uint16{53}, []uint16{443}},
+		{"tcp", "65535", "65535", []uint16{65535}, nil},
+		// an ICMP code of 0 has always meant any code
+		{"icmp", "0", "*", []uint16{0, 3}, nil},
+		{"icmp", "3", "3", []uint16{3}, []uint16{0}},
+	}
+	for _, tt := range tests {
+		pl, ok := parsePortList(tt.proto, tt.spec)
+		if !ok {
+			t.Errorf("%s %q: not parsed", tt.proto, tt.spec)
+			continue
+		}
+		if pl.String() != tt.want {
+			t.Errorf("%s %q: written as %q, want %q", tt.proto, tt.spec, pl, tt.want)
+		}
+		for _, port := range tt.in {
+			if !pl.matches(port) {
+				t.Errorf("%s %q does not match %d", tt.proto, tt.spec, port)
+			}
+		}
+		for _, port := range tt.out {
+			if pl.matches(port) {
+				t.Errorf("%s %q matches %d", tt.proto, tt.spec, port)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "0", "65536", "100-10", "80,", "-80", "80-", "no-such-service", "https-8443"} {
+		if _, ok := parsePortList("tcp", spec); ok {
+			t.Errorf("tcp %q accepted", spec)
+		}
+	}
+	if _, ok := parsePortList("icmp", "echo"); ok {
+		t.Errorf("service name accepted as an ICMP code")
+	}
+
+	// the port is the last field of the target, after any IPv6 address
+	r := &Rule{}
+	if !r.parse("ALLOW|udp:2001:db8::1:domain,5353|SYSTEM|-1:-1||") || r.proto != "udp" || !r.addr.Equal(net.ParseIP("2001:db8::1")) || r.ports.String() != "domain,5353" {
+		t.Errorf("parsed as %s %v %s", r.proto, r.addr, r.ports)
+	}
+	if s := r.String(); s != "ALLOW|udp:2001:db8::1:domain,5353|SYSTEM|-1:-1|" {
+		t.Errorf("written as %q", s)
+	}
+}
@@ -0,0 +1,145 @@
+package sgfw
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the hit counts of persistent rules are written to the rule file
+const ruleStatsInterval = 15 * time.Minute
+
+// ruleStats counts how often a rule decided the fate of a connection.
+// Rules are matched without any lock held, so both fields are only
+// accessed atomically.
+type ruleStats struct {
+	hits    uint64
+	lastHit int64 // UnixNano, 0 if never
+}
+
+// hit records that r matched a connection.
+func (r *Rule) hit(now time.Time) {
+	atomic.AddUint64(&r.stats.hits, 1)
+	atomic.StoreInt64(&r.stats.lastHit, now.UnixNano())
+	if r.policy != nil && r.policy.fw != nil && r.mode != RULE_MODE_SESSION && r.mode != RULE_MODE_PROCESS {
+		atomic.StoreInt32(&r.policy.fw.statsDirty, 1)
+	}
+}
+
+func (r *Rule) hitCount() uint64 {
+	return atomic.LoadUint64(&r.stats.hits)
+}
+
+// lastHit returns when r last matched, or the zero time.
+func (r *Rule) lastHit() time.Time {
+	if ns := atomic.LoadInt64(&r.stats.lastHit); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+func (r *Rule) setStats(hits uint64, last time.Time) {
+	ns := int64(0)
+	if !last.IsZero() {
+		ns = last.UnixNano()
+	}
+	atomic.StoreUint64(&r.stats.hits, hits)
+	atomic.StoreInt64(&r.stats.lastHit, ns)
+}
+
+// collectRuleStats returns the counts of the rules kept in the rule file by
+// their uuid, since they are newer than what was last saved.  It must be
+// called with fw.lock held.
+func (fw *Firewall) collectRuleStats() map[string]*Rule {
+	stats := make(map[string]*Rule)
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		for _, r := range p.rules {
+			if r.sourceFile == "" && r.hitCount() > 0 {
+				stats[r.uuid] = r
+			}
+		}
+		p.lock.Unlock()
+	}
+	return stats
+}
+
+// restoreRuleStats carries the counts returned by collectRuleStats over to
+// the rules loaded since.  It must be called with fw.lock held.
+func (fw *Firewall) restoreRuleStats(stats map[string]*Rule) {
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		for _, r := range p.rules {
+			if old, ok := stats[r.uuid]; ok && old != r && old.hitCount() > r.hitCount() {
+				r.setStats(old.hitCount(), old.lastHit())
+			}
+		}
+		p.lock.Unlock()
+	}
+}
+
+// saveRuleStats writes the rule file if a persistent rule has matched since
+// it was last written.  Only the counts changed, so no snapshot is kept.
+func (fw *Firewall) saveRuleStats() {
+	if !atomic.CompareAndSwapInt32(&fw.statsDirty, 1, 0) {
+		return
+	}
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	if fw.rulesUnreadable {
+		return
+	}
+	p, err := rulesPath()
+	if err == nil {
+		var bs []byte
+		if bs, err = fw.marshalRules(); err == nil {
+			err = writeRuleFile(p, "", bs)
+		}
+	}
+	if err != nil {
+		log.Warningf("Failed to save rule hit counts: %v", err)
+	}
+}
+
+// lastUsed returns when r last matched, or when it was created if it never
+// did.  It is zero for rules of unknown age, such as those migrated from the
+// line based rule file.
+func (r *Rule) lastUsed() time.Time {
+	if last := r.lastHit(); !last.IsZero() {
+		return last
+	}
+	return r.created
+}
+
+// pruneUnusedRules removes the permanent rules that have not matched since
+// cutoff, and returns them.  Nothing is removed on a dry run.
+func (fw *Firewall) pruneUnusedRules(cutoff time.Time, dryRun bool) []*Rule {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	var pruned []*Rule
+	for _, p := range fw.policies {
+		p.lock.Lock()
+		var remaining RuleList
+		for _, r := range p.rules {
+			last := r.lastUsed()
+			if r.mode == RULE_MODE_PERMANENT && r.sourceFile == "" && !last.IsZero() && last.Before(cutoff) {
+				pruned = append(pruned, r)
+			} else {
+				remaining = append(remaining, r)
+			}
+		}
+		if !dryRun && len(remaining) != len(p.rules) {
+			p.rules = remaining
+			p.rulesChanged()
+		}
+		p.lock.Unlock()
+	}
+	if !dryRun && len(pruned) > 0 {
+		log.Noticef("Removed %d rules unused since %s", len(pruned), cutoff.Format(time.RFC3339))
+		if err := fw.writeRules(); err != nil {
+			log.Warningf("Failed to save rules: %v", err)
+		}
+	}
+	return pruned
+}
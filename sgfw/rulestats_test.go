@@ -0,0 +1,116 @@
+package sgfw
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRuleHitsCounted(t *testing.T) {
+	p := testPolicy(t, []string{
+		"DENY|www.example.com:443|PERMANENT|-1:-1||",
+		"ALLOW|*:443|PERMANENT|-1:-1||",
+	})
+	pinfo := testPInfo()
+	src, dst := net.IP{192, 168, 1, 10}, net.IP{203, 0, 113, 1}
+	pkt := testPacket(t, "tcp", src, dst, 443)
+
+	before := time.Now()
+	for i := 0; i < 3; i++ {
+		p.ruleIndex().filter(pkt, src, dst, 443, "www.example.com", pinfo, "")
+	}
+	p.ruleIndex().filter(pkt, src, dst, 443, "www.example.org", pinfo, "")
+	p.ruleIndex().filter(pkt, src, dst, 443, "www.example.net", pinfo, "")
+
+	if n := p.rules[0].hitCount(); n != 3 {
+		t.Errorf("deny rule has %d hits, want 3", n)
+	}
+	if n := p.rules[1].hitCount(); n != 2 {
+		t.Errorf("allow rule has %d hits, want 2", n)
+	}
+	if last := p.rules[1].lastHit(); last.Before(before) {
+		t.Errorf("last hit %v is older than the test", last)
+	}
+	if p.fw.statsDirty == 0 {
+		t.Error("hits on permanent rules did not mark the rules for saving")
+	}
+
+	// connections through the SOCKS proxy have no packet
+	p = testPolicy(t, []string{"ALLOW|*:443|SYSTEM|-1:-1||"})
+	if p.ruleIndex().filter(nil, nil, dst, 443, "www.example.org", pinfo, "") != FILTER_ALLOW || p.rules[0].hitCount() != 1 {
+		t.Errorf("SOCKS connection not counted: %d hits", p.rules[0].hitCount())
+	}
+}
+
+func TestRuleStatsPersisted(t *testing.T) {
+	fw := testFirewall()
+	p := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	processRuleLine(p, "ALLOW|*:443|PERMANENT|-1:-1|")
+	last := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	p.rules[0].setStats(42, last)
+
+	bs, err := fw.marshalRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := testFirewall()
+	if err := loaded.loadRulesJSON(bs); err != nil {
+		t.Fatal(err)
+	}
+	r := loaded.policyMap["|/usr/bin/curl"].rules[0]
+	if r.hitCount() != 42 || !r.lastHit().Equal(last) {
+		t.Errorf("stats not loaded: %d hits, last %v", r.hitCount(), r.lastHit())
+	}
+
+	// counts gathered since the file was written win when it is reloaded
+	stats := fw.collectRuleStats()
+	p.rules[0].hit(time.Now())
+	loaded.restoreRuleStats(stats)
+	if r.hitCount() != 43 {
+		t.Errorf("in-memory stats not carried over: %d hits", r.hitCount())
+	}
+
+	f, _ := newRuleFilter(DbusRuleFilter{})
+	export, err := fw.exportRules(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := decodeRuleFile(export)
+	if rec := data.Policies[0].Rules[0]; rec.Hits != 0 || rec.LastHit != nil {
+		t.Errorf("exported rule carries hit counts: %+v", rec)
+	}
+}
+
+func TestPruneUnusedRules(t *testing.T) {
+	fw := testFirewall()
+	fw.rulesUnreadable = true // keep pruneUnusedRules from saving
+	p := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	now := time.Now()
+	for _, s := range []string{
+		"ALLOW|old.example.com:443|PERMANENT|-1:-1|",
+		"ALLOW|used.example.com:443|PERMANENT|-1:-1|",
+		"ALLOW|new.example.com:443|PERMANENT|-1:-1|",
+		"ALLOW|legacy.example.com:443|PERMANENT|-1:-1|",
+		"ALLOW|system.example.com:443|SYSTEM|-1:-1|",
+	} {
+		processRuleLine(p, s)
+	}
+	for _, r := range p.rules {
+		r.created = now.AddDate(0, 0, -100)
+	}
+	p.rules[1].setStats(7, now.AddDate(0, 0, -1))
+	p.rules[2].created = now.AddDate(0, 0, -2)
+	p.rules[3].created = time.Time{}
+
+	cutoff := now.AddDate(0, 0, -30)
+	if pruned := fw.pruneUnusedRules(cutoff, true); len(pruned) != 1 || len(p.rules) != 5 {
+		t.Fatalf("dry run: %d rules pruned, %d left", len(pruned), len(p.rules))
+	}
+	pruned := fw.pruneUnusedRules(cutoff, false)
+	if len(pruned) != 1 || pruned[0].hostname != "old.example.com" {
+		t.Errorf("pruned the wrong rules: %v", pruned)
+	}
+	if len(p.rules) != 4 {
+		t.Errorf("%d rules left, want 4", len(p.rules))
+	}
+}
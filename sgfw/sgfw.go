@@ -1,16 +1,16 @@
 package sgfw
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"os"
 	"os/signal"
 	"regexp"
+	"strings"
 	"sync"
 	"syscall"
-	//	"time"
-	"bufio"
-	"encoding/json"
-	"fmt"
-	"strings"
+	"time"
 
 	"github.com/op/go-logging"
 	nfqueue "github.com/subgraph/go-nfnetlink/nfqueue"
@@ -23,11 +23,20 @@ import (
 
 var dbusp *dbusObjectP = nil
 
+// How often time-limited rules are checked for expiry
+const ruleExpiryInterval = 10 * time.Second
+
 type Firewall struct {
 	dbus *dbusServer
 	dns  *dnsCache
 
+	// installs the rules queueing connections to the daemon
+	backend firewallBackend
+
 	enabled bool
+	// every new connection not on the allowlist is denied, without prompting
+	lockdown      bool
+	lockdownAllow []*lockdownEntry
 
 	logBackend logging.LeveledBackend
 
@@ -35,9 +44,29 @@ type Firewall struct {
 	policyMap map[string]*Policy
 	policies  []*Policy
 
+	// set when the rule file exists but could not be loaded, so that it is
+	// not overwritten with the few rules created since
+	rulesUnreadable bool
+	// set when a persistent rule has matched since the rules were saved
+	statsDirty int32
+	// connections waiting for a prompt, of all policies
+	pendingCount int32
+	// how long the worker of each queue takes per packet
+	queueStats []*queueStats
+	// the SOCKS proxies, whose open sessions are judged again with the
+	// connections when the rules change
+	socksChains []*socksChain
+	enforceChan chan bool
+
+	audit   auditLog
+	learner learner
+
 	ruleLock   sync.Mutex
 	rulesByID  map[uint]*Rule
 	nextRuleID uint
+	// the verdict marks of the rules removed or changed, to be cleared
+	// from the connections once they have been judged again
+	forgotten map[uint32]bool
 
 	reloadRulesChan chan bool
 	stopChan        chan bool
@@ -47,6 +76,10 @@ func (fw *Firewall) setEnabled(flag bool) {
 	fw.lock.Lock()
 	defer fw.lock.Unlock()
 	fw.enabled = flag
+	if flag {
+		// the rules may have changed while it was disabled
+		fw.enforceLater()
+	}
 }
 
 func (fw *Firewall) isEnabled() bool {
@@ -92,53 +125,58 @@ func (fw *Firewall) reloadRules() {
 	fw.reloadRulesChan <- true
 }
 
-func (fw *Firewall) runFilter() {
-	q := nfqueue.NewNFQueue(0)
+func decodeIPv6Packet(p *nfqueue.NFQPacket) bool {
+	data := p.Packet.Data()
+	if len(data) == 0 || data[0]>>4 != 6 {
+		return false
+	}
+
+	ip6p := gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.Default)
+	if ip6p.Layer(layers.LayerTypeIPv6) == nil {
+		return false
+	}
 
-	// XXX: need to implement this
-	//	q.DefaultVerdict = nfqueue.DROP
-	// XXX: need this as well
-	//	q.Timeout = 5 * time.Minute
+	p.Packet = ip6p
+	return true
+}
 
-	ps, err := q.Open()
+func (fw *Firewall) runFilter() {
+	// packets the filter cannot judge are given defaultVerdict, and have
+	// no timeout in the queue; those waiting for a prompt are given a
+	// verdict by expirePending instead
 
-	if err != nil {
-		log.Fatal("Error opening NFQueue:", err)
+	for _, q := range fw.openQueues() {
+		defer q.Close()
 	}
-	q.EnableHWTrace()
-	defer q.Close()
+	go fw.enforceLoop()
 
-	go func() {
-		for p := range ps {
-			if fw.isEnabled() {
-				ipLayer := p.Packet.Layer(layers.LayerTypeIPv4)
-				if ipLayer == nil {
-					continue
-				}
-
-				ip, _ := ipLayer.(*layers.IPv4)
-				if ip == nil {
-					continue
-				}
-
-				if ip.Version == 6 {
-					ip6p := gopacket.NewPacket(ip.LayerContents(), layers.LayerTypeIPv6, gopacket.Default)
-					p.Packet = ip6p
-
-				}
-
-				fw.filterPacket(p)
-			} else {
-				p.Accept()
-			}
-		}
-	}()
+	expiryTicker := time.NewTicker(ruleExpiryInterval)
+	defer expiryTicker.Stop()
+	statsTicker := time.NewTicker(ruleStatsInterval)
+	defer statsTicker.Stop()
 
 	for {
 		select {
 		case <-fw.reloadRulesChan:
 			fw.loadRules()
+		case <-expiryTicker.C:
+			fw.expireRules()
+			fw.expirePending()
+			if fw.learner.expire(time.Now()) {
+				fw.saveLearned()
+				dbusp.alertRule("Learning finished")
+			}
+		case <-statsTicker.C:
+			fw.saveRuleStats()
+			fw.saveAudit()
+			fw.saveLearned()
 		case <-fw.stopChan:
+			if failClosed() {
+				fw.dropPending(time.Now(), true, "firewall stopped")
+			}
+			fw.saveRuleStats()
+			fw.saveAudit()
+			fw.saveLearned()
 			return
 		}
 	}
@@ -211,7 +249,7 @@ func Main() {
 		os.Exit(1)
 	}
 
-	setupIPTables()
+	backend := setupBackend()
 
 	ds, err := newDbusServer()
 	if err != nil {
@@ -220,6 +258,7 @@ func Main() {
 	}
 
 	fw := &Firewall{
+		backend:         backend,
 		dbus:            ds,
 		dns:             newDNSCache(),
 		enabled:         true,
@@ -227,11 +266,20 @@ func Main() {
 		policyMap:       make(map[string]*Policy),
 		reloadRulesChan: make(chan bool, 0),
 		stopChan:        make(chan bool, 0),
+		enforceChan:     make(chan bool, 1),
 	}
 	ds.fw = fw
+	fw.lockdownAllow = compileLockdownAllow(FirewallConfig.LockdownAllow)
+	fw.loadLockdown()
 	go pcoroner.MonitorThread(procDeathCallbackDNS, fw.dns)
 
 	fw.loadRules()
+	if err := fw.audit.load(auditFile); err != nil {
+		log.Warningf("Failed to load the audit report: %v", err)
+	}
+	if err := fw.learner.load(learnFile); err != nil {
+		log.Warningf("Failed to load the candidate rules: %v", err)
+	}
 
 	/*
 	   go func() {
@@ -268,23 +316,34 @@ func Main() {
 
 	go OzReceiver(fw)
 
-	fw.runFilter()
-
 	// observe process signals and either
 	// reload rules or shutdown firewall service
 	sigKillChan := make(chan os.Signal, 1)
-	signal.Notify(sigKillChan, os.Interrupt, os.Kill)
+	signal.Notify(sigKillChan, os.Interrupt, syscall.SIGTERM)
 
 	sigHupChan := make(chan os.Signal, 1)
 	signal.Notify(sigHupChan, syscall.SIGHUP)
 
-	for {
-		select {
-		case <-sigHupChan:
-			fw.reloadRules()
-		case <-sigKillChan:
-			fw.stop()
-			return
+	go func() {
+		for {
+			select {
+			case <-sigHupChan:
+				fw.reloadRules()
+			case <-sigKillChan:
+				fw.stop()
+				return
+			}
 		}
+	}()
+
+	fw.runFilter()
+
+	forgetAllVerdicts()
+	if failClosed() {
+		log.Warning("Leaving the rules in place, new connections are blocked until the daemon is back")
+		return
+	}
+	if err := fw.backend.teardown(); err != nil {
+		log.Warningf("Failed to remove the %s rules: %v", fw.backend.name(), err)
 	}
 }
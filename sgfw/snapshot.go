@@ -0,0 +1,236 @@
+package sgfw
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Previous generations of the rule file are kept here, so that a bad change
+// or a damaged file can be rolled back.
+const ruleBackupDir = "/var/lib/sgfw/backups"
+
+const maxRuleSnapshots = 10
+
+const (
+	ruleSnapshotPrefix = "sgfw_rules-"
+	ruleSnapshotSuffix = ".json"
+	ruleSnapshotLayout = "20060102T150405.000000000Z"
+)
+
+type ruleSnapshot struct {
+	id    string
+	fname string
+	saved time.Time
+}
+
+// writeRuleFile atomically replaces fname with data.  The data is written to
+// a temporary file which is synced before it is renamed over the old file,
+// so that a crash leaves either the old or the new rules behind.  The old
+// file becomes the newest snapshot in backupDir, unless it is empty.
+func writeRuleFile(fname, backupDir string, data []byte) error {
+	dir := filepath.Dir(fname)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(fname)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+
+	if backupDir != "" {
+		if err := snapshotRuleFile(fname, backupDir); err != nil {
+			// not worth losing the new rules over
+			log.Warningf("Failed to keep a snapshot of %s: %v", fname, err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), fname); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// snapshotRuleFile adds the current contents of fname to the snapshots in
+// backupDir, and drops the oldest snapshots beyond maxRuleSnapshots.
+func snapshotRuleFile(fname, backupDir string) error {
+	if _, err := os.Stat(fname); os.IsNotExist(err) {
+		return nil
+	}
+	if err := maybeCreateDir(backupDir); err != nil {
+		return err
+	}
+	id := time.Now().UTC().Format(ruleSnapshotLayout)
+	dst := filepath.Join(backupDir, ruleSnapshotPrefix+id+ruleSnapshotSuffix)
+	if err := os.Link(fname, dst); err != nil {
+		if err := copyFile(fname, dst); err != nil {
+			return err
+		}
+	}
+
+	snapshots, err := listRuleSnapshots(backupDir)
+	if err != nil {
+		return err
+	}
+	for i := maxRuleSnapshots; i < len(snapshots); i++ {
+		if err := os.Remove(snapshots[i].fname); err != nil {
+			log.Warningf("Failed to remove old rule snapshot: %v", err)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// listRuleSnapshots returns the snapshots in backupDir, newest first.
+func listRuleSnapshots(backupDir string) ([]ruleSnapshot, error) {
+	matches, err := filepath.Glob(filepath.Join(backupDir, ruleSnapshotPrefix+"*"+ruleSnapshotSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []ruleSnapshot
+	for _, m := range matches {
+		id := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), ruleSnapshotPrefix), ruleSnapshotSuffix)
+		if _, err := time.Parse(ruleSnapshotLayout, id); err != nil {
+			continue
+		}
+		fi, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, ruleSnapshot{id: id, fname: m, saved: fi.ModTime()})
+	}
+	sort.Sort(byNewest(snapshots))
+	return snapshots, nil
+}
+
+// the identifiers sort in the order the snapshots were taken
+type byNewest []ruleSnapshot
+
+func (s byNewest) Len() int           { return len(s) }
+func (s byNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byNewest) Less(i, j int) bool { return s[i].id > s[j].id }
+
+func findRuleSnapshot(backupDir, id string) (ruleSnapshot, error) {
+	snapshots, err := listRuleSnapshots(backupDir)
+	if err != nil {
+		return ruleSnapshot{}, err
+	}
+	for _, s := range snapshots {
+		if s.id == id {
+			return s, nil
+		}
+	}
+	return ruleSnapshot{}, fmt.Errorf("no rule snapshot %s", id)
+}
+
+// countRules returns the number of rules in a rule file, or an error if it
+// cannot be loaded.
+func countRules(bs []byte) (int, error) {
+	data, err := decodeRuleFile(bs)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, pr := range data.Policies {
+		n += len(pr.Rules)
+	}
+	return n, nil
+}
+
+// restoreRuleSnapshot loads the newest snapshot in backupDir that can be
+// read, after the rule file itself could not be.  The damaged file is moved
+// aside for inspection.  It must be called with fw.lock held.
+func (fw *Firewall) restoreRuleSnapshot(fname, backupDir string) bool {
+	snapshots, err := listRuleSnapshots(backupDir)
+	if err != nil {
+		log.Errorf("Failed to list rule snapshots in %s: %v", backupDir, err)
+		return false
+	}
+	for _, s := range snapshots {
+		bs, err := ioutil.ReadFile(s.fname)
+		if err == nil {
+			err = fw.loadRulesJSON(bs)
+		}
+		if err != nil {
+			log.Warningf("Rule snapshot %s cannot be used either: %v", s.id, err)
+			continue
+		}
+		log.Errorf("FALLING BACK TO RULE SNAPSHOT %s saved at %s: %s could not be loaded",
+			s.id, s.saved.Format(time.RFC3339), fname)
+		if err := os.Rename(fname, fname+".corrupt"); err != nil && !os.IsNotExist(err) {
+			log.Warningf("Failed to move %s aside: %v", fname, err)
+		}
+		return true
+	}
+	return false
+}
+
+// rollbackRules makes a snapshot the current rule file and loads it.  The
+// rules being replaced are kept as a snapshot of their own.
+func (fw *Firewall) rollbackRules(id string) error {
+	fw.lock.Lock()
+	s, err := findRuleSnapshot(ruleBackupDir, id)
+	if err != nil {
+		fw.lock.Unlock()
+		return err
+	}
+	bs, err := ioutil.ReadFile(s.fname)
+	if err == nil {
+		_, err = countRules(bs)
+	}
+	if err == nil {
+		err = writeRuleFile(ruleFile, ruleBackupDir, bs)
+	}
+	fw.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Noticef("Rolled back rules to snapshot %s saved at %s", s.id, s.saved.Format(time.RFC3339))
+	fw.loadRules()
+	return nil
+}
@@ -0,0 +1,126 @@
+package sgfw
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testRuleFileData(n int) []byte {
+	return []byte(fmt.Sprintf(`{"version": 2, "policies": [{"sandbox": "", "path": "/usr/bin/test%d",
+		"rules": [{"id": "r%d", "verb": "ALLOW", "target": "*:%d", "mode": "PERMANENT"}]}]}`, n, n, 1000+n))
+}
+
+func TestWriteRuleFileKeepsSnapshots(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sgfw-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fname, backups := filepath.Join(tmp, "sgfw_rules.json"), filepath.Join(tmp, "backups")
+
+	for i := 0; i < maxRuleSnapshots+3; i++ {
+		if err := writeRuleFile(fname, backups, testRuleFileData(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bs, err := ioutil.ReadFile(fname)
+	if err != nil || string(bs) != string(testRuleFileData(maxRuleSnapshots+2)) {
+		t.Fatalf("rule file does not hold the last write: %s (%v)", bs, err)
+	}
+	if fi, _ := os.Stat(fname); fi.Mode().Perm() != 0600 {
+		t.Errorf("rule file has mode %v", fi.Mode().Perm())
+	}
+	if files, _ := filepath.Glob(filepath.Join(tmp, ".sgfw_rules.json.*")); len(files) != 0 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+
+	snapshots, err := listRuleSnapshots(backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != maxRuleSnapshots {
+		t.Fatalf("expected %d snapshots, got %d", maxRuleSnapshots, len(snapshots))
+	}
+	// the newest snapshot holds the generation before the current one
+	bs, _ = ioutil.ReadFile(snapshots[0].fname)
+	if string(bs) != string(testRuleFileData(maxRuleSnapshots+1)) {
+		t.Errorf("newest snapshot holds %s", bs)
+	}
+	if s, err := findRuleSnapshot(backups, snapshots[3].id); err != nil || s.fname != snapshots[3].fname {
+		t.Errorf("snapshot %s not found: %v", snapshots[3].id, err)
+	}
+	if _, err := findRuleSnapshot(backups, "../sgfw_rules"); err == nil {
+		t.Error("found a snapshot that does not exist")
+	}
+}
+
+func TestRestoreRuleSnapshot(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "sgfw-snapshots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	fname, backups := filepath.Join(tmp, "sgfw_rules.json"), filepath.Join(tmp, "backups")
+
+	for _, data := range [][]byte{testRuleFileData(1), []byte("{ truncated"), testRuleFileData(2)} {
+		if err := writeRuleFile(fname, backups, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(fname, []byte(`{"version": 2, "policies": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fw := testFirewall()
+	if !fw.restoreRuleSnapshot(fname, backups) {
+		t.Fatal("no snapshot restored")
+	}
+	if p := fw.policyMap["|/usr/bin/test1"]; p == nil || len(p.rules) != 1 || p.rules[0].uuid != "r1" {
+		t.Errorf("the newest readable snapshot was not restored: %v", fw.policies)
+	}
+	if _, err := os.Stat(fname + ".corrupt"); err != nil {
+		t.Errorf("damaged rule file not kept: %v", err)
+	}
+
+	if testFirewall().restoreRuleSnapshot(fname, filepath.Join(tmp, "none")) {
+		t.Error("restored a snapshot from an empty directory")
+	}
+}
+
+// Reloading or rolling back the rules keeps the session and process rules,
+// which the rule file does not hold, in every policy.
+func TestDetachRulesKeepsSessionRules(t *testing.T) {
+	fw := testFirewall()
+	curl := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	processRuleLine(curl, "ALLOW|*:443|PERMANENT|-1:-1|")
+	session, err := curl.parseRule("ALLOW|*:22||-1:-1|", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.mode = RULE_MODE_SESSION
+	process, err := fw.policyForPathAndSandbox("/usr/bin/wget", "").parseRule("ALLOW|*:80||-1:-1|", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	process.mode, process.pid = RULE_MODE_PROCESS, os.Getpid()
+
+	if err := fw.loadRulesJSON(testRuleFileData(1)); err != nil {
+		t.Fatal(err)
+	}
+	fw.clearRules()
+	kept := fw.detachRules()
+	if len(curl.rules) != 0 || len(process.policy.rules) != 0 {
+		t.Errorf("rules left in the policies: %v, %v", curl.rules, process.policy.rules)
+	}
+	if len(kept) != 2 || len(kept[curl]) != 1 || kept[curl][0] != session || len(kept[process.policy]) != 1 || kept[process.policy][0] != process {
+		t.Errorf("kept rules are %v", kept)
+	}
+	for _, r := range []*Rule{session, process} {
+		if fw.getRuleByID(r.id) != r {
+			t.Errorf("kept rule %s not found by its ID", r)
+		}
+	}
+}
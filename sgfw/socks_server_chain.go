@@ -26,6 +26,10 @@ type socksChain struct {
 	listener net.Listener
 	wg       *sync.WaitGroup
 	procInfo procsnitch.ProcInfo
+
+	// the sessions that were let through and are still open
+	lock     sync.Mutex
+	sessions map[*socksChainSession]bool
 }
 
 type socksChainSession struct {
@@ -38,6 +42,15 @@ type socksChainSession struct {
 	procInfo     procsnitch.ProcInfo
 	pinfo        *procsnitch.Info
 	server       *socksChain
+
+	// what the session was judged on, to judge it again when the rules
+	// change, and the rule that let it through, nil if none did
+	policy   *Policy
+	hostname string
+	ip       net.IP
+	port     uint16
+	optstr   string
+	rule     *Rule
 }
 
 const (
@@ -57,6 +70,7 @@ type pendingSocksConnection struct {
 	verdict    chan int
 	prompting  bool
 	optstr     string
+	queued     time.Time
 }
 
 func (sc *pendingSocksConnection) sandbox() string {
@@ -67,6 +81,10 @@ func (sc *pendingSocksConnection) socks() bool {
 	return true
 }
 
+func (sc *pendingSocksConnection) direction() RuleDirection {
+	return RULE_DIRECTION_OUT
+}
+
 func (sc *pendingSocksConnection) policy() *Policy {
 	return sc.pol
 }
@@ -123,6 +141,8 @@ func (sc *pendingSocksConnection) getPrompting() bool { return sc.prompting }
 
 func (sc *pendingSocksConnection) setPrompting(val bool) { sc.prompting = val }
 
+func (sc *pendingSocksConnection) queuedAt() time.Time { return sc.queued }
+
 func (sc *pendingSocksConnection) print() string { return "socks connection" }
 
 func NewSocksChain(cfg *socksChainConfig, wg *sync.WaitGroup, fw *Firewall) *socksChain {
@@ -131,7 +151,11 @@ func NewSocksChain(cfg *socksChainConfig, wg *sync.WaitGroup, fw *Firewall) *soc
 		fw:       fw,
 		wg:       wg,
 		procInfo: procsnitch.SystemProcInfo{},
+		sessions: make(map[*socksChainSession]bool),
 	}
+	fw.lock.Lock()
+	fw.socksChains = append(fw.socksChains, &chain)
+	fw.lock.Unlock()
 	return &chain
 }
 
@@ -265,7 +289,6 @@ func findProxyEndpoint(pdata []string, conn net.Conn) (*procsnitch.Info, string)
 				continue
 			}
 
-			res := procsnitch.LookupTCPSocketProcessAll(srcip, uint16(srcport), dstip, uint16(dstport), nil)
 			res, optstr := LookupSandboxProc(srcip, uint16(srcport), dstip, uint16(dstport), "tcp", procsnitch.MATCH_STRICT, 0)
 
 			if res != nil {
@@ -319,7 +342,38 @@ func (c *socksChainSession) filterConnect() (bool, bool) {
 	if ip == nil && hostname == "" {
 		return false, false
 	}
-	result := policy.rules.filter(nil, nil, ip, port, hostname, pinfo, optstr)
+	c.policy, c.hostname, c.ip, c.port, c.optstr = policy, hostname, ip, port, optstr
+	if fw := c.server.fw; fw.inLockdown() {
+		if fw.lockdownAllows(true, policy.path, "tcp", nil, ip, port, hostname) {
+			return true, false
+		}
+		log.Warningf("DENIED outgoing [socks5] connection attempt by %s: network locked down", pinfo.ExePath)
+		return false, false
+	}
+	pin := policy.hashForPin(pinfo)
+	result, rule := c.matchWith(pin.match)
+	policy.lock.Lock()
+	result, rule, pinned := policy.pinnedVerdict(pin, result, rule)
+	audit := policy.auditing()
+	policy.lock.Unlock()
+	c.rule = rule
+	if !pinned {
+		optstr = pinMismatchOptString(optstr)
+	}
+	if c.rule != nil {
+		c.rule.hit(time.Now())
+	}
+	if pinned && result == FILTER_PROMPT && c.server.fw.learner.active(time.Now()) {
+		policy.learn("tcp", hostname, ip, port, time.Now())
+		return true, false
+	}
+	if audit {
+		// the TLS guard is left out as well, since it would block traffic
+		if kind := auditVerdict(result); kind != "" {
+			policy.recordAudit(kind, "tcp", hostname, ip, port, pinfo)
+		}
+		return true, false
+	}
 	switch result {
 	case FILTER_DENY:
 		return false, false
@@ -365,20 +419,66 @@ func (c *socksChainSession) filterConnect() (bool, bool) {
 			verdict:    make(chan int),
 			prompting:  false,
 			optstr:     optstr,
+			queued:     time.Now(),
 		}
+		policy.lock.Lock()
 		policy.processPromptResult(pending)
+		policy.lock.Unlock()
 		v := <-pending.verdict
-		if v == socksVerdictAccept {
-			return true, false
-		} else if v == socksVerdictAcceptTLSOnly {
-			return true, true
+		if v != socksVerdictAccept && v != socksVerdictAcceptTLSOnly {
+			return false, false
 		}
+		// the rule added from the prompt, if it was kept
+		_, c.rule = c.match()
+		return true, v == socksVerdictAcceptTLSOnly
 	}
 
 	return false, false
 
 }
 
+// match applies the rules to the connection of the session.
+func (c *socksChainSession) match() (FilterResult, *Rule) {
+	return c.matchWith(matchPolicies)
+}
+
+// matchWith applies the rules with match instead of matchPolicies.
+func (c *socksChainSession) matchWith(match policyMatcher) (FilterResult, *Rule) {
+	fw := c.server.fw
+	return match(RULE_DIRECTION_OUT, fw.unitPolicy(c.pinfo), c.policy, fw.anyExePolicy(c.policy.sandbox), nil, c.pinfo, nil, c.ip, c.port, c.hostname, c.optstr)
+}
+
+func (s *socksChain) addSession(c *socksChainSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[c] = true
+}
+
+func (s *socksChain) removeSession(c *socksChainSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, c)
+}
+
+// openSessions returns the sessions that are open.
+func (s *socksChain) openSessions() []*socksChainSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sessions := make([]*socksChainSession, 0, len(s.sessions))
+	for c := range s.sessions {
+		sessions = append(sessions, c)
+	}
+	return sessions
+}
+
+// close ends the session, as the rules no longer let it through.
+func (c *socksChainSession) close() {
+	c.clientConn.Close()
+	if c.upstreamConn != nil {
+		c.upstreamConn.Close()
+	}
+}
+
 func (c *socksChainSession) handleConnect(tls bool) {
 	err := c.dispatchTorSOCKS()
 	if err != nil {
@@ -386,6 +486,8 @@ func (c *socksChainSession) handleConnect(tls bool) {
 	}
 	c.req.Reply(ReplySucceeded)
 	defer c.upstreamConn.Close()
+	c.server.addSession(c)
+	defer c.server.removeSession(c)
 
 	if c.optData != nil {
 		if _, err = c.upstreamConn.Write(c.optData); err != nil {
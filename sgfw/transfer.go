@@ -0,0 +1,262 @@
+package sgfw
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ruleFilter selects the rules to export or import.  Empty fields match
+// anything; without a mode only the rules kept in the rule file match.
+type ruleFilter struct {
+	app     string
+	sandbox string
+	mode    string
+}
+
+func newRuleFilter(f DbusRuleFilter) (*ruleFilter, error) {
+	mode := strings.ToUpper(strings.TrimSpace(f.Mode))
+	switch mode {
+	case "", RuleModeString[RULE_MODE_PERMANENT], RuleModeString[RULE_MODE_SYSTEM], RuleModeString[RULE_MODE_SESSION]:
+	default:
+		// process rules name a pid, which means nothing anywhere else
+		return nil, fmt.Errorf("rules of mode %s cannot be exported", f.Mode)
+	}
+	return &ruleFilter{app: strings.TrimSpace(f.App), sandbox: strings.TrimSpace(f.Sandbox), mode: mode}, nil
+}
+
+// matchPolicy reports whether the policy for an executable path is selected.
+// An application matches its full path, the file name or the name of its
+// desktop entry.
+func (f *ruleFilter) matchPolicy(ppath, sandbox, application string) bool {
+	if f.sandbox != "" && f.sandbox != sandbox {
+		return false
+	}
+	return f.app == "" || f.app == ppath || f.app == path.Base(ppath) || f.app == application
+}
+
+func (f *ruleFilter) matchMode(mode RuleMode) bool {
+	if f.mode == "" {
+		return mode == RULE_MODE_PERMANENT || mode == RULE_MODE_SYSTEM
+	}
+	return RuleModeString[mode] == f.mode
+}
+
+// matchRule reports whether a rule in a selected policy is selected.  Rules
+// from drop-in files are never exported or replaced.
+func (f *ruleFilter) matchRule(r *Rule) bool {
+	return r.sourceFile == "" && f.matchMode(r.mode)
+}
+
+// matchKey identifies what a rule applies to, without what it does to it.
+// Two rules of a policy with the same key are duplicates if they have the
+// same verb, and conflict otherwise.
+func (r *Rule) matchKey() string {
+	saddr := ""
+	if r.saddr != nil {
+		saddr = r.saddr.String()
+	}
+	return strings.Join([]string{r.proto, r.AddrString(false), r.privString(), r.sandbox, saddr,
+		r.ancestry.String(), r.cgroup.String(), RuleDirectionString[r.direction]}, "|")
+}
+
+// exportRules returns the selected rules in the format of the rule file.
+// Executable hashes and hit counts are left out, since they only hold for
+// this system.
+func (fw *Firewall) exportRules(f *ruleFilter) ([]byte, error) {
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	data := ruleFileData{Version: ruleFileVersion, Policies: []policyRecord{}}
+	for _, p := range fw.policies {
+		if !f.matchPolicy(p.path, p.sandbox, p.application) {
+			continue
+		}
+		p.lock.Lock()
+		pr := policyRecord{Sandbox: p.sandbox, Path: p.path, Rules: []ruleRecord{}}
+		for _, r := range p.rules {
+			if f.matchRule(r) {
+				rec := r.record()
+				rec.Hits, rec.LastHit = 0, nil
+				pr.Rules = append(pr.Rules, rec)
+			}
+		}
+		p.lock.Unlock()
+		if len(pr.Rules) > 0 {
+			data.Policies = append(data.Policies, pr)
+		}
+	}
+	return json.MarshalIndent(data, "", "\t")
+}
+
+type importedRule struct {
+	path    string
+	sandbox string
+	rule    *Rule
+}
+
+// decodeImportData parses rules to import: exported ones, or those of a
+// rule file in the line based format of older versions, which it reports.
+func decodeImportData(bs []byte) (ruleFileData, bool, error) {
+	if trimmed := bytes.TrimSpace(bs); len(trimmed) > 0 && trimmed[0] == '{' {
+		data, err := decodeRuleFile(bs)
+		return data, false, err
+	}
+	legacy := &Firewall{policyMap: make(map[string]*Policy)}
+	legacy.loadLegacyRules(bs)
+	data := ruleFileData{Version: ruleFileVersion, Policies: []policyRecord{}}
+	for _, p := range legacy.policies {
+		if pr := p.record(); len(pr.Rules) > 0 {
+			data.Policies = append(data.Policies, pr)
+		}
+	}
+	if len(data.Policies) == 0 {
+		return data, true, errors.New("no rules found, neither exported nor in the format of older versions")
+	}
+	return data, true, nil
+}
+
+// ConvertImportData returns rules to import as ImportRules takes them: as
+// they are if they were exported, or converted from a rule file in the line
+// based format of older versions, which it reports.
+func ConvertImportData(bs []byte) ([]byte, bool, error) {
+	data, legacy, err := decodeImportData(bs)
+	if err != nil || !legacy {
+		return bs, false, err
+	}
+	out, err := json.MarshalIndent(data, "", "\t")
+	return out, true, err
+}
+
+// importRules adds the selected rules from exported data to the policies.
+// Rules that duplicate or contradict a rule already in their policy are
+// skipped and reported.  With IMPORT_REPLACE, the selected rules of every
+// selected policy are removed first.  Nothing is changed on a dry run.
+func (fw *Firewall) importRules(bs []byte, how string, dryRun bool, f *ruleFilter) (DbusImportReport, error) {
+	report := DbusImportReport{Duplicates: []string{}, Conflicts: []string{}, Invalid: []string{}}
+	if how != IMPORT_MERGE && how != IMPORT_REPLACE {
+		return report, fmt.Errorf("unknown import mode %s", how)
+	}
+	data, _, err := decodeImportData(bs)
+	if err != nil {
+		return report, err
+	}
+
+	fw.lock.Lock()
+	defer fw.lock.Unlock()
+
+	// the rules each rule to import is compared with, by policy key
+	existing := make(map[string]map[string]*Rule)
+	uuids := make(map[string]bool)
+	replaced := make(map[*Policy]bool)
+	for _, p := range fw.policies {
+		key := p.sandbox + "|" + p.path
+		replace := how == IMPORT_REPLACE && f.matchPolicy(p.path, p.sandbox, p.application)
+		replaced[p] = replace
+		keys := make(map[string]*Rule)
+		p.lock.Lock()
+		for _, r := range p.rules {
+			if replace && f.matchRule(r) {
+				report.Removed++
+			} else {
+				keys[r.matchKey()] = r
+				uuids[r.uuid] = true
+			}
+		}
+		p.lock.Unlock()
+		if existing[key] == nil {
+			existing[key] = keys
+		}
+	}
+
+	var imports []importedRule
+	for _, pr := range data.Policies {
+		if !f.matchPolicy(pr.Path, pr.Sandbox, "") {
+			continue
+		}
+		key := pr.Sandbox + "|" + pr.Path
+		if existing[key] == nil {
+			existing[key] = make(map[string]*Rule)
+		}
+		for _, rec := range pr.Rules {
+			r := new(Rule)
+			r.pid = -1
+			if !r.parseRecord(rec) {
+				report.Invalid = append(report.Invalid, fmt.Sprintf("%s: %s|%s", pr.Path, rec.Verb, rec.Target))
+				continue
+			}
+			if !f.matchMode(r.mode) {
+				continue
+			}
+			desc := pr.Path + ": " + r.String()
+			if old, ok := existing[key][r.matchKey()]; ok {
+				if old.rtype == r.rtype {
+					report.Duplicates = append(report.Duplicates, desc)
+				} else {
+					report.Conflicts = append(report.Conflicts, desc+" (conflicts with "+old.String()+")")
+				}
+				continue
+			}
+			existing[key][r.matchKey()] = r
+			imports = append(imports, importedRule{path: pr.Path, sandbox: pr.Sandbox, rule: r})
+		}
+	}
+	report.Added = uint32(len(imports))
+	if dryRun {
+		return report, nil
+	}
+
+	changed := make(map[*Policy]bool)
+	var removed []*Rule
+	for p, replace := range replaced {
+		if !replace {
+			continue
+		}
+		p.lock.Lock()
+		var remaining RuleList
+		for _, r := range p.rules {
+			if !f.matchRule(r) {
+				remaining = append(remaining, r)
+				continue
+			}
+			removed = append(removed, r)
+			fw.ruleLock.Lock()
+			delete(fw.rulesByID, r.id)
+			fw.ruleLock.Unlock()
+		}
+		p.rules = remaining
+		p.lock.Unlock()
+		changed[p] = true
+	}
+	fw.forgetVerdicts(removed...)
+	for _, ir := range imports {
+		p := fw.policyForPathAndSandbox(ir.path, ir.sandbox)
+		r := ir.rule
+		r.policy = p
+		if r.author == "" {
+			r.author = RULE_AUTHOR_IMPORT
+		}
+		if uuids[r.uuid] {
+			r.uuid = newRuleUUID()
+		}
+		uuids[r.uuid] = true
+		fw.addRule(r)
+		p.lock.Lock()
+		p.rules = append(p.rules, r)
+		p.lock.Unlock()
+		changed[p] = true
+	}
+	for p := range changed {
+		p.lock.Lock()
+		p.rulesChanged()
+		p.lock.Unlock()
+	}
+	if err := fw.writeRules(); err != nil {
+		log.Warningf("Failed to save imported rules: %v", err)
+	}
+	log.Noticef("Imported %d rules, removed %d", report.Added, report.Removed)
+	return report, nil
+}
@@ -0,0 +1,205 @@
+package sgfw
+
+import (
+	"strings"
+	"testing"
+)
+
+func testTransferFirewall(t *testing.T) *Firewall {
+	fw := testFirewall()
+	fw.rulesUnreadable = true // keep importRules from saving
+	curl := fw.policyForPathAndSandbox("/usr/bin/curl", "")
+	for _, s := range []string{
+		"ALLOW|*:443|PERMANENT|-1:-1|",
+		"DENY|evil.example.com:80|PERMANENT|-1:-1|",
+		"ALLOW|*:8080|SYSTEM|-1:-1|",
+	} {
+		processRuleLine(curl, s)
+	}
+	session, err := curl.parseRule("ALLOW|*:22||-1:-1|", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.mode = RULE_MODE_SESSION
+	processRuleLine(fw.policyForPathAndSandbox("/usr/bin/wget", "oz"), "ALLOW|*:443|PERMANENT|-1:-1|oz")
+	return fw
+}
+
+func policyRuleStrings(p *Policy) []string {
+	var rules []string
+	for _, r := range p.rules {
+		rules = append(rules, r.String())
+	}
+	return rules
+}
+
+func TestExportRulesFilters(t *testing.T) {
+	fw := testTransferFirewall(t)
+	tests := []struct {
+		filter DbusRuleFilter
+		want   []string
+	}{
+		{DbusRuleFilter{}, []string{"*:443", "evil.example.com:80", "*:8080", "*:443"}},
+		{DbusRuleFilter{App: "curl"}, []string{"*:443", "evil.example.com:80", "*:8080"}},
+		{DbusRuleFilter{Sandbox: "oz"}, []string{"*:443"}},
+		{DbusRuleFilter{Mode: "session"}, []string{"*:22"}},
+		{DbusRuleFilter{App: "/usr/bin/curl", Mode: "SYSTEM"}, []string{"*:8080"}},
+	}
+	for _, tt := range tests {
+		f, err := newRuleFilter(tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := fw.exportRules(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := decodeRuleFile(bs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, pr := range data.Policies {
+			for _, rec := range pr.Rules {
+				got = append(got, rec.Target)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("export with %+v: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	if _, err := newRuleFilter(DbusRuleFilter{Mode: "PROCESS"}); err == nil {
+		t.Error("process rules should not be exportable")
+	}
+}
+
+const testImportData = `{"version": 2, "policies": [
+	{"sandbox": "", "path": "/usr/bin/curl", "rules": [
+		{"id": "a", "verb": "ALLOW", "target": "*:443", "mode": "PERMANENT"},
+		{"id": "b", "verb": "ALLOW", "target": "evil.example.com:80", "mode": "PERMANENT"},
+		{"id": "c", "verb": "DENY", "target": "*:25", "mode": "PERMANENT"},
+		{"id": "d", "verb": "DENY", "target": "*:25", "mode": "PERMANENT"},
+		{"id": "e", "verb": "ALLOW", "target": "*:bogus", "mode": "PERMANENT"}
+	]},
+	{"sandbox": "", "path": "/usr/bin/git", "rules": [
+		{"id": "f", "verb": "ALLOW", "target": ".github.com:443", "mode": "PERMANENT", "author": "alice"}
+	]}
+]}`
+
+func TestImportRulesMerge(t *testing.T) {
+	fw := testTransferFirewall(t)
+	f, _ := newRuleFilter(DbusRuleFilter{})
+
+	report, err := fw.importRules([]byte(testImportData), IMPORT_MERGE, true, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 2 || len(report.Duplicates) != 2 || len(report.Conflicts) != 1 || len(report.Invalid) != 1 {
+		t.Fatalf("unexpected dry run report: %+v", report)
+	}
+	if !strings.Contains(report.Conflicts[0], "conflicts with DENY|evil.example.com:80") {
+		t.Errorf("conflict not described: %q", report.Conflicts[0])
+	}
+	if fw.policyMap["|/usr/bin/git"] != nil || len(fw.policyMap["|/usr/bin/curl"].rules) != 4 {
+		t.Fatal("dry run changed the policies")
+	}
+
+	if _, err := fw.importRules([]byte(testImportData), IMPORT_MERGE, false, f); err != nil {
+		t.Fatal(err)
+	}
+	curl := policyRuleStrings(fw.policyMap["|/usr/bin/curl"])
+	if len(curl) != 5 || curl[4] != "DENY|*:25|PERMANENT|-1:-1|" {
+		t.Errorf("unexpected rules after merge: %v", curl)
+	}
+	git := fw.policyMap["|/usr/bin/git"]
+	if git == nil || len(git.rules) != 1 || git.rules[0].author != "alice" || git.rules[0].uuid != "f" {
+		t.Errorf("git rule not imported with its metadata: %v", git)
+	}
+	if r := fw.policyMap["|/usr/bin/curl"].rules[4]; r.author != RULE_AUTHOR_IMPORT || r.id == 0 {
+		t.Errorf("imported rule not registered: %+v", r)
+	}
+}
+
+func TestImportRulesReplace(t *testing.T) {
+	defer func(saved bool) { FirewallConfig.CacheVerdicts = saved }(FirewallConfig.CacheVerdicts)
+	FirewallConfig.CacheVerdicts = true
+	fw := testTransferFirewall(t)
+	f, _ := newRuleFilter(DbusRuleFilter{App: "curl"})
+	var old []*Rule
+	for _, r := range fw.policyMap["|/usr/bin/curl"].rules {
+		if f.matchRule(r) {
+			old = append(old, r)
+		}
+	}
+
+	report, err := fw.importRules([]byte(testImportData), IMPORT_REPLACE, false, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 3 || report.Removed != 3 || len(report.Duplicates) != 1 || len(report.Conflicts) != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	want := []string{
+		"ALLOW|*:22|SESSION|-1:-1|",
+		"ALLOW|*:443|PERMANENT|-1:-1|",
+		"ALLOW|evil.example.com:80|PERMANENT|-1:-1|",
+		"DENY|*:25|PERMANENT|-1:-1|",
+	}
+	if got := policyRuleStrings(fw.policyMap["|/usr/bin/curl"]); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected rules after replace:\n%s", strings.Join(got, "\n"))
+	}
+	if fw.policyMap["|/usr/bin/git"] != nil {
+		t.Error("imported rules of an application outside the filter")
+	}
+	if len(fw.policyMap["oz|/usr/bin/wget"].rules) != 1 {
+		t.Error("replaced rules of an application outside the filter")
+	}
+	forgotten := fw.takeForgotten()
+	for _, r := range old {
+		if fw.getRuleByID(r.id) == r {
+			t.Errorf("replaced rule %s still found by its ID", r)
+		}
+		if !forgotten[verdictMark(r)] {
+			t.Errorf("verdicts of replaced rule %s not forgotten", r)
+		}
+	}
+}
+
+// A rule file of an older version is imported as well.
+func TestImportLegacyRules(t *testing.T) {
+	fw := testTransferFirewall(t)
+	f, _ := newRuleFilter(DbusRuleFilter{})
+	legacy := strings.Join([]string{
+		"# rules of an older version",
+		"[|/usr/bin/curl]",
+		"ALLOW|*:443|PERMANENT|-1:-1|",
+		"DENY|*:25|SYSTEM|-1:-1|",
+		"[|/usr/bin/git]",
+		"ALLOW|github.com:22|PERMANENT|-1:-1|",
+	}, "\n")
+
+	report, err := fw.importRules([]byte(legacy), IMPORT_MERGE, false, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 2 || len(report.Duplicates) != 1 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if git := policyRuleStrings(fw.policyMap["|/usr/bin/git"]); len(git) != 1 || git[0] != "ALLOW|github.com:22|PERMANENT|-1:-1|" {
+		t.Errorf("git rules after import: %v", git)
+	}
+
+	bs, converted, err := ConvertImportData([]byte(legacy))
+	if err != nil || !converted {
+		t.Fatalf("legacy rules not converted: %v", err)
+	}
+	if _, err := decodeRuleFile(bs); err != nil {
+		t.Errorf("converted rules do not read back: %v\n%s", err, bs)
+	}
+	if _, _, err := ConvertImportData([]byte("not rules")); err == nil {
+		t.Error("data without rules imported")
+	}
+	if _, converted, err := ConvertImportData([]byte(testImportData)); err != nil || converted {
+		t.Errorf("exported rules converted (%v, %v)", converted, err)
+	}
+}